@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// dashboardTemplate - The `/dashboard` page, kept to a single table on purpose
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>GoLow Dashboard</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		table { border-collapse: collapse; }
+		th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+	</style>
+</head>
+<body>
+	<h1>GoLow</h1>
+	<p>Last reload: {{.LoadedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+	<p>Default: {{.Default}} ({{.DefaultHits}} hits)</p>
+	<table>
+		<tr><th>Host</th><th>Rule</th><th>Target</th><th>Tags</th><th>Description</th><th>Hits</th></tr>
+		{{range .Rules}}
+		<tr><td>{{.Host}}</td><td>{{.Path}}</td><td>{{.URL}}</td><td>{{range $i, $t := .Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</td><td>{{.Description}}</td><td>{{.Hits}}</td></tr>
+		{{end}}
+	</table>
+</body>
+</html>
+`))
+
+// dashboardRule - A Rule row on the Dashboard
+type dashboardRule struct {
+	URLRule
+	Hits uint64
+}
+
+// buildAdminRouter - Routes only served on the `-admin-addr` listener
+func buildAdminRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(compress)
+	r.Handle("/dashboard", basicAuth(http.HandlerFunc(dashboardHandler)))
+	r.Handle("/rules.json", basicAuth(http.HandlerFunc(rulesHandler)))
+	r.Handle("/metrics", basicAuth(http.HandlerFunc(metricsHandler)))
+	r.Handle("/stats", basicAuth(http.HandlerFunc(statsHandler)))
+	if statusPublic {
+		r.HandleFunc("/status", statusHandler)
+	} else {
+		r.Handle("/status", basicAuth(http.HandlerFunc(statusHandler)))
+	}
+	r.Handle("/reload", basicAuth(leaderOnly(http.HandlerFunc(reloadHandler)))).Methods(http.MethodPost)
+	r.Handle("/maintenance", basicAuth(leaderOnly(http.HandlerFunc(maintenanceHandler)))).Methods(http.MethodGet, http.MethodPost)
+
+	// Left open for load balancer and orchestrator probes
+	r.HandleFunc("/healthz", healthHandler)
+	r.HandleFunc("/readyz", readyHandler)
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+
+	// Runtime profiling, only ever on the admin listener
+	if enablePprof {
+		r.Handle("/debug/pprof/cmdline", basicAuth(http.HandlerFunc(pprof.Cmdline)))
+		r.Handle("/debug/pprof/profile", basicAuth(http.HandlerFunc(pprof.Profile)))
+		r.Handle("/debug/pprof/symbol", basicAuth(http.HandlerFunc(pprof.Symbol)))
+		r.Handle("/debug/pprof/trace", basicAuth(http.HandlerFunc(pprof.Trace)))
+		r.PathPrefix("/debug/pprof/").Handler(basicAuth(http.HandlerFunc(pprof.Index)))
+	}
+
+	return r
+}
+
+// newAdminServer - The admin listener, with its own timeouts since the admin
+// pages can be slower than a Redirect
+func newAdminServer() *http.Server {
+	return &http.Server{
+		Addr:         adminAddr,
+		Handler:      buildAdminRouter(),
+		ReadTimeout:  adminReadTimeout,
+		WriteTimeout: adminWriteTimeout,
+		IdleTimeout:  adminIdleTimeout,
+	}
+}
+
+// dashboardHandler - HTML table of the active Rules and their hit counts
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	conf, loadedAt := activeConfig()
+
+	rules := []dashboardRule{}
+	for _, rule := range activeRules(conf) {
+		rules = append(rules, dashboardRule{URLRule: rule, Hits: hits.Get(rule.ID())})
+	}
+
+	data := struct {
+		LoadedAt    time.Time
+		Default     string
+		DefaultHits uint64
+		Rules       []dashboardRule
+	}{loadedAt, conf.FinalRedirect, hits.Get(""), rules}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		slog.Error("Failed to Render Dashboard", "err", err)
+	}
+}
+
+// rulesHandler - The active Rules as JSON, followed by any switched off with
+// `enabled: false` so they aren't forgotten about
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	conf, _ := activeConfig()
+	rules := append(activeRules(conf), disabledRules(conf)...)
+	for i := range rules {
+		if rules[i].SigningKey != "" {
+			rules[i].SigningKey = redactedSecret
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		slog.Error("Failed to Encode Rules", "err", err)
+	}
+}
+
+// statsHandler - Process and Config freshness as JSON, for alerting on
+// stale configs
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	conf, loadedAt := activeConfig()
+
+	stats := struct {
+		StartedAt     time.Time `json:"startedAt"`
+		Uptime        string    `json:"uptime"`
+		UptimeSeconds float64   `json:"uptimeSeconds"`
+		LastReload    time.Time `json:"lastReload"`
+		RuleCount     int       `json:"ruleCount"`
+	}{
+		StartedAt:     startedAt,
+		Uptime:        time.Since(startedAt).Round(time.Second).String(),
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		LastReload:    loadedAt,
+		RuleCount:     len(activeRules(conf)),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.Error("Failed to Encode Stats", "err", err)
+	}
+}
+
+// statusHandler - Plain text summary for a quick look with curl
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	conf, loadedAt := activeConfig()
+
+	counts := hits.Snapshot()
+	var total uint64
+	rules := make([]string, 0, len(counts))
+	for rule, n := range counts {
+		total += n
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if counts[rules[i]] != counts[rules[j]] {
+			return counts[rules[i]] > counts[rules[j]]
+		}
+		return rules[i] < rules[j]
+	})
+	if len(rules) > 10 {
+		rules = rules[:10]
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "uptime: %s\n", time.Since(startedAt).Round(time.Second))
+	fmt.Fprintf(w, "last reload: %s\n", loadedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "rules: %d\n", len(activeRules(conf)))
+	fmt.Fprintf(w, "total hits: %d\n", total)
+	fmt.Fprintln(w, "top rules:")
+	for _, rule := range rules {
+		name := rule
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Fprintf(w, "  %10d  %s\n", counts[rule], name)
+	}
+}
+
+// writeJSONError - Every admin API error has the same `{"error", "code"}` shape
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	body := struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{msg, status}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to Encode Error", "err", err)
+	}
+}
+
+// basicAuth - Require the `-admin-user`/`-admin-pass` credentials. With no
+// credentials configured nothing gets through.
+func basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if adminUser == "" || adminPass == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(adminPass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoLow"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// leaderOnly - Refuse requests that would change state with a 403 when running
+// with `-follower`, reads still pass through
+func leaderOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if followerMode && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusForbidden, "read only follower, change the config source instead")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
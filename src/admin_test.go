@@ -0,0 +1,588 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest - Run a request through the admin router, with the given
+// credentials when user isn't empty
+func adminRequest(method, path, user, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	return adminServe(req)
+}
+
+// adminServe - Run the request through the admin router
+func adminServe(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	buildAdminRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDashboard(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org", "tags": ["lang"], "description": "Go <home>"},
+		{"host": "docs.example.com", "rule": "/", "url": "https://example.com/docs"}
+	]}`)
+	useConfig(t, conf)
+	setGlobal(t, &hits, newHitCounter())
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+
+	serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+	serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+
+	rec := adminRequest(http.MethodGet, "/dashboard", "admin", "secret")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /dashboard = %d %s, want a 200 page", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<td></td><td>/go</td><td>https://golang.org</td><td>lang</td><td>Go &lt;home&gt;</td><td>2</td>",
+		"<td>docs.example.com</td><td>/</td><td>https://example.com/docs</td>",
+		"Default: https://example.com (0 hits)",
+		"Last reload: ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`))
+
+	tests := []struct {
+		name             string
+		adminUser        string
+		adminPass        string
+		user, pass, path string
+		status           int
+	}{
+		{"right credentials", "admin", "secret", "admin", "secret", "/dashboard", http.StatusOK},
+		{"no credentials", "admin", "secret", "", "", "/dashboard", http.StatusUnauthorized},
+		{"wrong password", "admin", "secret", "admin", "nope", "/dashboard", http.StatusUnauthorized},
+		{"wrong user", "admin", "secret", "root", "secret", "/dashboard", http.StatusUnauthorized},
+		{"nothing configured lets nobody in", "", "", "", "", "/dashboard", http.StatusUnauthorized},
+		{"nothing configured and empty credentials", "", "", "x", "", "/rules.json", http.StatusUnauthorized},
+		{"metrics need auth", "admin", "secret", "", "", "/metrics", http.StatusUnauthorized},
+		{"health checks stay open", "admin", "secret", "", "", "/healthz", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &adminUser, tt.adminUser)
+			setGlobal(t, &adminPass, tt.adminPass)
+
+			rec := adminRequest(http.MethodGet, tt.path, tt.user, tt.pass)
+			if rec.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAdminCompression(t *testing.T) {
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs", "url": "https://example.com/docs"}
+	]}`))
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", "gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"deflate", "deflate", func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil }},
+		{"br, gzip;q=0.5", "gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"", "", func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rules.json", nil)
+			req.SetBasicAuth("admin", "secret")
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := adminServe(req)
+			if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+
+			body, err := tt.decode(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules := []URLRule{}
+			if err := json.NewDecoder(body).Decode(&rules); err != nil {
+				t.Fatalf("decoding the rules: %v", err)
+			}
+			if len(rules) != 2 || rules[0].Path != "/go" || rules[1].Path != "/docs" {
+				t.Errorf("rules = %+v, want /go and /docs", rules)
+			}
+		})
+	}
+}
+
+func TestPprof(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		user    string
+		status  int
+	}{
+		{"enabled", true, "admin", http.StatusOK},
+		{"enabled needs auth", true, "", http.StatusUnauthorized},
+		{"disabled", false, "admin", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &enablePprof, tt.enabled)
+
+			rec := adminRequest(http.MethodGet, "/debug/pprof/", tt.user, "secret")
+			if rec.Code != tt.status {
+				t.Errorf("GET /debug/pprof/ = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), "goroutine") {
+				t.Errorf("pprof index doesn't list the profiles:\n%s", rec.Body.String())
+			}
+
+			// Never on the public listener, the default gets it like any path
+			if rec := serve(conf, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)); rec.Code != http.StatusTemporaryRedirect {
+				t.Errorf("public GET /debug/pprof/ = %d, want the default 307", rec.Code)
+			}
+		})
+	}
+}
+
+func TestRuleDescriptions(t *testing.T) {
+	data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://example.com/go", "description": "Campaign link from the spring mailer"},
+		{"rule": "/plain", "url": "https://example.com/plain"}
+	]}`
+	conf := mustConfig(t, data)
+	useConfig(t, conf)
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	const description = "Campaign link from the spring mailer"
+
+	t.Run("rules export", func(t *testing.T) {
+		rules := []URLRule{}
+		if err := json.NewDecoder(adminRequest(http.MethodGet, "/rules.json", "admin", "secret").Body).Decode(&rules); err != nil {
+			t.Fatal(err)
+		}
+		if len(rules) != 2 || rules[0].Description != description || rules[1].Description != "" {
+			t.Errorf("rules = %+v, want the description on /go only", rules)
+		}
+	})
+
+	t.Run("round trips", func(t *testing.T) {
+		saved, err := json.Marshal(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again := mustConfig(t, string(saved)); again.RedirectRules[0].Description != description {
+			t.Errorf("description after a save and load = %q", again.RedirectRules[0].Description)
+		}
+	})
+
+	t.Run("logs", func(t *testing.T) {
+		logs := captureLogs(t)
+		serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+		serve(conf, httptest.NewRequest(http.MethodGet, "/plain", nil))
+
+		lines := logs()
+		if len(lines) < 2 {
+			t.Fatalf("got %d log lines", len(lines))
+		}
+		if line := findLog(lines, "Redirected User Rule Based"); line == nil || line["description"] != description {
+			t.Errorf("/go logged %v, want the description", line)
+		}
+		for _, line := range lines {
+			if line["rule"] == "/plain" && line["description"] != nil {
+				t.Errorf("/plain logged a description %v", line["description"])
+			}
+		}
+	})
+
+	t.Run("simulate", func(t *testing.T) {
+		out := &strings.Builder{}
+		if err := simulate(out, conf, "GET", "https://example.com/go"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "Rule: /go\nDescription: "+description+"\n") {
+			t.Errorf("simulate output:\n%s", out)
+		}
+	})
+
+	t.Run("ignored by routing", func(t *testing.T) {
+		rec := serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+		if rec.Header().Get("Location") != "https://example.com/go" {
+			t.Errorf("GET /go = %q", rec.Header().Get("Location"))
+		}
+	})
+}
+
+// statsResponse - The fields of `/stats`
+type statsResponse struct {
+	StartedAt     time.Time `json:"startedAt"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+	LastReload    time.Time `json:"lastReload"`
+	RuleCount     int       `json:"ruleCount"`
+}
+
+func TestStats(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/one", "url": "https://example.com/1"}
+	]}`))
+	setGlobal[ConfigSource](t, &configSource, &flakySource{conf: mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/one", "url": "https://example.com/1"},
+		{"rule": "/two", "url": "https://example.com/2"},
+		{"rule": "/off", "url": "https://example.com/off", "enabled": false}
+	]}`)})
+
+	stats := func() statsResponse {
+		t.Helper()
+		rec := adminRequest(http.MethodGet, "/stats", "admin", "secret")
+		got := statsResponse{}
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("GET /stats = %d: %v", rec.Code, err)
+		}
+		return got
+	}
+
+	before := stats()
+	if !before.StartedAt.Equal(startedAt) || before.Uptime == "" || before.UptimeSeconds <= 0 || before.LastReload.IsZero() || before.RuleCount != 1 {
+		t.Errorf("stats before the reload = %+v", before)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if rec := adminRequest(http.MethodPost, "/reload", "admin", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("POST /reload = %d %s", rec.Code, rec.Body)
+	}
+
+	after := stats()
+	if !after.LastReload.After(before.LastReload) {
+		t.Errorf("lastReload %s didn't move on from %s", after.LastReload, before.LastReload)
+	}
+	if after.RuleCount != 2 {
+		t.Errorf("ruleCount after the reload = %d, want the 2 enabled rules", after.RuleCount)
+	}
+	if after.UptimeSeconds < before.UptimeSeconds || !after.StartedAt.Equal(before.StartedAt) {
+		t.Errorf("uptime went from %+v to %+v", before, after)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	setGlobal(t, &hits, newHitCounter())
+
+	redirects := []string{}
+	for i := 1; i <= 12; i++ {
+		redirects = append(redirects, fmt.Sprintf(`{"rule": "/r%d", "url": "https://example.com/%d"}`, i, i))
+	}
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+strings.Join(redirects, ",")+`]}`)
+	useConfig(t, conf)
+
+	// /rN gets N hits, so the top ten are /r12 down to /r3
+	for i := 1; i <= 12; i++ {
+		for n := 0; n < i; n++ {
+			serve(conf, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/r%d", i), nil))
+		}
+	}
+	serve(conf, httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	rec := adminRequest(http.MethodGet, "/status", "admin", "secret")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("GET /status = %d %s, want a 200 text page", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"uptime: ", "last reload: ", "rules: 12\n", "total hits: 79\n", "top rules:\n", "        12  /r12\n", "         3  /r3\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status is missing %q:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"/r2\n", "/r1\n", "(default)"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("status lists %q outside the top ten:\n%s", unwanted, body)
+		}
+	}
+	if strings.Index(body, "/r12\n") > strings.Index(body, "/r11\n") {
+		t.Errorf("top rules aren't busiest first:\n%s", body)
+	}
+
+	tests := []struct {
+		name   string
+		public bool
+		user   string
+		status int
+	}{
+		{"protected without credentials", false, "", http.StatusUnauthorized},
+		{"protected with credentials", false, "admin", http.StatusOK},
+		{"public without credentials", true, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &statusPublic, tt.public)
+			if rec := adminRequest(http.MethodGet, "/status", tt.user, "secret"); rec.Code != tt.status {
+				t.Errorf("GET /status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	useConfig(t, Config{})
+	path := filepath.Join(t.TempDir(), "config.json")
+	setGlobal[ConfigSource](t, &configSource, fileSource{path: path})
+	t.Cleanup(func() { recordReload(nil) })
+
+	writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/keep", "url": "https://example.com/keep"},
+		{"rule": "/change", "url": "https://example.com/before"},
+		{"rule": "/remove", "url": "https://example.com/remove"}
+	]}`)
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	public := func(path string) string {
+		rec := httptest.NewRecorder()
+		publicHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Header().Get("Location")
+	}
+	if got := public("/change"); got != "https://example.com/before" {
+		t.Fatalf("GET /change before the reload = %q", got)
+	}
+
+	writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/keep", "url": "https://example.com/keep"},
+		{"rule": "/change", "url": "https://example.com/after"},
+		{"rule": "/add", "url": "https://example.com/add"}
+	]}`)
+
+	t.Run("needs auth", func(t *testing.T) {
+		if rec := adminRequest(http.MethodPost, "/reload", "", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("POST /reload without credentials = %d", rec.Code)
+		}
+		if got := public("/change"); got != "https://example.com/before" {
+			t.Errorf("an unauthorized reload went through, /change = %q", got)
+		}
+	})
+
+	t.Run("only POST", func(t *testing.T) {
+		if rec := adminRequest(http.MethodGet, "/reload", "admin", "secret"); rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET /reload = %d, want 405", rec.Code)
+		}
+	})
+
+	t.Run("swaps in the new rules", func(t *testing.T) {
+		rec := adminRequest(http.MethodPost, "/reload", "admin", "secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /reload = %d %s", rec.Code, rec.Body)
+		}
+		diff := configDiff{}
+		if err := json.NewDecoder(rec.Body).Decode(&diff); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(diff.Added, ",") != "/add" || strings.Join(diff.Removed, ",") != "/remove" ||
+			strings.Join(diff.Changed, ",") != "/change" || diff.Rules != 3 {
+			t.Errorf("diff = %+v", diff)
+		}
+
+		for path, want := range map[string]string{
+			"/change": "https://example.com/after",
+			"/add":    "https://example.com/add",
+			"/remove": "https://example.com",
+			"/keep":   "https://example.com/keep",
+		} {
+			if got := public(path); got != want {
+				t.Errorf("GET %s after the reload = %q, want %q", path, got, want)
+			}
+		}
+	})
+
+	t.Run("a broken config keeps the current one", func(t *testing.T) {
+		writeFile(t, path, `{"version": 1,`)
+		rec := adminRequest(http.MethodPost, "/reload", "admin", "secret")
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "reload failed") {
+			t.Errorf("POST /reload with a broken config = %d %s", rec.Code, rec.Body)
+		}
+		if got := public("/change"); got != "https://example.com/after" {
+			t.Errorf("GET /change after a failed reload = %q", got)
+		}
+	})
+}
+
+func TestAdminErrors(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	useConfig(t, Config{})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		user     string
+		follower bool
+		status   int
+		message  string
+	}{
+		{"not found", http.MethodGet, "/nothing-here", "", "admin", false, http.StatusNotFound, "not found"},
+		{"wrong method", http.MethodGet, "/reload", "", "admin", false, http.StatusMethodNotAllowed, "method not allowed"},
+		{"bad maintenance body", http.MethodPost, "/maintenance", `{"enabled": "yes"`, "admin", false, http.StatusBadRequest, `expected {"enabled": true|false}`},
+		{"no credentials", http.MethodGet, "/stats", "", "", false, http.StatusUnauthorized, "unauthorized"},
+		{"follower refuses changes", http.MethodPost, "/maintenance", `{"enabled": true}`, "admin", true, http.StatusForbidden, "read only follower"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &followerMode, tt.follower)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "secret")
+			}
+			rec := adminServe(req)
+
+			if rec.Code != tt.status || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("%s %s = %d %s, want %d JSON", tt.method, tt.path, rec.Code, rec.Header().Get("Content-Type"), tt.status)
+			}
+			body := struct {
+				Error string `json:"error"`
+				Code  int    `json:"code"`
+			}{}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.status || !strings.HasPrefix(body.Error, tt.message) {
+				t.Errorf("body = %+v, want code %d and error %q", body, tt.status, tt.message)
+			}
+		})
+	}
+
+	if maintenance.Load() {
+		t.Error("a refused request switched maintenance on")
+	}
+}
+
+func TestAdminTimeouts(t *testing.T) {
+	tests := []struct {
+		name              string
+		read, write, idle time.Duration
+	}{
+		{"defaults", 15 * time.Second, 15 * time.Second, 0},
+		{"slow profiles", 5 * time.Second, 2 * time.Minute, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &adminAddr, "127.0.0.1:8081")
+			setGlobal(t, &adminReadTimeout, tt.read)
+			setGlobal(t, &adminWriteTimeout, tt.write)
+			setGlobal(t, &adminIdleTimeout, tt.idle)
+
+			srv := newAdminServer()
+			if srv.Addr != "127.0.0.1:8081" || srv.ReadTimeout != tt.read || srv.WriteTimeout != tt.write || srv.IdleTimeout != tt.idle {
+				t.Errorf("admin server = %s read %s write %s idle %s, want %s %s %s", srv.Addr, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout, tt.read, tt.write, tt.idle)
+			}
+
+			// The public listener keeps its own
+			public := newPublicServer(http.NotFoundHandler())
+			if public.ReadTimeout != 15*time.Second || public.WriteTimeout != 15*time.Second {
+				t.Errorf("public server read %s write %s, want the 15s defaults", public.ReadTimeout, public.WriteTimeout)
+			}
+		})
+	}
+}
+
+func TestFollowerMode(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	setGlobal(t, &followerMode, true)
+	setGlobal(t, &configLoaded, int32(1))
+	t.Cleanup(func() { maintenance.Store(false) })
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`))
+	source := &flakySource{conf: mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)}
+	setGlobal[ConfigSource](t, &configSource, source)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		user   string
+		status int
+	}{
+		{"reload refused", http.MethodPost, "/reload", "", "admin", http.StatusForbidden},
+		{"maintenance switch refused", http.MethodPost, "/maintenance", `{"enabled": true}`, "admin", http.StatusForbidden},
+		{"credentials still checked first", http.MethodPost, "/reload", "", "", http.StatusUnauthorized},
+		{"maintenance state", http.MethodGet, "/maintenance", "", "admin", http.StatusOK},
+		{"rules", http.MethodGet, "/rules.json", "", "admin", http.StatusOK},
+		{"stats", http.MethodGet, "/stats", "", "admin", http.StatusOK},
+		{"dashboard", http.MethodGet, "/dashboard", "", "admin", http.StatusOK},
+		{"metrics", http.MethodGet, "/metrics", "", "admin", http.StatusOK},
+		{"status", http.MethodGet, "/status", "", "admin", http.StatusOK},
+		{"health", http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{"readiness", http.MethodGet, "/readyz", "", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "secret")
+			}
+			rec := adminServe(req)
+			if rec.Code != tt.status {
+				t.Errorf("%s %s as a follower = %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body, tt.status)
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(rec.Body.String(), "read only follower") {
+				t.Errorf("%s %s body = %s", tt.method, tt.path, rec.Body)
+			}
+		})
+	}
+
+	if maintenance.Load() || source.calls != 0 {
+		t.Errorf("maintenance %v after %d loads, a follower changed state", maintenance.Load(), source.calls)
+	}
+
+	t.Run("the leader still changes state", func(t *testing.T) {
+		setGlobal(t, &followerMode, false)
+		req := httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(`{"enabled": true}`))
+		req.SetBasicAuth("admin", "secret")
+		if rec := adminServe(req); rec.Code != http.StatusOK || !maintenance.Load() {
+			t.Errorf("POST /maintenance on the leader = %d, maintenance %v", rec.Code, maintenance.Load())
+		}
+	})
+}
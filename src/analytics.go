@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// analyticsEvent - A single Redirect written as one line of the Analytics file
+type analyticsEvent struct {
+	Time      time.Time `json:"time"`
+	Rule      string    `json:"rule,omitempty"`
+	Status    int       `json:"status"`
+	ClientIP  string    `json:"clientIp"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+}
+
+// analyticsWriter - Buffered, size capped JSONL writer for Redirect events
+type analyticsWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	flush   bool
+	done    chan struct{}
+}
+
+// newAnalyticsWriter - Open (or create) the Analytics file and start the
+// periodic flush, a flushEvery of 0 (or less) flushes every event as it is
+// written instead. When maxSize is above zero the file is rotated to
+// `<path>.1` once it would grow past it.
+func newAnalyticsWriter(path string, maxSize int64, flushEvery time.Duration) (*analyticsWriter, error) {
+	a := &analyticsWriter{path: path, maxSize: maxSize, flush: flushEvery <= 0, done: make(chan struct{})}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	if a.flush {
+		return a, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(flushEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.mu.Lock()
+				a.buf.Flush()
+				a.mu.Unlock()
+			case <-a.done:
+				return
+			}
+		}
+	}()
+
+	return a, nil
+}
+
+func (a *analyticsWriter) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.buf = bufio.NewWriter(f)
+	a.size = info.Size()
+	return nil
+}
+
+func (a *analyticsWriter) rotate() error {
+	a.buf.Flush()
+	a.file.Close()
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record - Queue a Redirect event for the given request. Safe to call on a
+// nil writer so callers don't need to check if Analytics is enabled.
+func (a *analyticsWriter) Record(r *http.Request, rule string, status int) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(analyticsEvent{
+		Time:      time.Now().UTC(),
+		Rule:      rule,
+		Status:    status,
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			slog.Error("Failed to Rotate Analytics File", "err", err)
+			return
+		}
+	}
+
+	n, err := a.buf.Write(line)
+	a.size += int64(n)
+	if err == nil && a.flush {
+		err = a.buf.Flush()
+	}
+	if err != nil {
+		slog.Error("Failed to Write Analytics Event", "err", err)
+	}
+}
+
+// Close - Flush anything still buffered and close the file
+func (a *analyticsWriter) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	close(a.done)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf.Flush()
+	return a.file.Close()
+}
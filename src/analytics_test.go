@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readEvents - Every analytics event in the file, in order
+func readEvents(t *testing.T, path string) []analyticsEvent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	events := []analyticsEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := analyticsEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAnalyticsRecordsRedirects(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"host": "docs.example.com", "rule": "/go", "url": "https://docs.example.com/go"},
+		{"host": "docs.example.com", "rule": "/v1", "gone": true},
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/old", "url": "https://example.com/new", "options": {"statusCode": 301}}
+	]}`)
+
+	tests := []struct {
+		name  string
+		flush time.Duration
+	}{
+		{"flushed on close", time.Hour},
+		{"flushed on every write", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.jsonl")
+			writer, err := newAnalyticsWriter(path, 0, tt.flush)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setGlobal(t, &analytics, writer)
+
+			// Rules are told apart by their host as well as their path
+			requests := []struct {
+				host, path, referer string
+				rule                string
+				status              int
+			}{
+				{"example.com", "/go", "https://news.example.com/", "/go", http.StatusTemporaryRedirect},
+				{"docs.example.com", "/go", "", "docs.example.com/go", http.StatusTemporaryRedirect},
+				{"docs.example.com", "/v1", "", "docs.example.com/v1", http.StatusGone},
+				{"example.com", "/old", "", "/old", http.StatusMovedPermanently},
+				{"example.com", "/missing", "", "", http.StatusTemporaryRedirect},
+			}
+			for _, r := range requests {
+				req := httptest.NewRequest(http.MethodGet, "http://"+r.host+r.path, nil)
+				req.RemoteAddr = "203.0.113.7:5000"
+				req.Header.Set("User-Agent", "analytics-test")
+				if r.referer != "" {
+					req.Header.Set("Referer", r.referer)
+				}
+				serve(conf, req)
+			}
+
+			if tt.flush <= 0 {
+				// Nothing should be sitting in the buffer
+				if got := len(readEvents(t, path)); got != len(requests) {
+					t.Fatalf("before Close the file has %d events, want %d", got, len(requests))
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			events := readEvents(t, path)
+			if len(events) != len(requests) {
+				t.Fatalf("got %d events, want %d", len(events), len(requests))
+			}
+			for i, want := range requests {
+				got := events[i]
+				if got.Rule != want.rule || got.Status != want.status || got.ClientIP != "203.0.113.7" ||
+					got.UserAgent != "analytics-test" || got.Referer != want.referer || got.Time.IsZero() {
+					t.Errorf("event %d = %+v, want rule %q status %d referer %q", i, got, want.rule, want.status, want.referer)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyticsRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	writer, err := newAnalyticsWriter(path, 300, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/go", nil)
+	for i := 0; i < 5; i++ {
+		writer.Record(req, "/go", http.StatusTemporaryRedirect)
+	}
+	writer.Close()
+
+	current, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Size() > 300 {
+		t.Errorf("current file is %d bytes, over the 300 byte cap", current.Size())
+	}
+	total := len(readEvents(t, path)) + len(readEvents(t, path+".1"))
+	if total < 2 || len(readEvents(t, path+".1")) == 0 {
+		t.Errorf("expected events in both %s and the rotated .1, got %d in total", path, total)
+	}
+}
+
+func TestAnalyticsNilIsSafe(t *testing.T) {
+	var writer *analyticsWriter
+	writer.Record(httptest.NewRequest(http.MethodGet, "/", nil), "/", http.StatusTemporaryRedirect)
+	if err := writer.Close(); err != nil {
+		t.Errorf("Close on nil = %v", err)
+	}
+}
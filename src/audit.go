@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry - One line of the Audit log. Each MAC covers the previous
+// entry's MAC as well as this Event, so editing, dropping or reordering any
+// line breaks every MAC after it.
+type auditEntry struct {
+	Event json.RawMessage `json:"event"`
+	Prev  string          `json:"prev"`
+	MAC   string          `json:"mac"`
+}
+
+// auditMAC - HMAC-SHA256 over the previous MAC and the Event
+func auditMAC(key []byte, prev string, event []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(prev))
+	mac.Write([]byte{'\n'})
+	mac.Write(event)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLog - Append only, hash chained Redirect log from `-audit-file`
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	key  []byte
+	prev string
+}
+
+// audit - Redirect audit trail, nil when `-audit-file` isn't set
+var audit *auditLog
+
+// newAuditLog - Open (or create) the Audit log, carrying on the chain from
+// the last entry so restarts don't break it. The existing entries are
+// verified first, an already broken chain is an error.
+func newAuditLog(path string, key []byte) (*auditLog, error) {
+	prev := ""
+	if f, err := os.Open(path); err == nil {
+		prev, err = verifyAuditLog(f, key)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f, key: key, prev: prev}, nil
+}
+
+// Record - Chain a Redirect event onto the log, written straight through so
+// nothing is lost sitting in a buffer. Safe to call on a nil log.
+func (a *auditLog) Record(r *http.Request, rule string, status int) {
+	if a == nil {
+		return
+	}
+
+	event, err := json.Marshal(analyticsEvent{
+		Time:      time.Now().UTC(),
+		Rule:      rule,
+		Status:    status,
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	})
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := auditEntry{Event: event, Prev: a.prev, MAC: auditMAC(a.key, a.prev, event)}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to Write Audit Entry", "err", err)
+		return
+	}
+	a.prev = entry.MAC
+}
+
+// Close - Close the file
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// verifyAuditLog - Check every entry's MAC and that it chains onto the one
+// before, returning the last MAC. The error names the first bad line.
+func verifyAuditLog(r io.Reader, key []byte) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	prev := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		entry := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return prev, fmt.Errorf("line %d: %v", line, err)
+		}
+		if entry.Prev != prev {
+			return prev, fmt.Errorf("line %d: does not follow the previous entry", line)
+		}
+		if !hmac.Equal([]byte(entry.MAC), []byte(auditMAC(key, prev, entry.Event))) {
+			return prev, fmt.Errorf("line %d: MAC does not match, the entry was modified", line)
+		}
+		prev = entry.MAC
+	}
+	return prev, scanner.Err()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditChain(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+	key := []byte("audit key")
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	record := func(paths ...string) {
+		t.Helper()
+		log, err := newAuditLog(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setGlobal(t, &audit, log)
+		for _, p := range paths {
+			serve(conf, httptest.NewRequest(http.MethodGet, p, nil))
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restart carries the chain on from the last entry
+	record("/go", "/missing")
+	record("/go")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("audit log has %d entries, want 3:\n%s", len(lines), data)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(data), key); err != nil {
+		t.Fatalf("a well formed chain = %v, want it to verify", err)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		key  string
+		err  string
+	}{
+		{"modified event", strings.Replace(string(data), `"rule":"/go"`, `"rule":"/gone"`, 1), string(key), "line 1: MAC does not match"},
+		{"dropped entry", lines[0] + lines[2], string(key), "line 2: does not follow"},
+		{"reordered entries", lines[1] + lines[0] + lines[2], string(key), "line 1: does not follow"},
+		{"wrong key", string(data), "other key", "line 1: MAC does not match"},
+		{"not JSON", lines[0] + "garbage\n", string(key), "line 2: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifyAuditLog(strings.NewReader(tt.data), []byte(tt.key)); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("verifyAuditLog = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("a broken log isn't carried on", func(t *testing.T) {
+		broken := filepath.Join(t.TempDir(), "audit.log")
+		writeFile(t, broken, lines[1]+lines[0])
+		if _, err := newAuditLog(broken, key); err == nil {
+			t.Error("newAuditLog on a broken chain = nil, want an error")
+		}
+	})
+
+	t.Run("entries name the rule by its host and path", func(t *testing.T) {
+		conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+			{"host": "docs.example.com", "rule": "/go", "url": "https://docs.example.com/go"},
+			{"rule": "/go", "url": "https://golang.org"}
+		]}`)
+		path := filepath.Join(t.TempDir(), "audit.log")
+		log, err := newAuditLog(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setGlobal(t, &audit, log)
+		serve(conf, httptest.NewRequest(http.MethodGet, "http://docs.example.com/go", nil))
+		serve(conf, httptest.NewRequest(http.MethodGet, "http://example.com/go", nil))
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 || !strings.Contains(lines[0], `"rule":"docs.example.com/go"`) || !strings.Contains(lines[1], `"rule":"/go"`) {
+			t.Errorf("audit log =\n%s\nwant docs.example.com/go then /go", data)
+		}
+	})
+}
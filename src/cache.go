@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// targetCacheSize - Most entries a Rule's cache holds before it starts over
+const targetCacheSize = 10000
+
+// targetCache - Short lived targets for a Rule, keyed by the parts of the
+// request the Rule's target depends on
+type targetCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedTarget
+}
+
+type cachedTarget struct {
+	url     string
+	expires time.Time
+}
+
+func newTargetCache(ttl time.Duration) *targetCache {
+	return &targetCache{ttl: ttl, entries: map[string]cachedTarget{}}
+}
+
+// Get - The cached target for the key, if it hasn't expired
+func (c *targetCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.url, true
+}
+
+// Set - Cache the target for the key, a full cache is emptied rather than
+// tracking which entry is oldest
+func (c *targetCache) Set(key, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= targetCacheSize {
+		c.entries = map[string]cachedTarget{}
+	}
+	c.entries[key] = cachedTarget{url: url, expires: time.Now().Add(c.ttl)}
+}
+
+// cacheKey - Everything about the request that selectTarget looks at
+func (s *targetSelector) cacheKey(r *http.Request) string {
+	parts := []string{}
+	if len(s.referers) > 0 {
+		parts = append(parts, r.Referer())
+	}
+	if s.langMatcher != nil || s.locales != nil {
+		parts = append(parts, r.Header.Get("Accept-Language"))
+	}
+	for _, c := range s.rule.CookieRules {
+		if cookie, err := r.Cookie(c.Name); err == nil {
+			parts = append(parts, "="+cookie.Value)
+		} else {
+			parts = append(parts, "")
+		}
+	}
+	for _, h := range s.rule.HeaderRules {
+		parts = append(parts, r.Header.Get(h.Header))
+	}
+	// A shortener's target is down to its code alone
+	if s.rule.Type == ruleTypeShortener {
+		parts = append(parts, mux.Vars(r)[shortCodeVar])
+	}
+	// And a lookup's to its key
+	if s.rule.Type == ruleTypeLookup {
+		parts = append(parts, mux.Vars(r)[s.lookupKey])
+	}
+	if len(s.rule.QueryRules) > 0 {
+		query := r.URL.Query()
+		for _, q := range s.rule.QueryRules {
+			if values, ok := query[q.Param]; ok {
+				parts = append(parts, "="+strings.Join(values, "&"))
+			} else {
+				parts = append(parts, "")
+			}
+		}
+	}
+	if s.rule.HTTP2URL != "" {
+		parts = append(parts, strconv.Itoa(r.ProtoMajor))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// cacheable - If the same request always gets the same target. Anything that
+// changes with the time of day or rotates per hit is worked out every time.
+func (rule URLRule) cacheable() bool {
+	return len(rule.TimeTargets) == 0 && len(rule.Targets) == 0 && !rule.Template && rule.Ramp == nil && len(rule.Variants) == 0 && rule.Holidays == nil
+}
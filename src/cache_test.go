@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTargetCache(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/buy", "url": "https://shop.example.com", "cacheTTL": "1m", "refererRules": [
+			{"match": "partner\\.com", "url": "https://shop.example.com?ref=partner"}
+		]},
+		{"rule": "/rr", "targets": ["https://a.example.com", "https://b.example.com"], "cacheTTL": "1m"},
+		{"rule": "/ab", "cacheTTL": "1m", "variants": [
+			{"url": "https://a.example.com", "weight": 1},
+			{"url": "https://b.example.com", "weight": 1}
+		]},
+		{"rule": "/beta", "url": "https://example.com/stable", "cacheTTL": "1m", "headerRules": [
+			{"header": "X-Beta", "match": "1", "url": "https://example.com/beta"}
+		]},
+		{"rule": "/docs", "url": "https://docs.example.com", "cacheTTL": "1m", "langRules": [{"lang": "fr", "url": "https://docs.example.com/fr"}]}
+	]}`)
+
+	request := func(path, referer string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		return req
+	}
+
+	t.Run("deterministic rule is served from the cache", func(t *testing.T) {
+		s := newTargetSelector(conf.RedirectRules[0], time.UTC)
+		if s.cache == nil {
+			t.Fatal("a refererRules rule with cacheTTL has no cache")
+		}
+
+		tests := []struct {
+			referer string
+			want    string
+		}{
+			{"", "https://shop.example.com"},
+			{"https://partner.com/", "https://shop.example.com?ref=partner"},
+		}
+		for _, tt := range tests {
+			req := request("/buy", tt.referer)
+			if got := s.Select(req); got != tt.want {
+				t.Fatalf("Select from %q = %q, want %q", tt.referer, got, tt.want)
+			}
+			// A hit returns what was stored, not what selectTarget works out
+			s.cache.Set(s.cacheKey(req), "https://cached.example.com")
+			if got := s.Select(request("/buy", tt.referer)); got != "https://cached.example.com" {
+				t.Errorf("second Select from %q = %q, want the cached target", tt.referer, got)
+			}
+		}
+		if len(s.cache.entries) != len(tests) {
+			t.Errorf("cache holds %d entries, want one per referer (%d)", len(s.cache.entries), len(tests))
+		}
+	})
+
+	t.Run("expired entries are worked out again", func(t *testing.T) {
+		s := newTargetSelector(conf.RedirectRules[0], time.UTC)
+		req := request("/buy", "")
+		s.cache.entries[s.cacheKey(req)] = cachedTarget{url: "https://stale.example.com", expires: time.Now().Add(-time.Second)}
+		if got := s.Select(req); got != "https://shop.example.com" {
+			t.Errorf("Select = %q after the entry expired, want https://shop.example.com", got)
+		}
+	})
+
+	t.Run("only what the rule looks at splits the cache", func(t *testing.T) {
+		tests := []struct {
+			rule    int
+			headers []map[string]string
+			entries int
+		}{
+			// Neither referers nor languages matter to /beta
+			{3, []map[string]string{
+				{"Referer": "https://a.example.com/"},
+				{"Referer": "https://b.example.com/", "Accept-Language": "fr"},
+				{"Accept-Language": "de"},
+			}, 1},
+			// And only languages to /docs
+			{4, []map[string]string{
+				{"Referer": "https://a.example.com/", "Accept-Language": "fr"},
+				{"Referer": "https://b.example.com/", "Accept-Language": "fr"},
+				{"Accept-Language": "de"},
+			}, 2},
+		}
+		for _, tt := range tests {
+			rule := conf.RedirectRules[tt.rule]
+			s := newTargetSelector(rule, time.UTC)
+			for _, headers := range tt.headers {
+				req := request(rule.Path, "")
+				for name, value := range headers {
+					req.Header.Set(name, value)
+				}
+				s.Select(req)
+			}
+			if len(s.cache.entries) != tt.entries {
+				t.Errorf("%s cache holds %d entries, want %d", rule.Path, len(s.cache.entries), tt.entries)
+			}
+		}
+	})
+
+	for _, i := range []int{1, 2} {
+		rule := conf.RedirectRules[i]
+		t.Run(rule.Path+" is never cached", func(t *testing.T) {
+			s := newTargetSelector(rule, time.UTC)
+			if s.cache != nil {
+				t.Fatal("a rule that changes per hit was given a cache")
+			}
+
+			seen := map[string]bool{}
+			for n := 0; n < 200; n++ {
+				seen[s.Select(request(rule.Path, ""))] = true
+			}
+			if !seen["https://a.example.com"] || !seen["https://b.example.com"] {
+				t.Errorf("200 requests only went to %v, want both targets", seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetCheck - How one target answered `-check-targets`
+type targetCheck struct {
+	URL    string
+	Status int
+	Err    error
+}
+
+// checkableTargets - Every absolute target in the Config, once each. Template
+// targets aren't URLs until a request fills them in, so they're skipped.
+func checkableTargets(conf Config) []string {
+	seen := map[string]bool{}
+	add := func(target string) {
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			seen[target] = true
+		}
+	}
+
+	add(conf.FinalRedirect)
+	for _, target := range conf.HostDefaults {
+		add(target)
+	}
+	for _, t := range conf.DefaultTargets {
+		add(t.URL)
+	}
+	for _, rule := range activeRules(conf) {
+		if rule.Template || rule.Gone {
+			continue
+		}
+		for _, target := range rule.targets() {
+			if len(rule.Locales) > 0 {
+				target = strings.ReplaceAll(target, localeVar, rule.Locales[0])
+			}
+			add(target)
+		}
+	}
+
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// checkTargets - HEAD every target (GET when HEAD isn't allowed), at most
+// concurrency at once, and write a line for each. Errors and 4xx/5xx
+// answers count as failed, the number failed is returned.
+func checkTargets(out io.Writer, conf Config, timeout time.Duration, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	client := &http.Client{Timeout: timeout}
+
+	targets := checkableTargets(conf)
+	results := make([]targetCheck, len(targets))
+	slots := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for i, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, target string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = checkTarget(client, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", result.URL, result.Err)
+		case result.Status >= 400:
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %d %s\n", result.URL, result.Status, http.StatusText(result.Status))
+		default:
+			fmt.Fprintf(out, "ok   %s: %d\n", result.URL, result.Status)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d targets failed\n", failed, len(results))
+	return failed
+}
+
+// checkTarget - One target's answer, trying GET after a HEAD the server refuses
+func checkTarget(client *http.Client, target string) targetCheck {
+	status := 0
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			return targetCheck{URL: target, Err: err}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return targetCheck{URL: target, Err: err}
+		}
+		resp.Body.Close()
+
+		status = resp.StatusCode
+		if status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+			break
+		}
+	}
+	return targetCheck{URL: target, Status: status}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckTargets(t *testing.T) {
+	mu := sync.Mutex{}
+	running, most := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/get-only":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	u := upstream.URL
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "`+u+`/ok", "redirects": [
+		{"rule": "/a", "url": "`+u+`/ok"},
+		{"rule": "/b", "url": "`+u+`/missing"},
+		{"rule": "/c", "url": "`+u+`/get-only"},
+		{"rule": "/d", "url": "`+u+`/slow"},
+		{"rule": "/e", "url": "http://127.0.0.1:1/down"},
+		{"rule": "/f", "targets": ["`+u+`/one", "`+u+`/two"]},
+		{"rule": "/g", "url": "`+u+`/{locale}/docs", "locales": ["en", "fr"]},
+		{"rule": "/t", "url": "https://{{.Vars.x}}.invalid", "template": true},
+		{"rule": "/gone", "gone": true, "url": "http://127.0.0.1:1/gone"},
+		{"rule": "/rel", "url": "/relative"}
+	]}`)
+
+	want := []string{u + "/en/docs", u + "/get-only", u + "/missing", u + "/ok", u + "/one", u + "/slow", u + "/two", "http://127.0.0.1:1/down"}
+	sort.Strings(want)
+	if got := checkableTargets(conf); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkableTargets = %q, want %q", got, want)
+	}
+
+	out := &strings.Builder{}
+	failed := checkTargets(out, conf, 200*time.Millisecond, 2)
+	if failed != 3 {
+		t.Errorf("checkTargets = %d failed, want 3", failed)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	tests := []struct {
+		target string
+		prefix string
+	}{
+		{u + "/ok", "ok   " + u + "/ok: 200"},
+		{u + "/en/docs", "ok   " + u + "/en/docs: 200"},
+		{u + "/get-only", "ok   " + u + "/get-only: 200"},
+		{u + "/missing", "FAIL " + u + "/missing: 404 Not Found"},
+		{u + "/slow", "FAIL " + u + "/slow: "},
+		{"http://127.0.0.1:1/down", "FAIL http://127.0.0.1:1/down: "},
+	}
+	for _, tt := range tests {
+		found := false
+		for _, line := range lines {
+			// After the `ok   ` or `FAIL `
+			if len(line) > 5 && strings.HasPrefix(line[5:], tt.target+":") {
+				found = true
+				if !strings.HasPrefix(line, tt.prefix) {
+					t.Errorf("%s reported as %q, want %q", tt.target, line, tt.prefix)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s isn't in the report:\n%s", tt.target, out)
+		}
+	}
+	if last := lines[len(lines)-1]; last != "3 of 8 targets failed" {
+		t.Errorf("summary = %q", last)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most > 2 {
+		t.Errorf("%d checks ran at once, want at most 2", most)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies - Peers allowed to tell us the real client, from `-trusted-proxies`
+var trustedProxies []*net.IPNet
+
+// allowedClients / blockedClients - From `-allow-ips` and `-block-ips`
+var (
+	allowedClients []*net.IPNet
+	blockedClients []*net.IPNet
+)
+
+// parseCIDRs - Parse a comma separated list of CIDRs, a bare IP is taken as
+// just that address
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, item := range splitList(list) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipListed - If the IP is inside any of the networks
+func ipListed(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP - An IP from the forms it shows up in: `1.2.3.4`, `1.2.3.4:80`,
+// `::1`, `[::1]:80`, `"[::1]:80"` (Forwarded) and `fe80::1%eth0` (zoned)
+func parseIP(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	if i := strings.Index(value, "%"); i >= 0 {
+		value = value[:i]
+	}
+
+	ip := net.ParseIP(value)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// forwardedFor - The client chain from X-Forwarded-For, or the `for=` values
+// of the standard Forwarded header, nearest hop last
+func forwardedFor(r *http.Request) []string {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		return strings.Split(strings.Join(xff, ","), ",")
+	}
+
+	chain := []string{}
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					chain = append(chain, pair[4:])
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseClientIP - The client's IP, IPv4 or IPv6. Forwarded headers are only
+// believed when the peer is one of the `-trusted-proxies`, and then the chain
+// is walked from the nearest hop back to the first address we don't trust.
+func parseClientIP(r *http.Request) net.IP {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil || !ipListed(ip, trustedProxies) {
+		return ip
+	}
+
+	chain := forwardedFor(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseIP(chain[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !ipListed(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientIP - parseClientIP as a string for logs, RemoteAddr if it won't parse
+func clientIP(r *http.Request) string {
+	if ip := parseClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// ipFiltering - Refuse clients in the block list, or outside the allow list
+// when there is one, with a 403 before any Rule (or the default) sees them.
+// A Rule's own allowCIDRs/blockCIDRs are checked after this.
+func ipFiltering(allow []*net.IPNet, block []*net.IPNet) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := parseClientIP(r)
+			if ip == nil || ipListed(ip, block) || len(allow) > 0 && !ipListed(ip, allow) {
+				loggerFromContext(r.Context()).Info("Refused Client by IP", "client", clientIP(r), "status", http.StatusForbidden)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestHost - The Host the client asked for. X-Forwarded-Host is only used
+// with `-trust-forwarded-host` and a peer in `-trusted-proxies`, otherwise
+// anyone could pick which host's rules they get. With several values the
+// last is the one our nearest proxy added.
+func requestHost(r *http.Request) string {
+	if !trustForwardedHost {
+		return r.Host
+	}
+
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil || !ipListed(ip, trustedProxies) {
+		return r.Host
+	}
+
+	values := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Host"), ","), ",")
+	if host := strings.TrimSpace(values[len(values)-1]); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// requestScheme - http or https, as the client used it. X-Forwarded-Proto is
+// only believed from the `-trusted-proxies`.
+func requestScheme(r *http.Request) string {
+	ip := parseIP(r.RemoteAddr)
+	if ip != nil && ipListed(ip, trustedProxies) {
+		switch proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// localPort - The port of our listener the request arrived on, 0 when unknown
+func localPort(r *http.Request) int {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
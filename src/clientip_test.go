@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseClientIP(t *testing.T) {
+	trusted, _ := parseCIDRs("10.0.0.0/8, fd00::/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"IPv4", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"IPv4 without a port", "203.0.113.7", nil, "203.0.113.7"},
+		{"bracketed IPv6", "[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"bracketed loopback", "[::1]:80", nil, "::1"},
+		{"bare IPv6", "2001:db8::1", nil, "2001:db8::1"},
+		{"zoned IPv6", "[fe80::1%eth0]:5000", nil, "fe80::1"},
+		{"IPv4 mapped IPv6", "[::ffff:203.0.113.7]:5000", nil, "203.0.113.7"},
+		{"untrusted peer's X-Forwarded-For is ignored", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy X-Forwarded-For", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy chain stops at the first untrusted hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "192.0.2.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"trusted IPv6 proxy with an IPv6 client", "[fd00::1]:5000", map[string]string{"X-Forwarded-For": "2001:db8::5"}, "2001:db8::5"},
+		{"Forwarded for an IPv6 client", "10.0.0.1:5000", map[string]string{"Forwarded": `for="[2001:db8::5]:4711";proto=https`}, "2001:db8::5"},
+		{"Forwarded with several elements", "10.0.0.1:5000", map[string]string{"Forwarded": "for=192.0.2.60, for=198.51.100.17;by=10.0.0.1"}, "198.51.100.17"},
+		{"garbage in the chain keeps the last good hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "unknown"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &trustedProxies, trusted)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := clientIP(req); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPFiltering(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/internal", "url": "https://intranet.example.com", "allowCIDRs": ["2001:db8::/32", "192.0.2.0/24"]}
+	]}`)
+
+	tests := []struct {
+		remoteAddr string
+		location   string
+	}{
+		{"[2001:db8::1]:5000", "https://intranet.example.com"},
+		{"192.0.2.1:5000", "https://intranet.example.com"},
+		{"[::ffff:192.0.2.1]:5000", "https://intranet.example.com"},
+		{"[2001:db9::1]:5000", "https://example.com"},
+		{"198.51.100.1:5000", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/internal", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /internal from %s = %q, want %q", tt.remoteAddr, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestRuleCIDRs(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/public", "url": "https://example.com/public", "blockCIDRs": ["198.51.100.0/24"]},
+		{"rule": "/office", "url": "https://example.com/office", "allowCIDRs": ["10.0.0.0/8"], "blockCIDRs": ["10.66.0.0/16"]},
+		{"rule": "/open", "url": "https://example.com/open"}
+	]}`)
+	allowAll, _ := parseCIDRs("0.0.0.0/0")
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		location   string
+	}{
+		{"outside the block list", "/public", "203.0.113.1:5000", "https://example.com/public"},
+		{"inside the block list falls through", "/public", "198.51.100.7:5000", "https://example.com"},
+		{"in range", "/office", "10.1.2.3:5000", "https://example.com/office"},
+		{"out of range falls through", "/office", "203.0.113.1:5000", "https://example.com"},
+		{"blocked inside the allowed range", "/office", "10.66.1.1:5000", "https://example.com"},
+		{"other rules aren't gated", "/open", "198.51.100.7:5000", "https://example.com/open"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The global allow list lets everyone through, the rule still decides
+			setGlobal(t, &allowedClients, allowAll)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s from %s = %q, want %q", tt.path, tt.remoteAddr, got, tt.location)
+			}
+		})
+	}
+
+	for _, field := range []string{"allowCIDRs", "blockCIDRs"} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "url": "https://example.com", "` + field + `": ["10.0.0.0/33"]}]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("parseConfig with a bad %s = %v, want a %s error", field, err, field)
+		}
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "hostDefaults": {"b.example.com": "https://b.example.com/fallback"}, "redirects": [
+		{"host": "a.example.com", "rule": "/go", "url": "https://a.example.com/go"}
+	]}`)
+	trusted, _ := parseCIDRs("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		trust      bool
+		remoteAddr string
+		forwarded  string
+		path       string
+		location   string
+	}{
+		{"trusted proxy", true, "10.0.0.1:5000", "a.example.com", "/go", "https://a.example.com/go"},
+		{"trusted proxy with several hops takes the last", true, "10.0.0.1:5000", "evil.example, A.Example.com.", "/go", "https://a.example.com/go"},
+		{"forwarded host picks the host default", true, "10.0.0.1:5000", "b.example.com", "/missing", "https://b.example.com/fallback"},
+		{"untrusted peer is ignored", true, "203.0.113.9:5000", "a.example.com", "/go", "https://example.com"},
+		{"not turned on", false, "10.0.0.1:5000", "a.example.com", "/go", "https://example.com"},
+		{"empty header falls back to Host", true, "10.0.0.1:5000", "", "/go", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &trustedProxies, trusted)
+			setGlobal(t, &trustForwardedHost, tt.trust)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = "proxy.internal"
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwarded)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// currentConfigVersion - The newest Config `version` this build understands
+const currentConfigVersion = 1
+
+// migrateSettings - Upgrade an older Config shape to the current one in
+// place, the Rules are each done by migrateRule.
+//
+// Version 0 (no `version` key): `options.permanently` becomes a 301 `statusCode`.
+func migrateSettings(conf *Config) error {
+	if conf.Version > currentConfigVersion {
+		return fmt.Errorf("config version %d is newer than this build supports (%d)", conf.Version, currentConfigVersion)
+	}
+	if conf.Version == 0 {
+		conf.Version = 1
+	}
+	return nil
+}
+
+// migrateRule - migrateSettings for one Rule of a Config written at version
+func migrateRule(version int, rule *URLRule) {
+	if version == 0 {
+		options := &rule.RedirectOptions
+		if options.Permanently && options.StatusCode == 0 {
+			options.StatusCode = http.StatusMovedPermanently
+		}
+		options.Permanently = false
+	}
+}
+
+// finishConfig - Everything done to a freshly decoded Config, whatever format.
+// Relative lookupFiles are read from dir, the Config file's own directory like
+// an include (empty, the working directory, for one not read from a file).
+func finishConfig(conf *Config, dir string) error {
+	version := conf.Version
+	if err := finishSettings(conf); err != nil {
+		return err
+	}
+	for i := range conf.RedirectRules {
+		if err := finishRule(*conf, version, dir, &conf.RedirectRules[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishSettings - finishConfig for everything but the Rules
+func finishSettings(conf *Config) error {
+	if err := migrateSettings(conf); err != nil {
+		return err
+	}
+	normalizeSettings(conf)
+	return validateSettings(*conf)
+}
+
+// finishRule - finishConfig for one Rule, conf giving the (finished) settings
+// and version the one the Config was written at (dir as for finishConfig), so
+// a streamed Config can finish each Rule as it is decoded
+func finishRule(conf Config, version int, dir string, rule *URLRule) error {
+	migrateRule(version, rule)
+	if err := loadLookupTable(dir, rule); err != nil {
+		return err
+	}
+	normalizeRule(conf, rule)
+	if err := resolveSigningKey(rule); err != nil {
+		return err
+	}
+	return validateRule(conf, *rule)
+}
+
+// resolveSigningKey - Read the Rule's signingKey given as `file:` or `env:`
+// (see resolveSecret), so the Config only ever holds a reference
+func resolveSigningKey(rule *URLRule) error {
+	if rule.SigningKey == "" {
+		return nil
+	}
+	key, err := resolveSecret(rule.SigningKey)
+	if err != nil {
+		return fmt.Errorf("rule %s: signingKey: %v", rule.Path, err)
+	}
+	rule.SigningKey = key
+	return nil
+}
+
+// normalizeTargets - Run every target in the Config through normalizeTarget,
+// and lowerTargetHost too with `lowercaseTargetHosts`
+func normalizeTargets(conf *Config) {
+	normalizeSettings(conf)
+	for i := range conf.RedirectRules {
+		normalizeRule(*conf, &conf.RedirectRules[i])
+	}
+}
+
+// normalizeSettings - normalizeTargets for everything but the Rules
+func normalizeSettings(conf *Config) {
+	conf.FinalRedirect = normalizeConfigTarget(*conf, conf.FinalRedirect, false)
+	conf.MaintenanceURL = normalizeConfigTarget(*conf, conf.MaintenanceURL, false)
+	if conf.IconURL != iconNone {
+		conf.IconURL = normalizeConfigTarget(*conf, conf.IconURL, false)
+	}
+	for host, target := range conf.HostDefaults {
+		conf.HostDefaults[host] = normalizeConfigTarget(*conf, target, false)
+	}
+	for i := range conf.DefaultTargets {
+		conf.DefaultTargets[i].URL = normalizeConfigTarget(*conf, conf.DefaultTargets[i].URL, false)
+	}
+}
+
+// normalizeRule - normalizeTargets for one Rule
+func normalizeRule(conf Config, rule *URLRule) {
+	canonical := rule.RedirectOptions.Canonicalize && !rule.Template
+	normalize := func(target string) string {
+		target = normalizeConfigTarget(conf, target, rule.Template)
+		if canonical {
+			target = canonicalTarget(target)
+		}
+		return target
+	}
+
+	for _, field := range rule.targetFields() {
+		*field = normalize(*field)
+	}
+	for code, target := range rule.Codes {
+		rule.Codes[code] = normalize(target)
+	}
+	for key, target := range rule.lookup {
+		rule.lookup[key] = normalize(target)
+	}
+}
+
+// normalizeConfigTarget - One target through normalizeTarget with the Config's
+// defaultScheme, and lowerTargetHost with `lowercaseTargetHosts`
+func normalizeConfigTarget(conf Config, target string, template bool) string {
+	scheme := conf.DefaultScheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	target = normalizeTarget(target, scheme)
+	// Templates aren't URLs until they're rendered
+	if conf.LowercaseTargetHosts && !template {
+		if lowered := lowerTargetHost(target); lowered != target {
+			slog.Warn("Lowercased the host of a target", "target", target, "now", lowered)
+			target = lowered
+		}
+	}
+	return target
+}
+
+// lowerTargetHost - The target with only its host lowercased, hosts are case
+// insensitive but the path, query and any user info may not be
+func lowerTargetHost(target string) string {
+	start := strings.Index(target, "//")
+	if start < 0 {
+		return target
+	}
+	start += 2
+	if i := strings.LastIndexByte(target[:start-2], '/'); i >= 0 {
+		// A `//` further along the path, not an authority
+		return target
+	}
+
+	end := len(target)
+	if i := strings.IndexAny(target[start:], "/?#"); i >= 0 {
+		end = start + i
+	}
+	if i := strings.LastIndexByte(target[start:end], '@'); i >= 0 {
+		start += i + 1
+	}
+	return target[:start] + strings.ToLower(target[start:end]) + target[end:]
+}
+
+// canonicalTarget - One spelling for equivalent absolute targets: lowercase
+// scheme and host, no default port and the query keys sorted (values keep
+// their order). Everything else is kept exactly as written, so the path
+// stays case sensitive and `{locale}` isn't escaped.
+func canonicalTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return target
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil &&
+		(scheme == "http" && port == "80" || scheme == "https" && port == "443") {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+
+	// Any user info and what follows the host, as written
+	authority := target[strings.Index(target, "://")+3:]
+	rest := ""
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		authority, rest = authority[:i], authority[i:]
+	}
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		host = authority[:i+1] + host
+	}
+
+	fragment := ""
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest, fragment = rest[:i], rest[i:]
+	}
+	if i := strings.IndexByte(rest, '?'); i >= 0 && i < len(rest)-1 {
+		pairs := strings.Split(rest[i+1:], "&")
+		sort.SliceStable(pairs, func(a, b int) bool {
+			return strings.SplitN(pairs[a], "=", 2)[0] < strings.SplitN(pairs[b], "=", 2)[0]
+		})
+		rest = rest[:i+1] + strings.Join(pairs, "&")
+	}
+
+	return scheme + "://" + host + rest + fragment
+}
+
+// normalizeTarget - Give targets that are clearly a bare host (`example.com/x`,
+// `localhost:8080`) the default scheme. Relative targets (`/x`, `./x`, `?q`)
+// are left to be resolved against the request, and anything that looks like
+// a typo is logged rather than guessed at.
+func normalizeTarget(target string, scheme string) string {
+	if target == "" || strings.HasPrefix(target, "/") || strings.HasPrefix(target, ".") ||
+		strings.HasPrefix(target, "?") || strings.HasPrefix(target, "#") {
+		return target
+	}
+
+	lower := strings.ToLower(target)
+	if strings.HasPrefix(lower, "http//") || strings.HasPrefix(lower, "https//") ||
+		strings.HasPrefix(lower, "http:/") && !strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "https:/") && !strings.HasPrefix(lower, "https://") {
+		slog.Warn("Target looks like a mistyped scheme, check the config", "target", target)
+		return target
+	}
+
+	if strings.Contains(target, "://") {
+		// {subdomain} is filled in per request, a host can't hold the braces
+		if u, err := url.Parse(strings.ReplaceAll(target, subdomainVar, subdomainKey)); err != nil || u.Host == "" {
+			slog.Warn("Target has no host, check the config", "target", target)
+		}
+		return target
+	}
+
+	// First segment decides: host, host:port, a scheme like mailto: or a path
+	first := target
+	if i := strings.IndexAny(first, "/?#"); i >= 0 {
+		first = first[:i]
+	}
+
+	if i := strings.Index(first, ":"); i >= 0 {
+		if _, err := strconv.Atoi(first[i+1:]); err != nil {
+			// mailto:, tel: and friends
+			return target
+		}
+		return scheme + "://" + target
+	}
+
+	if strings.Contains(first, ".") || strings.EqualFold(first, "localhost") {
+		return scheme + "://" + target
+	}
+
+	slog.Warn("Target has no scheme or host, treating it as relative to the request", "target", target)
+	return target
+}
+
+// mergeConfigs - Layer Configs left to right, names saying where each came
+// from. Top level settings a later Config sets replace earlier ones (maps
+// merge key by key) and its Rules replace any earlier Rule with the same
+// host, path and methods, unless `-on-rule-conflict error` makes that an
+// error. Everything else carries through untouched.
+func mergeConfigs(names []string, configs ...Config) (Config, error) {
+	merged := Config{}
+	into := reflect.ValueOf(&merged).Elem()
+	origin := map[string]string{}
+
+	for c, conf := range configs {
+		from := reflect.ValueOf(conf)
+		for i := 0; i < from.NumField(); i++ {
+			if f := into.Type().Field(i); f.Name == "RedirectRules" || !f.IsExported() {
+				continue
+			}
+
+			field := from.Field(i)
+			if field.IsZero() {
+				continue
+			}
+
+			if field.Kind() == reflect.Map {
+				target := into.Field(i)
+				if target.IsNil() {
+					target.Set(reflect.MakeMap(field.Type()))
+				}
+				for _, key := range field.MapKeys() {
+					target.SetMapIndex(key, field.MapIndex(key))
+				}
+				continue
+			}
+
+			into.Field(i).Set(field)
+		}
+
+		for _, rule := range conf.RedirectRules {
+			key := ruleKey(rule)
+			replaced := false
+			for i, existing := range merged.RedirectRules {
+				if ruleKey(existing) != key {
+					continue
+				}
+				if onRuleConflict == ruleConflictError {
+					return merged, fmt.Errorf("rule %s is in both %s and %s", rule.ID(), origin[key], names[c])
+				}
+				slog.Warn("Rule replaced by a later config", "rule", rule.ID(), "was", origin[key], "now", names[c])
+				merged.RedirectRules[i] = rule
+				replaced = true
+				break
+			}
+			if !replaced {
+				merged.RedirectRules = append(merged.RedirectRules, rule)
+			}
+			origin[key] = names[c]
+		}
+	}
+
+	return merged, nil
+}
+
+// ruleKey - Rules with the same key conflict when Configs merge, the same
+// host and path only for the same methods
+func ruleKey(rule URLRule) string {
+	methods := make([]string, len(rule.Methods))
+	for i, method := range rule.Methods {
+		methods[i] = strings.ToUpper(method)
+	}
+	sort.Strings(methods)
+	return rule.ID() + " " + strings.Join(methods, ",")
+}
+
+// configLocation - The Config Timezone, local time when it isn't set
+func configLocation(conf Config) *time.Location {
+	if conf.Timezone == "" {
+		return time.Local
+	}
+	// Already checked by validateConfig
+	location, _ := time.LoadLocation(conf.Timezone)
+	return location
+}
+
+// validateConfig - Catch settings that would load fine but break at request time
+func validateConfig(conf Config) error {
+	if err := validateSettings(conf); err != nil {
+		return err
+	}
+	for _, rule := range conf.RedirectRules {
+		if err := validateRule(conf, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSettings - validateConfig for everything but the Rules
+func validateSettings(conf Config) error {
+	if targetBlocked(conf.FinalRedirect, conf.BlockedTargetHosts) {
+		return fmt.Errorf("defaultRedirect %s is on a blocked host", conf.FinalRedirect)
+	}
+	if !targetAllowed(conf.FinalRedirect, conf.AllowedTargetHosts) {
+		return fmt.Errorf("defaultRedirect %s is not on an allowed host", conf.FinalRedirect)
+	}
+	if conf.IconURL != iconNone && targetBlocked(conf.IconURL, conf.BlockedTargetHosts) {
+		return fmt.Errorf("iconURL %s is on a blocked host", conf.IconURL)
+	}
+	for host, target := range conf.HostDefaults {
+		if targetBlocked(target, conf.BlockedTargetHosts) {
+			return fmt.Errorf("hostDefaults %s: target %s is on a blocked host", host, target)
+		}
+		if !targetAllowed(target, conf.AllowedTargetHosts) {
+			return fmt.Errorf("hostDefaults %s: target %s is not on an allowed host", host, target)
+		}
+	}
+
+	for _, t := range conf.DefaultTargets {
+		if t.URL == "" || t.Weight <= 0 {
+			return fmt.Errorf("defaultTargets need a url and a weight above 0")
+		}
+		if targetBlocked(t.URL, conf.BlockedTargetHosts) {
+			return fmt.Errorf("defaultTargets %s is on a blocked host", t.URL)
+		}
+		if !targetAllowed(t.URL, conf.AllowedTargetHosts) {
+			return fmt.Errorf("defaultTargets %s is not on an allowed host", t.URL)
+		}
+	}
+
+	if conf.DefaultHost != "" && strings.ContainsAny(conf.DefaultHost, "/?#@ ") {
+		return fmt.Errorf("defaultHost must be a bare host like example.com, got %q", conf.DefaultHost)
+	}
+
+	switch conf.QueryMerge {
+	case "", queryMergeAll, queryMergeFirst, queryMergeLast:
+	default:
+		return fmt.Errorf("queryMerge must be all, first or last, got %q", conf.QueryMerge)
+	}
+
+	if _, err := time.LoadLocation(conf.Timezone); err != nil {
+		return fmt.Errorf("timezone %s: %v", conf.Timezone, err)
+	}
+	return nil
+}
+
+// validateRule - validateConfig for one Rule, against the Config's settings
+func validateRule(conf Config, rule URLRule) error {
+	if rule.RedirectOptions.Permanently {
+		return fmt.Errorf("rule %s: options.permanently was replaced by options.statusCode in config version 1", rule.Path)
+	}
+
+	if rule.Port < 0 || rule.Port > 65535 {
+		return fmt.Errorf("rule %s: port %d is out of range", rule.Path, rule.Port)
+	}
+
+	if rule.Gone && rule.Type == ruleTypeProxy {
+		return fmt.Errorf("rule %s: a proxy rule can't also be gone", rule.Path)
+	}
+
+	switch rule.Type {
+	case "", ruleTypeRedirect:
+	case ruleTypeProxy:
+		if u, err := url.Parse(rule.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("rule %s: a proxy rule needs an absolute url", rule.Path)
+		}
+	case ruleTypeShortener:
+		if !strings.Contains(rule.Path, "{"+shortCodeVar) || len(rule.Codes) == 0 {
+			return fmt.Errorf("rule %s: a shortener rule needs {%s} in its path and some codes", rule.Path, shortCodeVar)
+		}
+	case ruleTypeLookup:
+		if rule.LookupFile == "" || len(pathVarNames(rule.Path)) != 1 {
+			return fmt.Errorf("rule %s: a lookup rule needs a lookupFile and one variable in its path to look up", rule.Path)
+		}
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", rule.Path, rule.Type)
+	}
+
+	for _, method := range rule.Methods {
+		if !methodListed(method, httpMethods) {
+			return fmt.Errorf("rule %s: methods: %q isn't an HTTP method", rule.Path, method)
+		}
+	}
+
+	if rule.ProxyMethod != "" {
+		if rule.Type != ruleTypeProxy {
+			return fmt.Errorf("rule %s: proxyMethod only applies to proxy rules", rule.Path)
+		}
+		if !methodListed(rule.ProxyMethod, httpMethods) {
+			return fmt.Errorf("rule %s: proxyMethod %q isn't an HTTP method", rule.Path, rule.ProxyMethod)
+		}
+	}
+
+	if rule.ProxyHost != "" && rule.Type != ruleTypeProxy {
+		return fmt.Errorf("rule %s: proxyHost only applies to proxy rules", rule.Path)
+	}
+
+	if rule.ProxyTimeout != "" {
+		if _, err := time.ParseDuration(rule.ProxyTimeout); err != nil {
+			return fmt.Errorf("rule %s: proxyTimeout: %v", rule.Path, err)
+		}
+	}
+
+	if _, err := parseCIDRs(strings.Join(rule.AllowCIDRs, ",")); err != nil {
+		return fmt.Errorf("rule %s: allowCIDRs: %v", rule.Path, err)
+	}
+	if _, err := parseCIDRs(strings.Join(rule.BlockCIDRs, ",")); err != nil {
+		return fmt.Errorf("rule %s: blockCIDRs: %v", rule.Path, err)
+	}
+
+	if _, err := parseLogLevel(rule.LogLevel); err != nil {
+		return fmt.Errorf("rule %s: logLevel must be debug, info, warn or error", rule.Path)
+	}
+
+	if rule.CacheTTL != "" {
+		if ttl, err := time.ParseDuration(rule.CacheTTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("rule %s: cacheTTL must be a positive duration, e.g. 30s", rule.Path)
+		}
+		if !rule.cacheable() {
+			slog.Warn("cacheTTL is ignored, the target changes per request", "rule", rule.Path)
+		}
+	}
+
+	if rule.Template {
+		for _, target := range rule.targets() {
+			if _, err := parseTargetTemplate(target); err != nil {
+				return fmt.Errorf("rule %s: template: %v", rule.Path, err)
+			}
+		}
+	}
+
+	for _, l := range rule.Locales {
+		if _, err := language.Parse(l); err != nil {
+			return fmt.Errorf("rule %s: locales: %q isn't a language tag", rule.Path, l)
+		}
+	}
+	if strings.Contains(strings.TrimPrefix(rule.Host, "*."), "*") {
+		return fmt.Errorf("rule %s: host %s can only be a wildcard as a leading *., e.g. *.example.com", rule.Path, rule.Host)
+	}
+	if !isWildcardHost(rule.Host) {
+		for _, target := range rule.targets() {
+			if strings.Contains(target, subdomainVar) {
+				return fmt.Errorf("rule %s: target %s has %s but the rule's host isn't a *. wildcard", rule.Path, target, subdomainVar)
+			}
+		}
+	}
+
+	if len(rule.Locales) == 0 {
+		for _, target := range rule.targets() {
+			if strings.Contains(target, localeVar) {
+				return fmt.Errorf("rule %s: target %s has %s but the rule has no locales", rule.Path, target, localeVar)
+			}
+		}
+	}
+
+	if param := rule.RedirectOptions.CorrelationParam; param != "" && url.QueryEscape(param) != param {
+		return fmt.Errorf("rule %s: correlationParam %q needs to be a plain query parameter name", rule.Path, param)
+	}
+
+	switch rule.RedirectOptions.TrailingSlash {
+	case "", trailingSlashAdd, trailingSlashRemove:
+	default:
+		return fmt.Errorf("rule %s: trailingSlash must be %s or %s, got %q", rule.Path, trailingSlashAdd, trailingSlashRemove, rule.RedirectOptions.TrailingSlash)
+	}
+
+	if rule.Delay != "" {
+		if delay, err := time.ParseDuration(rule.Delay); err != nil || delay < 0 {
+			return fmt.Errorf("rule %s: delay must be a duration, e.g. 2s", rule.Path)
+		}
+	}
+
+	for _, c := range rule.CookieRules {
+		if c.Name == "" || c.URL == "" {
+			return fmt.Errorf("rule %s: cookieRules need both a name and a url", rule.Path)
+		}
+	}
+
+	for _, l := range rule.LangRules {
+		if _, err := language.Parse(l.Lang); err != nil || l.URL == "" {
+			return fmt.Errorf("rule %s: langRules need a valid lang and a url", rule.Path)
+		}
+	}
+
+	for _, t := range rule.TimeTargets {
+		_, startErr := time.Parse(clockLayout, t.Start)
+		_, endErr := time.Parse(clockLayout, t.End)
+		if startErr != nil || endErr != nil || t.URL == "" {
+			return fmt.Errorf("rule %s: timeTargets need a start and end (HH:MM) and a url", rule.Path)
+		}
+	}
+
+	if holidays := rule.Holidays; holidays != nil {
+		if holidays.URL == "" || len(holidays.Dates) == 0 {
+			return fmt.Errorf("rule %s: holidays need some dates and a url", rule.Path)
+		}
+		for _, date := range holidays.Dates {
+			if _, err := time.Parse(dateLayout, date); err != nil {
+				return fmt.Errorf("rule %s: holiday %q isn't a date (YYYY-MM-DD)", rule.Path, date)
+			}
+		}
+	}
+
+	for _, t := range rule.Variants {
+		if t.URL == "" || t.Weight <= 0 {
+			return fmt.Errorf("rule %s: variants need a url and a weight above 0", rule.Path)
+		}
+	}
+	switch rule.Sticky {
+	case "":
+	case stickyIP, stickyCookie:
+		if len(rule.Variants) == 0 {
+			return fmt.Errorf("rule %s: sticky needs some variants to stick to", rule.Path)
+		}
+	default:
+		return fmt.Errorf("rule %s: sticky must be %s or %s, got %q", rule.Path, stickyIP, stickyCookie, rule.Sticky)
+	}
+
+	if ramp := rule.Ramp; ramp != nil {
+		_, startErr := time.Parse(time.RFC3339, ramp.Start)
+		duration, durationErr := time.ParseDuration(ramp.Duration)
+		if ramp.URL == "" || rule.URL == "" || startErr != nil || durationErr != nil || duration <= 0 {
+			return fmt.Errorf("rule %s: ramp needs a url (and the rule one), a start (RFC 3339) and a positive duration", rule.Path)
+		}
+	}
+
+	for _, ref := range rule.RefererRules {
+		if _, err := regexp.Compile(ref.Match); err != nil || ref.URL == "" {
+			return fmt.Errorf("rule %s: refererRules need a valid match regex and a url", rule.Path)
+		}
+	}
+
+	for _, target := range rule.Targets {
+		if target == "" {
+			return fmt.Errorf("rule %s: targets can't be empty", rule.Path)
+		}
+	}
+
+	for _, h := range rule.HeaderRules {
+		if _, err := regexp.Compile(h.Match); err != nil || h.Header == "" || h.URL == "" {
+			return fmt.Errorf("rule %s: headerRules need a header, a valid match regex and a url", rule.Path)
+		}
+	}
+
+	for _, q := range rule.QueryRules {
+		if q.Param == "" || q.URL == "" {
+			return fmt.Errorf("rule %s: queryRules need both a param and a url", rule.Path)
+		}
+	}
+
+	for _, target := range rule.targets() {
+		if targetBlocked(target, conf.BlockedTargetHosts) {
+			return fmt.Errorf("rule %s: target %s is on a blocked host", rule.Path, target)
+		}
+		// A proxy's url is its upstream, the client is never sent there
+		if rule.Type != ruleTypeProxy && !targetAllowed(target, conf.AllowedTargetHosts) {
+			return fmt.Errorf("rule %s: target %s is not on an allowed host", rule.Path, target)
+		}
+	}
+
+	if rule.RateLimit != nil && rule.RateLimit.RPS <= 0 {
+		return fmt.Errorf("rule %s: rateLimit.rps must be above 0", rule.Path)
+	}
+
+	if code := rule.RedirectOptions.StatusCode; code != 0 && (code < 300 || code > 399) {
+		return fmt.Errorf("rule %s: statusCode %d is not a redirect (3xx)", rule.Path, code)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Formats accepted by `-dump-routes`
+const (
+	dumpRoutesDOT = "dot"
+)
+
+// dotQuote - A DOT string, quoted and escaped
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// writeRoutesDOT - The active Rules as a Graphviz digraph for `-dump-routes
+// dot`, one cluster per host with an edge from each Rule to where it goes.
+// Render it with e.g. `dot -Tsvg`.
+func writeRoutesDOT(out io.Writer, conf Config) {
+	byHost := map[string][]URLRule{}
+	for _, rule := range activeRules(conf) {
+		byHost[rule.Host] = append(byHost[rule.Host], rule)
+	}
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	fmt.Fprintln(out, "digraph golow {")
+	fmt.Fprintln(out, "\trankdir=LR;")
+	fmt.Fprintln(out, "\tnode [shape=box];")
+
+	edges := []string{}
+	for i, host := range hosts {
+		label := host
+		if label == "" {
+			label = "any host"
+		}
+		fmt.Fprintf(out, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(out, "\t\tlabel=%s;\n", dotQuote(label))
+		for _, rule := range byHost[host] {
+			node := dotQuote("rule " + rule.ID())
+			fmt.Fprintf(out, "\t\t%s [label=%s];\n", node, dotQuote(rule.Path))
+
+			switch {
+			case rule.Gone:
+				edges = append(edges, fmt.Sprintf("\t%s -> %s;", node, dotQuote("410 Gone")))
+			case rule.Type == ruleTypeLookup:
+				// The table can be huge, it gets one node
+				edges = append(edges, fmt.Sprintf("\t%s -> %s;", node, dotQuote("lookup "+rule.LookupFile)))
+			default:
+				seen := map[string]bool{}
+				for _, target := range rule.targets() {
+					if target == "" || seen[target] {
+						continue
+					}
+					seen[target] = true
+					edge := fmt.Sprintf("\t%s -> %s", node, dotQuote(target))
+					if rule.Type == ruleTypeProxy {
+						edge += " [label=proxy]"
+					}
+					edges = append(edges, edge+";")
+				}
+			}
+		}
+		fmt.Fprintln(out, "\t}")
+	}
+
+	if conf.FinalRedirect != "" {
+		edges = append(edges, fmt.Sprintf("\t%s -> %s;", dotQuote("default"), dotQuote(conf.FinalRedirect)))
+	}
+	for _, t := range conf.DefaultTargets {
+		edges = append(edges, fmt.Sprintf("\t%s -> %s [label=%s];", dotQuote("default"), dotQuote(t.URL), dotQuote(fmt.Sprintf("weight %d", t.Weight))))
+	}
+
+	for _, edge := range edges {
+		fmt.Fprintln(out, edge)
+	}
+	fmt.Fprintln(out, "}")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutesDOT(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/rr", "targets": ["https://a.example.com", "https://b.example.com", "https://a.example.com"]},
+		{"host": "docs.example.com", "rule": "/app", "type": "proxy", "url": "https://app.internal"},
+		{"host": "docs.example.com", "rule": "/old", "gone": true},
+		{"rule": "/say \"hi\"", "url": "https://example.com/hi"},
+		{"rule": "/off", "url": "https://example.com/off", "enabled": false}
+	]}`)
+
+	// Grouped by host, a repeated target drawn once and the disabled Rule left out
+	want := `digraph golow {
+	rankdir=LR;
+	node [shape=box];
+	subgraph cluster_0 {
+		label="any host";
+		"rule /go" [label="/go"];
+		"rule /rr" [label="/rr"];
+		"rule /say \"hi\"" [label="/say \"hi\""];
+	}
+	subgraph cluster_1 {
+		label="docs.example.com";
+		"rule docs.example.com/app" [label="/app"];
+		"rule docs.example.com/old" [label="/old"];
+	}
+	"rule /go" -> "https://golang.org";
+	"rule /rr" -> "https://a.example.com";
+	"rule /rr" -> "https://b.example.com";
+	"rule /say \"hi\"" -> "https://example.com/hi";
+	"rule docs.example.com/app" -> "https://app.internal" [label=proxy];
+	"rule docs.example.com/old" -> "410 Gone";
+	"default" -> "https://example.com";
+}
+`
+	var out strings.Builder
+	writeRoutesDOT(&out, conf)
+	if out.String() != want {
+		t.Errorf("writeRoutesDOT =\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -13,123 +13,888 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
-	"io/ioutil"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"reflect"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Config - The Config file that Gets Loaded on Start
 type Config struct {
-	FinalRedirect string    `json:"defaultRedirect"`
-	RedirectRules []URLRule `json:"redirects"`
+	Version int `json:"version" yaml:"version" toml:"version"`
+
+	// Other Config files (paths or globs, relative to this one) merged in
+	// ahead of this file, see mergeConfigs
+	Include []string `json:"include" yaml:"include" toml:"include"`
+
+	FinalRedirect string            `json:"defaultRedirect" yaml:"defaultRedirect" toml:"defaultRedirect"`
+	HostDefaults  map[string]string `json:"hostDefaults" yaml:"hostDefaults" toml:"hostDefaults"`
+	RedirectRules []URLRule         `json:"redirects" yaml:"redirects" toml:"redirects"`
+
+	// Unmatched requests split across these by weight instead of going to
+	// the defaultRedirect, hostDefaults still win for their hosts
+	DefaultTargets []WeightedTarget `json:"defaultTargets" yaml:"defaultTargets" toml:"defaultTargets"`
+
+	// Host a request without one (HTTP/1.0) is matched as, otherwise it only
+	// gets Rules for any host and then the defaultRedirect
+	DefaultHost string `json:"defaultHost" yaml:"defaultHost" toml:"defaultHost"`
+
+	// Methods the default Redirect applies to, others get a 405. Empty for all.
+	DefaultMethods []string `json:"defaultMethods" yaml:"defaultMethods" toml:"defaultMethods"`
+
+	// Scheme given to targets written without one, `https` by default
+	DefaultScheme string `json:"defaultScheme" yaml:"defaultScheme" toml:"defaultScheme"`
+
+	// Lowercase the host of every target at load, leaving the rest as written
+	LowercaseTargetHosts bool `json:"lowercaseTargetHosts" yaml:"lowercaseTargetHosts" toml:"lowercaseTargetHosts"`
+
+	// Never Redirect to these hosts (or their subdomains)
+	BlockedTargetHosts []string `json:"blockedTargetHosts" yaml:"blockedTargetHosts" toml:"blockedTargetHosts"`
+
+	// When set, the only hosts a Redirect can go to
+	AllowedTargetHosts []string `json:"allowedTargetHosts" yaml:"allowedTargetHosts" toml:"allowedTargetHosts"`
+
+	// Optional body sent with every Redirect, a template given `.Target`
+	ResponseBody     string `json:"responseBody" yaml:"responseBody" toml:"responseBody"`
+	ResponseBodyType string `json:"responseBodyType" yaml:"responseBodyType" toml:"responseBodyType"`
+
+	// How a key in both the target's and request's query is kept: all, first or last
+	QueryMerge string `json:"queryMerge" yaml:"queryMerge" toml:"queryMerge"`
+
+	// Headers set on every public response, on top of (or with "" to remove)
+	// the defaults in defaultSecurityHeaders
+	SecurityHeaders map[string]string `json:"securityHeaders" yaml:"securityHeaders" toml:"securityHeaders"`
+
+	// Where /favicon.ico and the apple-touch-icons Redirect to, `none` for a
+	// 204. Empty leaves them to the Rules and default like any other path.
+	IconURL string `json:"iconURL" yaml:"iconURL" toml:"iconURL"`
+
+	// Where every request goes while maintenance is on (see POST
+	// /maintenance on the admin listener), a plain 503 when empty
+	MaintenanceURL string `json:"maintenanceURL" yaml:"maintenanceURL" toml:"maintenanceURL"`
+
+	// IANA zone (e.g. `Europe/London`) timeTargets are read in, local time when empty
+	Timezone string `json:"timezone" yaml:"timezone" toml:"timezone"`
+
+	// Built by streamConfig as it decoded the Rules, so applyConfig doesn't
+	// build another. Never carried over by mergeConfigs.
+	router *mux.Router
 }
 
 // URLRule - Controls Redirects in the Config File
 type URLRule struct {
-	Type            string   `json:"type"`
-	Path            string   `json:"rule"`
-	URL             string   `json:"url"`
-	RedirectOptions struct{} `json:"options"`
+	Type            string            `json:"type" yaml:"type" toml:"type"`
+	Enabled         *bool             `json:"enabled,omitempty" yaml:"enabled,omitempty" toml:"enabled,omitempty"`
+	Host            string            `json:"host" yaml:"host" toml:"host"`
+	Port            int               `json:"port" yaml:"port" toml:"port"`
+	Path            string            `json:"rule" yaml:"rule" toml:"rule"`
+	URL             string            `json:"url" yaml:"url" toml:"url"`
+	Targets         []string          `json:"targets" yaml:"targets" toml:"targets"`
+	Codes           map[string]string `json:"codes" yaml:"codes" toml:"codes"`
+	LookupFile      string            `json:"lookupFile" yaml:"lookupFile" toml:"lookupFile"`
+	Template        bool              `json:"template" yaml:"template" toml:"template"`
+	Gone            bool              `json:"gone" yaml:"gone" toml:"gone"`
+	GoneMessage     string            `json:"goneMessage" yaml:"goneMessage" toml:"goneMessage"`
+	Reason          string            `json:"reason" yaml:"reason" toml:"reason"`
+	Tags            []string          `json:"tags" yaml:"tags" toml:"tags"`
+	Methods         []string          `json:"methods" yaml:"methods" toml:"methods"`
+	Description     string            `json:"description" yaml:"description" toml:"description"`
+	RateLimit       *RateLimit        `json:"rateLimit" yaml:"rateLimit" toml:"rateLimit"`
+	ProxyTimeout    string            `json:"proxyTimeout" yaml:"proxyTimeout" toml:"proxyTimeout"`
+	ProxyMethod     string            `json:"proxyMethod" yaml:"proxyMethod" toml:"proxyMethod"`
+	ProxyHost       string            `json:"proxyHost" yaml:"proxyHost" toml:"proxyHost"`
+	AllowCIDRs      []string          `json:"allowCIDRs" yaml:"allowCIDRs" toml:"allowCIDRs"`
+	BlockCIDRs      []string          `json:"blockCIDRs" yaml:"blockCIDRs" toml:"blockCIDRs"`
+	CookieRules     []CookieRule      `json:"cookieRules" yaml:"cookieRules" toml:"cookieRules"`
+	LangRules       []LangRule        `json:"langRules" yaml:"langRules" toml:"langRules"`
+	Locales         []string          `json:"locales" yaml:"locales" toml:"locales"`
+	RefererRules    []RefererRule     `json:"refererRules" yaml:"refererRules" toml:"refererRules"`
+	HeaderRules     []HeaderRule      `json:"headerRules" yaml:"headerRules" toml:"headerRules"`
+	QueryRules      []QueryRule       `json:"queryRules" yaml:"queryRules" toml:"queryRules"`
+	HTTP2URL        string            `json:"http2URL" yaml:"http2URL" toml:"http2URL"`
+	TimeTargets     []TimeTarget      `json:"timeTargets" yaml:"timeTargets" toml:"timeTargets"`
+	Holidays        *Holidays         `json:"holidays" yaml:"holidays" toml:"holidays"`
+	Ramp            *Ramp             `json:"ramp" yaml:"ramp" toml:"ramp"`
+	Variants        []WeightedTarget  `json:"variants" yaml:"variants" toml:"variants"`
+	Sticky          string            `json:"sticky" yaml:"sticky" toml:"sticky"`
+	CacheTTL        string            `json:"cacheTTL" yaml:"cacheTTL" toml:"cacheTTL"`
+	Delay           string            `json:"delay" yaml:"delay" toml:"delay"`
+	SigningKey      string            `json:"signingKey" yaml:"signingKey" toml:"signingKey"`
+	LogLevel        string            `json:"logLevel" yaml:"logLevel" toml:"logLevel"`
+	RedirectOptions RedirectOptions   `json:"options" yaml:"options" toml:"options"`
+
+	// lookup - The lookupFile table, read when the Config is loaded
+	lookup map[string]string
+}
+
+// RateLimit - Requests per second (and burst) allowed for a single Rule
+type RateLimit struct {
+	RPS   float64 `json:"rps" yaml:"rps" toml:"rps"`
+	Burst int     `json:"burst" yaml:"burst" toml:"burst"`
+}
+
+// CookieRule - Send the request to URL when it has the named Cookie, with a
+// matching Value when one is given
+type CookieRule struct {
+	Name  string `json:"name" yaml:"name" toml:"name"`
+	Value string `json:"value" yaml:"value" toml:"value"`
+	URL   string `json:"url" yaml:"url" toml:"url"`
+}
+
+// LangRule - Send the request to URL when Accept-Language best matches Lang
+type LangRule struct {
+	Lang string `json:"lang" yaml:"lang" toml:"lang"`
+	URL  string `json:"url" yaml:"url" toml:"url"`
+}
+
+// HeaderRule - Send requests whose Header value matches the regex somewhere else
+type HeaderRule struct {
+	Header string `json:"header" yaml:"header" toml:"header"`
+	Match  string `json:"match" yaml:"match" toml:"match"`
+	URL    string `json:"url" yaml:"url" toml:"url"`
+}
+
+// QueryRule - Send requests with the query parameter (set to Value, or to
+// anything when Value is empty) somewhere else
+type QueryRule struct {
+	Param string `json:"param" yaml:"param" toml:"param"`
+	Value string `json:"value" yaml:"value" toml:"value"`
+	URL   string `json:"url" yaml:"url" toml:"url"`
+}
+
+// TimeTarget - Send requests between Start and End (`15:04`, in the Config
+// Timezone) somewhere else. An End before the Start runs past midnight.
+type TimeTarget struct {
+	Start string `json:"start" yaml:"start" toml:"start"`
+	End   string `json:"end" yaml:"end" toml:"end"`
+	URL   string `json:"url" yaml:"url" toml:"url"`
+}
+
+// Holidays - Send requests somewhere else (a "closed" page) all day on these
+// Dates (`2006-01-02`, in the Config Timezone), whatever the TimeTargets say
+type Holidays struct {
+	Dates []string `json:"dates" yaml:"dates" toml:"dates"`
+	URL   string   `json:"url" yaml:"url" toml:"url"`
+}
+
+// Ramp - Move a Rule's traffic from its url to URL bit by bit, none at Start
+// (RFC 3339) rising evenly to all of it once Duration has passed
+type Ramp struct {
+	URL      string `json:"url" yaml:"url" toml:"url"`
+	Start    string `json:"start" yaml:"start" toml:"start"`
+	Duration string `json:"duration" yaml:"duration" toml:"duration"`
+}
+
+// RefererRule - Send requests whose Referer matches the regex somewhere else
+type RefererRule struct {
+	Match string `json:"match" yaml:"match" toml:"match"`
+	URL   string `json:"url" yaml:"url" toml:"url"`
+}
+
+// WeightedTarget - A target picked Weight times out of the total of its list
+type WeightedTarget struct {
+	URL    string `json:"url" yaml:"url" toml:"url"`
+	Weight int    `json:"weight" yaml:"weight" toml:"weight"`
+}
+
+// RedirectOptions - Extra settings for how a Rule Redirects
+type RedirectOptions struct {
+	StatusCode int `json:"statusCode" yaml:"statusCode" toml:"statusCode"`
+
+	// Carry the request's query over onto the target, see `queryMerge`
+	PreserveQuery bool `json:"preserveQuery" yaml:"preserveQuery" toml:"preserveQuery"`
+
+	// For a `/word*` Rule, add whatever followed the prefix onto the target's
+	// path, capped by `-max-append-segments` and `-max-append-length`
+	AppendPath bool `json:"appendPath" yaml:"appendPath" toml:"appendPath"`
+
+	// Rewrite the targets at load to one spelling (see canonicalTarget) so
+	// logs and hit counts don't split over `Example.com:443` and `example.com`
+	Canonicalize bool `json:"canonicalize" yaml:"canonicalize" toml:"canonicalize"`
+
+	// Force the target's path to end in a slash (add) or not (remove),
+	// whatever the request looked like
+	TrailingSlash string `json:"trailingSlash" yaml:"trailingSlash" toml:"trailingSlash"`
+
+	// Add a fresh token under this query parameter on every Redirect and log
+	// it, so landing page traffic can be tied back to the Redirect
+	CorrelationParam string `json:"correlationParam" yaml:"correlationParam" toml:"correlationParam"`
+
+	// Answer clients that Accept application/json with a 200 describing the
+	// Redirect instead of the Redirect itself, for SPAs that navigate themselves
+	JSONDescriptor bool `json:"jsonDescriptor" yaml:"jsonDescriptor" toml:"jsonDescriptor"`
+
+	// Version 0 only, migrated to StatusCode
+	Permanently bool `json:"permanently,omitempty" yaml:"permanently,omitempty" toml:"permanently,omitempty"`
+}
+
+// enabled - Rules are on unless `enabled: false` turns them off
+func (rule URLRule) enabled() bool {
+	return rule.Enabled == nil || *rule.Enabled
+}
+
+// ID - Identifies the Rule in hit counts and the admin pages
+func (rule URLRule) ID() string {
+	if rule.Port != 0 {
+		return rule.Host + ":" + strconv.Itoa(rule.Port) + rule.Path
+	}
+	return rule.Host + rule.Path
+}
+
+// Modes accepted by `-long-target`
+const (
+	longTargetError   = "error"
+	longTargetDefault = "default"
+)
+
+// Modes accepted by `-long-query`
+const (
+	longQueryError    = "error"
+	longQueryTruncate = "truncate"
+	longQueryDrop     = "drop-query"
+)
+
+// Modes accepted by `-method-mismatch`
+const (
+	methodMismatchDefault = "default"
+	methodMismatch405     = "405"
+)
+
+// Modes accepted by `-on-rule-conflict`
+const (
+	ruleConflictLastWins = "last-wins"
+	ruleConflictError    = "error"
+)
+
+// Modes accepted by `-on-config-error`
+const (
+	onConfigErrorExit    = "exit"
+	onConfigErrorDefault = "serve-default"
+)
+
+// Modes accepted by `-on-empty-default`
+const (
+	emptyDefaultNotFound = "404"
+	emptyDefaultError    = "error"
+)
+
+// Runtime Options, set from the command line flags in main
+var (
+	wait                 time.Duration
+	configPath           string
+	configRetry          time.Duration
+	analyticsFile        string
+	analyticsMaxSize     int64
+	analyticsFlush       time.Duration
+	pathDecodeMode       string
+	maxTargetLength      int
+	longTargetMode       string
+	clientRPS            float64
+	clientBurst          int
+	allowIPList          string
+	blockIPList          string
+	enableTracing        bool
+	maxConns             int
+	enableTags           string
+	disableTags          string
+	adminAddr            string
+	adminUser            string
+	adminPass            string
+	onConfigError        string
+	enablePprof          bool
+	useEmbedded          bool
+	cleanPaths           bool
+	keepTrailingSlash    bool
+	disableKeepAlive     bool
+	reusePort            bool
+	listenAddr           string
+	tlsCert              string
+	tlsKey               string
+	tlsReload            time.Duration
+	logSample            uint64
+	logSampleRandom      bool
+	healthDrainingStatus int
+	healthUnhealthyAfter time.Duration
+	proxyTimeout         time.Duration
+	trustedProxyList     string
+	maxRules             int
+	strictRules          bool
+	trustForwardedHost   bool
+	inheritScheme        bool
+	basePath             string
+	hitsFile             string
+	hitsFlush            time.Duration
+	statusPublic         bool
+	onEmptyDefault       string
+	logLevel             string
+	auditFile            string
+	auditKey             string
+	auditVerify          bool
+	adminReadTimeout     time.Duration
+	adminWriteTimeout    time.Duration
+	adminIdleTimeout     time.Duration
+	enableH2C            bool
+	enableSitemap        bool
+	sitemapBase          string
+	gracefulRestart      bool
+	warmupCheck          bool
+	longQueryMode        string
+	adminLinger          time.Duration
+	initPath             string
+	initForce            bool
+	methodMismatch       string
+	simulateMethod       string
+	requestTimeout       time.Duration
+	maintenanceFile      string
+	maxDelay             time.Duration
+	statsdAddr           string
+	statsdPrefix         string
+	onRuleConflict       string
+	checkTargetsOnly     bool
+	checkTimeout         time.Duration
+	checkConcurrency     int
+	maxAppendSegments    int
+	maxAppendLength      int
+	localOnly            bool
+	signPath             string
+	signKey              string
+	signTTL              time.Duration
+	malformedPaths       string
+	followerMode         bool
+	earlyHints           bool
+	logDedupe            time.Duration
+	compressHTMLSize     int
+	bindRetry            time.Duration
+	dumpRoutes           string
+	gcPercent            int
+	memoryLimit          string
+	maxMetricRules       int
+)
+
+// analytics - Redirect event export, nil when `-analytics-file` isn't set
+var analytics *analyticsWriter
+
+// newPublicServer - The public listener's server. `-disable-keepalive` closes
+// every connection after its response, draining does the same later on.
+func newPublicServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:      handler,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		// `OPTIONS *` is answered by asteriskForm, with an Allow header
+		DisableGeneralOptionsHandler: true,
+	}
+	if disableKeepAlive {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return srv
+}
+
+// configureH2C - Serve HTTP/2 over cleartext as well as HTTP/1.1.
+// ConfigureServer hooks the HTTP/2 connections into srv.Shutdown, so they
+// still get a GOAWAY and a chance to finish when we drain.
+func configureH2C(srv *http.Server) error {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return err
+	}
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	return nil
+}
+
+// shutdownServers - Public listener first, the admin listener (nil when
+// there isn't one) keeps answering /healthz and /readyz (as draining) until
+// the redirects are done and `-admin-linger` has passed. Each gets up to wait
+// to finish what it's serving.
+func shutdownServers(srv, adminSrv *http.Server, wait time.Duration) {
+	// Send clients elsewhere for their next request while we drain
+	setDraining()
+	srv.SetKeepAlivesEnabled(false)
+
+	// Doesn't block if no connections, but will otherwise wait until the
+	// timeout deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	slog.Info("Draining Public Server", "timeout", wait)
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Public Server didn't drain in time", "err", err)
+	}
+	slog.Info("Public Server Drained")
+
+	if adminSrv != nil {
+		time.Sleep(adminLinger)
+		slog.Info("Stopping Admin Server")
+		adminCtx, adminCancel := context.WithTimeout(context.Background(), wait)
+		defer adminCancel()
+		adminSrv.Shutdown(adminCtx)
+	}
+}
+
+// localAddrs - The public and admin addresses for `-local`, anything open to
+// every interface bound to 127.0.0.1 instead. An explicit -addr is taken as
+// asked for.
+func localAddrs(listen, admin string, explicitAddr bool) (string, string) {
+	if !explicitAddr {
+		listen = loopbackAddr(listen)
+	}
+	return listen, loopbackAddr(admin)
 }
 
 func main() {
-	var wait time.Duration
 	flag.DurationVar(&wait, "gtimeout", time.Second*15, "The duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+	flag.StringVar(&configPath, "config", "./config.json", "Path or http(s) URL of the config file to load, comma separated to merge several or | separated to fall back to the next")
+	flag.DurationVar(&configRetry, "config-retry", 0, "How long to keep retrying (with backoff) to load the config on start before giving up - e.g. 30s or 2m")
+	flag.StringVar(&analyticsFile, "analytics-file", "", "Append every redirect as a JSON line to this file, disabled when empty")
+	flag.Int64Var(&analyticsMaxSize, "analytics-max-size", 100<<20, "Rotate the analytics file once it reaches this many bytes, 0 to never rotate")
+	flag.DurationVar(&analyticsFlush, "analytics-flush", 5*time.Second, "How often buffered analytics events are flushed to disk, 0 to write each one straight through")
+	flag.StringVar(&pathDecodeMode, "path-decoding", pathDecodeOnce, "How percent-encoded request paths are matched: decode, strict or raw")
+	flag.IntVar(&maxTargetLength, "max-target-length", 8000, "Longest redirect target (Location) allowed, 0 for no limit")
+	flag.StringVar(&longTargetMode, "long-target", longTargetError, "What to do when a target is over -max-target-length: error (414) or default")
+	flag.Float64Var(&clientRPS, "rate-limit", 0, "Requests per second allowed from each client IP across every rule, 0 for no limit")
+	flag.IntVar(&clientBurst, "rate-limit-burst", 0, "Requests a client may burst over -rate-limit, 0 for the rate rounded up")
+	flag.StringVar(&allowIPList, "allow-ips", "", "Comma separated IPs/CIDRs of the only clients served, empty for everyone")
+	flag.StringVar(&blockIPList, "block-ips", "", "Comma separated IPs/CIDRs of clients refused with a 403")
+	flag.BoolVar(&enableTracing, "tracing", false, "Join (or start) a W3C traceparent trace for each request and log its IDs")
+	flag.IntVar(&maxConns, "max-conns", 0, "Most simultaneous connections to accept, extras are closed straight away, 0 for no limit")
+	flag.StringVar(&enableTags, "enable-tags", "", "Comma separated tags, when set only rules with one of these tags (or no tags) are active")
+	flag.StringVar(&disableTags, "disable-tags", "", "Comma separated tags, rules with any of these tags are never active")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Address for the admin listener (dashboard) e.g. 127.0.0.1:8081, disabled when empty")
+	flag.StringVar(&adminUser, "admin-user", "", "Basic auth username for the admin listener, or file:/path or env:NAME to read it from there")
+	flag.StringVar(&adminPass, "admin-pass", "", "Basic auth password for the admin listener, or file:/path or env:NAME to read it from there")
+	flag.StringVar(&onConfigError, "on-config-error", onConfigErrorExit, "What to do when the config can't be loaded on start: exit or serve-default (only the defaultRedirect)")
+	flag.BoolVar(&enablePprof, "pprof", false, "Serve the Go runtime profiles under /debug/pprof/ on the admin listener")
+	flag.BoolVar(&useEmbedded, "use-embedded", false, "Fall back to the config built into the binary when the -config file doesn't exist")
+	flag.BoolVar(&cleanPaths, "clean-paths", true, "Collapse doubled slashes and dot segments in request paths before matching")
+	flag.BoolVar(&keepTrailingSlash, "keep-trailing-slash", false, "Keep a single trailing slash when cleaning paths, so /go// matches /go/ rather than /go")
+	flag.BoolVar(&disableKeepAlive, "disable-keepalive", false, "Close every connection after its response (sends Connection: close)")
+	flag.BoolVar(&reusePort, "reuseport", false, "Set SO_REUSEPORT (Linux) so a new GoLow process can bind the same port for a zero-downtime handoff")
+	flag.StringVar(&listenAddr, "addr", ":80", "Address for the public listener, a comma separated list listens on each (see a Rule's `port`)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, serves HTTPS when set along with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.DurationVar(&tlsReload, "tls-reload", time.Minute, "How often the TLS files are checked for changes and reloaded, 0 to only load them at startup")
+	flag.Uint64Var(&logSample, "log-sample", 1, "Only log 1 in every N redirects, errors are always logged")
+	flag.BoolVar(&logSampleRandom, "log-sample-random", false, "Pick the sampled redirects at random instead of every Nth")
+	flag.IntVar(&healthDrainingStatus, "health-draining-status", http.StatusServiceUnavailable, "Status code /readyz returns while draining, e.g. 503 or 429")
+	flag.DurationVar(&healthUnhealthyAfter, "health-unhealthy-after", 0, "Report not ready on /readyz once config reloads have kept failing this long, 0 to never")
+	flag.DurationVar(&proxyTimeout, "proxy-timeout", 30*time.Second, "How long a proxy rule waits on its upstream before returning 504, 0 for no limit")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma separated IPs/CIDRs of proxies whose X-Forwarded-For/Forwarded headers are believed")
+	flag.IntVar(&maxRules, "max-rules", 10000, "Warn when the config has more active rules than this, 0 for no limit")
+	flag.BoolVar(&strictRules, "strict-rules", false, "Refuse to load a config with more than -max-rules active rules instead of warning")
+	flag.BoolVar(&trustForwardedHost, "trust-forwarded-host", false, "Match rules on X-Forwarded-Host when the request comes from one of the -trusted-proxies")
+	flag.BoolVar(&inheritScheme, "inherit-scheme", false, "Give scheme relative targets (//example.com/x) the scheme of the incoming request")
+	flag.StringVar(&basePath, "base-path", "", "Mount every rule under this path prefix, e.g. /r, requests outside it get a 404")
+	flag.StringVar(&hitsFile, "hits-file", "", "Save the per-rule hit counts to this file so they survive restarts, disabled when empty")
+	flag.DurationVar(&hitsFlush, "hits-flush", time.Minute, "How often the hit counts are saved to -hits-file, 0 only saves them on shutdown")
+	flag.BoolVar(&statusPublic, "status-public", false, "Serve /status on the admin listener without the basic auth credentials")
+	flag.StringVar(&onEmptyDefault, "on-empty-default", emptyDefaultNotFound, "What to do when the config has no defaultRedirect: 404 (for requests no rule or hostDefaults match) or error (refuse the config)")
+	flag.StringVar(&logLevel, "log-level", "info", "Lowest level logged: debug, info, warn or error")
+	flag.StringVar(&auditFile, "audit-file", "", "Append every redirect to this tamper-evident (HMAC chained) log, disabled when empty")
+	flag.StringVar(&auditKey, "audit-key", "", "Secret key for the -audit-file HMAC chain, or file:/path or env:NAME to read it from there")
+	flag.BoolVar(&auditVerify, "audit-verify", false, "Verify the -audit-file chain with -audit-key and exit")
+	flag.DurationVar(&adminReadTimeout, "admin-read-timeout", 15*time.Second, "Read timeout for the admin listener")
+	flag.DurationVar(&adminWriteTimeout, "admin-write-timeout", 15*time.Second, "Write timeout for the admin listener, raise it for long pprof profiles")
+	flag.DurationVar(&adminIdleTimeout, "admin-idle-timeout", 0, "Idle keep-alive timeout for the admin listener, 0 uses -admin-read-timeout")
+	flag.BoolVar(&enableH2C, "h2c", false, "Serve HTTP/2 over cleartext (h2c) for a TLS terminating proxy in front, ignored with -tls-cert")
+	flag.BoolVar(&enableSitemap, "sitemap", false, "Serve /sitemap.xml listing the exact-match rule paths (not their targets)")
+	flag.StringVar(&sitemapBase, "sitemap-base", "", "Base URL for the -sitemap entries e.g. https://go.example.com, the request scheme and host when empty")
+	flag.BoolVar(&gracefulRestart, "graceful-restart", false, "On SIGUSR2 start the binary again with the same flags, hand it the listeners and drain this process (Unix only)")
+	flag.BoolVar(&warmupCheck, "warmup", false, "Probe the health check and a sample of rules in-process before /readyz reports ready")
+	flag.StringVar(&longQueryMode, "long-query", longQueryError, "What to do when preserving the query makes a target longer than -max-target-length: error (see -long-target), truncate or drop-query")
+	flag.DurationVar(&adminLinger, "admin-linger", 0, "Keep the admin listener up this long after the public one has drained, so probes see the final state")
+	flag.StringVar(&initPath, "init", "", "Write an example config to this path (format from the extension) and exit")
+	flag.BoolVar(&initForce, "force", false, "Let -init overwrite an existing file")
+	flag.StringVar(&methodMismatch, "method-mismatch", methodMismatchDefault, "What a request gets when only rules for other methods match its path: default (redirect) or 405 (with an Allow header)")
+	flag.StringVar(&simulateMethod, "simulate", "", "Print what a request would get then exit, without starting a server, given the method with the url after it e.g. -simulate GET https://example.com/path")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "Answer with a 503 when a request has written nothing after this long e.g. 10s, off when 0")
+	flag.StringVar(&maintenanceFile, "maintenance-file", "", "File that keeps maintenance mode on across restarts, it exists while maintenance is on")
+	flag.DurationVar(&maxDelay, "max-delay", 10*time.Second, "Cap on any Rule's delay, so a typo can't hold connections open for hours")
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "StatsD host:port to send redirect counts and request timings to over UDP, off when empty")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "golow", "Prefix for the StatsD metric names")
+	flag.StringVar(&onRuleConflict, "on-rule-conflict", ruleConflictLastWins, "When merged or included configs both have a rule for the same host, path and methods: last-wins (the later replaces it) or error (refuse the config, naming both)")
+	flag.BoolVar(&checkTargetsOnly, "check-targets", false, "Load the config, send a HEAD to every target and list the ones that fail, then exit (1 if any did) without starting a server")
+	flag.DurationVar(&checkTimeout, "check-timeout", 5*time.Second, "How long -check-targets waits on each target")
+	flag.IntVar(&checkConcurrency, "check-concurrency", 8, "How many targets -check-targets checks at once")
+	flag.IntVar(&maxAppendSegments, "max-append-segments", 32, "Most path segments an appendPath Rule adds to its target, deeper requests get the default")
+	flag.IntVar(&maxAppendLength, "max-append-length", 1024, "Longest path an appendPath Rule adds to its target, longer requests get the default")
+	flag.BoolVar(&localOnly, "local", false, "Bind the listeners to 127.0.0.1 instead of every interface, for trying things out. An -addr given explicitly is used as is")
+	flag.StringVar(&signPath, "sign", "", "Print a signed link (path and query, e.g. /download/report.pdf) good for -sign-ttl, for a Rule with a signingKey, then exit")
+	flag.StringVar(&signKey, "sign-key", "", "The signingKey -sign signs with, or file:/path or env:NAME to read it from there")
+	flag.DurationVar(&signTTL, "sign-ttl", time.Hour, "How long a link from -sign works for")
+	flag.StringVar(&malformedPaths, "malformed-paths", malformedPathsReject, "Paths with control characters or invalid UTF-8 once decoded: reject (400), strip (drop those bytes and match what is left) or allow")
+	flag.BoolVar(&followerMode, "follower", false, "Run as a read only follower: admin endpoints that change state answer 403 and the config only changes through its source")
+	flag.BoolVar(&earlyHints, "early-hints", false, "Send a 103 Early Hints with a preconnect Link to the target before Redirecting, HTTP/2 clients only")
+	flag.DurationVar(&logDedupe, "log-dedupe", 0, "Coalesce identical consecutive log lines into one with a repeated count, written out when the line changes or after this long (0 to turn off)")
+	flag.IntVar(&compressHTMLSize, "compress-html", 0, "gzip public HTML responses (e.g. a responseBody page) of at least this many bytes for clients that accept it (0 to turn off)")
+	flag.DurationVar(&bindRetry, "bind-retry", 0, "How long to keep retrying (with backoff) to bind the listen addresses on start, e.g. while the old process lets go of the port, before exiting")
+	flag.StringVar(&dumpRoutes, "dump-routes", "", "Print the active rules in this format (dot, for Graphviz) then exit")
+	flag.IntVar(&gcPercent, "gogc", 0, "GC target percentage like GOGC, lower collects more often and uses less memory (0 leaves it to GOGC, negative turns the GC off)")
+	flag.StringVar(&memoryLimit, "memory-limit", "", "Soft memory limit for the runtime like GOMEMLIMIT, e.g. 512MiB or 2GiB (empty leaves it to GOMEMLIMIT)")
+	flag.IntVar(&maxMetricRules, "max-metric-rules", 1000, "Most rules with their own metrics label, the rest are counted as rule=\"other\" so the series stay bounded (0 for no limit)")
 	flag.Parse()
 
-	conf := Config{}
+	var err error
+	allowedClients, err = parseCIDRs(allowIPList)
+	if err != nil {
+		fatal("Invalid -allow-ips", "err", err)
+	}
+	blockedClients, err = parseCIDRs(blockIPList)
+	if err != nil {
+		fatal("Invalid -block-ips", "err", err)
+	}
+	if clientRPS < 0 || clientBurst < 0 {
+		fatal("Invalid -rate-limit, must not be negative", "rate", clientRPS, "burst", clientBurst)
+	}
+
+	level, err := parseLogLevel(logLevel)
+	if err != nil {
+		fatal("Invalid -log-level", "err", err)
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	if logDedupe > 0 {
+		logDeduper = newLineDeduper(logDedupe)
+		handler = logDeduper.Handler(handler)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if err := tuneRuntime(gcPercent, memoryLimit); err != nil {
+		fatal("Invalid -memory-limit", "err", err)
+	}
 
-	fileData, _ := ioutil.ReadFile("./config.json")
-	json.Unmarshal(fileData, &conf)
+	for name, secret := range map[string]*string{"admin-user": &adminUser, "admin-pass": &adminPass, "audit-key": &auditKey} {
+		if *secret, err = resolveSecret(*secret); err != nil {
+			fatal("Unable to Read -"+name, "err", err)
+		}
+	}
 
-	r := mux.NewRouter()
+	if localOnly {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) {
+			explicit = explicit || f.Name == "addr"
+		})
+		listenAddr, adminAddr = localAddrs(listenAddr, adminAddr, explicit)
+	}
 
-	for _, v := range conf.RedirectRules {
-		if v.Path != "" && v.URL != "" {
+	if signPath != "" {
+		key, err := resolveSecret(signKey)
+		if err != nil || key == "" {
+			fatal("-sign needs a -sign-key", "err", err)
+		}
+		link, err := signLink([]byte(key), signPath, time.Now().Add(signTTL))
+		if err != nil {
+			fatal("Unable to Sign Link", "err", err)
+		}
+		fmt.Println(link)
+		os.Exit(0)
+	}
 
-			// Path can be `/` or `/word*`
-			path := v.Path
-			url := v.URL
-			options := v.RedirectOptions
+	if initPath != "" {
+		if err := writeExampleConfig(initPath, initForce); err != nil {
+			fatal("Unable to Write Example Config", "err", err)
+		}
+		slog.Info("Wrote Example Config", "file", initPath)
+		os.Exit(0)
+	}
 
-			r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-				// Default Redirect Method, 307
-				statusCode := http.StatusTemporaryRedirect
+	if auditVerify {
+		f, err := os.Open(auditFile)
+		if err != nil {
+			fatal("Unable to Open Audit File", "err", err)
+		}
+		if _, err := verifyAuditLog(f, []byte(auditKey)); err != nil {
+			fatal("Audit File Failed Verification", "err", err)
+		}
+		slog.Info("Audit File Verified", "file", auditFile)
+		os.Exit(0)
+	}
 
-				// Loop through the given Struct and give the key and values
-				fields := reflect.TypeOf(options)
-				values := reflect.ValueOf(options)
-				num := fields.NumField()
-				for i := 0; i < num; i++ {
-					field := fields.Field(i)
-					value := values.Field(i)
+	accessLog = &logSampler{rate: logSample, random: logSampleRandom}
 
-					// Set the Header value in the Request
-					// field.Name, value.String()
-					if field.Name == "permanently" && value.Bool() == true {
-						statusCode = http.StatusTemporaryRedirect
-					}
-				}
+	trustedProxies, err = parseCIDRs(trustedProxyList)
+	if err != nil {
+		fatal("Invalid -trusted-proxies", "err", err)
+	}
 
-				// http.StatusTemporaryRedirect, 307
-				// http.StatusMovedPermanently, 301/302
-				log.Println("Redirected User Rule Based: ", url)
-				http.Redirect(w, r, url, statusCode)
-			}) // Close Anonymous function registration for the Method.
+	switch pathDecodeMode {
+	case pathDecodeOnce, pathDecodeStrict, pathDecodeRaw:
+	default:
+		fatal("Unknown -path-decoding mode", "mode", pathDecodeMode)
+	}
+	switch malformedPaths {
+	case malformedPathsReject, malformedPathsStrip, malformedPathsAllow:
+	default:
+		fatal("Unknown -malformed-paths mode", "mode", malformedPaths)
+	}
+	if longTargetMode != longTargetError && longTargetMode != longTargetDefault {
+		fatal("Unknown -long-target mode", "mode", longTargetMode)
+	}
+	if onConfigError != onConfigErrorExit && onConfigError != onConfigErrorDefault {
+		fatal("Unknown -on-config-error mode", "mode", onConfigError)
+	}
+	if methodMismatch != methodMismatchDefault && methodMismatch != methodMismatch405 {
+		fatal("Unknown -method-mismatch mode", "mode", methodMismatch)
+	}
+	switch longQueryMode {
+	case longQueryError, longQueryTruncate, longQueryDrop:
+	default:
+		fatal("Unknown -long-query mode", "mode", longQueryMode)
+	}
+	if onRuleConflict != ruleConflictLastWins && onRuleConflict != ruleConflictError {
+		fatal("Unknown -on-rule-conflict mode", "mode", onRuleConflict)
+	}
+	if dumpRoutes != "" && dumpRoutes != dumpRoutesDOT {
+		fatal("Unknown -dump-routes format", "format", dumpRoutes)
+	}
+	if onEmptyDefault != emptyDefaultNotFound && onEmptyDefault != emptyDefaultError {
+		fatal("Unknown -on-empty-default mode", "mode", onEmptyDefault)
+	}
 
+	configSource = newConfigSource(configPath)
+	if useEmbedded {
+		configSource = embeddedFallback{configSource}
+	}
+
+	conf, err := loadWithRetry(configSource, configRetry)
+	loaded := err == nil
+	if err != nil {
+		fallback, fallbackErr := startupConfig(conf, err)
+		if fallbackErr != nil {
+			fatal("Unable to Load Config", "err", fallbackErr)
 		}
+
+		// Keep the domain pointing somewhere, but make sure nobody misses why
+		slog.Error("!!! Unable to Load Config", "err", err)
+		slog.Error("!!! Serving ONLY the default redirect until the config is fixed", "target", fallback.FinalRedirect)
+		conf = fallback
 	}
 
-	// Default 404 Route, Redirect using Default URL
-	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Redirected User with Default: ", conf.FinalRedirect)
-		http.Redirect(w, r, conf.FinalRedirect, http.StatusTemporaryRedirect)
-	})
+	if conf.ResponseBody != "" {
+		responseBodyType = conf.ResponseBodyType
+		if responseBodyType == "" {
+			responseBodyType = "text/html; charset=utf-8"
+		}
+		responseBody, err = parseResponseBody(conf.ResponseBody, responseBodyType)
+		if err != nil {
+			fatal("Unable to Parse Response Body", "err", err)
+		}
+	}
 
-	srv := &http.Server{
-		Addr:         ":80",
-		Handler:      r,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	if checkTargetsOnly {
+		if failed := checkTargets(os.Stdout, conf, checkTimeout, checkConcurrency); failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// Run our server in a goroutine so that it doesn't block.
-	go func() {
-		log.Println("Server Started")
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+	if dumpRoutes != "" {
+		writeRoutesDOT(os.Stdout, conf)
+		os.Exit(0)
+	}
+
+	if simulateMethod != "" {
+		if err := simulate(os.Stdout, conf, simulateMethod, flag.Arg(0)); err != nil {
+			fatal("Unable to Simulate Request", "err", err)
 		}
-	}()
+		os.Exit(0)
+	}
+
+	if analyticsFile != "" {
+		analytics, err = newAnalyticsWriter(analyticsFile, analyticsMaxSize, analyticsFlush)
+		if err != nil {
+			fatal("Unable to Open Analytics File", "err", err)
+		}
+	}
+
+	if statsdAddr != "" {
+		statsd, err = newStatsdClient(statsdAddr, statsdPrefix)
+		if err != nil {
+			fatal("Unable to Set Up StatsD", "err", err)
+		}
+	}
+
+	if auditFile != "" {
+		if auditKey == "" {
+			fatal("-audit-file needs an -audit-key")
+		}
+		audit, err = newAuditLog(auditFile, []byte(auditKey))
+		if err != nil {
+			fatal("Unable to Open Audit File", "err", err)
+		}
+	}
+
+	if maintenanceFile != "" {
+		loadMaintenance(maintenanceFile)
+	}
+
+	stopPersisting := make(chan struct{})
+	if hitsFile != "" {
+		if err := loadHits(hitsFile); err != nil {
+			fatal("Unable to Load Hit Counts", "err", err)
+		}
+		go persistHits(hitsFile, hitsFlush, stopPersisting)
+	}
+
+	if err := applyConfig(conf); err != nil {
+		fatal("Unable to Apply Config", "err", err)
+	}
+	if loaded {
+		readyAfterWarmup(conf)
+	}
+
+	srv := newPublicServer(publicHandler)
+
+	if enableH2C && tlsCert == "" {
+		if err := configureH2C(srv); err != nil {
+			fatal("Unable to Configure h2c", "err", err)
+		}
+	}
+
+	lc := net.ListenConfig{}
+	if reusePort {
+		// While both processes hold the port the kernel spreads new
+		// connections between them, stop the old one once the new is up.
+		lc.Control = reusePortControl
+	}
+
+	// What a restart hands over, before any wrapping
+	handoff := map[string]net.Listener{}
+	listeners := []net.Listener{}
+	for i, addr := range splitList(listenAddr) {
+		ln, err := listenWithRetry(lc, addr, publicFDEnv(i), bindRetry)
+		if err != nil {
+			fatal("Unable to Listen", "addr", addr, "err", err)
+		}
+		handoff[publicFDEnv(i)] = ln
+		listeners = append(listeners, limitConns(ln, maxConns))
+	}
+
+	stopWatching := make(chan struct{})
+	if tlsCert != "" || tlsKey != "" {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			fatal("Unable to Load TLS Certificate", "err", err)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		if tlsReload > 0 {
+			go certs.watch(tlsReload, stopWatching)
+		}
+	}
+
+	// Run our server in a goroutine so that it doesn't block. Decided up
+	// front, Serve fills in a TLSConfig of its own for HTTP/2.
+	useTLS := srv.TLSConfig != nil
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			slog.Info("Server Started", "addr", ln.Addr().String())
+			var err error
+			if useTLS {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil {
+				slog.Info("Server Stopped", "addr", ln.Addr().String(), "err", err)
+			}
+		}(ln)
+	}
+
+	if enablePprof && adminAddr == "" {
+		slog.Warn("-pprof does nothing without -admin-addr, it is never served publicly")
+	}
+
+	var adminSrv *http.Server
+	if adminAddr != "" {
+		if adminUser == "" || adminPass == "" {
+			slog.Warn("No -admin-user/-admin-pass set, the admin pages will refuse every request")
+		}
+
+		adminSrv = newAdminServer()
+		adminLn, err := listenWithRetry(net.ListenConfig{}, adminAddr, adminFDEnv, bindRetry)
+		if err != nil {
+			fatal("Unable to Listen for the Admin Server", "err", err)
+		}
+		handoff[adminFDEnv] = adminLn
+
+		go func() {
+			slog.Info("Admin Server Started", "addr", adminAddr)
+			if err := adminSrv.Serve(adminLn); err != nil {
+				slog.Info("Admin Server Stopped", "err", err)
+			}
+		}()
+	}
+
+	logStartup(conf)
 
 	/**
 	 * This section of code is from the MUX docs for a graceful shtudown.
 	 * @link https://github.com/gorilla/mux#graceful-shutdown
 	 */
+	// SIGHUP reloads the config in place
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("SIGHUP received, reloading config")
+			reloadConfig()
+		}
+	}()
+
+	// SIGUSR1 logs the current state
+	usr1 := make(chan os.Signal, 1)
+	notifyDumpState(usr1)
+	go dumpStateOn(usr1)
+
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
 	signal.Notify(c, os.Interrupt)
 
+	// SIGUSR2 starts the new binary on our listeners, then we drain as usual
+	if gracefulRestart {
+		usr2 := make(chan os.Signal, 1)
+		notifyRestart(usr2)
+		go func() {
+			for range usr2 {
+				child, err := restartHandoff(handoff)
+				if err != nil {
+					slog.Error("Unable to Restart", "err", err)
+					continue
+				}
+				slog.Info("Handed the listeners to the new process, draining", "pid", child.Pid)
+				c <- os.Interrupt
+				return
+			}
+		}()
+	}
+
 	// Block until we receive our signal.
 	<-c
 
-	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
-	defer cancel()
-	// Doesn't block if no connections, but will otherwise wait
-	// until the timeout deadline.
-	srv.Shutdown(ctx)
+	shutdownServers(srv, adminSrv, wait)
+	close(stopWatching)
+	analytics.Close()
+	audit.Close()
+	statsd.Close()
+	close(stopPersisting)
+	if hitsFile != "" {
+		if err := saveHits(hitsFile); err != nil {
+			slog.Error("Failed to Save Hit Counts", "err", err)
+		}
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
-	log.Println("Shutting Down.")
+	slog.Info("Shutting Down.")
+	logDeduper.Flush()
 	os.Exit(0)
 }
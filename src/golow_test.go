@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestKeepAlive(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+
+	tests := []struct {
+		name     string
+		disabled bool
+		drain    bool
+		closes   []bool
+	}{
+		{"kept alive", false, false, []bool{false, false}},
+		{"-disable-keepalive", true, false, []bool{true}},
+		{"draining closes the next response", false, true, []bool{false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &disableKeepAlive, tt.disabled)
+
+			srv := httptest.NewUnstartedServer(nil)
+			public := chain(buildRouter(conf), buildMiddleware(conf))
+			requests := 0
+			srv.Config = newPublicServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Shutdown starting while the second request is being served
+				if requests++; requests == 2 && tt.drain {
+					srv.Config.SetKeepAlivesEnabled(false)
+				}
+				public.ServeHTTP(w, r)
+			}))
+			srv.Start()
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			for i, closes := range tt.closes {
+				fmt.Fprint(conn, "GET /go HTTP/1.1\r\nHost: example.com\r\n\r\n")
+				resp, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != http.StatusTemporaryRedirect {
+					t.Errorf("response %d = %d, want 307", i, resp.StatusCode)
+				}
+				if resp.Close != closes {
+					t.Errorf("response %d Connection: close = %v, want %v", i, resp.Close, closes)
+				}
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+	srv := newPublicServer(chain(buildRouter(conf), buildMiddleware(conf)))
+	if err := configureH2C(srv); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/go"
+
+	// Prior knowledge h2c, as a TLS terminating proxy speaks it
+	h2 := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	h1 := &http.Client{CheckRedirect: h2.CheckRedirect}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		proto  int
+	}{
+		{"h2c", h2, 2},
+		{"HTTP/1.1 still works", h1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != tt.proto || resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "https://golang.org" {
+				t.Errorf("GET /go = HTTP/%d %d %q, want HTTP/%d 307 https://golang.org", resp.ProtoMajor, resp.StatusCode, resp.Header.Get("Location"), tt.proto)
+			}
+		})
+	}
+
+	// The open HTTP/2 connection doesn't hold up a drain
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown with an h2c connection open = %v", err)
+	}
+	if _, err := h2.Get(url); err == nil {
+		t.Error("the server still answered h2c after Shutdown")
+	}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	setGlobal(t, &draining, int32(0))
+	setGlobal(t, &configLoaded, int32(1))
+	setGlobal(t, &adminLinger, 50*time.Millisecond)
+	setGlobal(t, &healthDrainingStatus, http.StatusServiceUnavailable)
+	oldStarted := drainStarted
+	drainStarted, drainOnce = make(chan struct{}), sync.Once{}
+	t.Cleanup(func() { drainStarted, drainOnce = oldStarted, sync.Once{} })
+
+	// A redirect still being served when the shutdown starts
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := newPublicServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		http.Redirect(w, r, "https://example.com", http.StatusTemporaryRedirect)
+	}))
+	adminSrv := newAdminServer()
+	addrs := []string{}
+	for _, s := range []*http.Server{srv, adminSrv} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(ln)
+		addrs = append(addrs, "http://"+ln.Addr().String())
+	}
+	public, admin := addrs[0], addrs[1]
+	// A connection per request, a spare one the transport dialed and never
+	// used would hold up adminSrv.Shutdown for its grace period
+	client := &http.Client{
+		Transport:     &http.Transport{DisableKeepAlives: true},
+		Timeout:       5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := client.Get(public + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+
+	logs := captureLogs(t)
+	stopped := make(chan struct{})
+	go func() {
+		shutdownServers(srv, adminSrv, 5*time.Second)
+		close(stopped)
+	}()
+
+	// The public listener stops taking connections first
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(public, "http://"))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the public listener never closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// While the redirect drains, the admin listener still answers
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(admin + tt.path)
+		if err != nil {
+			t.Fatalf("GET %s while the public listener drains: %v", tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s while draining = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatal("shutdownServers returned with a redirect still in flight")
+	default:
+	}
+
+	close(release)
+	if status := <-slow; status != http.StatusTemporaryRedirect {
+		t.Errorf("in flight redirect = %d, want it finished with a 307", status)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdownServers never returned")
+	}
+	if _, err := client.Get(admin + "/healthz"); err == nil {
+		t.Error("the admin listener is still up after the shutdown")
+	}
+
+	order := []string{}
+	for _, line := range logs() {
+		order = append(order, line["msg"].(string))
+	}
+	want := []string{"Draining Public Server", "Public Server Drained", "Stopping Admin Server"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("shutdown logged %v, want %v", order, want)
+	}
+}
+
+func TestLocalAddrs(t *testing.T) {
+	tests := []struct {
+		name       string
+		listen     string
+		admin      string
+		explicit   bool
+		wantListen string
+		wantAdmin  string
+	}{
+		{"defaults", ":80", ":8081", false, "127.0.0.1:80", "127.0.0.1:8081"},
+		{"several listeners", ":80,:8443", "", false, "127.0.0.1:80,127.0.0.1:8443", ""},
+		{"a host is kept", "10.0.0.5:80,:81", "[::1]:8081", false, "10.0.0.5:80,127.0.0.1:81", "[::1]:8081"},
+		{"explicit -addr is left alone", ":8080", ":8081", true, ":8080", "127.0.0.1:8081"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, admin := localAddrs(tt.listen, tt.admin, tt.explicit)
+			if listen != tt.wantListen || admin != tt.wantAdmin {
+				t.Errorf("localAddrs(%q, %q, %v) = %q, %q, want %q, %q", tt.listen, tt.admin, tt.explicit, listen, admin, tt.wantListen, tt.wantAdmin)
+			}
+		})
+	}
+
+	t.Run("binds to loopback", func(t *testing.T) {
+		listen, _ := localAddrs(":0", "", false)
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("-local listened on %s, want loopback", ip)
+		}
+	})
+}
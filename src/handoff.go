@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment a restarted process finds its inherited listeners in, as the
+// file descriptor numbers passed down by restartHandoff
+const (
+	listenFDEnv = "GOLOW_LISTEN_FD"
+	adminFDEnv  = "GOLOW_ADMIN_FD"
+)
+
+// publicFDEnv - Where the i'th `-addr` listener is handed down, the first
+// keeps the plain name so older builds still find it
+func publicFDEnv(i int) string {
+	if i == 0 {
+		return listenFDEnv
+	}
+	return listenFDEnv + "_" + strconv.Itoa(i)
+}
+
+// listen - The listener handed down by the previous process when there is
+// one, otherwise a fresh one on the address
+func listen(lc net.ListenConfig, addr string, env string) (net.Listener, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	// Our own children get their own descriptors
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), env)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// listenWithRetry - listen, retrying with backoff until the deadline when the
+// address can't be bound yet (a restart where the old process still has it)
+func listenWithRetry(lc net.ListenConfig, addr string, env string, deadline time.Duration) (net.Listener, error) {
+	giveUp := time.Now().Add(deadline)
+	backoff := 100 * time.Millisecond
+
+	for {
+		ln, err := listen(lc, addr, env)
+		if err == nil {
+			return ln, nil
+		}
+
+		remaining := time.Until(giveUp)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		slog.Warn("Failed to Listen, retrying", "addr", addr, "in", backoff, "err", err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// loopbackAddr - The addresses (comma separated) with any left open to
+// every interface (`:80`) bound to 127.0.0.1 instead, for `-local`
+func loopbackAddr(addrs string) string {
+	parts := splitList(addrs)
+	for i, addr := range parts {
+		if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+			parts[i] = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// restartHandoff - Start a new copy of the binary (a new version after an
+// upgrade) with the same flags, handing it the listeners (keyed by the
+// environment the child finds each in) so no connection is refused while
+// this process drains.
+func restartHandoff(listeners map[string]net.Listener) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+
+	for env, ln := range listeners {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, errors.New("listener can't be handed over")
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		// ExtraFiles start at descriptor 3 in the child
+		cmd.Env = append(cmd.Env, env+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+// limitConns - Refuse connections past the first max, for `-max-conns`.
+// Extras are accepted and closed straight away rather than left waiting in
+// the kernel backlog. Shutdown closes the wrapped listener too, so draining
+// still works as usual.
+func limitConns(ln net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return ln
+	}
+	return &limitListener{Listener: ln, slots: make(chan struct{}, max)}
+}
+
+// limitListener - A slot in slots is held for each open connection
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			slog.Debug("Refused Connection", "remote", conn.RemoteAddr().String(), "max", cap(l.slots))
+			conn.Close()
+		}
+	}
+}
+
+// limitConn - Gives its slot back on the first Close
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitConns(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		conns int
+		want  int32
+	}{
+		{"capped", 2, 4, 2},
+		{"no limit", 0, 4, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var serving atomic.Int32
+			release := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serving.Add(1)
+				<-release
+				w.WriteHeader(http.StatusNoContent)
+			})}
+			go srv.Serve(limitConns(ln, tt.max))
+
+			answers := make(chan error, tt.conns)
+			for i := 0; i < tt.conns; i++ {
+				go func() {
+					conn, err := net.Dial("tcp", ln.Addr().String())
+					if err != nil {
+						answers <- err
+						return
+					}
+					defer conn.Close()
+					fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+					resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+					if err == nil && resp.StatusCode != http.StatusNoContent {
+						err = fmt.Errorf("status %d", resp.StatusCode)
+					}
+					answers <- err
+				}()
+			}
+
+			// Past the cap a connection is closed straight away, it doesn't
+			// wait for the held ones to finish
+			for i := 0; i < tt.conns-int(tt.want); i++ {
+				select {
+				case err := <-answers:
+					if err == nil {
+						t.Errorf("connection %d was served, want it refused", i)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d of %d extra connections were refused", i, tt.conns-int(tt.want))
+				}
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for serving.Load() < tt.want && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := serving.Load(); got != tt.want {
+				t.Errorf("%d connections served at once, want %d", got, tt.want)
+			}
+
+			close(release)
+			for i := 0; i < int(tt.want); i++ {
+				select {
+				case err := <-answers:
+					if err != nil {
+						t.Errorf("connection %d: %v", i, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d of %d held connections answered", i, tt.want)
+				}
+			}
+
+			// The slots come back as the held ones close, the server may still
+			// be closing its end just after answering so give it a moment
+			if tt.max > 0 {
+				deadline = time.Now().Add(5 * time.Second)
+				for {
+					conn, err := net.Dial("tcp", ln.Addr().String())
+					if err != nil {
+						t.Fatal(err)
+					}
+					fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+					resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+					conn.Close()
+					if err == nil && resp.StatusCode == http.StatusNoContent {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("no room for a connection after the held ones closed: %v", err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				t.Errorf("Shutdown = %v", err)
+			}
+		})
+	}
+}
+
+func TestListenWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		// freeAfter - When the port is let go of, 0 for never
+		freeAfter time.Duration
+		ok        bool
+	}{
+		{"bound once the port is free", 5 * time.Second, 250 * time.Millisecond, true},
+		{"gives up at the deadline", 300 * time.Millisecond, 0, false},
+		{"no retry", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer taken.Close()
+			addr := taken.Addr().String()
+			if tt.freeAfter > 0 {
+				time.AfterFunc(tt.freeAfter, func() { taken.Close() })
+			}
+			logs := captureLogs(t)
+
+			start := time.Now()
+			ln, err := listenWithRetry(net.ListenConfig{}, addr, "GOLOW_TEST_NO_FD", tt.deadline)
+			took := time.Since(start)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("listenWithRetry = %v, want it bound", err)
+				}
+				ln.Close()
+				if took < tt.freeAfter {
+					t.Errorf("bound after %s, before the port was free", took)
+				}
+			} else if err == nil {
+				ln.Close()
+				t.Fatal("listenWithRetry bound a port still in use")
+			}
+			if !tt.ok && took > tt.deadline+time.Second {
+				t.Errorf("gave up after %s, want about %s", took, tt.deadline)
+			}
+
+			warned := findLog(logs(), "Failed to Listen, retrying")
+			if (warned != nil) != (tt.deadline > 0) {
+				t.Errorf("retry warning = %v, want one only when retrying", warned)
+			}
+			if warned != nil && warned["addr"] != addr {
+				t.Errorf("retry warning for %v, want %s", warned["addr"], addr)
+			}
+		})
+	}
+}
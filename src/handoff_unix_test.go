@@ -0,0 +1,112 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// handoffChildEnv - Set for the copy of the test binary restartHandoff starts
+const handoffChildEnv = "GOLOW_TEST_HANDOFF_CHILD"
+
+func TestRestartHandoff(t *testing.T) {
+	if os.Getenv(handoffChildEnv) != "" {
+		handoffChild(t)
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	// The child is this test binary again, running only this test
+	t.Setenv(handoffChildEnv, "1")
+	setGlobal(t, &os.Args, []string{os.Args[0], "-test.run=^TestRestartHandoff$"})
+	child, err := restartHandoff(map[string]net.Listener{listenFDEnv: ln})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		state, err := child.Wait()
+		if err == nil && !state.Success() {
+			err = fmt.Errorf("child exited with %s", state)
+		}
+		exited <- err
+	}()
+	defer child.Kill()
+
+	// Once this process has let go, only the child can answer
+	ln.Close()
+	client := &http.Client{Timeout: time.Second}
+	var pid string
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := client.Get("http://" + addr + "/pid")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			pid = string(body)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing answered on the handed over listener: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if pid != strconv.Itoa(child.Pid) {
+		t.Errorf("answered by pid %q, want the child %d", pid, child.Pid)
+	}
+
+	if resp, err := client.Get("http://" + addr + "/stop"); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the child never stopped")
+	}
+}
+
+// handoffChild - The restarted process, serving on the listener it was given
+// until asked to stop
+func handoffChild(t *testing.T) {
+	if os.Getenv(listenFDEnv) == "" {
+		t.Fatal("no listener was handed down")
+	}
+	ln, err := listen(net.ListenConfig{}, "", listenFDEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv(listenFDEnv) != "" {
+		t.Error("the listener's descriptor is still in the environment for our own children")
+	}
+
+	stop := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getpid())
+		if r.URL.Path == "/stop" {
+			close(stop)
+		}
+	})}
+	go srv.Serve(ln)
+
+	select {
+	case <-stop:
+	case <-time.After(30 * time.Second):
+		t.Error("never asked to stop")
+	}
+	srv.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// draining - Set once shutdown starts, the public listener is finishing up
+var draining int32
+
+// drainStarted - Closed once shutdown starts, for anything waiting to stop
+var drainStarted = make(chan struct{})
+
+var drainOnce sync.Once
+
+func setDraining() {
+	atomic.StoreInt32(&draining, 1)
+	drainOnce.Do(func() { close(drainStarted) })
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// configLoaded - Set once a Config has loaded, serving only the default
+// after a failed start doesn't count
+var configLoaded int32
+
+func setConfigLoaded() {
+	atomic.StoreInt32(&configLoaded, 1)
+}
+
+func isConfigLoaded() bool {
+	return atomic.LoadInt32(&configLoaded) == 1
+}
+
+// reloadHealth - Tracks how long config reloads have been failing in a row
+var reloadHealth struct {
+	sync.Mutex
+	failingSince time.Time
+	lastErr      error
+}
+
+// recordReload - Note the outcome of a config reload, a success clears
+// any run of failures.
+func recordReload(err error) {
+	reloadHealth.Lock()
+	defer reloadHealth.Unlock()
+
+	if err == nil {
+		reloadHealth.failingSince = time.Time{}
+		reloadHealth.lastErr = nil
+		return
+	}
+
+	if reloadHealth.failingSince.IsZero() {
+		reloadHealth.failingSince = time.Now()
+	}
+	reloadHealth.lastErr = err
+}
+
+// reloadFailing - When reloads started failing and the latest error, or a
+// zero time if the last reload worked
+func reloadFailing() (time.Time, error) {
+	reloadHealth.Lock()
+	defer reloadHealth.Unlock()
+	return reloadHealth.failingSince, reloadHealth.lastErr
+}
+
+// healthHandler - Liveness, 200 for as long as the process is serving
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler - Readiness, 200 once a Config has loaded. `-health-draining-status`
+// while draining and 503 once reloads have been failing for `-health-unhealthy-after`
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if isDraining() {
+		w.WriteHeader(healthDrainingStatus)
+		fmt.Fprintln(w, "draining: shutting down, finishing in-flight requests")
+		return
+	}
+
+	if !isConfigLoaded() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready: no config loaded yet")
+		return
+	}
+
+	if since, err := reloadFailing(); healthUnhealthyAfter > 0 && !since.IsZero() && time.Since(since) >= healthUnhealthyAfter {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: config reloads failing since %s: %v\n", since.Format(time.RFC3339), err)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
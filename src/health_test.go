@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failReloadsSince - Pretend config reloads have been failing since then,
+// for the length of the test
+func failReloadsSince(t *testing.T, since time.Time) {
+	t.Helper()
+	reloadHealth.Lock()
+	reloadHealth.failingSince = since
+	reloadHealth.lastErr = errors.New("config source unreachable")
+	reloadHealth.Unlock()
+	t.Cleanup(func() { recordReload(nil) })
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name           string
+		loaded         bool
+		draining       bool
+		drainingStatus int
+		unhealthyAfter time.Duration
+		failingFor     time.Duration
+		status         int
+		body           string
+	}{
+		{"ready", true, false, http.StatusServiceUnavailable, 0, 0, http.StatusOK, "ok"},
+		{"no config yet", false, false, http.StatusServiceUnavailable, 0, 0, http.StatusServiceUnavailable, "no config loaded"},
+		{"draining default", true, true, http.StatusServiceUnavailable, 0, 0, http.StatusServiceUnavailable, "draining"},
+		{"draining as a 429", true, true, http.StatusTooManyRequests, 0, 0, http.StatusTooManyRequests, "draining"},
+		{"reloads failing past the limit", true, false, http.StatusServiceUnavailable, time.Minute, 2 * time.Minute, http.StatusServiceUnavailable, "config reloads failing since"},
+		{"reloads failing inside the limit", true, false, http.StatusServiceUnavailable, time.Minute, 10 * time.Second, http.StatusOK, "ok"},
+		{"reloads failing with no limit", true, false, http.StatusServiceUnavailable, 0, time.Hour, http.StatusOK, "ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadedFlag, drainingFlag := int32(0), int32(0)
+			if tt.loaded {
+				loadedFlag = 1
+			}
+			if tt.draining {
+				drainingFlag = 1
+			}
+			setGlobal(t, &configLoaded, loadedFlag)
+			setGlobal(t, &draining, drainingFlag)
+			setGlobal(t, &healthDrainingStatus, tt.drainingStatus)
+			setGlobal(t, &healthUnhealthyAfter, tt.unhealthyAfter)
+			if tt.failingFor > 0 {
+				failReloadsSince(t, time.Now().Add(-tt.failingFor))
+			}
+
+			rec := httptest.NewRecorder()
+			readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("GET /readyz = %d %q, want %d mentioning %q", rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestReloadFailuresRecover(t *testing.T) {
+	setGlobal(t, &configLoaded, int32(1))
+	setGlobal(t, &healthUnhealthyAfter, time.Minute)
+	failReloadsSince(t, time.Now().Add(-time.Hour))
+
+	// Another failure keeps the start of the run
+	recordReload(errors.New("still unreachable"))
+	if since, err := reloadFailing(); time.Since(since) < time.Hour || err == nil || err.Error() != "still unreachable" {
+		t.Errorf("after another failure reloadFailing = %s %v", since, err)
+	}
+
+	recordReload(nil)
+	rec := httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after a good reload /readyz = %d, want 200", rec.Code)
+	}
+}
+
+func TestLivenessVsReadiness(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	setGlobal(t, &healthDrainingStatus, http.StatusServiceUnavailable)
+
+	tests := []struct {
+		name     string
+		loaded   int32
+		draining int32
+		ready    int
+	}{
+		{"before the first config load", 0, 0, http.StatusServiceUnavailable},
+		{"serving", 1, 0, http.StatusOK},
+		{"draining", 1, 1, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &configLoaded, tt.loaded)
+			setGlobal(t, &draining, tt.draining)
+
+			// Open to probes, no credentials
+			if rec := adminRequest(http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+				t.Errorf("GET /healthz = %d, want 200 while the process runs", rec.Code)
+			}
+			if rec := adminRequest(http.MethodGet, "/readyz", "", ""); rec.Code != tt.ready {
+				t.Errorf("GET /readyz = %d, want %d", rec.Code, tt.ready)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+)
+
+// iconNone - The `iconURL` that answers the icon paths with a 204
+const iconNone = "none"
+
+// iconPaths - Paths browsers ask for on their own, whatever page they're on
+var iconPaths = []string{
+	"/favicon.ico",
+	"/apple-touch-icon.png",
+	"/apple-touch-icon-precomposed.png",
+}
+
+// iconHandler - Send the browser's icon requests to the brand asset, or a
+// 204 so they stop showing up as errors in the console
+func iconHandler(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target == iconNone {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIconPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		iconURL  string
+		path     string
+		status   int
+		location string
+	}{
+		{"favicon to the asset", "https://cdn.example.com/icon.png", "/favicon.ico", http.StatusFound, "https://cdn.example.com/icon.png"},
+		{"apple-touch-icon to the asset", "https://cdn.example.com/icon.png", "/apple-touch-icon.png", http.StatusFound, "https://cdn.example.com/icon.png"},
+		{"precomposed to the asset", "https://cdn.example.com/icon.png", "/apple-touch-icon-precomposed.png", http.StatusFound, "https://cdn.example.com/icon.png"},
+		{"none is a 204", "none", "/favicon.ico", http.StatusNoContent, ""},
+		{"none is a 204 for apple-touch-icon", "none", "/apple-touch-icon.png", http.StatusNoContent, ""},
+		{"unset goes to the default", "", "/favicon.ico", http.StatusTemporaryRedirect, "https://example.com"},
+		{"other rules still match", "none", "/robots.txt", http.StatusTemporaryRedirect, "https://example.com/robots"},
+		{"other paths are left alone", "none", "/favicon.png", http.StatusTemporaryRedirect, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "iconURL": "`+tt.iconURL+`", "redirects": [
+				{"rule": "/robots.txt", "url": "https://example.com/robots"}
+			]}`)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if tt.status == http.StatusNoContent && rec.Body.Len() != 0 {
+				t.Errorf("204 has a body %q", rec.Body)
+			}
+		})
+	}
+
+	t.Run("a rule on an icon path wins", func(t *testing.T) {
+		conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "iconURL": "none", "redirects": [
+			{"rule": "/favicon.ico", "url": "https://brand.example.com/favicon.ico"}
+		]}`)
+		if got := serve(conf, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil)).Header().Get("Location"); got != "https://brand.example.com/favicon.ico" {
+			t.Errorf("GET /favicon.ico = %q, want the rule's target", got)
+		}
+	})
+
+	_, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "iconURL": "https://evil.example/icon.png"}`))
+	if err == nil || !strings.Contains(err.Error(), "iconURL") {
+		t.Errorf("parseConfig with a blocked iconURL = %v, want an iconURL error", err)
+	}
+}
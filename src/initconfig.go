@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// exampleYAML - What `-init` writes for a `.yaml`/`.yml` path
+const exampleYAML = `# GoLow config
+version: 1
+
+# Where anything no rule matches is sent
+defaultRedirect: https://example.com
+
+# A different default per Host
+hostDefaults:
+  docs.example.com: https://example.com/docs
+
+redirects:
+  # Temporary (307) unless options.statusCode says otherwise
+  - rule: /google
+    url: https://google.com
+    description: Search
+
+  # Permanent, browsers will cache it
+  - rule: /drive
+    url: https://drive.google.com
+    options:
+      statusCode: 301
+`
+
+// exampleTOML - What `-init` writes for a `.toml` path
+const exampleTOML = `# GoLow config
+version = 1
+
+# Where anything no rule matches is sent
+defaultRedirect = "https://example.com"
+
+# A different default per Host
+[hostDefaults]
+"docs.example.com" = "https://example.com/docs"
+
+# Temporary (307) unless options.statusCode says otherwise
+[[redirects]]
+rule = "/google"
+url = "https://google.com"
+description = "Search"
+
+# Permanent, browsers will cache it
+[[redirects]]
+rule = "/drive"
+url = "https://drive.google.com"
+options = { statusCode = 301 }
+`
+
+// exampleJSON - What `-init` writes for any other path. JSON has no
+// comments, so the descriptions do the explaining.
+const exampleJSON = `{
+  "version": 1,
+  "defaultRedirect": "https://example.com",
+  "hostDefaults": {
+    "docs.example.com": "https://example.com/docs"
+  },
+  "redirects": [
+    {
+      "rule": "/google",
+      "url": "https://google.com",
+      "description": "Temporary (307) unless options.statusCode says otherwise"
+    },
+    {
+      "rule": "/drive",
+      "url": "https://drive.google.com",
+      "description": "Permanent, browsers will cache it",
+      "options": {
+        "statusCode": 301
+      }
+    }
+  ]
+}
+`
+
+// writeExampleConfig - Write the example Config for `-init`, in the format
+// the path's extension asks for. An existing file is only replaced with force.
+func writeExampleConfig(file string, force bool) error {
+	example := exampleJSON
+	switch {
+	case isYAML(file):
+		example = exampleYAML
+	case strings.EqualFold(path.Ext(file), ".toml"):
+		example = exampleTOML
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(file, flags, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return errors.New(file + " already exists, use -force to overwrite it")
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(example); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteExampleConfig(t *testing.T) {
+	for _, name := range []string{"golow.json", "golow.yaml", "golow.yml", "golow.toml", "golow.conf"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			if err := writeExampleConfig(file, false); err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := newConfigSource(file).Load()
+			if err != nil {
+				t.Fatalf("the example doesn't load: %v", err)
+			}
+			if len(conf.RedirectRules) != 2 {
+				t.Errorf("example has %d rules, want 2", len(conf.RedirectRules))
+			}
+
+			tests := []struct {
+				host, path string
+				status     int
+				location   string
+			}{
+				{"example.com", "/google", http.StatusTemporaryRedirect, "https://google.com"},
+				{"example.com", "/drive", http.StatusMovedPermanently, "https://drive.google.com"},
+				{"example.com", "/missing", http.StatusTemporaryRedirect, "https://example.com"},
+				{"docs.example.com", "/missing", http.StatusTemporaryRedirect, "https://example.com/docs"},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				req.Host = tt.host
+				rec := serve(conf, req)
+				if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+					t.Errorf("GET %s%s = %d %q, want %d %q", tt.host, tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+				}
+			}
+		})
+	}
+
+	t.Run("existing file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "golow.json")
+		writeFile(t, file, "mine")
+
+		if err := writeExampleConfig(file, false); err == nil || !strings.Contains(err.Error(), "use -force") {
+			t.Errorf("writeExampleConfig over a file = %v, want it refused", err)
+		}
+		if data, _ := os.ReadFile(file); string(data) != "mine" {
+			t.Errorf("the existing file was changed to %q", data)
+		}
+
+		if err := writeExampleConfig(file, true); err != nil {
+			t.Fatalf("writeExampleConfig with force = %v", err)
+		}
+		if _, err := newConfigSource(file).Load(); err != nil {
+			t.Errorf("the forced example doesn't load: %v", err)
+		}
+	})
+}
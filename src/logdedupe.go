@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lineDeduper - Coalesces identical consecutive log lines into one with a
+// `repeated` count, set by `-log-dedupe`. A line is held until a different
+// one comes along or the interval is up, whichever is first. Request IDs
+// differ on every line so they're left out when comparing.
+type lineDeduper struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	key     string
+	count   int
+	handler slog.Handler
+	held    slog.Record
+	timer   *time.Timer
+}
+
+// logDeduper - nil unless `-log-dedupe` is set
+var logDeduper *lineDeduper
+
+func newLineDeduper(interval time.Duration) *lineDeduper {
+	return &lineDeduper{interval: interval}
+}
+
+// Handler - Wrap the handler so its lines go through the deduper
+func (d *lineDeduper) Handler(next slog.Handler) slog.Handler {
+	return &dedupeHandler{deduper: d, next: next}
+}
+
+// Flush - Write out the held line, with its count
+func (d *lineDeduper) Flush() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushLocked()
+}
+
+func (d *lineDeduper) flushLocked() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.handler == nil {
+		return
+	}
+	if d.count > 1 {
+		d.held.AddAttrs(slog.Int("repeated", d.count))
+	}
+	d.handler.Handle(context.Background(), d.held)
+	d.handler, d.key, d.count = nil, "", 0
+}
+
+// hold - Count the line if it's the same as the held one, otherwise write
+// the held one out and hold this one instead
+func (d *lineDeduper) hold(handler slog.Handler, key string, r slog.Record) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handler != nil && d.key == key {
+		d.count++
+		return
+	}
+
+	d.flushLocked()
+	d.handler, d.key, d.count, d.held = handler, key, 1, r.Clone()
+	d.timer = time.AfterFunc(d.interval, d.Flush)
+}
+
+// dedupeHandler - The slog side of lineDeduper, it carries the attributes
+// added with With so they're part of what is compared
+type dedupeHandler struct {
+	deduper *lineDeduper
+	next    slog.Handler
+	prefix  string
+	groups  string
+}
+
+func (h *dedupeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle - Warnings and errors aren't held back, they go out right away
+// (after whatever line was held so the order is kept)
+func (h *dedupeHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		h.deduper.Flush()
+		return h.next.Handle(ctx, r)
+	}
+
+	var key strings.Builder
+	key.WriteString(r.Level.String() + "|" + r.Message + "|" + h.prefix)
+	r.Attrs(func(a slog.Attr) bool {
+		writeDedupeAttr(&key, h.groups, a)
+		return true
+	})
+	h.deduper.hold(h.next, key.String(), r)
+	return nil
+}
+
+func (h *dedupeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var prefix strings.Builder
+	prefix.WriteString(h.prefix)
+	for _, a := range attrs {
+		writeDedupeAttr(&prefix, h.groups, a)
+	}
+	return &dedupeHandler{deduper: h.deduper, next: h.next.WithAttrs(attrs), prefix: prefix.String(), groups: h.groups}
+}
+
+func (h *dedupeHandler) WithGroup(name string) slog.Handler {
+	return &dedupeHandler{deduper: h.deduper, next: h.next.WithGroup(name), prefix: h.prefix, groups: h.groups + name + "."}
+}
+
+// writeDedupeAttr - The attribute as compared, request IDs are skipped
+func writeDedupeAttr(b *strings.Builder, groups string, a slog.Attr) {
+	if a.Key == "requestId" {
+		return
+	}
+	b.WriteString(" " + groups + a.Key + "=" + a.Value.String())
+}
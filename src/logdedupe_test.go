@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer - A log buffer the dedupe timer can write to while the test reads
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines - The messages logged so far, with their repeated count (0 when unset)
+func (b *lockedBuffer) lines(t *testing.T) [][2]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := [][2]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		line := struct {
+			Msg      string `json:"msg"`
+			Repeated int    `json:"repeated"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, [2]interface{}{line.Msg, line.Repeated})
+	}
+	return lines
+}
+
+func TestLogDedupe(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs", "url": "https://docs.example.com"}
+	]}`)
+
+	capture := func(t *testing.T, interval time.Duration) (*lineDeduper, *lockedBuffer) {
+		buf := &lockedBuffer{}
+		d := newLineDeduper(interval)
+		old := slog.Default()
+		// At the default info level, the per request debug line would break up every run
+		slog.SetDefault(slog.New(d.Handler(slog.NewJSONHandler(buf, nil))))
+		t.Cleanup(func() { slog.SetDefault(old) })
+		return d, buf
+	}
+	get := func(path string) {
+		serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	t.Run("a burst becomes one line", func(t *testing.T) {
+		d, buf := capture(t, time.Hour)
+		for i := 0; i < 100; i++ {
+			get("/go")
+		}
+		if lines := buf.lines(t); len(lines) != 0 {
+			t.Fatalf("wrote %v before the line changed", lines)
+		}
+
+		get("/docs")
+		get("/go")
+		d.Flush()
+
+		want := [][2]interface{}{{"Redirected User Rule Based", 100}, {"Redirected User Rule Based", 0}, {"Redirected User Rule Based", 0}}
+		if got := buf.lines(t); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("lines = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("written out after the interval", func(t *testing.T) {
+		_, buf := capture(t, 50*time.Millisecond)
+		for i := 0; i < 3; i++ {
+			get("/go")
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for len(buf.lines(t)) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := buf.lines(t); len(got) != 1 || got[0][1] != 3 {
+			t.Errorf("lines = %v, want one line repeated 3 times", got)
+		}
+	})
+
+	t.Run("warnings go out right away, in order", func(t *testing.T) {
+		_, buf := capture(t, time.Hour)
+		get("/go")
+		get("/go")
+		slog.Warn("Something Odd")
+		slog.Warn("Something Odd")
+
+		want := [][2]interface{}{{"Redirected User Rule Based", 2}, {"Something Odd", 0}, {"Something Odd", 0}}
+		if got := buf.lines(t); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("lines = %v, want %v", got, want)
+		}
+	})
+}
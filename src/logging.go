@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// logSampler - Keeps 1 in every rate access log lines, either by counting
+// (exactly every Nth) or at random (each line has a 1/N chance).
+type logSampler struct {
+	rate   uint64
+	random bool
+	count  uint64
+}
+
+// Sample - If this line should be logged
+func (s *logSampler) Sample() bool {
+	if s.rate <= 1 {
+		return true
+	}
+	if s.random {
+		return rand.Int63n(int64(s.rate)) == 0
+	}
+	return (atomic.AddUint64(&s.count, 1)-1)%s.rate == 0
+}
+
+// accessLog - Sampling for the per request Redirect lines, set by `-log-sample`
+var accessLog = &logSampler{}
+
+// logAccess - Log a per request line at the Rule's level, subject to
+// sampling. Errors and warnings go straight to the logger so they're never
+// sampled away.
+func logAccess(r *http.Request, level slog.Level, msg string, args ...interface{}) {
+	ctx := r.Context()
+	logger := loggerFromContext(ctx)
+	if logger.Enabled(ctx, level) && accessLog.Sample() {
+		logger.Log(ctx, level, msg, args...)
+	}
+}
+
+// loggerKey - Context key for the request scoped logger
+type loggerKey struct{}
+
+// withLogger - Carry the logger with the request, so every line logged while
+// handling it has the same fields (request ID, matched Rule)
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext - The request scoped logger, or the default outside of one
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// withLogFields - The request with more fields on its logger
+func withLogFields(r *http.Request, args ...interface{}) *http.Request {
+	return r.WithContext(withLogger(r.Context(), loggerFromContext(r.Context()).With(args...)))
+}
+
+// newRequestID - A random ID to tie a request's log lines together
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := cryptorand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLogging - Give the request a logger with its request ID, taken from
+// a short enough X-Request-Id or made up, and echo the ID back. At debug
+// level every request also gets a line once it has been answered.
+func requestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = withLogFields(r, "requestId", id)
+
+		logger := loggerFromContext(r.Context())
+		if !logger.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		logger.Debug("Served Request", "method", r.Method, "host", r.Host, "path", sanitizeValue(r.URL.Path), "status", sw.status, "took", time.Since(start))
+	})
+}
+
+// parseLogLevel - debug, info, warn or error. Empty is info.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(strings.TrimSpace(name)))
+	return level, err
+}
+
+// fatal - Log the error and exit, like log.Fatal
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// maxLoggedValue - Longest request supplied value put in a log line or label
+const maxLoggedValue = 64
+
+// sanitizeValue - A request supplied value made safe to log: control
+// characters and invalid UTF-8 dropped, cut to maxLoggedValue bytes
+func sanitizeValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(value, ""))
+
+	if len(value) > maxLoggedValue {
+		cut := maxLoggedValue
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		value = value[:cut]
+	}
+	return value
+}
+
+// withLogReason - Label the request's log lines with why the Rule exists,
+// nothing when it has no reason
+func withLogReason(r *http.Request, reason string) *http.Request {
+	if reason == "" {
+		return r
+	}
+	return withLogFields(r, "reason", reason)
+}
+
+// withLogVars - Add the Rule's path variables to the request logger (as a
+// `vars` group) and the metrics, sanitized
+func withLogVars(r *http.Request, rule string) *http.Request {
+	vars := mux.Vars(r)
+	if len(vars) == 0 {
+		return r
+	}
+
+	clean := make(map[string]string, len(vars))
+	attrs := make([]interface{}, 0, len(vars)*2)
+	for name, value := range vars {
+		clean[name] = sanitizeValue(value)
+	}
+	names := make([]string, 0, len(clean))
+	for name := range clean {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, name, clean[name])
+	}
+
+	ruleVars.Inc(rule, clean)
+	return withLogFields(r, slog.Group("vars", attrs...))
+}
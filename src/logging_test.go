@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLogSampling(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/to/{site}", "url": "https://{{.Vars.site}}/", "template": true}
+	]}`)
+	const requests = 1000
+
+	tests := []struct {
+		name     string
+		sampler  *logSampler
+		min, max int
+	}{
+		{"everything", &logSampler{}, requests, requests},
+		{"every 10th", &logSampler{rate: 10}, 100, 100},
+		{"1 in 10 at random", &logSampler{rate: 10, random: true}, 50, 150},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &accessLog, tt.sampler)
+			logs := captureLogs(t)
+			for i := 0; i < requests; i++ {
+				serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+			}
+			// Warnings aren't sampled
+			for i := 0; i < 20; i++ {
+				serve(conf, httptest.NewRequest(http.MethodGet, "/to/evil.example", nil))
+			}
+
+			redirected, warned := 0, 0
+			for _, line := range logs() {
+				switch line["msg"] {
+				case "Redirected User Rule Based":
+					redirected++
+				case "Target for Rule is on a blocked host, serving the default":
+					warned++
+				}
+			}
+			if redirected < tt.min || redirected > tt.max {
+				t.Errorf("logged %d of %d redirects, want %d to %d", redirected, requests, tt.min, tt.max)
+			}
+			if warned != 20 {
+				t.Errorf("logged %d of 20 warnings, want every one", warned)
+			}
+		})
+	}
+}
+
+func TestRuleLogLevel(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/noisy", "url": "https://example.com/noisy", "logLevel": "debug"},
+		{"rule": "/plain", "url": "https://example.com/plain"},
+		{"rule": "/important", "url": "https://example.com/important", "logLevel": "warn"}
+	]}`)
+
+	tests := []struct {
+		global string
+		path   string
+		level  string
+	}{
+		{"info", "/noisy", ""},
+		{"info", "/plain", "INFO"},
+		{"info", "/important", "WARN"},
+		{"debug", "/noisy", "DEBUG"},
+		{"warn", "/plain", ""},
+		{"warn", "/important", "WARN"},
+		{"error", "/important", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.global+" "+tt.path, func(t *testing.T) {
+			level, err := parseLogLevel(tt.global)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// As main sets it up from -log-level
+			buf := &bytes.Buffer{}
+			old := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: level})))
+			t.Cleanup(func() { slog.SetDefault(old) })
+
+			serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			got := ""
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				entry := map[string]interface{}{}
+				if line != "" && json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "Redirected User Rule Based" {
+					got, _ = entry["level"].(string)
+				}
+			}
+			if got != tt.level {
+				t.Errorf("GET %s at -log-level %s logged at %q, want %q", tt.path, tt.global, got, tt.level)
+			}
+		})
+	}
+
+	if _, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "url": "https://example.com", "logLevel": "loud"}]}`)); err == nil || !strings.Contains(err.Error(), "logLevel") {
+		t.Errorf("parseConfig with logLevel loud = %v, want a logLevel error", err)
+	}
+}
+
+func TestRequestScopedLogger(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+	hexID := regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+	tests := []struct {
+		name   string
+		header string
+		path   string
+		msg    string
+		rule   string
+	}{
+		{"sent ID on a rule", "abc123", "/go", "Redirected User Rule Based", "/go"},
+		{"sent ID on the default", "abc123", "/missing", "Redirected User with Default", ""},
+		{"made up ID", "", "/go", "Redirected User Rule Based", "/go"},
+		{"overlong ID is replaced", strings.Repeat("x", 65), "/go", "Redirected User Rule Based", "/go"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Request-Id", tt.header)
+			}
+			id := serve(conf, req).Header().Get("X-Request-Id")
+			if tt.header != "" && len(tt.header) <= 64 {
+				if id != tt.header {
+					t.Errorf("X-Request-Id = %q, want the one sent back", id)
+				}
+			} else if !hexID.MatchString(id) {
+				t.Errorf("X-Request-Id = %q, want a new random ID", id)
+			}
+
+			// Logged deep in the rule's handler and once answered, both carry the ID
+			lines := logs()
+			for _, msg := range []string{tt.msg, "Served Request"} {
+				line := findLog(lines, msg)
+				if line == nil || line["requestId"] != id {
+					t.Errorf("%q log = %v, want requestId %q", msg, line, id)
+				}
+			}
+			if line := findLog(lines, tt.msg); tt.rule != "" && (line == nil || line["rule"] != tt.rule) {
+				t.Errorf("%q log = %v, want rule %q", tt.msg, line, tt.rule)
+			}
+		})
+	}
+
+	if loggerFromContext(context.Background()) != slog.Default() {
+		t.Error("loggerFromContext outside a request isn't the default logger")
+	}
+	logger := slog.Default().With("k", "v")
+	if loggerFromContext(withLogger(context.Background(), logger)) != logger {
+		t.Error("loggerFromContext didn't return the logger from withLogger")
+	}
+}
+
+func TestLogVars(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/u/{user:[a-z]+}/{id:[0-9]+}", "url": "https://example.com/profile"},
+		{"rule": "/tag/{tag}", "url": "https://example.com/tags"},
+		{"rule": "/plain", "url": "https://example.com/plain"}
+	]}`)
+	setGlobal(t, &ruleVars, newVarCounter())
+
+	tests := []struct {
+		name string
+		path string
+		want map[string]interface{}
+	}{
+		{"regex captures", "/u/ana/42", map[string]interface{}{"user": "ana", "id": "42"}},
+		{"control characters dropped", "/tag/go%07lang", map[string]interface{}{"tag": "golang"}},
+		{"long values cut", "/tag/" + strings.Repeat("x", 100), map[string]interface{}{"tag": strings.Repeat("x", maxLoggedValue)}},
+		{"no variables", "/plain", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			line := findLog(logs(), "Redirected User Rule Based")
+			if line == nil {
+				t.Fatalf("GET %s logged no redirect", tt.path)
+			}
+			vars, _ := line["vars"].(map[string]interface{})
+			if tt.want == nil {
+				if line["vars"] != nil {
+					t.Errorf("GET %s logged vars %v, want none", tt.path, line["vars"])
+				}
+				return
+			}
+			if !reflect.DeepEqual(vars, tt.want) {
+				t.Errorf("GET %s logged vars %v, want %v", tt.path, vars, tt.want)
+			}
+		})
+	}
+
+	if got := metricValue(t, `golow_rule_vars_total{rule="/u/{user:[a-z]+}/{id:[0-9]+}",var="user",value="ana"}`); got != 1 {
+		t.Errorf("user=ana counted %v, want 1", got)
+	}
+
+	// Past maxVarValues every new value is "other"
+	for i := 0; i < maxVarValues+10; i++ {
+		serve(conf, httptest.NewRequest(http.MethodGet, "/tag/t"+strconv.Itoa(i), nil))
+	}
+	series := 0
+	for key := range ruleVars.Snapshot() {
+		if key.Rule == "/tag/{tag}" {
+			series++
+		}
+	}
+	if series != maxVarValues+1 {
+		t.Errorf("/tag/{tag} has %d series, want %d values and other", series, maxVarValues)
+	}
+	if got := metricValue(t, `golow_rule_vars_total{rule="/tag/{tag}",var="tag",value="other"}`); got != 12 {
+		t.Errorf("other counted %v, want 12", got)
+	}
+}
+
+func TestRuleReason(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/spring-sale", "gone": true, "reason": "Spring sale ended"},
+		{"rule": "/worded", "gone": true, "reason": "campaign over", "goneMessage": "This offer has ended"},
+		{"rule": "/blog", "url": "https://blog.example.com", "reason": "blog moved to its own host"},
+		{"rule": "/plain", "url": "https://example.com/plain"}
+	]}`)
+	useConfig(t, conf)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+		msg    string
+		reason interface{}
+	}{
+		{"/spring-sale", http.StatusGone, "Spring sale ended\n", "Told User Rule is Gone", "Spring sale ended"},
+		{"/worded", http.StatusGone, "This offer has ended\n", "Told User Rule is Gone", "campaign over"},
+		{"/blog", http.StatusTemporaryRedirect, "", "Redirected User Rule Based", "blog moved to its own host"},
+		{"/plain", http.StatusTemporaryRedirect, "", "Redirected User Rule Based", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || (tt.body != "" && rec.Body.String() != tt.body) {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+			line := findLog(logs(), tt.msg)
+			if line == nil {
+				t.Fatalf("GET %s didn't log %q", tt.path, tt.msg)
+			}
+			if line["reason"] != tt.reason {
+				t.Errorf("GET %s logged reason %v, want %v", tt.path, line["reason"], tt.reason)
+			}
+		})
+	}
+
+	for rule, reason := range map[string]string{"/spring-sale": "Spring sale ended", "/blog": "blog moved to its own host"} {
+		if got := metricValue(t, `golow_rule_reason{rule="`+rule+`",reason="`+reason+`"}`); got != 1 {
+			t.Errorf("golow_rule_reason for %s = %v, want 1", rule, got)
+		}
+	}
+	if got := metricValue(t, `golow_rule_reason{rule="/plain",reason=""}`); got != -1 {
+		t.Errorf("a rule without a reason has a golow_rule_reason series")
+	}
+}
+
+func TestCorrelationParam(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/promo", "url": "https://shop.example.com/landing?src=mail", "options": {"correlationParam": "cid", "preserveQuery": true}},
+		{"rule": "/plain", "url": "https://example.com/plain"}
+	]}`)
+
+	tests := []struct {
+		path  string
+		param string
+		query url.Values
+	}{
+		{"/promo", "cid", url.Values{"src": {"mail"}}},
+		{"/promo?utm=x", "cid", url.Values{"src": {"mail"}, "utm": {"x"}}},
+		{"/plain", "", url.Values{}},
+	}
+
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		for i := 0; i < 3; i++ {
+			logs := captureLogs(t)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			target, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := target.Query()
+			token := query.Get("cid")
+			query.Del("cid")
+			if !reflect.DeepEqual(query, tt.query) {
+				t.Errorf("GET %s went to %s, want the query %v kept", tt.path, target, tt.query)
+			}
+
+			lines := logs()
+			logged := findLog(lines, "Redirected User Rule Based")
+			if logged == nil {
+				t.Fatalf("GET %s wasn't logged", tt.path)
+			}
+			if tt.param == "" {
+				if token != "" || logged["correlation"] != nil {
+					t.Errorf("GET %s got a token %q, logged %v", tt.path, token, logged["correlation"])
+				}
+				continue
+			}
+			if len(token) != 16 || seen[token] {
+				t.Errorf("GET %s token %q, want a fresh one every time", tt.path, token)
+			}
+			seen[token] = true
+			// The same token on every line the Rule logged, the access line is
+			// written outside it and carries none of the Rule's fields
+			if logged["requestId"] != rec.Header().Get("X-Request-Id") {
+				t.Errorf("GET %s logged requestId %v, sent %s", tt.path, logged["requestId"], rec.Header().Get("X-Request-Id"))
+			}
+			for _, line := range lines {
+				if line["msg"] != "Served Request" && line["correlation"] != token {
+					t.Errorf("GET %s logged %q with correlation %v, want %s", tt.path, line["msg"], line["correlation"], token)
+				}
+			}
+		}
+	}
+
+	data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "url": "https://example.com", "options": {"correlationParam": "c&d"}}]}`
+	if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "plain query parameter name") {
+		t.Errorf("parseConfig with correlationParam c&d = %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathVar - A mux path variable, `{sku}` or `{sku:[0-9]+}`
+var pathVar = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// pathVarNames - The variables in a Rule's path, in order
+func pathVarNames(path string) []string {
+	names := []string{}
+	for _, match := range pathVar.FindAllStringSubmatch(path, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// loadLookupTable - Read a lookup Rule's lookupFile, a relative one from
+// dir. Part of loading the Config, so a reload picks up a changed table too.
+func loadLookupTable(dir string, rule *URLRule) error {
+	if rule.Type != ruleTypeLookup || rule.LookupFile == "" {
+		return nil
+	}
+	path := rule.LookupFile
+	if dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	table, err := readLookupTable(path)
+	if err != nil {
+		return fmt.Errorf("rule %s: lookupFile: %v", rule.Path, err)
+	}
+	rule.lookup = table
+	return nil
+}
+
+// readLookupTable - A key to URL table, either a JSON object or (any other
+// extension) CSV rows of `key,url` where lines starting with # are comments
+func readLookupTable(path string) (map[string]string, error) {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		table := map[string]string{}
+		if err := json.Unmarshal(data, &table); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return table, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+
+	table := map[string]string{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if _, ok := table[record[0]]; ok {
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("%s: line %d: duplicate key %q", path, line, record[0])
+		}
+		table[record[0]] = record[1]
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tables := []struct {
+		file, data string
+	}{
+		{"skus.csv", "# sku,url\nA100,https://shop.example.com/widget\nB200, https://shop.example.com/gadget\n"},
+		{"skus.json", `{"A100": "https://shop.example.com/widget", "B200": "https://shop.example.com/gadget"}`},
+	}
+
+	for _, table := range tables {
+		for _, ttl := range []string{"", "1m"} {
+			t.Run(table.file+" cacheTTL "+ttl, func(t *testing.T) {
+				// Read through the file Source, the table sits next to the Config
+				// and not in the working directory
+				dir := t.TempDir()
+				writeFile(t, filepath.Join(dir, table.file), table.data)
+				path := filepath.Join(dir, "golow.json")
+				writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+					{"type": "lookup", "rule": "/p/{sku}", "lookupFile": "`+table.file+`", "cacheTTL": "`+ttl+`"}
+				]}`)
+				conf, err := fileSource{path: path}.Load()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// One handler throughout, so a target cached under the wrong key would be seen
+				handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+				tests := []struct {
+					path     string
+					location string
+				}{
+					{"/p/A100", "https://shop.example.com/widget"},
+					{"/p/B200", "https://shop.example.com/gadget"},
+					{"/p/A100", "https://shop.example.com/widget"},
+					{"/p/Z999", "https://example.com"},
+					{"/p/B200", "https://shop.example.com/gadget"},
+				}
+				for _, tt := range tests {
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+					if got := rec.Header().Get("Location"); got != tt.location {
+						t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+					}
+				}
+			})
+		}
+	}
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "skus.csv"), "A100,https://shop.example.com/widget\n")
+	writeFile(t, filepath.Join(dir, "dupes.csv"), "A100,https://a.example.com\nA100,https://b.example.com\n")
+	writeFile(t, filepath.Join(dir, "short.csv"), "A100\n")
+	errs := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{"no lookupFile", `{"type": "lookup", "rule": "/p/{sku}"}`, "a lookup rule needs a lookupFile"},
+		{"no variable", `{"type": "lookup", "rule": "/p", "lookupFile": "skus.csv"}`, "one variable in its path"},
+		{"two variables", `{"type": "lookup", "rule": "/p/{cat}/{sku}", "lookupFile": "skus.csv"}`, "one variable in its path"},
+		{"missing file", `{"type": "lookup", "rule": "/p/{sku}", "lookupFile": "missing.csv"}`, "lookupFile"},
+		{"duplicate key", `{"type": "lookup", "rule": "/p/{sku}", "lookupFile": "dupes.csv"}`, `line 2: duplicate key "A100"`},
+		{"short row", `{"type": "lookup", "rule": "/p/{sku}", "lookupFile": "short.csv"}`, "wrong number of fields"},
+	}
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "golow.json")
+			writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+tt.rule+`]}`)
+			if _, err := (fileSource{path: path}).Load(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupReload(t *testing.T) {
+	useConfig(t, Config{})
+	dir := t.TempDir()
+	table := filepath.Join(dir, "skus.csv")
+	path := filepath.Join(dir, "golow.json")
+	writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"type": "lookup", "rule": "/p/{sku}", "lookupFile": "skus.csv", "cacheTTL": "1m"}
+	]}`)
+	setGlobal[ConfigSource](t, &configSource, fileSource{path: path})
+	t.Cleanup(func() { recordReload(nil) })
+
+	public := func(path string) string {
+		rec := httptest.NewRecorder()
+		publicHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Header().Get("Location")
+	}
+
+	steps := []struct {
+		table string
+		want  map[string]string
+	}{
+		{"A100,https://shop.example.com/widget\n", map[string]string{
+			"/p/A100": "https://shop.example.com/widget",
+			"/p/B200": "https://example.com",
+		}},
+		{"A100,https://shop.example.com/widget-v2\nB200,https://shop.example.com/gadget\n", map[string]string{
+			"/p/A100": "https://shop.example.com/widget-v2",
+			"/p/B200": "https://shop.example.com/gadget",
+		}},
+	}
+	for i, step := range steps {
+		// Only the table changes, the Config file is the same every time
+		writeFile(t, table, step.table)
+		if _, err := reloadConfig(); err != nil {
+			t.Fatalf("reload %d: %v", i, err)
+		}
+		for path, want := range step.want {
+			if got := public(path); got != want {
+				t.Errorf("after reload %d, GET %s = %q, want %q", i, path, got, want)
+			}
+		}
+	}
+}
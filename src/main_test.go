@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestMain - Keep the server's own logging out of the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// setGlobal - Set one of the flag variables (or any package level state) for
+// the length of the test, putting the old value back afterwards
+func setGlobal[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// mustConfig - Decode a JSON Config the way the binary loads one
+func mustConfig(t *testing.T, data string) Config {
+	t.Helper()
+	conf, err := parseConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	return conf
+}
+
+// serve - Run the request through the router and middleware, as served
+func serve(conf Config, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	chain(buildRouter(conf), buildMiddleware(conf)).ServeHTTP(rec, r)
+	return rec
+}
+
+// useConfig - Make conf the active Config, as the admin pages see it, for the
+// length of the test
+func useConfig(t *testing.T, conf Config) {
+	t.Helper()
+	old, _ := activeConfig()
+	setActiveConfig(conf)
+	t.Cleanup(func() { setActiveConfig(old) })
+}
+
+// captureLogs - Send everything logged (debug and up) to a buffer for the
+// length of the test, the lines come back decoded by the returned func
+func captureLogs(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	return func() []map[string]interface{} {
+		lines := []map[string]interface{}{}
+		scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+		for scanner.Scan() {
+			line := map[string]interface{}{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("log line %q: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+}
+
+// findLog - The first captured line with the message, nil if there isn't one
+func findLog(lines []map[string]interface{}, msg string) map[string]interface{} {
+	for _, line := range lines {
+		if line["msg"] == msg {
+			return line
+		}
+	}
+	return nil
+}
+
+// writeFile - Write a file the test needs, failing the test if it can't
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
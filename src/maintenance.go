@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// maintenance - Set while every public request goes to the maintenance page
+var maintenance atomic.Bool
+
+// maintenanceState - Body of GET and POST /maintenance
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// loadMaintenance - Pick maintenance back up from `-maintenance-file`, the
+// file being there means it is on
+func loadMaintenance(file string) {
+	if _, err := os.Stat(file); err == nil {
+		maintenance.Store(true)
+		slog.Warn("Maintenance Mode is on, left on by the last run", "file", file)
+	}
+}
+
+// setMaintenance - Turn maintenance on or off, keeping `-maintenance-file` in
+// step when there is one
+func setMaintenance(on bool) error {
+	if maintenanceFile != "" {
+		if on {
+			if err := ioutil.WriteFile(maintenanceFile, nil, 0644); err != nil {
+				return err
+			}
+		} else if err := os.Remove(maintenanceFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	maintenance.Store(on)
+	return nil
+}
+
+// maintenanceHandler - GET says whether maintenance is on, POST with
+// `{"enabled": true}` (or false) switches it
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		state := maintenanceState{}
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "expected {\"enabled\": true|false}")
+			return
+		}
+		if err := setMaintenance(state.Enabled); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "unable to save maintenance: "+err.Error())
+			return
+		}
+		slog.Warn("Maintenance Mode switched", "enabled", state.Enabled)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(maintenanceState{Enabled: maintenance.Load()}); err != nil {
+		slog.Error("Failed to Encode Maintenance State", "err", err)
+	}
+}
+
+// maintenanceMode - While maintenance is on every request, whatever the
+// Rules say, goes to the Config `maintenanceURL` or gets a plain 503
+func maintenanceMode(target string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !maintenance.Load() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if target == "" {
+				logAccess(r, slog.LevelInfo, "Turned User Away for Maintenance", "status", http.StatusServiceUnavailable)
+				http.Error(w, "Service Unavailable: down for maintenance, please try again soon", http.StatusServiceUnavailable)
+				return
+			}
+			logAccess(r, slog.LevelInfo, "Redirected User for Maintenance", "target", target, "status", http.StatusTemporaryRedirect)
+			redirect(w, r, target, http.StatusTemporaryRedirect)
+		})
+	}
+}
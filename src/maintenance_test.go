@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	t.Cleanup(func() { maintenance.Store(false) })
+
+	switchTo := func(t *testing.T, state string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(`{"enabled": `+state+`}`))
+		req.SetBasicAuth("admin", "secret")
+		if rec := adminServe(req); rec.Code != http.StatusOK || rec.Body.String() != `{"enabled":`+state+"}\n" {
+			t.Fatalf("POST /maintenance %s = %d %s", state, rec.Code, rec.Body)
+		}
+	}
+
+	rules := `"redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs*", "url": "https://docs.example.com"},
+		{"type": "proxy", "rule": "/api", "url": "http://127.0.0.1:1"}
+	]}`
+	tests := []struct {
+		name     string
+		conf     Config
+		status   int
+		location string
+	}{
+		{"maintenance page", mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "maintenanceURL": "https://status.example.com", `+rules), http.StatusTemporaryRedirect, "https://status.example.com"},
+		{"plain 503", mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", `+rules), http.StatusServiceUnavailable, ""},
+	}
+
+	normal := map[string]string{"/go": "https://golang.org", "/docs/x": "https://docs.example.com", "/missing": "https://example.com"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switchTo(t, "true")
+			for _, path := range []string{"/go", "/docs/x", "/api", "/missing", "/"} {
+				rec := serve(tt.conf, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+					t.Errorf("GET %s in maintenance = %d %q, want %d %q", path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+				}
+			}
+
+			switchTo(t, "false")
+			for path, want := range normal {
+				if got := serve(tt.conf, httptest.NewRequest(http.MethodGet, path, nil)).Header().Get("Location"); got != want {
+					t.Errorf("GET %s after maintenance = %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("kept in -maintenance-file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "maintenance")
+		setGlobal(t, &maintenanceFile, file)
+
+		switchTo(t, "true")
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("switching on didn't write %s: %v", file, err)
+		}
+
+		// A restart picks it back up
+		maintenance.Store(false)
+		loadMaintenance(file)
+		if !maintenance.Load() {
+			t.Error("loadMaintenance with the file there left maintenance off")
+		}
+
+		switchTo(t, "false")
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("switching off left %s behind: %v", file, err)
+		}
+		loadMaintenance(file)
+		if maintenance.Load() {
+			t.Error("loadMaintenance without the file switched maintenance on")
+		}
+	})
+}
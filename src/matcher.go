@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Matcher - Custom routing for Rules that can't live in the static Config,
+// e.g. looked up from a database. Match returns the Rule to serve along with
+// any path variables, or false to pass on the request.
+type Matcher interface {
+	Match(r *http.Request) (*URLRule, map[string]string, bool)
+}
+
+// matchers - Registered custom Matchers, checked in order after the Config
+var matchers struct {
+	sync.RWMutex
+	list []Matcher
+}
+
+// RegisterMatcher - Add a custom Matcher, consulted for any request none of
+// the Config's Rules match, before falling back to the default.
+func RegisterMatcher(m Matcher) {
+	matchers.Lock()
+	defer matchers.Unlock()
+	matchers.list = append(matchers.list, m)
+}
+
+// matchedRuleLimit - Most Matcher Rules matcherHandler keeps built, a
+// Matcher handing out endless one-off Rules has the table start over
+const matchedRuleLimit = 10000
+
+// matchedRule - A Matcher's Rule, validated and built the first time it is seen
+type matchedRule struct {
+	rule    URLRule
+	handler http.Handler
+	err     error
+}
+
+// matcherHandler - Serve the first custom Matcher's Rule, or the default.
+// Each distinct Rule is validated (as it would be in the Config) and built
+// once, so its round robin, cache and limiter carry over between requests.
+func matcherHandler(conf Config, defaultHandler http.Handler) http.Handler {
+	var mu sync.Mutex
+	built := map[string]*matchedRule{}
+
+	handlerFor := func(rule URLRule) (http.Handler, error) {
+		key := ruleKey(rule)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if m, ok := built[key]; ok && reflect.DeepEqual(m.rule, rule) {
+			return m.handler, m.err
+		}
+
+		check := conf
+		check.RedirectRules = []URLRule{rule}
+		m := &matchedRule{rule: rule, err: validateConfig(check)}
+		if m.err == nil {
+			m.handler = ruleHandler(conf, rule, defaultHandler)
+		}
+
+		if len(built) >= matchedRuleLimit {
+			built = map[string]*matchedRule{}
+		}
+		built[key] = m
+		return m.handler, m.err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matchers.RLock()
+		list := matchers.list
+		matchers.RUnlock()
+
+		for _, m := range list {
+			rule, vars, ok := m.Match(r)
+			if !ok || rule == nil {
+				continue
+			}
+
+			handler, err := handlerFor(*rule)
+			if err != nil {
+				loggerFromContext(r.Context()).Warn("Matcher Rule is Invalid, serving the default", "rule", rule.ID(), "err", err)
+				break
+			}
+			if vars != nil {
+				r = mux.SetURLVars(r, vars)
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		defaultHandler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tableMatcher - Rules looked up by path, like one backed by a database
+type tableMatcher struct {
+	rules map[string]URLRule
+}
+
+func (m *tableMatcher) Match(r *http.Request) (*URLRule, map[string]string, bool) {
+	if strings.HasPrefix(r.URL.Path, "/db/") {
+		rule := m.rules["/db/*"]
+		return &rule, map[string]string{"code": strings.TrimPrefix(r.URL.Path, "/db/")}, true
+	}
+	rule, ok := m.rules[r.URL.Path]
+	if !ok {
+		return nil, nil, false
+	}
+	return &rule, nil, true
+}
+
+func TestMatcher(t *testing.T) {
+	matcher := &tableMatcher{rules: map[string]URLRule{
+		"/dynamic": {Path: "/dynamic", URL: "https://example.com/from-the-database"},
+		"/rotate":  {Path: "/rotate", Targets: []string{"https://a.example.com", "https://b.example.com"}},
+		"/broken":  {Path: "/broken", URL: "https://example.com/broken", Port: 70000},
+		"/static":  {Path: "/static", URL: "https://example.com/from-the-matcher"},
+		"/db/*":    {Path: "/db/*", URL: `https://example.com/codes/{{.Vars.code}}`, Template: true},
+	}}
+	setGlobal(t, &matchers.list, []Matcher{matcher})
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/static", "url": "https://example.com/from-the-config"}
+	]}`)
+	handler := chain(buildRouter(conf), buildMiddleware(conf))
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Header().Get("Location")
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		location string
+	}{
+		{"resolves a path the config doesn't have", "/dynamic", "https://example.com/from-the-database"},
+		{"the config wins", "/static", "https://example.com/from-the-config"},
+		{"vars reach the rule", "/db/abc", "https://example.com/codes/abc"},
+		{"an invalid rule gets the default", "/broken", "https://example.com"},
+		{"nothing matched gets the default", "/nowhere", "https://example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(tt.path); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+
+	t.Run("the rule is built once", func(t *testing.T) {
+		// A fresh handler each request would start the round robin over
+		seen := []string{get("/rotate"), get("/rotate"), get("/rotate")}
+		want := []string{"https://a.example.com", "https://b.example.com", "https://a.example.com"}
+		if strings.Join(seen, " ") != strings.Join(want, " ") {
+			t.Errorf("round robin went %v, want %v", seen, want)
+		}
+	})
+
+	t.Run("a changed rule is built again", func(t *testing.T) {
+		matcher.rules["/dynamic"] = URLRule{Path: "/dynamic", URL: "https://example.com/updated"}
+		if got := get("/dynamic"); got != "https://example.com/updated" {
+			t.Errorf("GET /dynamic = %q after the rule changed", got)
+		}
+	})
+}
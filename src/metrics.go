@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redirectKey - Labels for one Redirect counter series
+type redirectKey struct {
+	Rule   string
+	Status int
+}
+
+// redirectCounter - Concurrency safe Redirect counts by Rule and status code
+type redirectCounter struct {
+	mu     sync.RWMutex
+	counts map[redirectKey]*uint64
+	rules  map[string]bool
+}
+
+func newRedirectCounter() *redirectCounter {
+	return &redirectCounter{counts: map[redirectKey]*uint64{}, rules: map[string]bool{}}
+}
+
+// otherRule - The rule label once `-max-metric-rules` Rules have their own
+const otherRule = "other"
+
+// Inc - Count one Redirect for the Rule with the status code sent, returns
+// the rule label it was counted under
+func (c *redirectCounter) Inc(rule string, status int) string {
+	key := redirectKey{Rule: rule, Status: status}
+
+	c.mu.RLock()
+	count, ok := c.counts[key]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+		// Rules come and go over reloads, past the cap the rest share a label
+		if !c.rules[rule] {
+			if maxMetricRules > 0 && len(c.rules) >= maxMetricRules {
+				key.Rule = otherRule
+			} else {
+				c.rules[rule] = true
+			}
+		}
+		if count, ok = c.counts[key]; !ok {
+			count = new(uint64)
+			c.counts[key] = count
+		}
+		c.mu.Unlock()
+	}
+
+	atomic.AddUint64(count, 1)
+	return key.Rule
+}
+
+// Snapshot - Copy of every series
+func (c *redirectCounter) Snapshot() map[redirectKey]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	snapshot := make(map[redirectKey]uint64, len(c.counts))
+	for key, count := range c.counts {
+		snapshot[key] = atomic.LoadUint64(count)
+	}
+	return snapshot
+}
+
+// redirects - Redirect counts labelled with the status, the default is rule ""
+var redirects = newRedirectCounter()
+
+// countRedirect - Record a Redirect in both the hit counts and the metrics
+func countRedirect(rule string, status int) {
+	hits.Inc(rule)
+	statsd.CountRedirect(redirects.Inc(rule, status), status)
+}
+
+// varKey - Labels for one path variable counter series
+type varKey struct {
+	Rule  string
+	Var   string
+	Value string
+}
+
+// maxVarValues - Distinct values counted per Rule and variable, past this
+// they're all counted as "other" so a scanner can't blow up the series
+const maxVarValues = 50
+
+// varCounter - Counts of the values a Rule's path variables matched
+type varCounter struct {
+	mu     sync.Mutex
+	counts map[varKey]uint64
+	values map[[2]string]int
+}
+
+func newVarCounter() *varCounter {
+	return &varCounter{counts: map[varKey]uint64{}, values: map[[2]string]int{}}
+}
+
+// Inc - Count the (sanitized) values the Rule's variables matched
+func (c *varCounter) Inc(rule string, vars map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, value := range vars {
+		key := varKey{Rule: rule, Var: name, Value: value}
+		if _, ok := c.counts[key]; !ok {
+			seen := [2]string{rule, name}
+			if c.values[seen] >= maxVarValues {
+				key.Value = "other"
+			} else {
+				c.values[seen]++
+			}
+		}
+		c.counts[key]++
+	}
+}
+
+// Snapshot - Copy of every series
+func (c *varCounter) Snapshot() map[varKey]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[varKey]uint64, len(c.counts))
+	for key, count := range c.counts {
+		snapshot[key] = count
+	}
+	return snapshot
+}
+
+// ruleVars - What the path variables of Rules like `/u/{user}` matched
+var ruleVars = newVarCounter()
+
+// metricLabel - Escape a Prometheus label value
+var metricLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler - Prometheus text exposition of the Redirect counters
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := redirects.Snapshot()
+
+	keys := make([]redirectKey, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rule != keys[j].Rule {
+			return keys[i].Rule < keys[j].Rule
+		}
+		return keys[i].Status < keys[j].Status
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP golow_redirects_total Redirects served, by rule (past -max-metric-rules they are other) and status code.")
+	fmt.Fprintln(w, "# TYPE golow_redirects_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "golow_redirects_total{rule=\"%s\",status=\"%d\"} %d\n", metricLabel.Replace(key.Rule), key.Status, snapshot[key])
+	}
+
+	responses.Lock()
+	codes := make([]int, 0, len(responses.counts))
+	for code := range responses.counts {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintln(w, "# HELP golow_responses_total Public responses, by status code.")
+	fmt.Fprintln(w, "# TYPE golow_responses_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "golow_responses_total{code=\"%d\"} %d\n", code, responses.counts[code])
+	}
+	fmt.Fprintln(w, "# HELP golow_request_duration_seconds How long public requests took to serve.")
+	fmt.Fprintln(w, "# TYPE golow_request_duration_seconds summary")
+	fmt.Fprintf(w, "golow_request_duration_seconds_sum %g\n", responses.seconds)
+	fmt.Fprintf(w, "golow_request_duration_seconds_count %d\n", responses.total)
+	responses.Unlock()
+
+	vars := ruleVars.Snapshot()
+	varKeys := make([]varKey, 0, len(vars))
+	for key := range vars {
+		varKeys = append(varKeys, key)
+	}
+	sort.Slice(varKeys, func(i, j int) bool {
+		a, b := varKeys[i], varKeys[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Var != b.Var {
+			return a.Var < b.Var
+		}
+		return a.Value < b.Value
+	})
+
+	fmt.Fprintln(w, "# HELP golow_rule_vars_total Path variable values matched, by rule (at most 50 values each, the rest are other).")
+	fmt.Fprintln(w, "# TYPE golow_rule_vars_total counter")
+	for _, key := range varKeys {
+		fmt.Fprintf(w, "golow_rule_vars_total{rule=\"%s\",var=\"%s\",value=\"%s\"} %d\n",
+			metricLabel.Replace(key.Rule), metricLabel.Replace(key.Var), metricLabel.Replace(key.Value), vars[key])
+	}
+
+	// An info series to join on, a reason per request would only multiply the series
+	conf, _ := activeConfig()
+	fmt.Fprintln(w, "# HELP golow_rule_reason Why a rule exists, always 1, join on rule.")
+	fmt.Fprintln(w, "# TYPE golow_rule_reason gauge")
+	for _, rule := range activeRules(conf) {
+		if rule.Reason != "" {
+			fmt.Fprintf(w, "golow_rule_reason{rule=\"%s\",reason=\"%s\"} 1\n", metricLabel.Replace(rule.ID()), metricLabel.Replace(rule.Reason))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP golow_requests_in_flight Public requests being served right now.")
+	fmt.Fprintln(w, "# TYPE golow_requests_in_flight gauge")
+	fmt.Fprintf(w, "golow_requests_in_flight %d\n", atomic.LoadInt64(&inFlight))
+}
+
+// responses - Public responses by status code, and how long they all took
+var responses = struct {
+	sync.Mutex
+	counts  map[int]uint64
+	seconds float64
+	total   uint64
+}{counts: map[int]uint64{}}
+
+// requestMetrics - Count every public response by its status code and time
+// it, whatever answered it (a Rule, the default or other Middleware)
+func requestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		took := time.Since(start)
+
+		responses.Lock()
+		defer responses.Unlock()
+		responses.counts[sw.status]++
+		responses.seconds += took.Seconds()
+		responses.total++
+	})
+}
+
+// inFlight - Public requests currently being served
+var inFlight int64
+
+// inFlightTracking - Count the request as in flight until its handler
+// returns, deferred so a panic still counts it back out
+func inFlightTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// metricValue - The value of one line from /metrics, -1 when it is missing
+func metricValue(t *testing.T, line string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(line) + ` (\S+)$`).FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		return -1
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRequestMetrics(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+	setGlobal(t, &adminAddr, ":8081")
+	setGlobal(t, &pathDecodeMode, pathDecodeStrict)
+
+	redirected := metricValue(t, `golow_responses_total{code="307"}`)
+	refused := metricValue(t, `golow_responses_total{code="400"}`)
+	count := metricValue(t, "golow_request_duration_seconds_count")
+
+	serve(conf, httptest.NewRequest(http.MethodGet, "/one", nil))
+	serve(conf, httptest.NewRequest(http.MethodGet, "/two", nil))
+	serve(conf, httptest.NewRequest(http.MethodGet, "/g%256F", nil))
+
+	// Missing lines start from -1, counted from 0
+	if got := metricValue(t, `golow_responses_total{code="307"}`) - max(redirected, 0); got != 2 {
+		t.Errorf("307s counted %v, want 2", got)
+	}
+	if got := metricValue(t, `golow_responses_total{code="400"}`) - max(refused, 0); got != 1 {
+		t.Errorf("400s counted %v, want 1 even though no Rule answered it", got)
+	}
+	if got := metricValue(t, "golow_request_duration_seconds_count") - count; got != 3 {
+		t.Errorf("timed %v requests, want 3", got)
+	}
+}
+
+func TestRedirectStatusLabels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/perm", "url": "https://example.com/perm", "options": {"statusCode": 301}},
+		{"rule": "/temp", "url": "https://example.com/temp"},
+		{"type": "proxy", "rule": "/proxied", "url": "`+upstream.URL+`"}
+	]}`)
+	setGlobal(t, &redirects, newRedirectCounter())
+	setGlobal(t, &hits, newHitCounter())
+
+	tests := []struct {
+		path   string
+		msg    string
+		status int
+	}{
+		{"/perm", "Redirected User Rule Based", http.StatusMovedPermanently},
+		{"/temp", "Redirected User Rule Based", http.StatusTemporaryRedirect},
+		{"/proxied", "Proxied User Rule Based", http.StatusAccepted},
+		{"/missing", "Redirected User with Default", http.StatusTemporaryRedirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			logs := captureLogs(t)
+			if rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)); rec.Code != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, rec.Code, tt.status)
+			}
+
+			line := findLog(logs(), tt.msg)
+			if line == nil || line["status"] != float64(tt.status) {
+				t.Errorf("log line %v, want %q with status %d", line, tt.msg, tt.status)
+			}
+
+			rule := tt.path
+			if tt.path == "/missing" {
+				rule = ""
+			}
+			if got := redirects.Snapshot()[redirectKey{Rule: rule, Status: tt.status}]; got != 1 {
+				t.Errorf("counted %d under status %d, want 1", got, tt.status)
+			}
+			if got := metricValue(t, `golow_redirects_total{rule="`+rule+`",status="`+strconv.Itoa(tt.status)+`"}`); got != 1 {
+				t.Errorf("/metrics has %v for the rule and status, want 1", got)
+			}
+		})
+	}
+
+	if got := hits.Get("/proxied"); got != 1 {
+		t.Errorf("proxied hits = %d, want 1", got)
+	}
+}
+
+func TestInFlightGauge(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+	setGlobal(t, &adminAddr, ":8081")
+	base := metricValue(t, "golow_requests_in_flight")
+
+	const slow = 3
+	arrived, release := make(chan struct{}, slow), make(chan struct{})
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		arrived <- struct{}{}
+		<-release
+	}), buildMiddleware(conf))
+
+	var wg sync.WaitGroup
+	for i := 0; i < slow; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+	}
+	for i := 0; i < slow; i++ {
+		<-arrived
+	}
+
+	// Scraped mid-flight
+	if got := metricValue(t, "golow_requests_in_flight") - base; got != slow {
+		t.Errorf("in flight = %v with %d slow requests, want %d", got, slow, slow)
+	}
+
+	// A panic is counted back out on its way to the 500
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("GET /panic = %d, want 500", rec.Code)
+	}
+	if got := metricValue(t, "golow_requests_in_flight") - base; got != slow {
+		t.Errorf("in flight = %v after a panic, want it back to %d", got, slow)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := metricValue(t, "golow_requests_in_flight") - base; got != 0 {
+		t.Errorf("in flight = %v once every request finished, want 0", got)
+	}
+}
+
+func TestMetricCardinality(t *testing.T) {
+	// series - The golow_ lines in /metrics for the metric, by their labels
+	series := func(metric string) []string {
+		rec := httptest.NewRecorder()
+		metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return regexp.MustCompile(`(?m)^`+metric+`(\{.*\}) \S+$`).FindAllString(rec.Body.String(), -1)
+	}
+
+	t.Run("labelled by rule, not path", func(t *testing.T) {
+		setGlobal(t, &redirects, newRedirectCounter())
+		setGlobal(t, &ruleVars, newVarCounter())
+		setGlobal(t, &maxAppendSegments, 32)
+		setGlobal(t, &maxAppendLength, 2048)
+		conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+			{"rule": "/docs*", "url": "https://docs.example.com", "options": {"appendPath": true}},
+			{"rule": "/u/{user}", "url": "https://example.com/people"}
+		]}`)
+
+		for i := 0; i < 500; i++ {
+			serve(conf, httptest.NewRequest(http.MethodGet, "/docs/page-"+strconv.Itoa(i), nil))
+			serve(conf, httptest.NewRequest(http.MethodGet, "/u/user-"+strconv.Itoa(i), nil))
+		}
+
+		if got := series("golow_redirects_total"); len(got) != 2 {
+			t.Errorf("1000 distinct paths made %d redirect series, want one per rule: %v", len(got), got)
+		}
+		if got := metricValue(t, `golow_redirects_total{rule="/docs*",status="307"}`); got != 500 {
+			t.Errorf("/docs* counted %v, want 500", got)
+		}
+		// Path variable values are capped per rule, the rest are other
+		if got := series("golow_rule_vars_total"); len(got) != maxVarValues+1 {
+			t.Errorf("500 distinct users made %d var series, want %d", len(got), maxVarValues+1)
+		}
+		if got := metricValue(t, `golow_rule_vars_total{rule="/u/{user}",var="user",value="other"}`); got != 500-maxVarValues {
+			t.Errorf("other users counted %v, want %d", got, 500-maxVarValues)
+		}
+	})
+
+	t.Run("-max-metric-rules", func(t *testing.T) {
+		setGlobal(t, &redirects, newRedirectCounter())
+		setGlobal(t, &maxMetricRules, 3)
+		for i := 0; i < 10; i++ {
+			redirects.Inc("/rule-"+strconv.Itoa(i), http.StatusTemporaryRedirect)
+		}
+		// Ones already labelled keep their label
+		if label := redirects.Inc("/rule-0", http.StatusMovedPermanently); label != "/rule-0" {
+			t.Errorf("a labelled rule was counted as %q", label)
+		}
+
+		if got := series("golow_redirects_total"); len(got) != 5 {
+			t.Errorf("10 rules over a cap of 3 made %d series, want 3 rules, their 301 and other: %v", len(got), got)
+		}
+		if got := metricValue(t, `golow_redirects_total{rule="other",status="307"}`); got != 7 {
+			t.Errorf("other counted %v, want 7", got)
+		}
+		if got := metricValue(t, `golow_redirects_total{rule="/rule-9",status="307"}`); got != -1 {
+			t.Error("a rule over the cap has its own series")
+		}
+	})
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Middleware - Wraps a Handler to add behavior before and/or after it runs
+type Middleware func(http.Handler) http.Handler
+
+// buildMiddleware - The ordered list of enabled Middleware, outermost first.
+// Anything turned off is left out entirely rather than becoming a no-op.
+func buildMiddleware(conf Config) []Middleware {
+	middleware := []Middleware{}
+
+	// Logging, then metrics so they see every answer including the
+	// refusals, then the client checks, then tracing
+	middleware = append(middleware, requestLogging)
+	middleware = append(middleware, inFlightTracking)
+	if adminAddr != "" {
+		middleware = append(middleware, requestMetrics)
+	}
+	if statsd != nil {
+		middleware = append(middleware, statsdTiming)
+	}
+	if clientRPS > 0 {
+		middleware = append(middleware, clientRateLimit(clientRPS, clientBurst))
+	}
+	if len(allowedClients) > 0 || len(blockedClients) > 0 {
+		middleware = append(middleware, ipFiltering(allowedClients, blockedClients))
+	}
+	if enableTracing {
+		middleware = append(middleware, tracing)
+	}
+	middleware = append(middleware, recovery)
+	middleware = append(middleware, asteriskForm)
+	if requestTimeout > 0 {
+		middleware = append(middleware, requestDeadline(requestTimeout))
+	}
+	if compressHTMLSize > 0 {
+		middleware = append(middleware, compressHTML(compressHTMLSize))
+	}
+	middleware = append(middleware, securityHeaders(conf.SecurityHeaders))
+	middleware = append(middleware, maintenanceMode(conf.MaintenanceURL))
+	middleware = append(middleware, fragmentSplitting)
+	middleware = append(middleware, emptyQueryDropping)
+	middleware = append(middleware, hostNormalization(normalizeHost(conf.DefaultHost)))
+	middleware = append(middleware, pathDecoding(pathDecodeMode))
+	if malformedPaths != malformedPathsAllow {
+		middleware = append(middleware, malformedPathChecking(malformedPaths))
+	}
+	if cleanPaths {
+		middleware = append(middleware, pathCleaning(keepTrailingSlash))
+	}
+
+	return middleware
+}
+
+// chain - Wrap the Handler so the first Middleware in the list runs first
+func chain(h http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Modes accepted by `-path-decoding`
+const (
+	pathDecodeOnce   = "decode"
+	pathDecodeStrict = "strict"
+	pathDecodeRaw    = "raw"
+)
+
+// escapeSequence - Matches a valid percent-encoded byte such as `%6F`
+var escapeSequence = regexp.MustCompile(`%[0-9A-Fa-f]{2}`)
+
+// pathDecoding - Decide which form of the request path rules are matched
+// against. `decode` matches the path decoded exactly once (so `/g%6F` hits
+// `/go`), `strict` does the same but refuses paths that still hold escapes
+// after decoding (`/g%256F`) since that is almost always a double-encoding
+// trick, and `raw` matches the path exactly as the client sent it.
+func pathDecoding(mode string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			escaped := r.URL.EscapedPath()
+
+			if mode == pathDecodeRaw {
+				r.URL.Path = escaped
+				r.URL.RawPath = ""
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			decoded, err := url.PathUnescape(escaped)
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+
+			if mode == pathDecodeStrict && escapeSequence.MatchString(decoded) {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+
+			// Only ever decode once, never feed the result back through
+			r.URL.Path = decoded
+			r.URL.RawPath = ""
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Modes accepted by `-malformed-paths`
+const (
+	malformedPathsReject = "reject"
+	malformedPathsStrip  = "strip"
+	malformedPathsAllow  = "allow"
+)
+
+// malformedPath - If the decoded path has control characters or isn't UTF-8
+func malformedPath(path string) bool {
+	if !utf8.ValidString(path) {
+		return true
+	}
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// malformedPathChecking - Paths with control characters or invalid UTF-8
+// (`/go%0A`, `/go%FF`) are never a real link and can forge log lines, `reject`
+// answers them with a 400 and `strip` drops the offending bytes and carries on.
+func malformedPathChecking(mode string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !malformedPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if mode == malformedPathsReject {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			r.URL.Path = strings.Map(func(c rune) rune {
+				if unicode.IsControl(c) {
+					return -1
+				}
+				return c
+			}, strings.ToValidUTF8(r.URL.Path, ""))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// normalizeHost - Lowercase the Host and drop trailing dots and default
+// ports so `Example.com.` and `example.com:80` are both `example.com`.
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimRight(host, ".")
+	}
+
+	h = strings.TrimRight(h, ".")
+	if port == "80" || port == "443" {
+		if strings.Contains(h, ":") {
+			// Put the brackets back on IPv6 literals
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// hostNormalization - Normalize the request Host before anything matches on
+// it, taking the forwarded Host from a trusted proxy (see requestHost). A
+// request without one (HTTP/1.0 allows it) is given the defaultHost. mux
+// matches an absolute-form request on its URL's host, that is kept in step.
+func hostNormalization(defaultHost string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Host = normalizeHost(requestHost(r))
+			if r.Host == "" && defaultHost != "" {
+				r.Host = defaultHost
+			}
+			if r.URL.IsAbs() {
+				r.URL.Host = r.Host
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recovery - A panic in any handler (Rules, Matchers, proxying) is logged
+// with its stack and answered with a 500 instead of dropping the connection.
+// http.ErrAbortHandler is how a handler asks to abort, so it is passed on.
+func recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				loggerFromContext(r.Context()).Error("Panic Serving Request", "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultSecurityHeaders - Sent unless the Config `securityHeaders` override
+// them. Strict-Transport-Security is left to the Config, turning it on by
+// default could lock a domain into HTTPS by surprise.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"Referrer-Policy":        "strict-origin-when-cross-origin",
+}
+
+// securityHeaders - Set the security headers on every response. HSTS only
+// means anything over HTTPS, so plain HTTP responses never get it.
+func securityHeaders(overrides map[string]string) Middleware {
+	headers := map[string]string{}
+	for name, value := range defaultSecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range overrides {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				if value == "" || name == "Strict-Transport-Security" && requestScheme(r) != "https" {
+					continue
+				}
+				w.Header().Set(name, value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// fragmentSplitting - The rare client that sends a `#fragment` gets it in the
+// path (or query), move it to URL.Fragment so rules still match. Only a raw
+// `#` counts, an encoded `%23` is part of the path.
+func fragmentSplitting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := strings.IndexByte(r.RequestURI, '#'); i >= 0 {
+			if u, err := url.ParseRequestURI(r.RequestURI[:i]); err == nil {
+				r.URL.Path = u.Path
+				r.URL.RawPath = u.RawPath
+				r.URL.RawQuery = u.RawQuery
+				r.URL.Fragment = r.RequestURI[i+1:]
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// asteriskForm - Answer requests that aren't for a path at all before they
+// reach the Rules: `OPTIONS *` asks what the server supports and gets a 200
+// with Allow, CONNECT (authority-form) and anything else for `*` are refused.
+func asteriskForm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.RequestURI == "*" && r.Method == http.MethodOptions:
+			w.Header().Set("Allow", strings.Join(httpMethods, ", "))
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodConnect:
+			w.Header().Set("Allow", strings.Join(httpMethods, ", "))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		case r.RequestURI == "*":
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// emptyQueryDropping - `/go?` is the same request as `/go`, don't let the
+// bare `?` carry on to a proxied upstream or anything else looking at the URL
+func emptyQueryDropping(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery == "" {
+			r.URL.ForceQuery = false
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compressWriter - Sends everything written through the compressor
+type compressWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (c compressWriter) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// acceptsEncoding - If the client listed the encoding in Accept-Encoding
+// without turning it off with `q=0`
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	return headerAccepts(r.Header.Get("Accept-Encoding"), encoding)
+}
+
+// headerAccepts - If the value is listed in an Accept style header without
+// being turned off with `q=0`
+func headerAccepts(header string, value string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), value) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compress - gzip or deflate the response when the client accepts it. Only
+// meant for handlers with real bodies, redirects are left alone.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		switch {
+		case acceptsEncoding(r, "gzip"):
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			next.ServeHTTP(compressWriter{ResponseWriter: w, w: gz}, r)
+
+		case acceptsEncoding(r, "deflate"):
+			fl, _ := flate.NewWriter(w, flate.DefaultCompression)
+			defer fl.Close()
+			w.Header().Set("Content-Encoding", "deflate")
+			w.Header().Del("Content-Length")
+			next.ServeHTTP(compressWriter{ResponseWriter: w, w: fl}, r)
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// compressHTML - gzip HTML responses of at least minSize bytes when the
+// client accepts it. The start of the body is held back until there's enough
+// of it to decide, anything smaller isn't worth the gzip header.
+func compressHTML(minSize int) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acceptsEncoding(r, "gzip") || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hw := &htmlCompressWriter{ResponseWriter: w, minSize: minSize, status: http.StatusOK}
+			defer hw.Close()
+			next.ServeHTTP(hw, r)
+		})
+	}
+}
+
+// htmlCompressWriter - Buffers up to minSize bytes, then either starts
+// gzipping (HTML over the size) or passes the rest through as is
+type htmlCompressWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (h *htmlCompressWriter) WriteHeader(code int) {
+	// Informational responses like Early Hints go out right away
+	if code < 200 {
+		h.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !h.decided {
+		h.status = code
+	}
+}
+
+func (h *htmlCompressWriter) Write(b []byte) (int, error) {
+	if h.decided {
+		if h.gz != nil {
+			return h.gz.Write(b)
+		}
+		return h.ResponseWriter.Write(b)
+	}
+
+	h.buf = append(h.buf, b...)
+	if len(h.buf) >= h.minSize {
+		if err := h.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide - Compress or not, then send the header and what was held back
+func (h *htmlCompressWriter) decide() error {
+	h.decided = true
+
+	header := h.Header()
+	if strings.Contains(header.Get("Content-Type"), "html") {
+		header.Add("Vary", "Accept-Encoding")
+		if len(h.buf) >= h.minSize && header.Get("Content-Encoding") == "" &&
+			h.status != http.StatusNoContent && h.status != http.StatusNotModified {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			h.gz = gzip.NewWriter(h.ResponseWriter)
+		}
+	}
+
+	h.ResponseWriter.WriteHeader(h.status)
+	buf := h.buf
+	h.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := h.Write(buf)
+	return err
+}
+
+func (h *htmlCompressWriter) Flush() {
+	if !h.decided {
+		h.decide()
+	}
+	if h.gz != nil {
+		h.gz.Flush()
+	}
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close - Send whatever is still held back and finish the gzip stream
+func (h *htmlCompressWriter) Close() error {
+	if !h.decided {
+		if err := h.decide(); err != nil {
+			return err
+		}
+	}
+	if h.gz != nil {
+		return h.gz.Close()
+	}
+	return nil
+}
+
+func (h *htmlCompressWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// cleanPath - Collapse doubled slashes and dot segments, the trailing slash
+// is dropped too unless keepTrailing is set.
+func cleanPath(p string, keepTrailing bool) string {
+	if p == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + p)
+	if keepTrailing && strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// pathCleaning - Clean the path before routing so `//go` and `/go//` match
+// `/go` directly instead of via the router's own redirect to the clean path.
+func pathCleaning(keepTrailing bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = cleanPath(r.URL.Path, keepTrailing)
+			r.URL.RawPath = ""
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusWriter - Remembers the status code written, for logging after the fact
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush - Keep streamed responses streaming
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap - Lets http.ResponseController reach the underlying writer
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// errRequestTimeout - Why a request's context was cancelled by requestDeadline
+var errRequestTimeout = errors.New("request took longer than -request-timeout")
+
+// requestDeadline - Answer with a 503 when nothing has been written within
+// the timeout. Like http.TimeoutHandler the handler runs in its own goroutine
+// and the 503 is written from here, so one that ignores its context still
+// can't hold the client. The request's context is cancelled too (see
+// errRequestTimeout) so a slow upstream is given up on. Only until the
+// response starts, a proxied response already streaming is left alone.
+func requestDeadline(timeout time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+
+			tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+						return
+					}
+					close(done)
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+			}()
+
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			tw.mu.Lock()
+			if tw.wrote {
+				// Already answering, see it through
+				tw.mu.Unlock()
+				select {
+				case p := <-panicked:
+					panic(p)
+				case <-done:
+				}
+				return
+			}
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			cancel(errRequestTimeout)
+			loggerFromContext(r.Context()).Warn("Request Timed Out", "timeout", timeout)
+			http.Error(w, "Service Unavailable: this took too long, please try again", http.StatusServiceUnavailable)
+		})
+	}
+}
+
+// timeoutWriter - Drops whatever a handler writes after requestDeadline gave
+// up on it. Until the response starts the handler gets a header of its own,
+// requestDeadline may be writing the 503's at the same time.
+type timeoutWriter struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	header   http.Header
+	wrote    bool
+	timedOut bool
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wrote {
+		// Only the handler is writing now, trailers go straight through
+		return t.ResponseWriter.Header()
+	}
+	return t.header
+}
+
+// copyHeader - Send what the handler set so far, called with mu held
+func (t *timeoutWriter) copyHeader() {
+	dst := t.ResponseWriter.Header()
+	for k := range dst {
+		if _, ok := t.header[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range t.header {
+		dst[k] = v
+	}
+}
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return
+	}
+	// An informational 1xx isn't the answer, the deadline still applies
+	if code >= 200 {
+		if !t.wrote {
+			t.copyHeader()
+		}
+		t.wrote = true
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !t.wrote {
+		t.copyHeader()
+		t.wrote = true
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush - Keep streamed responses streaming
+func (t *timeoutWriter) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.ResponseWriter.(http.Flusher); ok && !t.timedOut {
+		if !t.wrote {
+			t.copyHeader()
+			t.wrote = true
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap - Lets http.ResponseController reach the underlying writer
+func (t *timeoutWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
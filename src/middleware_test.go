@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// middlewareName - The function a Middleware came from, `clientRateLimit`
+// for both the constructor and the closure it returns
+func middlewareName(m Middleware) string {
+	// `<package path>.clientRateLimit.func1`
+	name := runtime.FuncForPC(reflect.ValueOf(m).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	return strings.Split(name, ".")[1]
+}
+
+// middlewareNames - The names of buildMiddleware, outermost first
+func middlewareNames(conf Config) []string {
+	names := []string{}
+	for _, m := range buildMiddleware(conf) {
+		names = append(names, middlewareName(m))
+	}
+	return names
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	_, blocked, _ := net.ParseCIDR("198.51.100.0/24")
+	setGlobal(t, &adminAddr, ":8081")
+	setGlobal(t, &clientRPS, 10.0)
+	setGlobal(t, &blockedClients, []*net.IPNet{blocked})
+	setGlobal(t, &enableTracing, true)
+
+	want := []string{"requestLogging", "inFlightTracking", "requestMetrics", "clientRateLimit", "ipFiltering", "tracing", "recovery"}
+	got := middlewareNames(Config{})
+	if !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("middleware starts %v, want %v", got[:len(want)], want)
+	}
+}
+
+func TestMiddlewareLeftOutWhenOff(t *testing.T) {
+	setGlobal(t, &adminAddr, "")
+	setGlobal(t, &clientRPS, 0.0)
+	setGlobal(t, &allowedClients, nil)
+	setGlobal(t, &blockedClients, nil)
+	setGlobal(t, &enableTracing, false)
+
+	for _, name := range middlewareNames(Config{}) {
+		switch name {
+		case "requestMetrics", "clientRateLimit", "ipFiltering", "tracing":
+			t.Errorf("%s is in the chain while turned off", name)
+		}
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	resetLimiters(t)
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+	setGlobal(t, &clientRPS, 0.001)
+	setGlobal(t, &clientBurst, 2)
+
+	handler := chain(buildRouter(conf), buildMiddleware(conf))
+	get := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("192.0.2.10:1000"); rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("request %d inside the burst = %d", i, rec.Code)
+		}
+	}
+	rec := get("192.0.2.10:1001")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over the burst = %d Retry-After %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := get("192.0.2.11:1000"); rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("another client = %d, want its own limit", rec.Code)
+	}
+}
+
+func TestIPFiltering(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com"}`)
+	allow, _ := parseCIDRs("192.0.2.0/24")
+	block, _ := parseCIDRs("192.0.2.66")
+
+	tests := []struct {
+		name   string
+		allow  []*net.IPNet
+		block  []*net.IPNet
+		addr   string
+		status int
+	}{
+		{"allowed", allow, nil, "192.0.2.1:1000", http.StatusTemporaryRedirect},
+		{"not in the allow list", allow, nil, "203.0.113.1:1000", http.StatusForbidden},
+		{"blocked", nil, block, "192.0.2.66:1000", http.StatusForbidden},
+		{"not blocked", nil, block, "192.0.2.67:1000", http.StatusTemporaryRedirect},
+		{"blocked wins over allow", allow, block, "192.0.2.66:1000", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &allowedClients, tt.allow)
+			setGlobal(t, &blockedClients, tt.block)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.addr
+			if rec := serve(conf, req); rec.Code != tt.status {
+				t.Errorf("GET from %s = %d, want %d", tt.addr, rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceparent := regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+	tests := []struct {
+		name   string
+		header string
+		trace  string
+	}{
+		{"joins the client's trace", parent, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"starts a trace", "", ""},
+		{"ignores a malformed header", "00-xyz-01", ""},
+		{"ignores the all zero trace", "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := tracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = r.Header.Get("traceparent")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("traceparent", tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			m := traceparent.FindStringSubmatch(seen)
+			if m == nil {
+				t.Fatalf("downstream traceparent %q isn't valid", seen)
+			}
+			if tt.trace != "" && m[1] != tt.trace {
+				t.Errorf("trace ID = %s, want the client's %s", m[1], tt.trace)
+			}
+			if tt.trace == "" && (m[1] == "4bf92f3577b34da6a3ce929d0e0e4736" || m[1] == strings.Repeat("0", 32)) {
+				t.Errorf("trace ID = %s, want a new one", m[1])
+			}
+			if seen == tt.header {
+				t.Errorf("traceparent wasn't given a new span, still %q", seen)
+			}
+		})
+	}
+}
+
+func TestPathDecoding(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	tests := []struct {
+		name     string
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{"plain path", pathDecodeOnce, "/go", http.StatusTemporaryRedirect, "https://golang.org"},
+		{"encoded letter matches", pathDecodeOnce, "/g%6F", http.StatusTemporaryRedirect, "https://golang.org"},
+		{"encoded letter matches strict", pathDecodeStrict, "/g%6F", http.StatusTemporaryRedirect, "https://golang.org"},
+		{"double encoded is only decoded once", pathDecodeOnce, "/g%256F", http.StatusTemporaryRedirect, "https://example.com"},
+		{"double encoded is refused strict", pathDecodeStrict, "/g%256F", http.StatusBadRequest, ""},
+		{"raw doesn't decode", pathDecodeRaw, "/g%6F", http.StatusTemporaryRedirect, "https://example.com"},
+		{"raw still matches plain", pathDecodeRaw, "/go", http.StatusTemporaryRedirect, "https://golang.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &pathDecodeMode, tt.mode)
+
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+}
+
+func TestHostNormalization(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com/fallback", "redirects": [
+		{"host": "example.com", "rule": "/go", "url": "https://golang.org"}
+	]}`)
+
+	tests := []struct {
+		host       string
+		normalized string
+		location   string
+	}{
+		{"example.com", "example.com", "https://golang.org"},
+		{"Example.COM", "example.com", "https://golang.org"},
+		{"example.com.", "example.com", "https://golang.org"},
+		{"example.com:80", "example.com", "https://golang.org"},
+		{"example.com.:443", "example.com", "https://golang.org"},
+		// Host rules match on any port, `port` is what scopes one
+		{"example.com:8080", "example.com:8080", "https://golang.org"},
+		{"[::1]:80", "[::1]", "https://example.com/fallback"},
+		{"[::1]:8080", "[::1]:8080", "https://example.com/fallback"},
+		{"other.example.com", "other.example.com", "https://example.com/fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := normalizeHost(tt.host); got != tt.normalized {
+				t.Errorf("normalizeHost(%q) = %q, want %q", tt.host, got, tt.normalized)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/go", nil)
+			req.Host = tt.host
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s/go = %q, want %q", tt.host, got, tt.location)
+			}
+
+			// An absolute-form request is matched on its URL, the same goes
+			req = httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/go", nil)
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET http://%s/go = %q, want %q", tt.host, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestPathCleaning(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs/*", "url": "https://docs.example.com", "options": {"appendPath": true}}
+	]}`)
+	setGlobal(t, &cleanPaths, true)
+	setGlobal(t, &maxAppendLength, 1024)
+	setGlobal(t, &maxAppendSegments, 32)
+
+	tests := []struct {
+		name         string
+		keepTrailing bool
+		path         string
+		location     string
+	}{
+		{"doubled slash", false, "/go//", "https://golang.org"},
+		{"leading doubled slash", false, "//go", "https://golang.org"},
+		{"dot segments", false, "/x/../go", "https://golang.org"},
+		{"appendPath gets the clean suffix", false, "/docs//guide//intro", "https://docs.example.com/guide/intro"},
+		{"appendPath with leading doubled slash", false, "//docs/guide", "https://docs.example.com/guide"},
+		{"trailing slash dropped", false, "/docs/guide/", "https://docs.example.com/guide"},
+		{"trailing slash kept", true, "/docs/guide//", "https://docs.example.com/guide/"},
+		{"root stays root", false, "//", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &keepTrailingSlash, tt.keepTrailing)
+
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil))
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want 307 %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.location)
+			}
+		})
+	}
+}
+
+func TestFragmentPreserving(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs", "url": "https://example.org/docs#intro"}
+	]}`)
+
+	tests := []struct {
+		name       string
+		requestURI string
+		location   string
+	}{
+		{"no fragment", "/go", "https://golang.org"},
+		{"raw fragment is appended", "/go#install", "https://golang.org#install"},
+		{"fragment after a query", "/go?x=1#install", "https://golang.org#install"},
+		{"empty fragment", "/go#", "https://golang.org"},
+		{"target's own fragment wins", "/docs#other", "https://example.org/docs#intro"},
+		{"encoded hash is part of the path", "/go%23install", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Read off the request line as the server would, the `#` is left in
+			req := httptest.NewRequest(http.MethodGet, tt.requestURI, nil)
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.requestURI, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": []}`)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/boom":
+			panic("boom")
+		case "/abort":
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(chain(handler, buildMiddleware(conf)))
+	defer srv.Close()
+	logs := captureLogs(t)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/boom", http.StatusInternalServerError},
+		{"/ok", http.StatusNoContent},
+		{"/boom", http.StatusInternalServerError},
+		{"/abort", 0},
+		{"/ok", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if tt.status == 0 {
+			// Aborted on purpose, the connection is dropped without a response
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("GET %s = %d, want the connection dropped", tt.path, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GET %s: %v, the server didn't survive", tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+
+	line := findLog(logs(), "Panic Serving Request")
+	if line == nil || line["err"] != "boom" || line["path"] != "/boom" || !strings.Contains(line["stack"].(string), "TestRecovery") {
+		t.Errorf("panic log = %v, want the error, path and stack", line)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	hsts := "max-age=31536000; includeSubDomains"
+
+	tests := []struct {
+		name    string
+		headers string
+		https   bool
+		path    string
+		want    map[string]string
+	}{
+		{"defaults", `{}`, false, "/go", map[string]string{
+			"X-Content-Type-Options": "nosniff", "Referrer-Policy": "strict-origin-when-cross-origin", "Strict-Transport-Security": "",
+		}},
+		{"defaults on the default redirect", `{}`, false, "/missing", map[string]string{
+			"X-Content-Type-Options": "nosniff", "Referrer-Policy": "strict-origin-when-cross-origin",
+		}},
+		{"overridden", `{"referrer-policy": "no-referrer", "X-Frame-Options": "DENY"}`, false, "/go", map[string]string{
+			"X-Content-Type-Options": "nosniff", "Referrer-Policy": "no-referrer", "X-Frame-Options": "DENY",
+		}},
+		{"empty turns a default off", `{"X-Content-Type-Options": ""}`, false, "/go", map[string]string{
+			"X-Content-Type-Options": "", "Referrer-Policy": "strict-origin-when-cross-origin",
+		}},
+		{"HSTS over HTTPS", `{"Strict-Transport-Security": "` + hsts + `"}`, true, "/go", map[string]string{
+			"Strict-Transport-Security": hsts,
+		}},
+		{"no HSTS over HTTP", `{"Strict-Transport-Security": "` + hsts + `"}`, false, "/go", map[string]string{
+			"Strict-Transport-Security": "",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "securityHeaders": `+tt.headers+`, "redirects": [
+				{"rule": "/go", "url": "https://golang.org"}
+			]}`)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.https {
+				req = httptest.NewRequest(http.MethodGet, "https://example.com"+tt.path, nil)
+			}
+			rec := serve(conf, req)
+			if rec.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("GET %s = %d, want a redirect", tt.path, rec.Code)
+			}
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMalformedPaths(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/café", "url": "https://example.com/cafe"}
+	]}`)
+
+	tests := []struct {
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{malformedPathsReject, "/go", http.StatusTemporaryRedirect, "https://golang.org"},
+		{malformedPathsReject, "/caf%C3%A9", http.StatusTemporaryRedirect, "https://example.com/cafe"},
+		{malformedPathsReject, "/go%0A", http.StatusBadRequest, ""},
+		{malformedPathsReject, "/g%00o", http.StatusBadRequest, ""},
+		{malformedPathsReject, "/go%1B%5B31m", http.StatusBadRequest, ""},
+		{malformedPathsReject, "/go%FF", http.StatusBadRequest, ""},
+		{malformedPathsReject, "/caf%C3", http.StatusBadRequest, ""},
+		{malformedPathsStrip, "/go%0A", http.StatusTemporaryRedirect, "https://golang.org"},
+		{malformedPathsStrip, "/g%00o", http.StatusTemporaryRedirect, "https://golang.org"},
+		{malformedPathsStrip, "/go%FF", http.StatusTemporaryRedirect, "https://golang.org"},
+		{malformedPathsStrip, "/caf%C3%A9", http.StatusTemporaryRedirect, "https://example.com/cafe"},
+		{malformedPathsAllow, "/go%0A", http.StatusTemporaryRedirect, "https://example.com"},
+		{malformedPathsAllow, "/go%FF", http.StatusTemporaryRedirect, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.path, func(t *testing.T) {
+			setGlobal(t, &malformedPaths, tt.mode)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+
+	t.Run("left out when allowed", func(t *testing.T) {
+		setGlobal(t, &malformedPaths, malformedPathsAllow)
+		for _, name := range middlewareNames(conf) {
+			if name == "malformedPathChecking" {
+				t.Error("malformedPathChecking is in the chain with -malformed-paths=allow")
+			}
+		}
+	})
+}
+
+func TestCompressHTML(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+	large := `<p>Moving to <a href="{{.Target}}">{{.Target}}</a></p>` + strings.Repeat("<p>Thanks for your patience.</p>", 50)
+	small := `<a href="{{.Target}}">here</a>`
+
+	tests := []struct {
+		name        string
+		minSize     int
+		body        string
+		contentType string
+		accept      string
+		gzipped     bool
+	}{
+		{"large html", 512, large, "text/html; charset=utf-8", "gzip, deflate", true},
+		{"tiny html", 512, small, "text/html; charset=utf-8", "gzip", false},
+		{"client doesn't accept gzip", 512, large, "text/html; charset=utf-8", "br", false},
+		{"large, but not html", 512, large, "text/plain", "gzip", false},
+		{"turned off", 0, large, "text/html; charset=utf-8", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &compressHTMLSize, tt.minSize)
+			body, err := parseResponseBody(tt.body, tt.contentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setGlobal(t, &responseBody, body)
+			setGlobal(t, &responseBodyType, tt.contentType)
+			// The body this would be without compression
+			want := serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil)).Body.String()
+
+			req := httptest.NewRequest(http.MethodGet, "/go", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rec := serve(conf, req)
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "https://golang.org" {
+				t.Fatalf("GET /go = %d %q, want the 307 unchanged", rec.Code, rec.Header().Get("Location"))
+			}
+
+			if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.gzipped {
+				t.Fatalf("Content-Encoding = %q, want gzipped %v", rec.Header().Get("Content-Encoding"), tt.gzipped)
+			}
+			got := rec.Body.String()
+			if tt.gzipped {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(data)
+				if rec.Body.Len() >= len(want) {
+					t.Errorf("gzipped to %d bytes from %d", rec.Body.Len(), len(want))
+				}
+			}
+			if got != want {
+				t.Errorf("body = %q, want %q", got, want)
+			}
+			if varies := rec.Header().Get("Vary") == "Accept-Encoding"; varies != (tt.minSize > 0 && tt.accept != "br" && strings.Contains(tt.contentType, "html")) {
+				t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+			}
+		})
+	}
+
+	t.Run("written a little at a time", func(t *testing.T) {
+		handler := compressHTML(512)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			for i := 0; i < 100; i++ {
+				io.WriteString(w, "<p>chunk</p>")
+			}
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("Content-Encoding %q: %v", rec.Header().Get("Content-Encoding"), err)
+		}
+		if data, _ := io.ReadAll(zr); string(data) != strings.Repeat("<p>chunk</p>", 100) {
+			t.Errorf("decompressed %d bytes, want the 1200 written", len(data))
+		}
+	})
+}
+
+func TestAsteriskForm(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+	// A real server, net/http answers `OPTIONS *` itself unless told not to
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = newPublicServer(chain(buildRouter(conf), buildMiddleware(conf)))
+	srv.Start()
+	defer srv.Close()
+
+	allow := strings.Join(httpMethods, ", ")
+	tests := []struct {
+		name    string
+		request string
+		status  int
+		allow   string
+		body    string
+	}{
+		{"OPTIONS *", "OPTIONS * HTTP/1.1", http.StatusOK, allow, ""},
+		{"GET *", "GET * HTTP/1.1", http.StatusBadRequest, "", "Bad Request\n"},
+		{"CONNECT", "CONNECT example.com:443 HTTP/1.1", http.StatusMethodNotAllowed, allow, "Method Not Allowed\n"},
+		{"OPTIONS on a path still reaches the rules", "OPTIONS /go HTTP/1.1", http.StatusTemporaryRedirect, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "%s\r\nHost: example.com\r\nConnection: close\r\n\r\n", tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status || resp.Header.Get("Allow") != tt.allow {
+				t.Errorf("%s = %d Allow %q, want %d Allow %q", tt.request, resp.StatusCode, resp.Header.Get("Allow"), tt.status, tt.allow)
+			}
+			if tt.status == http.StatusTemporaryRedirect {
+				if resp.Header.Get("Location") != "https://golang.org" {
+					t.Errorf("%s went to %q", tt.request, resp.Header.Get("Location"))
+				}
+			} else if string(body) != tt.body {
+				t.Errorf("%s body = %q, want %q", tt.request, body, tt.body)
+			}
+		})
+	}
+}
+
+func TestMissingHost(t *testing.T) {
+	rules := `"hostDefaults": {"docs.example.com": "https://docs.example.com/home"}, "redirects": [
+		{"host": "docs.example.com", "rule": "/app", "url": "https://docs.example.com/app"},
+		{"rule": "/go", "url": "https://golang.org"}
+	]}`
+	configs := map[string]Config{
+		"defaultHost":    mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "defaultHost": "Docs.Example.com", `+rules),
+		"no defaultHost": mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", `+rules),
+	}
+
+	tests := []struct {
+		config   string
+		request  string
+		location string
+	}{
+		{"defaultHost", "GET /app HTTP/1.0\r\n", "https://docs.example.com/app"},
+		{"defaultHost", "GET /elsewhere HTTP/1.0\r\n", "https://docs.example.com/home"},
+		{"defaultHost", "GET /go HTTP/1.0\r\n", "https://golang.org"},
+		{"defaultHost", "GET /app HTTP/1.0\r\nHost: other.example.com\r\n", "https://example.com"},
+		{"defaultHost", "GET /app HTTP/1.1\r\nHost: docs.example.com\r\n", "https://docs.example.com/app"},
+		{"no defaultHost", "GET /app HTTP/1.0\r\n", "https://example.com"},
+		{"no defaultHost", "GET /elsewhere HTTP/1.0\r\n", "https://example.com"},
+		{"no defaultHost", "GET /go HTTP/1.0\r\n", "https://golang.org"},
+	}
+
+	servers := map[string]*httptest.Server{}
+	for name, conf := range configs {
+		srv := httptest.NewServer(chain(buildRouter(conf), buildMiddleware(conf)))
+		defer srv.Close()
+		servers[name] = srv
+	}
+	for _, tt := range tests {
+		t.Run(tt.config+" "+strings.SplitN(tt.request, "\r\n", 2)[0], func(t *testing.T) {
+			conn, err := net.Dial("tcp", servers[tt.config].Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "%sConnection: close\r\n\r\n", tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusTemporaryRedirect || got != tt.location {
+				t.Errorf("%q = %d %q, want 307 %q", tt.request, resp.StatusCode, got, tt.location)
+			}
+		})
+	}
+
+	data := `{"version": 1, "defaultRedirect": "https://example.com", "defaultHost": "https://docs.example.com"}`
+	if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "defaultHost must be a bare host") {
+		t.Errorf("parseConfig with a URL for defaultHost = %v", err)
+	}
+}
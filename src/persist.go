@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// loadHits - Restore the hit counts saved by saveHits, a missing file is a
+// first start and not an error
+func loadHits(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	counts := map[string]uint64{}
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+	hits.Restore(counts)
+	return nil
+}
+
+// saveHits - Write the hit counts out, through a temp file so a crash
+// mid-write never leaves a truncated file behind
+func saveHits(path string) error {
+	data, err := json.Marshal(hits.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// persistHits - Save the hit counts every interval until done is closed. An
+// interval of zero or less leaves the save on shutdown as the only one.
+func persistHits(path string, interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		<-done
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveHits(path); err != nil {
+				slog.Error("Failed to Save Hit Counts", "err", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHitsPersistAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hits.json")
+	setGlobal(t, &hits, newHitCounter())
+
+	// First run, a missing file is a first start
+	if err := loadHits(path); err != nil {
+		t.Fatalf("loadHits with no file = %v", err)
+	}
+	hits.Inc("a")
+	hits.Inc("a")
+	hits.Inc("")
+	if err := saveHits(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted, with a hit counted before the file is read
+	hits = newHitCounter()
+	hits.Inc("b")
+	if err := loadHits(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{"a": 2, "": 1, "b": 1}
+	for rule, n := range want {
+		if got := hits.Get(rule); got != n {
+			t.Errorf("hits for %q = %d after the restart, want %d", rule, got, n)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadHits(path); err == nil {
+		t.Error("loadHits of a truncated file = nil, want an error")
+	}
+}
+
+func TestPersistHits(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		saved    bool
+	}{
+		{"every interval", 10 * time.Millisecond, true},
+		{"zero only saves on shutdown", 0, false},
+		{"negative only saves on shutdown", -time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hits.json")
+			setGlobal(t, &hits, newHitCounter())
+			hits.Inc("a")
+
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				persistHits(path, tt.interval, done)
+				close(stopped)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+			close(done)
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("persistHits didn't stop once done was closed")
+			}
+
+			if _, err := os.Stat(path); (err == nil) != tt.saved {
+				t.Errorf("hits file written = %v, want %v", err == nil, tt.saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Values for a Rule's `type`
+const (
+	ruleTypeRedirect  = "redirect"
+	ruleTypeProxy     = "proxy"
+	ruleTypeShortener = "shortener"
+	ruleTypeLookup    = "lookup"
+)
+
+// proxyHandler - Serve the Rule's target in place instead of Redirecting to
+// it. The request's query is added to the target's (see mergeQuery), and an
+// upstream that takes longer than the timeout gets a 504.
+func proxyHandler(conf Config, v URLRule) http.Handler {
+	// Already checked by validateConfig
+	target, _ := url.Parse(v.URL)
+
+	// Already checked by validateConfig
+	level, _ := parseLogLevel(v.LogLevel)
+
+	// Virtual hosted backends may want another Host than the target's
+	host := target.Host
+	if v.ProxyHost != "" {
+		host = v.ProxyHost
+	}
+
+	timeout := proxyTimeout
+	if v.ProxyTimeout != "" {
+		timeout, _ = time.ParseDuration(v.ProxyTimeout)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path
+			req.URL.RawPath = target.RawPath
+			req.URL.RawQuery = mergeQuery(target.RawQuery, req.URL.RawQuery, conf.QueryMerge)
+			req.Host = host
+
+			// Legacy backends that only answer one method. A HEAD stays a HEAD,
+			// checking a link shouldn't become a POST with side effects.
+			if v.ProxyMethod != "" && req.Method != http.MethodHead {
+				req.Method = strings.ToUpper(v.ProxyMethod)
+				if req.Method == http.MethodGet || req.Method == http.MethodHead {
+					req.Body = nil
+					req.ContentLength = 0
+					req.Header.Del("Content-Type")
+				}
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// requestDeadline answers for us
+			if errors.Is(context.Cause(r.Context()), errRequestTimeout) {
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				loggerFromContext(r.Context()).Warn("Upstream for Rule timed out", "timeout", timeout)
+				http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+				return
+			}
+			loggerFromContext(r.Context()).Warn("Upstream for Rule failed", "err", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withLogFields(r, "rule", v.Path)
+		r = withLogReason(r, v.Reason)
+		r = withLogVars(r, v.ID())
+
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		proxy.ServeHTTP(sw, r)
+
+		logAccess(r, level, "Proxied User Rule Based", "target", v.URL, "status", sw.status)
+		analytics.Record(r, v.ID(), sw.status)
+		audit.Record(r, v.ID(), sw.status)
+		countRedirect(v.ID(), sw.status)
+	})
+}
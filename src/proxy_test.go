@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		global time.Duration
+		rule   string
+		status int
+	}{
+		{"global timeout", 50 * time.Millisecond, "", http.StatusGatewayTimeout},
+		{"rule overrides the global", time.Minute, "50ms", http.StatusGatewayTimeout},
+		{"rule gives it longer", 50 * time.Millisecond, "5s", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &proxyTimeout, tt.global)
+			setGlobal(t, &redirects, newRedirectCounter())
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"type": "proxy", "rule": "/slow", "url": "`+upstream.URL+`", "proxyTimeout": "`+tt.rule+`"}
+			]}`)
+
+			start := time.Now()
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, "/slow", nil))
+			took := time.Since(start)
+			if rec.Code != tt.status {
+				t.Errorf("GET /slow = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusGatewayTimeout && took > 250*time.Millisecond {
+				t.Errorf("the 504 took %s, the timeout didn't cut it short", took)
+			}
+			if got := redirects.Snapshot()[redirectKey{Rule: "/slow", Status: tt.status}]; got != 1 {
+				t.Errorf("counted %d under status %d, want 1", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestProxyMethod(t *testing.T) {
+	type received struct {
+		method, contentType, body string
+	}
+	got := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Method, r.Header.Get("Content-Type"), string(body)}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		proxyMethod string
+		method      string
+		want        received
+	}{
+		{"not rewritten", "", http.MethodPost, received{http.MethodPost, "text/plain", "hello"}},
+		{"POST forced to GET drops the body", "get", http.MethodPost, received{http.MethodGet, "", ""}},
+		{"GET forced to POST", "POST", http.MethodGet, received{http.MethodPost, "", ""}},
+		{"POST forced to PUT keeps the body", "PUT", http.MethodPost, received{http.MethodPut, "text/plain", "hello"}},
+		{"HEAD stays a HEAD", "POST", http.MethodHead, received{http.MethodHead, "", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"type": "proxy", "rule": "/legacy", "url": "`+upstream.URL+`", "proxyMethod": "`+tt.proxyMethod+`"}
+			]}`)
+
+			var body io.Reader
+			if tt.method != http.MethodGet && tt.method != http.MethodHead {
+				body = strings.NewReader("hello")
+			}
+			req := httptest.NewRequest(tt.method, "/legacy", body)
+			if body != nil {
+				req.Header.Set("Content-Type", "text/plain")
+			}
+			if rec := serve(conf, req); rec.Code != http.StatusOK {
+				t.Fatalf("%s /legacy = %d, want the upstream's 200", tt.method, rec.Code)
+			}
+			if r := <-got; r != tt.want {
+				t.Errorf("upstream got %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"type": "proxy", "rule": "/legacy", "url": "` + upstream.URL + `", "proxyMethod": "FETCH"}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/legacy", "url": "https://example.com", "proxyMethod": "GET"}]}`,
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "proxyMethod") {
+			t.Errorf("parseConfig(%s) = %v, want a proxyMethod error", data, err)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+			w.Write([]byte("too late"))
+		case "/stream":
+			// Starts straight away, finishes well after the timeout
+			for i := 0; i < 3; i++ {
+				w.Write([]byte("chunk "))
+				w.(http.Flusher).Flush()
+				time.Sleep(60 * time.Millisecond)
+			}
+		default:
+			w.Write([]byte("fast"))
+		}
+	}))
+	defer upstream.Close()
+
+	setGlobal(t, &proxyTimeout, time.Minute)
+	setGlobal(t, &requestTimeout, 50*time.Millisecond)
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"type": "proxy", "rule": "/slow", "url": "`+upstream.URL+`/slow"},
+		{"type": "proxy", "rule": "/stream", "url": "`+upstream.URL+`/stream"},
+		{"type": "proxy", "rule": "/fast", "url": "`+upstream.URL+`/fast"}
+	]}`)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/slow", http.StatusServiceUnavailable, "Service Unavailable: this took too long, please try again\n"},
+		{"/stream", http.StatusOK, "chunk chunk chunk "},
+		{"/fast", http.StatusOK, "fast"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			start := time.Now()
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Body.String() != tt.body {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+			if tt.status == http.StatusServiceUnavailable && time.Since(start) > 500*time.Millisecond {
+				t.Errorf("the 503 took %s, the upstream wasn't given up on", time.Since(start))
+			}
+		})
+	}
+
+	t.Run("a handler ignoring its context", func(t *testing.T) {
+		finished := make(chan struct{})
+		handler := requestDeadline(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(finished)
+			time.Sleep(300 * time.Millisecond)
+			w.Header().Set("X-Late", "1")
+			w.Write([]byte("too late"))
+		}))
+
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if took := time.Since(start); took > 250*time.Millisecond {
+			t.Errorf("the 503 took %s, it waited on the handler", took)
+		}
+		<-finished
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Late") != "" || strings.Contains(rec.Body.String(), "too late") {
+			t.Errorf("got %d %v %q, want the 503 and nothing the handler wrote late", rec.Code, rec.Header(), rec.Body.String())
+		}
+	})
+}
+
+func TestProxyHost(t *testing.T) {
+	got := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Host
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	tests := []struct {
+		name      string
+		proxyHost string
+		want      string
+	}{
+		{"defaults to the target's host", "", upstreamHost},
+		{"configured host", "tenant.internal.example.com", "tenant.internal.example.com"},
+		{"configured host and port", "tenant.internal.example.com:8080", "tenant.internal.example.com:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"type": "proxy", "rule": "/app", "url": "`+upstream.URL+`/app", "proxyHost": "`+tt.proxyHost+`"}
+			]}`)
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			req.Host = "public.example.com"
+			if rec := serve(conf, req); rec.Code != http.StatusOK {
+				t.Fatalf("GET /app = %d, want the upstream's 200", rec.Code)
+			}
+			if host := <-got; host != tt.want {
+				t.Errorf("upstream got Host %q, want %q", host, tt.want)
+			}
+		})
+	}
+
+	data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "proxyHost": "x.example.com"}]}`
+	if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "proxyHost only applies to proxy rules") {
+		t.Errorf("parseConfig with proxyHost on a redirect = %v, want an error", err)
+	}
+}
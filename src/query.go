@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Values for the Config `queryMerge`, how keys in both the target's query and
+// the request's are handled
+const (
+	queryMergeAll   = "all"
+	queryMergeFirst = "first"
+	queryMergeLast  = "last"
+)
+
+// mergeQuery - Add the request's query onto the target's. With `all` both
+// values are kept in order, `first` keeps only the first value of a key (the
+// target's when it has one) and `last` only the last (the request's). The
+// pairs are spliced as written, so the target's order and escaping are kept
+// and each key stays where it first appears.
+func mergeQuery(target, request, strategy string) string {
+	if target == "" || request == "" {
+		return target + request
+	}
+	if strategy == "" || strategy == queryMergeAll {
+		return target + "&" + request
+	}
+
+	pairs := []string{}
+	for _, pair := range strings.Split(target+"&"+request, "&") {
+		if pair != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	// Where each key is kept, the first pair for it and the one that wins
+	order := []string{}
+	kept := map[string]string{}
+	for _, pair := range pairs {
+		key := queryKey(pair)
+		if _, ok := kept[key]; !ok {
+			order = append(order, key)
+		} else if strategy == queryMergeFirst {
+			continue
+		}
+		kept[key] = pair
+	}
+
+	merged := make([]string, len(order))
+	for i, key := range order {
+		merged[i] = kept[key]
+	}
+	return strings.Join(merged, "&")
+}
+
+// queryKey - The (unescaped) key of a `key=value` query pair, as written
+// when it won't unescape
+func queryKey(pair string) string {
+	key := pair
+	if i := strings.IndexByte(pair, '='); i >= 0 {
+		key = pair[:i]
+	}
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
+
+// preserveQuery - The target with the request's query merged in. When that
+// goes over `-max-target-length` the `-long-query` policy decides: leave it
+// for the usual length check, drop request parameters from the end until it
+// fits (never splitting one) or drop the request's query altogether.
+func preserveQuery(target, query, strategy string) string {
+	if query == "" {
+		return target
+	}
+
+	fragment := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	base, targetQuery := target, ""
+	if i := strings.Index(target, "?"); i >= 0 {
+		base, targetQuery = target[:i], target[i+1:]
+	}
+
+	build := func(query string) string {
+		merged := mergeQuery(targetQuery, query, strategy)
+		if merged == "" {
+			return base + fragment
+		}
+		return base + "?" + merged + fragment
+	}
+
+	merged := build(query)
+	if maxTargetLength <= 0 || len(merged) <= maxTargetLength {
+		return merged
+	}
+
+	switch longQueryMode {
+	case longQueryTruncate:
+		params := strings.Split(query, "&")
+		for len(params) > 1 {
+			params = params[:len(params)-1]
+			if candidate := build(strings.Join(params, "&")); len(candidate) <= maxTargetLength {
+				return candidate
+			}
+		}
+		return build("")
+	case longQueryDrop:
+		return build("")
+	default:
+		return merged
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMergeQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		request  string
+		strategy string
+		want     string
+	}{
+		{"no request query", "b=2&a=1", "", queryMergeLast, "b=2&a=1"},
+		{"no target query", "", "a=1", queryMergeFirst, "a=1"},
+		{"all keeps both", "b=2&a=1", "a=9", queryMergeAll, "b=2&a=1&a=9"},
+		{"default is all", "b=2&a=1", "a=9", "", "b=2&a=1&a=9"},
+		{"first keeps the target's value", "b=2&a=1", "a=9&c=3", queryMergeFirst, "b=2&a=1&c=3"},
+		{"last keeps the request's value where the target had it", "b=2&a=1&z=0", "a=9&c=3", queryMergeLast, "b=2&a=9&z=0&c=3"},
+		{"last keeps only the final value", "a=1", "a=8&a=9", queryMergeLast, "a=9"},
+		{"first keeps only the first value", "a=1&a=2", "a=9", queryMergeFirst, "a=1"},
+		{"request duplicates of a new key", "b=2", "c=1&c=2", queryMergeLast, "b=2&c=2"},
+		{"escaping is kept as written", "q=a%20b&x=%2F", "x=%2f", queryMergeFirst, "q=a%20b&x=%2F"},
+		{"escaped keys meet", "a%5B%5D=1", "a[]=2", queryMergeLast, "a[]=2"},
+		{"keys without values", "flag&b=2", "flag=on", queryMergeLast, "flag=on&b=2"},
+		{"empty pairs are dropped", "a=1&&b=2", "&c=3", queryMergeLast, "a=1&b=2&c=3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeQuery(tt.target, tt.request, tt.strategy); got != tt.want {
+				t.Errorf("mergeQuery(%q, %q, %q) = %q, want %q", tt.target, tt.request, tt.strategy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMergeRule(t *testing.T) {
+	tests := []struct {
+		strategy string
+		location string
+	}{
+		{queryMergeAll, "https://example.com/s?utm=golow&lang=en&lang=fr&page=2"},
+		{queryMergeFirst, "https://example.com/s?utm=golow&lang=en&page=2"},
+		{queryMergeLast, "https://example.com/s?utm=golow&lang=fr&page=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "queryMerge": "`+tt.strategy+`", "redirects": [
+				{"rule": "/s", "url": "https://example.com/s?utm=golow&lang=en", "options": {"preserveQuery": true}}
+			]}`)
+			req := httptest.NewRequest(http.MethodGet, "/s?lang=fr&page=2", nil)
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /s?lang=fr&page=2 = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestLongQuery(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/s", "url": "https://s.example.com/q?src=go", "options": {"preserveQuery": true}},
+		{"rule": "/f", "url": "https://s.example.com/q?src=go#top", "options": {"preserveQuery": true}}
+	]}`)
+	long := "a=1111111111&b=2222222222&c=3333333333"
+
+	tests := []struct {
+		name     string
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{"fits", longQueryError, "/s?a=1", http.StatusTemporaryRedirect, "https://s.example.com/q?src=go&a=1"},
+		{"error leaves it to -long-target", longQueryError, "/s?" + long, http.StatusRequestURITooLong, ""},
+		{"truncate drops whole parameters from the end", longQueryTruncate, "/s?" + long, http.StatusTemporaryRedirect, "https://s.example.com/q?src=go&a=1111111111&b=2222222222"},
+		{"truncate keeps the target's fragment", longQueryTruncate, "/f?" + long, http.StatusTemporaryRedirect, "https://s.example.com/q?src=go&a=1111111111&b=2222222222#top"},
+		{"truncate with one huge parameter keeps only the target's query", longQueryTruncate, "/s?q=" + strings.Repeat("x", 100), http.StatusTemporaryRedirect, "https://s.example.com/q?src=go"},
+		{"drop-query", longQueryDrop, "/s?" + long, http.StatusTemporaryRedirect, "https://s.example.com/q?src=go"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &maxTargetLength, 64)
+			setGlobal(t, &longTargetMode, longTargetError)
+			setGlobal(t, &longQueryMode, tt.mode)
+
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if n := len(rec.Header().Get("Location")); n > 64 {
+				t.Errorf("Location is %d long, over the limit of 64", n)
+			}
+		})
+	}
+}
+
+func TestBareQuery(t *testing.T) {
+	requested := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.RequestURI
+	}))
+	defer upstream.Close()
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/keep", "url": "https://example.com/k?src=go", "options": {"preserveQuery": true}},
+		{"rule": "/plain", "url": "https://example.com/p", "options": {"preserveQuery": true}},
+		{"rule": "/docs*", "url": "https://docs.example.com", "options": {"appendPath": true, "preserveQuery": true}},
+		{"rule": "/beta", "url": "https://example.com/stable", "queryRules": [{"param": "beta", "url": "https://example.com/beta"}]},
+		{"type": "proxy", "rule": "/api", "url": "`+upstream.URL+`/v1"}
+	]}`)
+	setGlobal(t, &maxAppendLength, 100)
+	setGlobal(t, &maxAppendSegments, 10)
+
+	for _, path := range []string{"/go", "/keep", "/plain", "/docs/intro", "/beta", "/missing"} {
+		t.Run(path, func(t *testing.T) {
+			bare := serve(conf, httptest.NewRequest(http.MethodGet, path+"?", nil))
+			none := serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+			if bare.Code != none.Code || bare.Header().Get("Location") != none.Header().Get("Location") {
+				t.Errorf("GET %s? = %d %q, GET %s = %d %q, want the same", path, bare.Code, bare.Header().Get("Location"), path, none.Code, none.Header().Get("Location"))
+			}
+			if strings.HasSuffix(bare.Header().Get("Location"), "?") {
+				t.Errorf("GET %s? = %q, a bare ? was carried over", path, bare.Header().Get("Location"))
+			}
+		})
+	}
+
+	t.Run("proxied", func(t *testing.T) {
+		for _, path := range []string{"/api?", "/api"} {
+			serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+			if got := <-requested; got != "/v1" {
+				t.Errorf("GET %s reached the upstream as %q, want /v1", path, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ruleLimiters - One limiter per Rule ID, kept across router rebuilds so a
+// reload doesn't hand every Rule a fresh burst.
+var ruleLimiters = struct {
+	sync.Mutex
+	limiters map[string]*rate.Limiter
+}{limiters: map[string]*rate.Limiter{}}
+
+// ruleLimiter - The limiter for the Rule, created or updated to match its
+// RateLimit. Burst defaults to the rps rounded up.
+func ruleLimiter(id string, limit RateLimit) *rate.Limiter {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(limit.RPS))
+	}
+
+	ruleLimiters.Lock()
+	defer ruleLimiters.Unlock()
+
+	limiter, ok := ruleLimiters.limiters[id]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limit.RPS), burst)
+		ruleLimiters.limiters[id] = limiter
+		return limiter
+	}
+
+	limiter.SetLimit(rate.Limit(limit.RPS))
+	limiter.SetBurst(burst)
+	return limiter
+}
+
+// clientLimiterSize - Most clients `-rate-limit` tracks before it starts over
+const clientLimiterSize = 10000
+
+// clientLimiters - One limiter per client IP for `-rate-limit`, kept across
+// router rebuilds like ruleLimiters
+var clientLimiters = struct {
+	sync.Mutex
+	limiters map[string]*rate.Limiter
+}{limiters: map[string]*rate.Limiter{}}
+
+// clientLimiter - The client's limiter, a full table is emptied rather than
+// tracking which client was seen last
+func clientLimiter(ip string, rps float64, burst int) *rate.Limiter {
+	clientLimiters.Lock()
+	defer clientLimiters.Unlock()
+
+	limiter, ok := clientLimiters.limiters[ip]
+	if !ok {
+		if len(clientLimiters.limiters) >= clientLimiterSize {
+			clientLimiters.limiters = map[string]*rate.Limiter{}
+		}
+		limiter = rate.NewLimiter(rate.Limit(rps), burst)
+		clientLimiters.limiters[ip] = limiter
+	}
+	return limiter
+}
+
+// clientRateLimit - Answer a client going over rps requests per second
+// (across every Rule and the default) with a 429, for `-rate-limit`. Burst
+// defaults to the rps rounded up like a Rule's rateLimit.
+func clientRateLimit(rps float64, burst int) Middleware {
+	if burst <= 0 {
+		burst = int(math.Ceil(rps))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !clientLimiter(clientIP(r), rps, burst).Allow() {
+				loggerFromContext(r.Context()).Warn("Client is over the -rate-limit", "client", clientIP(r))
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
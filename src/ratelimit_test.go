@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+// resetLimiters - Start the test with no Rule or client limiters, they'd
+// otherwise carry their spent bursts over from earlier tests
+func resetLimiters(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		ruleLimiters.Lock()
+		ruleLimiters.limiters = map[string]*rate.Limiter{}
+		ruleLimiters.Unlock()
+		clientLimiters.Lock()
+		clientLimiters.limiters = map[string]*rate.Limiter{}
+		clientLimiters.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestRuleRateLimit(t *testing.T) {
+	resetLimiters(t)
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/hot", "url": "https://example.com/hot", "rateLimit": {"rps": 0.001, "burst": 3}},
+		{"rule": "/cold", "url": "https://example.com/cold"},
+		{"rule": "/warm", "url": "https://example.com/warm", "rateLimit": {"rps": 0.001, "burst": 1}}
+	]}`)
+	handler := chain(buildRouter(conf), buildMiddleware(conf))
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := get("/hot"); code != http.StatusTemporaryRedirect {
+			t.Fatalf("request %d inside the burst = %d", i, code)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if code := get("/hot"); code != http.StatusTooManyRequests {
+			t.Errorf("request %d past the burst = %d, want 429", i, code)
+		}
+	}
+
+	// Each Rule has a limiter of its own, or none at all
+	for i := 0; i < 10; i++ {
+		if code := get("/cold"); code != http.StatusTemporaryRedirect {
+			t.Fatalf("unlimited rule request %d = %d", i, code)
+		}
+	}
+	if code := get("/warm"); code != http.StatusTemporaryRedirect {
+		t.Errorf("another limited rule = %d, want its own burst", code)
+	}
+	if code := get("/missing"); code != http.StatusTemporaryRedirect {
+		t.Errorf("the default = %d, want it untouched", code)
+	}
+
+	// A reload keeps the spent burst
+	handler = chain(buildRouter(conf), buildMiddleware(conf))
+	if code := get("/hot"); code != http.StatusTooManyRequests {
+		t.Errorf("after a rebuild = %d, want still 429", code)
+	}
+}
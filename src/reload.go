@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// swapHandler - A Handler that can be replaced while serving, so a reload
+// swaps in a new router without touching the listener
+type swapHandler struct {
+	v atomic.Value
+}
+
+func (s *swapHandler) Store(h http.Handler) {
+	s.v.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.v.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+// publicHandler - What the public listener serves, swapped on every reload
+var publicHandler = &swapHandler{}
+
+// currentRouter - The *mux.Router inside publicHandler, for the warmup probe
+var currentRouter atomic.Value
+
+// configSource - Where the Config comes from, loaded again on reload
+var configSource ConfigSource
+
+// configDiff - Summary of what a reload changed, by Rule ID
+type configDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	Rules   int      `json:"rules"`
+}
+
+// diffConfigs - Which Rules a reload added, removed or changed
+func diffConfigs(old, new Config) configDiff {
+	before := map[string]URLRule{}
+	for _, rule := range activeRules(old) {
+		before[rule.ID()] = rule
+	}
+
+	diff := configDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	after := activeRules(new)
+	for _, rule := range after {
+		previous, ok := before[rule.ID()]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, rule.ID())
+		case !reflect.DeepEqual(previous, rule):
+			diff.Changed = append(diff.Changed, rule.ID())
+		}
+		delete(before, rule.ID())
+	}
+	for id := range before {
+		diff.Removed = append(diff.Removed, id)
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	diff.Rules = len(after)
+	return diff
+}
+
+// applyConfig - Build everything the Config needs and start serving it
+func applyConfig(conf Config) error {
+	if conf.FinalRedirect == "" && len(conf.DefaultTargets) == 0 && onEmptyDefault == emptyDefaultError {
+		return errors.New("the config has no defaultRedirect (see -on-empty-default)")
+	}
+
+	rules := len(activeRules(conf))
+	if err := checkRuleCount(rules); err != nil {
+		return err
+	}
+
+	built := time.Now()
+	router := conf.router
+	if router == nil {
+		router = buildRouter(conf)
+	}
+	handler := chain(router, buildMiddleware(conf))
+	slog.Info("Built router", "rules", rules, "took", time.Since(built))
+
+	currentRouter.Store(router)
+	publicHandler.Store(handler)
+	setActiveConfig(conf)
+	return nil
+}
+
+// errDraining - A reload asked for once shutdown has started
+var errDraining = errors.New("the server is draining")
+
+// reloads - Serializes reloadConfig (signal and admin endpoint can ask at the
+// same time), with the outcome of the last one for coalesced callers
+var reloads struct {
+	sync.Mutex
+	started uint64
+	diff    configDiff
+	err     error
+}
+
+// reloadConfig - Load the Config again and swap it in. On any error the
+// current Config keeps serving, and once draining it is refused outright.
+// One reload runs at a time, a caller that had to wait for one that started
+// after it asked gets that reload's outcome instead of loading again.
+func reloadConfig() (configDiff, error) {
+	// Shutting down, a new Config would only serve the last few requests
+	// and a failed one would mark us unhealthy on the way out
+	if isDraining() {
+		slog.Warn("Config Reload Refused, the server is draining")
+		return configDiff{}, errDraining
+	}
+
+	asked := atomic.LoadUint64(&reloads.started)
+	reloads.Lock()
+	defer reloads.Unlock()
+	if atomic.LoadUint64(&reloads.started) != asked {
+		slog.Info("Config Reload Skipped, one already in progress loaded the config since it was asked for")
+		return reloads.diff, reloads.err
+	}
+	atomic.AddUint64(&reloads.started, 1)
+
+	reloads.diff, reloads.err = reload()
+	return reloads.diff, reloads.err
+}
+
+// reload - One reloadConfig, always called with reloads held
+func reload() (configDiff, error) {
+	old, _ := activeConfig()
+
+	conf, err := configSource.Load()
+	if err == nil {
+		err = applyConfig(conf)
+	}
+	recordReload(err)
+	if err != nil {
+		slog.Error("Config Reload Failed, keeping the current config", "err", err)
+		return configDiff{}, err
+	}
+
+	setConfigLoaded()
+	diff := diffConfigs(old, conf)
+	slog.Info("Config Reloaded", "rules", diff.Rules, "added", len(diff.Added), "removed", len(diff.Removed), "changed", len(diff.Changed))
+	return diff, nil
+}
+
+// reloadHandler - `POST /reload` on the admin listener, replies with the diff
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	diff, err := reloadConfig()
+	if err == errDraining {
+		writeJSONError(w, http.StatusServiceUnavailable, "reload refused: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "reload failed: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		slog.Error("Failed to Encode Reload Diff", "err", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/one", "url": "https://example.com/1"},
+		{"rule": "/two", "url": "https://example.com/2"},
+		{"rule": "/three", "url": "https://example.com/3"},
+		{"rule": "/off", "url": "https://example.com/off", "enabled": false}
+	]}`)
+
+	tests := []struct {
+		name   string
+		max    int
+		strict bool
+		warns  bool
+		err    bool
+	}{
+		{"under the limit", 3, false, false, false},
+		{"over the limit warns", 2, false, true, false},
+		{"over the limit in strict mode", 2, true, false, true},
+		{"no limit", 0, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &maxRules, tt.max)
+			setGlobal(t, &strictRules, tt.strict)
+			useConfig(t, Config{})
+			logs := captureLogs(t)
+
+			err := applyConfig(conf)
+			if tt.err {
+				if err == nil || !strings.Contains(err.Error(), "3 active rules, over the -max-rules limit of 2") {
+					t.Errorf("applyConfig = %v, want the rule count refused", err)
+				}
+				if active, _ := activeConfig(); len(active.RedirectRules) != 0 {
+					t.Error("the refused config was made active")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lines := logs()
+			if warned := findLog(lines, "Config is over the -max-rules limit, matching may be slow") != nil; warned != tt.warns {
+				t.Errorf("warned = %v, want %v", warned, tt.warns)
+			}
+			built := findLog(lines, "Built router")
+			if built == nil || built["rules"] != float64(3) || built["took"] == nil {
+				t.Errorf("router build log = %v, want the rule count and how long it took", built)
+			}
+		})
+	}
+}
+
+func TestEmptyDefault(t *testing.T) {
+	empty := `{"version": 1, "hostDefaults": {"b.example.com": "https://b.example.com/home"}, "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`
+	configured := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`
+
+	tests := []struct {
+		name     string
+		mode     string
+		config   string
+		err      bool
+		host     string
+		status   int
+		location string
+	}{
+		{"empty default is a 404", emptyDefaultNotFound, empty, false, "example.com", http.StatusNotFound, ""},
+		{"empty default still uses hostDefaults", emptyDefaultNotFound, empty, false, "b.example.com", http.StatusTemporaryRedirect, "https://b.example.com/home"},
+		{"empty default is refused", emptyDefaultError, empty, true, "", 0, ""},
+		{"configured default redirects", emptyDefaultError, configured, false, "example.com", http.StatusTemporaryRedirect, "https://example.com"},
+		{"configured default redirects in 404 mode", emptyDefaultNotFound, configured, false, "example.com", http.StatusTemporaryRedirect, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &onEmptyDefault, tt.mode)
+			useConfig(t, Config{})
+			conf := mustConfig(t, tt.config)
+
+			err := applyConfig(conf)
+			if tt.err {
+				if err == nil || !strings.Contains(err.Error(), "no defaultRedirect") {
+					t.Errorf("applyConfig = %v, want the empty default refused", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+			req.Host = tt.host
+			rec := serve(conf, req)
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s/missing = %d %q, want %d %q", tt.host, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if tt.status == http.StatusNotFound && !strings.Contains(rec.Body.String(), "no redirect is configured") {
+				t.Errorf("404 body = %q, want it to say no redirect is configured", rec.Body)
+			}
+			// Matched rules aren't affected either way
+			if got := serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil)).Header().Get("Location"); got != "https://golang.org" {
+				t.Errorf("GET /go = %q, want https://golang.org", got)
+			}
+		})
+	}
+}
+
+func TestReloadWhileDraining(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	setGlobal(t, &draining, int32(0))
+	setGlobal(t, &configLoaded, int32(1))
+	setGlobal(t, &healthDrainingStatus, http.StatusServiceUnavailable)
+	oldStarted := drainStarted
+	drainStarted, drainOnce = make(chan struct{}), sync.Once{}
+	t.Cleanup(func() { drainStarted, drainOnce = oldStarted, sync.Once{} })
+	t.Cleanup(func() { recordReload(nil) })
+
+	before := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/v", "url": "https://example.com/before"}]}`)
+	useConfig(t, before)
+	source := &flakySource{conf: mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/v", "url": "https://example.com/after"}]}`)}
+	setGlobal[ConfigSource](t, &configSource, source)
+
+	// Before the shutdown a reload goes through
+	if rec := adminRequest(http.MethodPost, "/reload", "admin", "secret"); rec.Code != http.StatusOK || source.calls != 1 {
+		t.Fatalf("POST /reload before draining = %d, %d loads", rec.Code, source.calls)
+	}
+	useConfig(t, before)
+	setDraining()
+
+	tests := []struct {
+		name   string
+		reload func() (int, error)
+	}{
+		{"admin endpoint", func() (int, error) {
+			rec := adminRequest(http.MethodPost, "/reload", "admin", "secret")
+			if !strings.Contains(rec.Body.String(), "reload refused: the server is draining") {
+				t.Errorf("POST /reload body = %s", rec.Body)
+			}
+			return rec.Code, nil
+		}},
+		{"signal", func() (int, error) {
+			_, err := reloadConfig()
+			return 0, err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			code, err := tt.reload()
+			if code != 0 && code != http.StatusServiceUnavailable {
+				t.Errorf("refused with %d, want 503", code)
+			}
+			if code == 0 && err != errDraining {
+				t.Errorf("reloadConfig = %v, want errDraining", err)
+			}
+			if findLog(logs(), "Config Reload Refused, the server is draining") == nil {
+				t.Error("the refusal wasn't logged")
+			}
+
+			if source.calls != 1 {
+				t.Errorf("the config was loaded %d times, want no load while draining", source.calls)
+			}
+			if conf, _ := activeConfig(); conf.RedirectRules[0].URL != "https://example.com/before" {
+				t.Errorf("serving %s, want the config from before the drain", conf.RedirectRules[0].URL)
+			}
+			// Still on the way out
+			rec := httptest.NewRecorder()
+			readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if !isDraining() || rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("draining %v, /readyz %d, want still draining", isDraining(), rec.Code)
+			}
+		})
+	}
+}
+
+// gatedSource - A Source whose loads wait until release is closed, counting them
+type gatedSource struct {
+	mu      sync.Mutex
+	calls   int
+	started chan struct{}
+	release chan struct{}
+	conf    Config
+}
+
+func (s *gatedSource) Load() (Config, error) {
+	s.mu.Lock()
+	s.calls++
+	first := s.calls == 1
+	s.mu.Unlock()
+	if first {
+		close(s.started)
+	}
+	<-s.release
+	return s.conf, nil
+}
+
+func (s *gatedSource) String() string {
+	return "gated"
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+	setGlobal(t, &draining, int32(0))
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/v", "url": "https://example.com/before"}]}`))
+	source := &gatedSource{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		conf:    mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/v", "url": "https://example.com/after"}]}`),
+	}
+	setGlobal[ConfigSource](t, &configSource, source)
+	t.Cleanup(func() { recordReload(nil) })
+	logs := captureLogs(t)
+
+	// One reload holds the lock while the rest ask, half by signal and half
+	// through the admin endpoint
+	const waiting = 8
+	errs := make(chan error, waiting+1)
+	go func() {
+		_, err := reloadConfig()
+		errs <- err
+	}()
+	<-source.started
+	for i := 0; i < waiting; i++ {
+		if i%2 == 0 {
+			go func() {
+				_, err := reloadConfig()
+				errs <- err
+			}()
+			continue
+		}
+		go func() {
+			if rec := adminRequest(http.MethodPost, "/reload", "admin", "secret"); rec.Code != http.StatusOK {
+				errs <- fmt.Errorf("POST /reload = %d %s", rec.Code, rec.Body)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	// Long enough for them all to be waiting on the first
+	time.Sleep(100 * time.Millisecond)
+	close(source.release)
+
+	for i := 0; i < waiting+1; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("reload %d: %v", i, err)
+		}
+	}
+
+	// The first, then one more for everyone who asked while it ran
+	if source.calls != 2 {
+		t.Errorf("the config was loaded %d times, want 2", source.calls)
+	}
+	skipped := 0
+	for _, line := range logs() {
+		if line["msg"] == "Config Reload Skipped, one already in progress loaded the config since it was asked for" {
+			skipped++
+		}
+	}
+	if skipped != waiting-1 {
+		t.Errorf("logged %d skipped reloads, want %d", skipped, waiting-1)
+	}
+	rec := httptest.NewRecorder()
+	publicHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v", nil))
+	if got := rec.Header().Get("Location"); got != "https://example.com/after" {
+		t.Errorf("GET /v after the reloads = %q, want the new config", got)
+	}
+}
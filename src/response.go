@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+)
+
+// bodyTemplate - Either an html or text template, picked by the content type
+type bodyTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// bodyData - What a Response Body template can reference
+type bodyData struct {
+	Target string
+	Status int
+}
+
+// responseBody - The parsed Config `responseBody`, nil to keep the stock body
+var responseBody bodyTemplate
+
+// responseBodyType - The Content-Type sent along with the Response Body
+var responseBodyType string
+
+// parseResponseBody - Compile the Response Body template. HTML content types
+// get `html/template` so the target is escaped, everything else is plain text.
+func parseResponseBody(body string, contentType string) (bodyTemplate, error) {
+	if strings.Contains(contentType, "html") {
+		return htmltemplate.New("body").Parse(body)
+	}
+	return texttemplate.New("body").Parse(body)
+}
+
+// redirect - Send the Redirect, with the configured Response Body if there is
+// one. Browsers ignore the body but curl and friends will show it.
+func redirect(w http.ResponseWriter, r *http.Request, target string, statusCode int) {
+	target = finalTarget(r, target)
+
+	if earlyHints {
+		sendEarlyHints(w, r, target)
+	}
+
+	if responseBody == nil {
+		http.Redirect(w, r, target, statusCode)
+		return
+	}
+
+	// Having a Content-Type already set stops http.Redirect writing its own body
+	w.Header().Set("Content-Type", responseBodyType)
+	http.Redirect(w, r, target, statusCode)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	err := responseBody.Execute(w, bodyData{Target: w.Header().Get("Location"), Status: statusCode})
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to Render Response Body", "err", err)
+	}
+}
+
+// finalTarget - The target as it goes out to the client
+func finalTarget(r *http.Request, target string) string {
+	if inheritScheme && strings.HasPrefix(target, "//") {
+		target = requestScheme(r) + ":" + target
+	}
+
+	// Keep a fragment the client sent, unless the target picks its own
+	if r.URL.Fragment != "" && !strings.Contains(target, "#") {
+		target += "#" + r.URL.Fragment
+	}
+	return target
+}
+
+// redirectDescriptor - The JSON a `jsonDescriptor` Rule answers with
+type redirectDescriptor struct {
+	Location string `json:"location"`
+	Status   int    `json:"status"`
+}
+
+// wantsDescriptor - If the client asked for JSON rather than being Redirected
+func wantsDescriptor(r *http.Request) bool {
+	return headerAccepts(r.Header.Get("Accept"), "application/json")
+}
+
+// writeDescriptor - Describe the Redirect as JSON with a 200, for clients
+// that would rather navigate themselves
+func writeDescriptor(w http.ResponseWriter, r *http.Request, target string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	body := redirectDescriptor{Location: finalTarget(r, target), Status: statusCode}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		loggerFromContext(r.Context()).Error("Failed to Encode Redirect Descriptor", "err", err)
+	}
+}
+
+// sendEarlyHints - A 103 so the browser can start connecting to the target
+// while the Redirect is still on its way. HTTP/2 only, plenty of HTTP/1.1
+// clients and proxies choke on a 1xx they didn't ask for.
+func sendEarlyHints(w http.ResponseWriter, r *http.Request, target string) {
+	if r.ProtoMajor != 2 {
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+
+	w.Header().Set("Link", "<"+u.Scheme+"://"+u.Host+">; rel=preconnect")
+	w.WriteHeader(http.StatusEarlyHints)
+	// Only meant for the 103, not the Redirect after it
+	w.Header().Del("Link")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestResponseBody(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org/?a=1&b=<2>"}
+	]}`)
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        string
+	}{
+		{"stock body", "", "", ""},
+		{"text template", "Moving to {{.Target}} ({{.Status}})", "text/plain", "Moving to https://golang.org/?a=1&b=<2> (307)"},
+		{"html template escapes the target", `<a href="{{.Target}}">here</a>`, "text/html; charset=utf-8", `<a href="https://golang.org/?a=1&amp;b=%3c2%3e">here</a>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bodyTemplate
+			if tt.body != "" {
+				var err error
+				if body, err = parseResponseBody(tt.body, tt.contentType); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setGlobal(t, &responseBody, body)
+			setGlobal(t, &responseBodyType, tt.contentType)
+
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, "/go", nil))
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "https://golang.org/?a=1&b=<2>" {
+				t.Fatalf("GET /go = %d %q, want the 307 unchanged", rec.Code, rec.Header().Get("Location"))
+			}
+			if tt.body == "" {
+				// http.Redirect's own short link to the target
+				if !strings.Contains(rec.Body.String(), "Temporary Redirect") {
+					t.Errorf("stock body = %q", rec.Body.String())
+				}
+				return
+			}
+			if rec.Body.String() != tt.want || rec.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("body = %q (%s), want %q (%s)", rec.Body.String(), rec.Header().Get("Content-Type"), tt.want, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestInheritScheme(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/mirror", "url": "//mirror.example.com/x"},
+		{"rule": "/fixed", "url": "https://example.com/fixed"}
+	]}`)
+	trusted, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &trustedProxies, trusted)
+
+	tests := []struct {
+		name     string
+		inherit  bool
+		path     string
+		tls      bool
+		remote   string
+		proto    string
+		location string
+	}{
+		{"over http", true, "/mirror", false, "192.0.2.1:5000", "", "http://mirror.example.com/x"},
+		{"over https", true, "/mirror", true, "192.0.2.1:5000", "", "https://mirror.example.com/x"},
+		{"https terminated at a trusted proxy", true, "/mirror", false, "10.0.0.1:5000", "https", "https://mirror.example.com/x"},
+		{"X-Forwarded-Proto from anyone else", true, "/mirror", false, "192.0.2.1:5000", "https", "http://mirror.example.com/x"},
+		{"explicit scheme is kept", true, "/fixed", false, "192.0.2.1:5000", "", "https://example.com/fixed"},
+		{"off leaves it scheme relative", false, "/mirror", true, "192.0.2.1:5000", "", "//mirror.example.com/x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &inheritScheme, tt.inherit)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestHead(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "14")
+		w.Write([]byte("hello upstream"))
+	}))
+	defer upstream.Close()
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/json", "url": "https://golang.org", "options": {"jsonDescriptor": true}},
+		{"rule": "/gone", "gone": true},
+		{"type": "proxy", "rule": "/api", "url": "`+upstream.URL+`"}
+	]}`)
+	page, err := parseResponseBody("Moving to {{.Target}}", "text/plain; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		body   bodyTemplate
+		status int
+	}{
+		{"redirect", "/go", "", nil, http.StatusTemporaryRedirect},
+		{"responseBody page", "/go", "", page, http.StatusTemporaryRedirect},
+		{"json descriptor", "/json", "application/json", nil, http.StatusOK},
+		{"gone", "/gone", "", nil, http.StatusGone},
+		{"proxied", "/api", "", nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &responseBody, tt.body)
+			if tt.body != nil {
+				setGlobal(t, &responseBodyType, "text/plain; charset=utf-8")
+			}
+			srv := httptest.NewServer(chain(buildRouter(conf), buildMiddleware(conf)))
+			defer srv.Close()
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+			responses := map[string]*http.Response{}
+			bodies := map[string]string{}
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req, _ := http.NewRequest(method, srv.URL+tt.path, nil)
+				if tt.accept != "" {
+					req.Header.Set("Accept", tt.accept)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("%s %s: %v", method, tt.path, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				responses[method], bodies[method] = resp, string(body)
+			}
+
+			get, head := responses[http.MethodGet], responses[http.MethodHead]
+			if head.StatusCode != tt.status || get.StatusCode != tt.status {
+				t.Errorf("GET %d, HEAD %d, want %d", get.StatusCode, head.StatusCode, tt.status)
+			}
+			if bodies[http.MethodHead] != "" {
+				t.Errorf("HEAD sent a body %q", bodies[http.MethodHead])
+			}
+			if bodies[http.MethodGet] == "" && tt.status != http.StatusGone {
+				t.Error("GET sent no body, nothing to compare the HEAD with")
+			}
+			for _, name := range []string{"Location", "Content-Type"} {
+				if head.Header.Get(name) != get.Header.Get(name) {
+					t.Errorf("HEAD %s = %q, GET had %q", name, head.Header.Get(name), get.Header.Get(name))
+				}
+			}
+			// A HEAD may leave Content-Length out, but one it sends has to be the GET's
+			if head.ContentLength != -1 && head.ContentLength != int64(len(bodies[http.MethodGet])) {
+				t.Errorf("HEAD Content-Length %d, the GET body is %d bytes", head.ContentLength, len(bodies[http.MethodGet]))
+			}
+			if tt.path == "/api" && head.ContentLength != 14 {
+				t.Errorf("proxied HEAD Content-Length %d, want the upstream's 14", head.ContentLength)
+			}
+		})
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org/doc"},
+		{"rule": "/rel", "url": "/elsewhere"}
+	]}`)
+	setGlobal(t, &earlyHints, true)
+
+	srv := httptest.NewUnstartedServer(chain(buildRouter(conf), buildMiddleware(conf)))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		http2 bool
+		path  string
+		hints []string
+	}{
+		{"HTTP/2 preconnects to the target", true, "/go", []string{"<https://golang.org>; rel=preconnect"}},
+		{"relative targets get none", true, "/rel", nil},
+		{"HTTP/1.1 gets none", false, "/go", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := srv.Client()
+			if !tt.http2 {
+				transport := client.Transport.(*http.Transport).Clone()
+				transport.ForceAttemptHTTP2 = false
+				transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+				transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+				client = &http.Client{Transport: transport}
+			}
+			client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+			hints := []string(nil)
+			trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			}}
+			req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if (resp.ProtoMajor == 2) != tt.http2 {
+				t.Fatalf("request went over %s", resp.Proto)
+			}
+			if resp.StatusCode != http.StatusTemporaryRedirect {
+				t.Errorf("GET %s = %d, want the 307 after the hints", tt.path, resp.StatusCode)
+			}
+			if strings.Join(hints, ",") != strings.Join(tt.hints, ",") {
+				t.Errorf("103 Links = %q, want %q", hints, tt.hints)
+			}
+			if link := resp.Header.Get("Link"); link != "" {
+				t.Errorf("the redirect itself carried Link %q", link)
+			}
+		})
+	}
+}
+
+func TestJSONDescriptor(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/spa", "url": "https://app.example.com/home", "options": {"jsonDescriptor": true, "statusCode": 301, "preserveQuery": true}},
+		{"rule": "/plain", "url": "https://example.com/plain"}
+	]}`)
+
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		descriptor *redirectDescriptor
+		status     int
+		vary       bool
+	}{
+		{"API client", "/spa?tab=2", "application/json", &redirectDescriptor{"https://app.example.com/home?tab=2", 301}, http.StatusOK, true},
+		{"API client listing several", "/spa", "text/plain, application/json;q=0.9", &redirectDescriptor{"https://app.example.com/home", 301}, http.StatusOK, true},
+		{"browser", "/spa?tab=2", "text/html,application/xhtml+xml,*/*;q=0.8", nil, http.StatusMovedPermanently, true},
+		{"JSON turned off", "/spa", "application/json;q=0", nil, http.StatusMovedPermanently, true},
+		{"rule without the option", "/plain", "application/json", nil, http.StatusTemporaryRedirect, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := serve(conf, req)
+			if rec.Code != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, rec.Code, tt.status)
+			}
+			if vary := rec.Header().Get("Vary") == "Accept"; vary != tt.vary {
+				t.Errorf("Vary = %q, want Accept %v", rec.Header().Get("Vary"), tt.vary)
+			}
+
+			if tt.descriptor == nil {
+				if rec.Header().Get("Location") == "" {
+					t.Error("no Location on the Redirect")
+				}
+				return
+			}
+			if rec.Header().Get("Location") != "" || rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("headers = %v, want uncached JSON and no Location", rec.Header())
+			}
+			got := redirectDescriptor{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %q: %v", rec.Body.String(), err)
+			}
+			if got != *tt.descriptor {
+				t.Errorf("descriptor = %+v, want %+v", got, *tt.descriptor)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		control  bool
+		bindsTwo bool
+	}{
+		{"with -reuseport", true, true},
+		{"without", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := net.ListenConfig{}
+			if tt.control {
+				lc.Control = reusePortControl
+			}
+
+			first, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+
+			second, err := lc.Listen(context.Background(), "tcp", first.Addr().String())
+			if tt.bindsTwo {
+				if err != nil {
+					t.Fatalf("second bind of %s: %v", first.Addr(), err)
+				}
+				defer second.Close()
+				if second.Addr().String() != first.Addr().String() {
+					t.Errorf("second listener is on %s, want %s", second.Addr(), first.Addr())
+				}
+
+				// Both are live, a connection lands on one of them
+				conn, err := net.Dial("tcp", first.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				second.Close()
+				t.Errorf("second bind of %s worked without SO_REUSEPORT", first.Addr())
+			}
+		})
+	}
+}
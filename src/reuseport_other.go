@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl - SO_REUSEPORT handoff is only wired up on Linux
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("-reuseport is only supported on Linux")
+}
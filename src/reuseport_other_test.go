@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePortUnsupported(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err == nil {
+		ln.Close()
+		t.Error("-reuseport listened, want it refused off Linux")
+	}
+}
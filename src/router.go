@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// buildRouter - Register every usable Rule from the Config, anything that
+// doesn't match falls through to the Default Redirect. With `-base-path`
+// all of it sits under the prefix and nothing outside it is served.
+func buildRouter(conf Config) *mux.Router {
+	b := newRouterBuilder(conf)
+	for _, v := range activeRules(conf) {
+		b.add(v)
+	}
+	return b.router(conf)
+}
+
+// routeTier - Rules of the same precedence, see routeTier.before
+type routeTier struct {
+	wildcard     bool
+	length       int // Of a wildcard's path, longer prefixes go first
+	wildcardHost bool
+	anyPort      bool
+}
+
+// before - If the tier's Rules are tried ahead of the other's. Exact paths
+// always beat a wildcard over the same path, the longest wildcard prefix
+// beats shorter ones whatever order the Config lists them in, and a Rule for
+// one port beats one for every port (or a `*.` host).
+func (t routeTier) before(other routeTier) bool {
+	if t.wildcard != other.wildcard {
+		return !t.wildcard
+	}
+	if t.length != other.length {
+		return t.length > other.length
+	}
+	if t.wildcardHost != other.wildcardHost {
+		return !t.wildcardHost
+	}
+	return !t.anyPort && other.anyPort
+}
+
+// tierRouter - The Rules of one routeTier, matched through match and
+// registered on rules (match itself, or its `-base-path` subrouter)
+type tierRouter struct {
+	match *mux.Router
+	rules *mux.Router
+}
+
+// routerBuilder - Builds the router a Rule at a time, so a streamed Config
+// can register each Rule as it is decoded (see streamConfig). mux takes the
+// first route that matches, so rather than sorting the Rules up front each
+// goes in the tier for its precedence and the tiers are tried in order.
+type routerBuilder struct {
+	conf           Config
+	defaultHandler http.Handler
+	tiers          map[routeTier]tierRouter
+}
+
+// newRouterBuilder - A routerBuilder for the Config's settings, its Rules are
+// left to add
+func newRouterBuilder(conf Config) *routerBuilder {
+	// Default 404 Route, Redirect using Default URL
+	defaultHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bouncing a form POST to some other site is rarely what anyone wants
+		if len(conf.DefaultMethods) > 0 && !methodListed(r.Method, conf.DefaultMethods) {
+			w.Header().Set("Allow", strings.ToUpper(strings.Join(conf.DefaultMethods, ", ")))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		target := defaultTarget(conf, r)
+
+		// No defaultRedirect, an empty Location is worse than saying so
+		if target == "" {
+			logAccess(r, slog.LevelInfo, "No Default Redirect", "host", r.Host, "path", r.URL.Path)
+			http.Error(w, "Not Found: no redirect is configured for this address", http.StatusNotFound)
+			return
+		}
+
+		logAccess(r, slog.LevelInfo, "Redirected User with Default", "target", target, "status", http.StatusTemporaryRedirect)
+		analytics.Record(r, "", http.StatusTemporaryRedirect)
+		audit.Record(r, "", http.StatusTemporaryRedirect)
+		countRedirect("", http.StatusTemporaryRedirect)
+		redirect(w, r, target, http.StatusTemporaryRedirect)
+	})
+
+	return &routerBuilder{conf: conf, defaultHandler: defaultHandler, tiers: map[routeTier]tierRouter{}}
+}
+
+// add - Register the Rule, it has to be one activeRules keeps
+func (b *routerBuilder) add(v URLRule) {
+	tier := routeTier{wildcard: isWildcard(v.Path), wildcardHost: isWildcardHost(v.Host), anyPort: v.Port == 0}
+	if tier.wildcard {
+		tier.length = len(v.Path)
+	}
+	t, ok := b.tiers[tier]
+	if !ok {
+		t.match = mux.NewRouter()
+		t.rules = t.match
+		if base := strings.TrimSuffix(basePath, "/"); base != "" {
+			t.rules = t.match.PathPrefix(base).Subrouter()
+		}
+		b.tiers[tier] = t
+	}
+
+	var route *mux.Route
+	if isWildcard(v.Path) {
+		route = t.rules.PathPrefix(strings.TrimSuffix(v.Path, "*")).Handler(ruleHandler(b.conf, v, b.defaultHandler))
+	} else {
+		route = t.rules.Handle(v.Path, ruleHandler(b.conf, v, b.defaultHandler))
+	}
+	// So -simulate can say which Rule a request got
+	route.Name(v.ID())
+
+	// Only match requests for this Host, when one is given. `*.example.com`
+	// takes any subdomain, it is kept as the subdomain variable.
+	if isWildcardHost(v.Host) {
+		route.Host("{" + subdomainKey + ":" + subdomainPattern + "}" + normalizeHost(strings.TrimPrefix(v.Host, "*")))
+	} else if v.Host != "" {
+		route.Host(normalizeHost(v.Host))
+	}
+
+	// Only match requests that came in on this listener port
+	if v.Port != 0 {
+		if len(splitList(listenAddr)) < 2 {
+			slog.Warn("Rule has a port but there is only one -addr listener", "rule", v.ID())
+		}
+		port := v.Port
+		route.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return localPort(req) == port
+		})
+	}
+
+	// Other methods carry on to the next Rule, see `-method-mismatch`
+	if len(v.Methods) > 0 {
+		methods := make([]string, len(v.Methods))
+		for i, method := range v.Methods {
+			methods[i] = strings.ToUpper(method)
+		}
+		route.Methods(methods...)
+	}
+}
+
+// router - The router for everything added, with conf (by now holding every
+// Rule) for the sitemap and Matchers
+func (b *routerBuilder) router(conf Config) *mux.Router {
+	root := mux.NewRouter()
+	r := root
+	if base := strings.TrimSuffix(basePath, "/"); base != "" {
+		// A whole segment, `/r` mustn't take `/rgo`
+		r = root.PathPrefix(base).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return req.URL.Path == base || strings.HasPrefix(req.URL.Path, base+"/")
+		}).Subrouter()
+		root.NotFoundHandler = http.NotFoundHandler()
+	}
+
+	// Reserved, registered ahead of the Rules so none of them can shadow it
+	if enableSitemap {
+		r.Handle("/sitemap.xml", sitemapHandler(conf)).Methods(http.MethodGet, http.MethodHead)
+	}
+
+	order := make([]routeTier, 0, len(b.tiers))
+	for tier := range b.tiers {
+		order = append(order, tier)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].before(order[j])
+	})
+	tiers := make([]*mux.Router, len(order))
+	for i, tier := range order {
+		tiers[i] = b.tiers[tier].match
+	}
+	r.NewRoute().MatcherFunc(matchTiers(tiers))
+
+	// After the Rules, so a Rule for one of the icon paths still wins
+	if conf.IconURL != "" {
+		for _, path := range iconPaths {
+			r.Handle(path, iconHandler(conf.IconURL))
+		}
+	}
+
+	// Anything the Config doesn't match gets a try with the custom Matchers
+	r.NotFoundHandler = matcherHandler(conf, b.defaultHandler)
+
+	// Only Rules for other methods matched the path
+	r.MethodNotAllowedHandler = r.NotFoundHandler
+	if methodMismatch == methodMismatch405 {
+		methods := limitedMethods(conf)
+		r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Allow", strings.Join(allowedMethods(root, req, methods), ", "))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		})
+
+		// mux forgets the mismatch when a later Rule for the path fails on
+		// something else (another Host), so a not found asks again. Only
+		// when some route is limited to methods, and only until one takes it.
+		if len(methods) > 0 {
+			notFound, notAllowed := r.NotFoundHandler, r.MethodNotAllowedHandler
+			r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for _, method := range methods {
+					if methodMatches(root, req, method) {
+						notAllowed.ServeHTTP(w, req)
+						return
+					}
+				}
+				notFound.ServeHTTP(w, req)
+			})
+		}
+	}
+	root.MethodNotAllowedHandler = r.MethodNotAllowedHandler
+
+	return root
+}
+
+// matchTiers - Try the tiers in order, as if their Rules were one list. A
+// tier with the path only for other methods has to leave that for the
+// `-method-mismatch` handler, where mux alone would report the later tiers'
+// not found instead.
+func matchTiers(tiers []*mux.Router) mux.MatcherFunc {
+	return func(req *http.Request, match *mux.RouteMatch) bool {
+		mismatch := false
+		for _, tier := range tiers {
+			if tier.Match(req, match) {
+				return true
+			}
+			if match.MatchErr == mux.ErrMethodMismatch {
+				mismatch = true
+			}
+			match.MatchErr = nil
+		}
+		if mismatch {
+			match.MatchErr = mux.ErrMethodMismatch
+		}
+		return false
+	}
+}
+
+// ruleHandler - Redirects (or proxies) requests matched to the Rule, for
+// the clients its allowCIDRs/blockCIDRs let through
+func ruleHandler(conf Config, v URLRule, defaultHandler http.Handler) http.Handler {
+	return networkGate(v, serveRule(conf, v, defaultHandler), defaultHandler)
+}
+
+// networkGate - Send clients outside the Rule's allowCIDRs, or inside its
+// blockCIDRs, to the default as if the Rule wasn't there
+func networkGate(v URLRule, next http.Handler, defaultHandler http.Handler) http.Handler {
+	if len(v.AllowCIDRs) == 0 && len(v.BlockCIDRs) == 0 {
+		return next
+	}
+
+	// Already checked by validateConfig
+	allow, _ := parseCIDRs(strings.Join(v.AllowCIDRs, ","))
+	block, _ := parseCIDRs(strings.Join(v.BlockCIDRs, ","))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := parseClientIP(r)
+		if ip == nil || ipListed(ip, block) || len(allow) > 0 && !ipListed(ip, allow) {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRule - The Redirect (or proxy) itself
+func serveRule(conf Config, v URLRule, defaultHandler http.Handler) http.Handler {
+	if v.Gone {
+		return goneHandler(v)
+	}
+	if v.Type == ruleTypeProxy {
+		return proxyHandler(conf, v)
+	}
+
+	path := v.Path
+	id := v.ID()
+	selector := newTargetSelector(v, configLocation(conf))
+	description := v.Description
+	// Already checked by validateConfig
+	level, _ := parseLogLevel(v.LogLevel)
+	options := v.RedirectOptions
+
+	var limiter *rate.Limiter
+	if v.RateLimit != nil {
+		limiter = ruleLimiter(id, *v.RateLimit)
+	}
+
+	var signingKey []byte
+	if v.SigningKey != "" {
+		signingKey = []byte(v.SigningKey)
+	}
+
+	// Default Redirect Method, 307
+	statusCode := http.StatusTemporaryRedirect
+	if options.StatusCode != 0 {
+		statusCode = options.StatusCode
+	}
+
+	var delay time.Duration
+	if v.Delay != "" {
+		// Already checked by validateConfig
+		delay, _ = time.ParseDuration(v.Delay)
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withLogFields(r, "rule", path)
+		r = withLogReason(r, v.Reason)
+		r = withLogVars(r, id)
+
+		// This Rule alone is over its limit, everything else carries on
+		if limiter != nil && !limiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		// Time limited links, only the signed ones get through
+		if signingKey != nil {
+			if err := verifyLink(signingKey, r, clock()); err != nil {
+				logAccess(r, level, "Refused Signed Link", "reason", err.Error(), "status", http.StatusForbidden)
+				http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		// Slow down whoever is hammering this link
+		if delay > 0 && !sleepCtx(r.Context(), delay) {
+			return
+		}
+
+		if v.Sticky == stickyCookie {
+			r = assignBucket(w, r)
+		}
+
+		url := selector.Select(r)
+		if url == "" {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+		if options.AppendPath && isWildcard(path) {
+			rest := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(basePath, "/")+strings.TrimSuffix(path, "*"))
+			if len(rest) > maxAppendLength || len(strings.Split(strings.Trim(rest, "/"), "/")) > maxAppendSegments {
+				loggerFromContext(r.Context()).Warn("Path to append is over the limit, serving the default", "length", len(rest))
+				defaultHandler.ServeHTTP(w, r)
+				return
+			}
+			url = appendPath(url, rest)
+		}
+		if options.TrailingSlash != "" {
+			url = setTrailingSlash(url, options.TrailingSlash)
+		}
+		if options.PreserveQuery {
+			url = preserveQuery(url, r.URL.RawQuery, conf.QueryMerge)
+		}
+		if param := options.CorrelationParam; param != "" {
+			token := newRequestID()
+			url = preserveQuery(url, param+"="+token, queryMergeAll)
+			r = withLogFields(r, "correlation", token)
+		}
+
+		// Catch anything computed at request time that slipped past the load check
+		if targetBlocked(url, conf.BlockedTargetHosts) {
+			loggerFromContext(r.Context()).Warn("Target for Rule is on a blocked host, serving the default", "target", url)
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+
+		if len(conf.AllowedTargetHosts) > 0 && !isAllowedTarget(url, conf.AllowedTargetHosts) {
+			loggerFromContext(r.Context()).Warn("Target for Rule is not an allowed host", "target", url)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Don't emit a Location that clients or proxies will choke on
+		if maxTargetLength > 0 && len(url) > maxTargetLength {
+			loggerFromContext(r.Context()).Warn("Target for Rule is over the length limit", "length", len(url), "limit", maxTargetLength)
+			if longTargetMode == longTargetDefault {
+				defaultHandler.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Request-URI Too Long", http.StatusRequestURITooLong)
+			return
+		}
+
+		// http.StatusTemporaryRedirect, 307
+		// http.StatusMovedPermanently, 301/302
+		args := []interface{}{"target", url, "status", statusCode, "description", description}
+		if description == "" {
+			args = args[:4]
+		}
+		logAccess(r, level, "Redirected User Rule Based", args...)
+		analytics.Record(r, id, statusCode)
+		audit.Record(r, id, statusCode)
+		countRedirect(id, statusCode)
+		if options.JSONDescriptor {
+			// Caches mustn't hand a browser the JSON, or an API client the Redirect
+			w.Header().Add("Vary", "Accept")
+			if wantsDescriptor(r) {
+				writeDescriptor(w, r, url, statusCode)
+				return
+			}
+		}
+		redirect(w, r, url, statusCode)
+	}) // Close Anonymous function registration for the Method.
+}
+
+// sleepCtx - Wait out the delay, false when the client gave up first. Shutdown
+// cuts the wait short so draining isn't held up, the request then carries on.
+func sleepCtx(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-drainStarted:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// goneHandler - A link retired on purpose, a 410 (with its goneMessage, or
+// else its reason) tells search engines to drop it rather than keep retrying
+func goneHandler(v URLRule) http.Handler {
+	message := v.GoneMessage
+	if message == "" {
+		message = v.Reason
+	}
+	if message == "" {
+		message = "Gone"
+	}
+	// Already checked by validateConfig
+	level, _ := parseLogLevel(v.LogLevel)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withLogFields(r, "rule", v.Path)
+		r = withLogReason(r, v.Reason)
+
+		logAccess(r, level, "Told User Rule is Gone", "status", http.StatusGone)
+		analytics.Record(r, v.ID(), http.StatusGone)
+		audit.Record(r, v.ID(), http.StatusGone)
+		countRedirect(v.ID(), http.StatusGone)
+		http.Error(w, message, http.StatusGone)
+	})
+}
+
+// defaultTarget - Where an unmatched request goes, the Host specific default
+// when there is one, otherwise the global FinalRedirect.
+func defaultTarget(conf Config, r *http.Request) string {
+	host := normalizeHost(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if target, ok := conf.HostDefaults[host]; ok && target != "" {
+		return target
+	}
+	if len(conf.DefaultTargets) > 0 {
+		return pickWeighted(conf.DefaultTargets)
+	}
+	return conf.FinalRedirect
+}
+
+// activeRules - The Rules that will actually be served, skipping anything
+// incomplete, turned off by its Tags or with `enabled: false`.
+func activeRules(conf Config) []URLRule {
+	enabled := splitList(enableTags)
+	disabled := splitList(disableTags)
+
+	rules := []URLRule{}
+	for _, v := range conf.RedirectRules {
+		if ruleServed(v, enabled, disabled) {
+			rules = append(rules, v)
+		}
+	}
+	return rules
+}
+
+// ruleServed - If activeRules keeps the Rule, with `-enable-tags` and
+// `-disable-tags` already split
+func ruleServed(v URLRule, enabled, disabled []string) bool {
+	return v.Path != "" && (v.URL != "" || len(v.Targets) > 0 || len(v.Variants) > 0 || len(v.Codes) > 0 || v.lookup != nil || v.Gone) && v.enabled() && ruleActive(v, enabled, disabled)
+}
+
+// checkRuleCount - Warn (or with `-strict-rules` fail) when there are more
+// than `-max-rules` Rules, big routers are slow to build and to match against
+func checkRuleCount(count int) error {
+	if maxRules <= 0 || count <= maxRules {
+		return nil
+	}
+
+	if strictRules {
+		return fmt.Errorf("config has %d active rules, over the -max-rules limit of %d", count, maxRules)
+	}
+	slog.Warn("Config is over the -max-rules limit, matching may be slow", "rules", count, "limit", maxRules)
+	return nil
+}
+
+// httpMethods - The methods a Rule can be limited to
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// limitedMethods - The methods some route is limited to, worked out as the
+// router is built. A route for any method would have matched the request
+// already, so these are the only ones worth probing for a 405.
+func limitedMethods(conf Config) []string {
+	limited := map[string]bool{}
+	for _, v := range conf.RedirectRules {
+		for _, method := range v.Methods {
+			limited[strings.ToUpper(method)] = true
+		}
+	}
+	if enableSitemap {
+		limited[http.MethodGet] = true
+		limited[http.MethodHead] = true
+	}
+
+	methods := []string{}
+	for _, method := range httpMethods {
+		if limited[method] {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// allowedMethods - Which of the methods some Rule would take for the
+// request's path
+func allowedMethods(router *mux.Router, r *http.Request, methods []string) []string {
+	allowed := []string{}
+	for _, method := range methods {
+		if methodMatches(router, r, method) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// methodMatches - If the request would match a route were it the method
+func methodMatches(router *mux.Router, r *http.Request, method string) bool {
+	probe := r.Clone(r.Context())
+	probe.Method = method
+
+	match := mux.RouteMatch{}
+	return router.Match(probe, &match) && match.MatchErr == nil && match.Route != nil
+}
+
+// Values for a Rule's `trailingSlash`
+const (
+	trailingSlashAdd    = "add"
+	trailingSlashRemove = "remove"
+)
+
+// setTrailingSlash - Add or remove the slash at the end of the target's path,
+// ahead of any query or fragment. A bare host's root path is left alone.
+func setTrailingSlash(target string, mode string) string {
+	suffix := ""
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target, suffix = target[:i], target[i:]
+	}
+
+	// Where the path starts, after the scheme and host when there are some
+	start := 0
+	if i := strings.Index(target, "//"); i >= 0 {
+		start = len(target)
+		if j := strings.Index(target[i+2:], "/"); j >= 0 {
+			start = i + 2 + j
+		}
+	}
+	path := target[start:]
+
+	switch mode {
+	case trailingSlashAdd:
+		if !strings.HasSuffix(path, "/") {
+			target += "/"
+		}
+	case trailingSlashRemove:
+		if len(path) > 1 {
+			target = target[:start] + strings.TrimRight(path, "/")
+			if target[start:] == "" {
+				target += "/"
+			}
+		}
+	}
+	return target + suffix
+}
+
+// appendPath - Add the rest of a request path onto the target's path, ahead
+// of any query or fragment, with exactly one slash between them
+func appendPath(target string, rest string) string {
+	if rest == "" {
+		return target
+	}
+
+	suffix := ""
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target, suffix = target[:i], target[i:]
+	}
+	return strings.TrimSuffix(target, "/") + "/" + strings.TrimPrefix(rest, "/") + suffix
+}
+
+// isWildcard - If the Rule path is a `/word*` prefix match
+func isWildcard(path string) bool {
+	return strings.HasSuffix(path, "*")
+}
+
+// disabledRules - The Rules switched off with `enabled: false`
+func disabledRules(conf Config) []URLRule {
+	rules := []URLRule{}
+	for _, v := range conf.RedirectRules {
+		if !v.enabled() {
+			rules = append(rules, v)
+		}
+	}
+	return rules
+}
+
+// ruleActive - Check the Rule's Tags against `-enable-tags`/`-disable-tags`.
+// Untagged Rules are always active, a disabled tag beats an enabled one.
+func ruleActive(rule URLRule, enabled []string, disabled []string) bool {
+	for _, tag := range rule.Tags {
+		if containsString(disabled, tag) {
+			return false
+		}
+	}
+
+	if len(enabled) == 0 || len(rule.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range rule.Tags {
+		if containsString(enabled, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList - Split a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// methodListed - If the method is in the list, ignoring case
+func methodListed(method string, methods []string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString - If the list has the value in it
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
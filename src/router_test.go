@@ -0,0 +1,931 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLongTargets(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/search", "url": "https://search.example.com/q", "options": {"preserveQuery": true}}
+	]}`)
+	long := "/search?q=" + strings.Repeat("a", 200)
+
+	tests := []struct {
+		name     string
+		max      int
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{"under the limit", 100, longTargetError, "/search?q=go", http.StatusTemporaryRedirect, "https://search.example.com/q?q=go"},
+		{"over the limit is a 414", 100, longTargetError, long, http.StatusRequestURITooLong, ""},
+		{"over the limit serves the default", 100, longTargetDefault, long, http.StatusTemporaryRedirect, "https://example.com"},
+		{"no limit", 0, longTargetError, long, http.StatusTemporaryRedirect, "https://search.example.com/q" + strings.TrimPrefix(long, "/search")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &maxTargetLength, tt.max)
+			setGlobal(t, &longTargetMode, tt.mode)
+
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET = %d %q, want %d %q", rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+}
+
+func TestHostDefaults(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "hostDefaults": {
+		"a.example.com": "https://a.example.org",
+		"b.example.com": "https://b.example.org"
+	}, "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		location string
+	}{
+		{"first host", "a.example.com", "/missing", "https://a.example.org"},
+		{"second host", "b.example.com", "/missing", "https://b.example.org"},
+		{"host is normalized", "A.Example.com.:80", "/missing", "https://a.example.org"},
+		{"host with a port", "b.example.com:8080", "/missing", "https://b.example.org"},
+		{"other hosts get the global default", "c.example.com", "/missing", "https://example.com"},
+		{"rules still win", "a.example.com", "/go", "https://golang.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			rec := serve(conf, req)
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s%s = %d %q, want 307 %q", tt.host, tt.path, rec.Code, rec.Header().Get("Location"), tt.location)
+			}
+		})
+	}
+}
+
+func TestDefaultTargets(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "hostDefaults": {"pinned.example.com": "https://pinned.example.org"},
+		"defaultTargets": [
+			{"url": "https://new-a.example.com", "weight": 3},
+			{"url": "https://new-b.example.com", "weight": 1}
+		], "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	const n = 4000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/missing/"+strconv.Itoa(i), nil)
+		counts[serve(conf, req).Header().Get("Location")]++
+	}
+
+	tests := []struct {
+		location string
+		share    float64
+	}{
+		{"https://new-a.example.com", 0.75},
+		{"https://new-b.example.com", 0.25},
+		{"https://example.com", 0},
+	}
+	for _, tt := range tests {
+		// Well over five standard deviations either side
+		if got := float64(counts[tt.location]) / n; got < tt.share-0.04 || got > tt.share+0.04 {
+			t.Errorf("%s got %.3f of unmatched requests, want about %.2f (%v)", tt.location, got, tt.share, counts)
+		}
+	}
+
+	for path, want := range map[string]string{"/go": "https://golang.org", "/missing": "https://pinned.example.org"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "pinned.example.com"
+		if got := serve(conf, req).Header().Get("Location"); got != want {
+			t.Errorf("GET pinned.example.com%s = %q, want %q", path, got, want)
+		}
+	}
+
+	for _, targets := range []string{`[{"url": "https://a.example.com", "weight": 0}]`, `[{"weight": 1}]`} {
+		if _, err := parseConfig([]byte(`{"version": 1, "defaultTargets": ` + targets + `}`)); err == nil || !strings.Contains(err.Error(), "defaultTargets") {
+			t.Errorf("parseConfig with defaultTargets %s = %v, want a defaultTargets error", targets, err)
+		}
+	}
+}
+
+func TestRuleTags(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/prod", "url": "https://prod.example.com", "tags": ["production"]},
+		{"rule": "/stage", "url": "https://stage.example.com", "tags": ["staging"]},
+		{"rule": "/both", "url": "https://both.example.com", "tags": ["production", "staging"]},
+		{"rule": "/untagged", "url": "https://untagged.example.com"}
+	]}`)
+
+	tests := []struct {
+		name     string
+		enable   string
+		disable  string
+		expected []string
+	}{
+		{"no filter", "", "", []string{"/prod", "/stage", "/both", "/untagged"}},
+		{"only production", "production", "", []string{"/prod", "/both", "/untagged"}},
+		{"disable staging", "", "staging", []string{"/prod", "/untagged"}},
+		{"disable wins over enable", "production", "staging", []string{"/prod", "/untagged"}},
+		{"several tags", "production, staging", "", []string{"/prod", "/stage", "/both", "/untagged"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &enableTags, tt.enable)
+			setGlobal(t, &disableTags, tt.disable)
+
+			for _, path := range []string{"/prod", "/stage", "/both", "/untagged"} {
+				want := "https://example.com"
+				if containsString(tt.expected, path) {
+					want = "https://" + strings.TrimPrefix(path, "/") + ".example.com"
+				}
+				rec := serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+				if got := rec.Header().Get("Location"); got != want {
+					t.Errorf("GET %s = %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectsAreNotCompressed(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/go", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := serve(conf, req)
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("GET /go = %d Content-Encoding %q, want a plain 307", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestDefaultMethods(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  string
+		method   string
+		status   int
+		location string
+		allow    string
+	}{
+		{"GET is redirected", `["GET", "HEAD"]`, http.MethodGet, http.StatusTemporaryRedirect, "https://example.com", ""},
+		{"HEAD is redirected", `["GET", "HEAD"]`, http.MethodHead, http.StatusTemporaryRedirect, "https://example.com", ""},
+		{"POST is refused", `["GET", "HEAD"]`, http.MethodPost, http.StatusMethodNotAllowed, "", "GET, HEAD"},
+		{"lowercase methods in the config", `["get"]`, http.MethodPut, http.StatusMethodNotAllowed, "", "GET"},
+		{"not configured redirects everything", `[]`, http.MethodPost, http.StatusTemporaryRedirect, "https://example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "defaultMethods": `+tt.methods+`, "redirects": [
+				{"rule": "/form", "url": "https://example.com/form"}
+			]}`)
+
+			rec := serve(conf, httptest.NewRequest(tt.method, "/missing", nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location || rec.Header().Get("Allow") != tt.allow {
+				t.Errorf("%s /missing = %d Location %q Allow %q, want %d %q %q", tt.method, rec.Code,
+					rec.Header().Get("Location"), rec.Header().Get("Allow"), tt.status, tt.location, tt.allow)
+			}
+
+			// Rules are untouched by it
+			if rec := serve(conf, httptest.NewRequest(tt.method, "/form", nil)); rec.Code != http.StatusTemporaryRedirect {
+				t.Errorf("%s /form = %d, want the rule's 307", tt.method, rec.Code)
+			}
+		})
+	}
+}
+
+func TestExactBeforeWildcard(t *testing.T) {
+	exact := `{"rule": "/blog", "url": "https://example.com/exact"}`
+	prefix := `{"rule": "/blog*", "url": "https://example.com/prefix"}`
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/blog", "https://example.com/exact"},
+		{"/blog/post", "https://example.com/prefix"},
+		{"/blogs", "https://example.com/prefix"},
+		{"/blo", "https://example.com"},
+	}
+
+	for name, rules := range map[string]string{"exact first": exact + "," + prefix, "prefix first": prefix + "," + exact} {
+		t.Run(name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+rules+`]}`)
+			for _, tt := range tests {
+				if got := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)).Header().Get("Location"); got != tt.location {
+					t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+				}
+			}
+		})
+	}
+}
+
+func TestMethodMismatch(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/form", "methods": ["post", "PUT"], "url": "https://example.com/posted"},
+		{"host": "api.example.com", "rule": "/form", "methods": ["DELETE"], "url": "https://example.com/api"},
+		{"rule": "/any", "url": "https://example.com/any"}
+	]}`)
+
+	tests := []struct {
+		name     string
+		mode     string
+		method   string
+		path     string
+		status   int
+		location string
+		allow    string
+	}{
+		{"allowed method", methodMismatchDefault, http.MethodPost, "/form", http.StatusTemporaryRedirect, "https://example.com/posted", ""},
+		{"other method falls to the default", methodMismatchDefault, http.MethodGet, "/form", http.StatusTemporaryRedirect, "https://example.com", ""},
+		{"allowed method in 405 mode", methodMismatch405, http.MethodPut, "/form", http.StatusTemporaryRedirect, "https://example.com/posted", ""},
+		{"other method is a 405", methodMismatch405, http.MethodGet, "/form", http.StatusMethodNotAllowed, "", "POST, PUT"},
+		{"405 lists every rule for the host", methodMismatch405, http.MethodGet, "http://api.example.com/form", http.StatusMethodNotAllowed, "", "POST, PUT, DELETE"},
+		{"host rule's own method", methodMismatch405, http.MethodDelete, "http://api.example.com/form", http.StatusTemporaryRedirect, "https://example.com/api", ""},
+		{"unrestricted rules take any method", methodMismatch405, http.MethodPatch, "/any", http.StatusTemporaryRedirect, "https://example.com/any", ""},
+		{"unmatched paths still get the default", methodMismatch405, http.MethodGet, "/missing", http.StatusTemporaryRedirect, "https://example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &methodMismatch, tt.mode)
+
+			rec := serve(conf, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location || rec.Header().Get("Allow") != tt.allow {
+				t.Errorf("%s %s = %d %q Allow %q, want %d %q Allow %q", tt.method, tt.path, rec.Code, rec.Header().Get("Location"), rec.Header().Get("Allow"), tt.status, tt.location, tt.allow)
+			}
+		})
+	}
+}
+
+func TestLimitedMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		sitemap bool
+		want    []string
+	}{
+		{"no rule is limited, nothing to probe", `{"rule": "/a", "url": "https://example.com/a"}`, false, []string{}},
+		{"each method once, in httpMethods order", `{"rule": "/a", "methods": ["delete", "POST"], "url": "https://example.com/a"},
+			{"rule": "/b", "methods": ["POST"], "url": "https://example.com/b"}`, false, []string{http.MethodPost, http.MethodDelete}},
+		{"the sitemap takes GET and HEAD", `{"rule": "/a", "methods": ["PUT"], "url": "https://example.com/a"}`, true, []string{http.MethodGet, http.MethodHead, http.MethodPut}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &enableSitemap, tt.sitemap)
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+tt.rules+`]}`)
+			if got := limitedMethods(conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("limitedMethods = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+	// Listed least specific first, the order the Config gives can't matter
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/a*", "url": "https://example.com/a-any"},
+		{"rule": "/a/b*", "url": "https://example.com/ab-any"},
+		{"rule": "/a/b/c", "url": "https://example.com/abc"},
+		{"rule": "/h", "host": "*.example.com", "url": "https://example.com/any-sub"},
+		{"rule": "/h", "host": "www.example.com", "url": "https://example.com/www"},
+		{"rule": "/p", "url": "https://example.com/any-port"},
+		{"rule": "/p", "port": 8443, "url": "https://example.com/8443"},
+		{"rule": "/m", "methods": ["POST"], "url": "https://example.com/m-post"},
+		{"rule": "/m*", "methods": ["GET"], "url": "https://example.com/m-get"},
+		{"rule": "/only-post", "methods": ["POST"], "url": "https://example.com/posted"}
+	]}`)
+	setGlobal(t, &listenAddr, ":8080,:8443")
+
+	tests := []struct {
+		name     string
+		method   string
+		host     string
+		port     int
+		path     string
+		mode     string
+		status   int
+		location string
+	}{
+		{"exact beats wildcards", http.MethodGet, "example.com", 0, "/a/b/c", "", http.StatusTemporaryRedirect, "https://example.com/abc"},
+		{"longest wildcard", http.MethodGet, "example.com", 0, "/a/b/x", "", http.StatusTemporaryRedirect, "https://example.com/ab-any"},
+		{"shorter wildcard", http.MethodGet, "example.com", 0, "/a/x", "", http.StatusTemporaryRedirect, "https://example.com/a-any"},
+		{"host beats a wildcard host", http.MethodGet, "www.example.com", 0, "/h", "", http.StatusTemporaryRedirect, "https://example.com/www"},
+		{"wildcard host", http.MethodGet, "api.example.com", 0, "/h", "", http.StatusTemporaryRedirect, "https://example.com/any-sub"},
+		{"port beats any port", http.MethodGet, "example.com", 8443, "/p", "", http.StatusTemporaryRedirect, "https://example.com/8443"},
+		{"other port", http.MethodGet, "example.com", 8080, "/p", "", http.StatusTemporaryRedirect, "https://example.com/any-port"},
+		{"method mismatch carries on to a wildcard", http.MethodGet, "example.com", 0, "/m", "", http.StatusTemporaryRedirect, "https://example.com/m-get"},
+		{"method match", http.MethodPost, "example.com", 0, "/m", "", http.StatusTemporaryRedirect, "https://example.com/m-post"},
+		{"method mismatch falls to the default", http.MethodGet, "example.com", 0, "/only-post", "", http.StatusTemporaryRedirect, "https://example.com"},
+		{"method mismatch 405 past the later rules", http.MethodGet, "example.com", 0, "/only-post", methodMismatch405, http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mode != "" {
+				setGlobal(t, &methodMismatch, tt.mode)
+			}
+			req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+			if tt.port != 0 {
+				req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{Port: tt.port}))
+			}
+			rec := serve(conf, req)
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("%s %s%s = %d %q, want %d %q", tt.method, tt.host, tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if tt.status == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != http.MethodPost {
+				t.Errorf("Allow = %q, want POST", rec.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "iconURL": "https://cdn.example.com/icon.png", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs*", "url": "https://docs.example.com", "options": {"appendPath": true}}
+	]}`)
+	setGlobal(t, &basePath, "/r/")
+	setGlobal(t, &enableSitemap, true)
+	setGlobal(t, &maxAppendLength, 100)
+	setGlobal(t, &maxAppendSegments, 10)
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/r/go", http.StatusTemporaryRedirect, "https://golang.org"},
+		{"/r/docs/guide", http.StatusTemporaryRedirect, "https://docs.example.com/guide"},
+		{"/r/favicon.ico", http.StatusFound, "https://cdn.example.com/icon.png"},
+		{"/r/sitemap.xml", http.StatusOK, ""},
+		{"/r/nothing", http.StatusTemporaryRedirect, "https://example.com"},
+		{"/go", http.StatusNotFound, ""},
+		{"/docs/guide", http.StatusNotFound, ""},
+		{"/favicon.ico", http.StatusNotFound, ""},
+		{"/sitemap.xml", http.StatusNotFound, ""},
+		{"/rgo", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestDisabledRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/on", "url": "https://example.com/on", "enabled": true},
+		{"rule": "/unset", "url": "https://example.com/unset"},
+		{"rule": "/off", "url": "https://example.com/off", "enabled": false},
+		{"rule": "/shadow/*", "url": "https://example.com/shadow"},
+		{"rule": "/shadow/off", "url": "https://example.com/shadow-off", "enabled": false}
+	]}`)
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/on", "https://example.com/on"},
+		{"/unset", "https://example.com/unset"},
+		{"/off", "https://example.com"},
+		{"/shadow/off", "https://example.com/shadow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+
+	t.Run("rules.json", func(t *testing.T) {
+		useConfig(t, conf)
+		setGlobal(t, &adminUser, "admin")
+		setGlobal(t, &adminPass, "secret")
+
+		rules := []struct {
+			Path    string `json:"rule"`
+			Enabled *bool  `json:"enabled"`
+		}{}
+		rec := adminRequest(http.MethodGet, "/rules.json", "admin", "secret")
+		if err := json.NewDecoder(rec.Body).Decode(&rules); err != nil {
+			t.Fatalf("GET /rules.json = %d: %v", rec.Code, err)
+		}
+
+		got := map[string]string{}
+		for _, rule := range rules {
+			got[rule.Path] = "unset"
+			if rule.Enabled != nil {
+				got[rule.Path] = strconv.FormatBool(*rule.Enabled)
+			}
+		}
+		want := map[string]string{"/on": "true", "/unset": "unset", "/off": "false", "/shadow/*": "unset", "/shadow/off": "false"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("rules.json enabled = %v, want %v", got, want)
+		}
+		for i, rule := range rules {
+			if disabled := rule.Enabled != nil && !*rule.Enabled; disabled != (i >= 3) {
+				t.Errorf("rules.json[%d] is %s, want the disabled rules listed after the active ones", i, rule.Path)
+			}
+		}
+	})
+}
+
+func TestPortRules(t *testing.T) {
+	listeners := make([]net.Listener, 2)
+	ports := make([]int, 2)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		listeners[i] = ln
+		ports[i] = ln.Addr().(*net.TCPAddr).Port
+	}
+	setGlobal(t, &listenAddr, listeners[0].Addr().String()+","+listeners[1].Addr().String())
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "port": `+strconv.Itoa(ports[0])+`, "url": "https://example.com/first"},
+		{"rule": "/go", "port": `+strconv.Itoa(ports[1])+`, "url": "https://example.com/second"},
+		{"rule": "/only-first", "port": `+strconv.Itoa(ports[0])+`, "url": "https://example.com/only-first"},
+		{"rule": "/any", "url": "https://example.com/any"}
+	]}`)
+
+	handler := chain(buildRouter(conf), buildMiddleware(conf))
+	srv := &http.Server{Handler: handler}
+	for _, ln := range listeners {
+		go srv.Serve(ln)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{
+		Transport:     &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	tests := []struct {
+		listener int
+		path     string
+		location string
+	}{
+		{0, "/go", "https://example.com/first"},
+		{1, "/go", "https://example.com/second"},
+		{0, "/only-first", "https://example.com/only-first"},
+		{1, "/only-first", "https://example.com"},
+		{0, "/any", "https://example.com/any"},
+		{1, "/any", "https://example.com/any"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.listener)+tt.path, func(t *testing.T) {
+			resp, err := client.Get("http://" + listeners[tt.listener].Addr().String() + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s: %v", tt.path, err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Location"); got != tt.location {
+				t.Errorf("GET %s on port %d = %q, want %q", tt.path, ports[tt.listener], got, tt.location)
+			}
+		})
+	}
+
+	t.Run("a port with one listener is warned about", func(t *testing.T) {
+		setGlobal(t, &listenAddr, ":8080")
+		logs := captureLogs(t)
+		buildRouter(conf)
+		if findLog(logs(), "Rule has a port but there is only one -addr listener") == nil {
+			t.Error("no warning for a port rule with a single listener")
+		}
+	})
+}
+
+func TestGoneRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/retired", "gone": true, "goneMessage": "This campaign has ended"},
+		{"rule": "/old", "gone": true, "reason": "moved off the old blog"},
+		{"rule": "/dead", "gone": true},
+		{"rule": "/was-a-link", "gone": true, "url": "https://example.com/still-here"},
+		{"rule": "/live", "url": "https://example.com/live"}
+	]}`)
+	setGlobal(t, &redirects, newRedirectCounter())
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/retired", http.StatusGone, "This campaign has ended\n"},
+		{"/old", http.StatusGone, "moved off the old blog\n"},
+		{"/dead", http.StatusGone, "Gone\n"},
+		{"/was-a-link", http.StatusGone, "Gone\n"},
+		{"/live", http.StatusTemporaryRedirect, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.status)
+			}
+			if tt.status != http.StatusGone {
+				return
+			}
+			if rec.Body.String() != tt.body || rec.Header().Get("Location") != "" {
+				t.Errorf("GET %s = %q Location %q, want %q and no redirect", tt.path, rec.Body.String(), rec.Header().Get("Location"), tt.body)
+			}
+			if got := redirects.Snapshot()[redirectKey{Rule: tt.path, Status: http.StatusGone}]; got != 1 {
+				t.Errorf("counted %d 410s for %s, want 1", got, tt.path)
+			}
+		})
+	}
+
+	_, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"type": "proxy", "rule": "/x", "url": "https://example.com", "gone": true}]}`))
+	if err == nil || !strings.Contains(err.Error(), "can't also be gone") {
+		t.Errorf("parseConfig with a gone proxy rule = %v, want an error", err)
+	}
+}
+
+func TestRuleDelay(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/slow", "delay": "100ms", "url": "https://example.com/slow"},
+		{"rule": "/capped", "delay": "1h", "url": "https://example.com/capped"},
+		{"rule": "/fast", "url": "https://example.com/fast"}
+	]}`)
+	setGlobal(t, &maxDelay, 200*time.Millisecond)
+	setGlobal(t, &draining, int32(0))
+	oldStarted := drainStarted
+	drainStarted, drainOnce = make(chan struct{}), sync.Once{}
+	t.Cleanup(func() { drainStarted, drainOnce = oldStarted, sync.Once{} })
+
+	tests := []struct {
+		path     string
+		min, max time.Duration
+	}{
+		{"/slow", 100 * time.Millisecond, time.Second},
+		{"/capped", 200 * time.Millisecond, time.Second},
+		{"/fast", 0, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			start := time.Now()
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			took := time.Since(start)
+			if took < tt.min || took > tt.max {
+				t.Errorf("GET %s took %s, want between %s and %s", tt.path, took, tt.min, tt.max)
+			}
+			if rec.Header().Get("Location") != "https://example.com"+tt.path {
+				t.Errorf("GET %s = %q after the delay", tt.path, rec.Header().Get("Location"))
+			}
+		})
+	}
+
+	t.Run("client gone", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		rec := serve(conf, httptest.NewRequest(http.MethodGet, "/capped", nil).WithContext(ctx))
+		if took := time.Since(start); took > 150*time.Millisecond {
+			t.Errorf("a cancelled request waited %s", took)
+		}
+		if rec.Header().Get("Location") != "" {
+			t.Errorf("a cancelled request was still redirected to %q", rec.Header().Get("Location"))
+		}
+	})
+
+	t.Run("shutdown cuts it short", func(t *testing.T) {
+		setGlobal(t, &maxDelay, time.Hour)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: chain(buildRouter(conf), buildMiddleware(conf))}
+		go srv.Serve(ln)
+
+		client := &http.Client{
+			Transport:     &http.Transport{DisableKeepAlives: true},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		type result struct {
+			location string
+			err      error
+		}
+		done := make(chan result, 1)
+		start := time.Now()
+		go func() {
+			resp, err := client.Get("http://" + ln.Addr().String() + "/capped")
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			resp.Body.Close()
+			done <- result{location: resp.Header.Get("Location")}
+		}()
+
+		// Well into the wait before the shutdown starts
+		time.Sleep(50 * time.Millisecond)
+		setDraining()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown = %v, the delay held up draining", err)
+		}
+
+		got := <-done
+		if got.err != nil || got.location != "https://example.com/capped" {
+			t.Errorf("GET /capped across the shutdown = %q, %v, want the redirect", got.location, got.err)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("GET /capped took %s, shutdown didn't cut the hour short", took)
+		}
+	})
+}
+
+func TestAppendPathLimits(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/docs*", "url": "https://docs.example.com", "options": {"appendPath": true}}
+	]}`)
+	setGlobal(t, &maxAppendSegments, 4)
+	setGlobal(t, &maxAppendLength, 40)
+
+	tests := []struct {
+		name     string
+		path     string
+		location string
+	}{
+		{"nothing appended", "/docs", "https://docs.example.com"},
+		{"normal path", "/docs/guide/intro", "https://docs.example.com/guide/intro"},
+		{"at the segment limit", "/docs/a/b/c/d", "https://docs.example.com/a/b/c/d"},
+		{"trailing slash doesn't count as a segment", "/docs/a/b/c/d/", "https://docs.example.com/a/b/c/d/"},
+		{"one segment too deep", "/docs/a/b/c/d/e", "https://example.com"},
+		{"deeply nested", "/docs" + strings.Repeat("/x", 500), "https://example.com"},
+		{"at the length limit", "/docs/" + strings.Repeat("a", 39), "https://docs.example.com/" + strings.Repeat("a", 39)},
+		{"one byte too long", "/docs/" + strings.Repeat("a", 40), "https://example.com"},
+		{"very long", "/docs/" + strings.Repeat("a", 10000), "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %.40s = %.60q, want %.60q", tt.path, got, tt.location)
+			}
+			capped := findLog(logs(), "Path to append is over the limit, serving the default") != nil
+			if capped != (tt.location == "https://example.com") {
+				t.Errorf("GET %.40s logged the cap %v", tt.path, capped)
+			}
+		})
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	rules := []string{
+		`{"rule": "/api*", "url": "https://example.com/api"}`,
+		`{"rule": "/api/v2*", "url": "https://example.com/v2"}`,
+		`{"rule": "/api/v2/users/admin*", "url": "https://example.com/admin"}`,
+		`{"rule": "/api/v2/users", "url": "https://example.com/users-exact"}`,
+	}
+	orders := map[string][]int{"shortest first": {0, 1, 2, 3}, "longest first": {3, 2, 1, 0}, "mixed": {1, 3, 0, 2}}
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/api", "https://example.com/api"},
+		{"/api/v1/users", "https://example.com/api"},
+		{"/apis", "https://example.com/api"},
+		{"/api/v2", "https://example.com/v2"},
+		{"/api/v2/users/42", "https://example.com/v2"},
+		{"/api/v2/users", "https://example.com/users-exact"},
+		{"/api/v2/users/admin/keys", "https://example.com/admin"},
+		{"/ap", "https://example.com"},
+	}
+
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			listed := make([]string, len(order))
+			for i, n := range order {
+				listed[i] = rules[n]
+			}
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+strings.Join(listed, ",")+`]}`)
+
+			for _, tt := range tests {
+				if got := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)).Header().Get("Location"); got != tt.location {
+					t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+				}
+			}
+		})
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		mode   string
+		target string
+		want   string
+	}{
+		{"add", "https://example.com/docs", "https://example.com/docs/"},
+		{"add", "https://example.com/docs/", "https://example.com/docs/"},
+		{"add", "https://example.com", "https://example.com/"},
+		{"add", "https://example.com/docs?x=1#top", "https://example.com/docs/?x=1#top"},
+		{"add", "/docs", "/docs/"},
+		{"remove", "https://example.com/docs/", "https://example.com/docs"},
+		{"remove", "https://example.com/docs", "https://example.com/docs"},
+		{"remove", "https://example.com/docs//", "https://example.com/docs"},
+		{"remove", "https://example.com/docs/?x=1#top", "https://example.com/docs?x=1#top"},
+		{"remove", "https://example.com/", "https://example.com/"},
+		{"remove", "https://example.com//", "https://example.com/"},
+		{"remove", "https://example.com", "https://example.com"},
+		{"remove", "/docs/", "/docs"},
+	}
+	for _, tt := range tests {
+		if got := setTrailingSlash(tt.target, tt.mode); got != tt.want {
+			t.Errorf("setTrailingSlash(%q, %s) = %q, want %q", tt.target, tt.mode, got, tt.want)
+		}
+	}
+
+	// Whatever the request, after appendPath and ahead of the query
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/add*", "url": "https://docs.example.com", "options": {"trailingSlash": "add", "appendPath": true, "preserveQuery": true}},
+		{"rule": "/remove*", "url": "https://docs.example.com/", "options": {"trailingSlash": "remove", "appendPath": true, "preserveQuery": true}}
+	]}`)
+	setGlobal(t, &maxAppendSegments, 32)
+	setGlobal(t, &maxAppendLength, 2048)
+	requests := []struct {
+		path     string
+		location string
+	}{
+		{"/add/guide", "https://docs.example.com/guide/"},
+		{"/add/guide/", "https://docs.example.com/guide/"},
+		{"/add/guide?v=2", "https://docs.example.com/guide/?v=2"},
+		{"/add", "https://docs.example.com/"},
+		{"/remove/guide/", "https://docs.example.com/guide"},
+		{"/remove/guide?v=2", "https://docs.example.com/guide?v=2"},
+		{"/remove", "https://docs.example.com/"},
+	}
+	for _, tt := range requests {
+		if got := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)).Header().Get("Location"); got != tt.location {
+			t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+		}
+	}
+
+	data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "url": "https://example.com", "options": {"trailingSlash": "yes"}}]}`
+	if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), `trailingSlash must be add or remove, got "yes"`) {
+		t.Errorf("parseConfig with trailingSlash yes = %v", err)
+	}
+}
+
+func TestRuleStatusCode(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/default", "url": "https://example.com/default", "description": "The usual"},
+		{"rule": "/moved", "url": "https://example.com/moved", "options": {"statusCode": 301}},
+		{"rule": "/found", "url": "https://example.com/found", "options": {"statusCode": 302}},
+		{"rule": "/308", "url": "https://example.com/308", "options": {"statusCode": 308}}
+	]}`)
+
+	tests := []struct {
+		path        string
+		status      int
+		description interface{}
+	}{
+		{"/default", http.StatusTemporaryRedirect, "The usual"},
+		{"/moved", http.StatusMovedPermanently, nil},
+		{"/found", http.StatusFound, nil},
+		{"/308", http.StatusPermanentRedirect, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			setGlobal(t, &redirects, newRedirectCounter())
+			logs := captureLogs(t)
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != "https://example.com"+tt.path {
+				t.Errorf("GET %s = %d %q, want %d", tt.path, rec.Code, rec.Header().Get("Location"), tt.status)
+			}
+
+			line := findLog(logs(), "Redirected User Rule Based")
+			if line == nil || line["status"] != float64(tt.status) || line["target"] != "https://example.com"+tt.path || line["description"] != tt.description {
+				t.Errorf("GET %s logged %v, want status %d and description %v", tt.path, line, tt.status, tt.description)
+			}
+			if got := redirects.Snapshot()[redirectKey{Rule: tt.path, Status: tt.status}]; got != 1 {
+				t.Errorf("counted %d under status %d, want 1", got, tt.status)
+			}
+		})
+	}
+}
+
+// discardWriter - A ResponseWriter that keeps nothing, its Header map reused
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(status int)      { d.status = status }
+
+// BenchmarkServeRule - An exact match 307, the common case. The 14
+// allocations a request left are the request scoped logger carrying the Rule
+// (about half), the access line's arguments and http.Redirect parsing the
+// target and setting Location.
+func BenchmarkServeRule(b *testing.B) {
+	conf, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org", "description": "Go"}
+	]}`))
+	if err != nil {
+		b.Fatal(err)
+	}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	defer slog.SetDefault(old)
+
+	handler := serveRule(conf, conf.RedirectRules[0], http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodGet, "/go", nil)
+	w := &discardWriter{header: http.Header{}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(w, req)
+		if w.status != http.StatusTemporaryRedirect {
+			b.Fatalf("GET /go = %d", w.status)
+		}
+	}
+}
+
+func TestWildcardHost(t *testing.T) {
+	for _, ttl := range []string{"", "1m"} {
+		t.Run("cacheTTL "+ttl, func(t *testing.T) {
+			// The wildcard listed first, the exact host still wins for its own
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"host": "*.example.com", "rule": "/go", "url": "https://{subdomain}.example.net/go", "cacheTTL": "`+ttl+`"},
+				{"host": "www.example.com", "rule": "/go", "url": "https://www.example.com/home"},
+				{"host": "*.shop.example.org", "rule": "/sale", "url": "https://shop.example.org/sale"}
+			]}`)
+			handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+			tests := []struct {
+				host     string
+				path     string
+				location string
+			}{
+				{"foo.example.com", "/go", "https://foo.example.net/go"},
+				{"bar.example.com", "/go", "https://bar.example.net/go"},
+				{"foo.example.com", "/go", "https://foo.example.net/go"},
+				{"a.b.example.com", "/go", "https://a.b.example.net/go"},
+				{"FOO.Example.com:80", "/go", "https://foo.example.net/go"},
+				{"www.example.com", "/go", "https://www.example.com/home"},
+				{"example.com", "/go", "https://example.com"},
+				{"fooexample.com", "/go", "https://example.com"},
+				{"foo.example.com.evil.test", "/go", "https://example.com"},
+				{"eu.shop.example.org", "/sale", "https://shop.example.org/sale"},
+				{"shop.example.org", "/sale", "https://example.com"},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				req.Host = tt.host
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if got := rec.Header().Get("Location"); got != tt.location {
+					t.Errorf("GET %s%s = %q, want %q", tt.host, tt.path, got, tt.location)
+				}
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		rule string
+		want string
+	}{
+		{`{"host": "foo.*.example.com", "rule": "/go", "url": "https://example.net"}`, "can only be a wildcard as a leading *."},
+		{`{"host": "*.*.example.com", "rule": "/go", "url": "https://example.net"}`, "can only be a wildcard as a leading *."},
+		{`{"host": "www.example.com", "rule": "/go", "url": "https://{subdomain}.example.net"}`, "has {subdomain} but the rule's host isn't a *. wildcard"},
+	} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [` + tt.rule + `]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%s) = %v, want %q", tt.rule, err, tt.want)
+		}
+	}
+}
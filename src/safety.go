@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// targetHost - The lowercased host of a target, without a port or trailing dot
+func targetHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(strings.ToLower(u.Hostname()), ".")
+}
+
+// hostListed - If the host is in the list, or a subdomain of something in it
+func hostListed(host string, list []string) bool {
+	for _, item := range list {
+		item = strings.TrimRight(strings.ToLower(item), ".")
+		if item != "" && (host == item || strings.HasSuffix(host, "."+item)) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetBlocked - If the target points at one of the BlockedTargetHosts
+func targetBlocked(target string, blocked []string) bool {
+	// Checked on every Redirect, don't parse the target for nothing
+	if len(blocked) == 0 {
+		return false
+	}
+	host := targetHost(target)
+	return host != "" && hostListed(host, blocked)
+}
+
+// isAllowedTarget - Open redirect guard for targets built from request data.
+// Relative (same origin) targets are fine, anything naming a host has to be
+// http(s) to a host in the allow list. Scheme relative `//evil.com` and the
+// backslash forms browsers treat the same way count as naming a host.
+func isAllowedTarget(target string, allow []string) bool {
+	target = strings.TrimSpace(target)
+	normalized := strings.Replace(target, `\`, "/", -1)
+
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return false
+	}
+
+	if u.Scheme == "" && u.Host == "" && !strings.HasPrefix(normalized, "//") {
+		return true
+	}
+
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	host := strings.TrimRight(strings.ToLower(u.Hostname()), ".")
+	return host != "" && hostListed(host, allow)
+}
+
+// targetAllowed - The load time AllowedTargetHosts check. A target with a
+// placeholder or template in it is only known per request, the Rule handler
+// checks those with isAllowedTarget as they're served.
+func targetAllowed(target string, allow []string) bool {
+	if len(allow) == 0 || strings.Contains(target, "{") {
+		return true
+	}
+	return isAllowedTarget(target, allow)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBlockedTargetHostsAtLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"rule target", `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+			{"rule": "/go", "url": "https://evil.example/landing"}
+		]}`, "rule /go: target https://evil.example/landing is on a blocked host"},
+		{"subdomain of a blocked host", `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+			{"rule": "/go", "url": "https://WWW.Evil.Example./landing"}
+		]}`, "is on a blocked host"},
+		{"one of several targets", `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+			{"rule": "/go", "targets": ["https://good.example", "https://evil.example"]}
+		]}`, "is on a blocked host"},
+		{"the default", `{"version": 1, "defaultRedirect": "https://evil.example", "blockedTargetHosts": ["evil.example"]}`, "defaultRedirect https://evil.example is on a blocked host"},
+		{"a host default", `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "hostDefaults": {"a.example.com": "https://evil.example"}}`, "hostDefaults a.example.com"},
+		{"a lookalike is fine", `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+			{"rule": "/go", "url": "https://notevil.example"}
+		]}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.data))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("parseConfig = %v, want it accepted", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseConfig = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBlockedTargetHostsAtRequest(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "blockedTargetHosts": ["evil.example"], "redirects": [
+		{"rule": "/to/{site}", "url": "https://{{.Vars.site}}/", "template": true}
+	]}`)
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/to/good.example", "https://good.example/"},
+		{"/to/evil.example", "https://example.com"},
+		{"/to/cdn.evil.example", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want 307 %q", tt.path, rec.Code, rec.Header().Get("Location"), tt.location)
+			}
+		})
+	}
+}
+
+func TestIsAllowedTarget(t *testing.T) {
+	allow := []string{"example.com", "partner.example"}
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"https://example.com/page", true},
+		{"http://www.example.com/page", true},
+		{"https://Partner.Example./x", true},
+		{"/local/path", true},
+		{"page?x=1", true},
+		{"https://evil.com/", false},
+		{"https://example.com.evil.com/", false},
+		{"https://evilexample.com/", false},
+		{"//evil.com", false},
+		{`\\evil.com`, false},
+		{`/\evil.com`, false},
+		{"  //evil.com", false},
+		{"//example.com/page", true},
+		{"javascript:alert(1)", false},
+		{"ftp://example.com/", false},
+		{"https://user@evil.com", false},
+		{"https://", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := isAllowedTarget(tt.target, allow); got != tt.want {
+				t.Errorf("isAllowedTarget(%q) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedTargetHosts(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "allowedTargetHosts": ["example.com"], "redirects": [
+		{"rule": "/out", "url": "https://{{.Query.Get \"to\"}}", "template": true}
+	]}`)
+
+	tests := []struct {
+		to       string
+		status   int
+		location string
+	}{
+		{"example.com/a", http.StatusTemporaryRedirect, "https://example.com/a"},
+		{"docs.example.com/a", http.StatusTemporaryRedirect, "https://docs.example.com/a"},
+		{"evil.com/", http.StatusBadRequest, ""},
+		{"example.com.evil.com/", http.StatusBadRequest, ""},
+		{"evil.com?.example.com", http.StatusBadRequest, ""},
+		{"/evil.com", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.to, func(t *testing.T) {
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, "/out?to="+url.QueryEscape(tt.to), nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET /out?to=%s = %d %q, want %d %q", tt.to, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+
+	// What's written in the Config is checked as it loads
+	loads := []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"allowed targets", `"defaultRedirect": "https://example.com", "hostDefaults": {"docs.example.com": "https://docs.example.com"}, "redirects": [
+			{"rule": "/a", "url": "https://a.example.com", "targets": ["/relative"]},
+			{"rule": "/{sub}", "url": "https://{sub}.example.com"},
+			{"type": "proxy", "rule": "/up", "url": "http://upstream.internal"}
+		]`, ""},
+		{"defaultRedirect", `"defaultRedirect": "https://evil.com", "redirects": []`, "defaultRedirect https://evil.com is not on an allowed host"},
+		{"hostDefaults", `"defaultRedirect": "https://example.com", "hostDefaults": {"docs.example.com": "https://evil.com"}, "redirects": []`, "hostDefaults docs.example.com: target https://evil.com is not on an allowed host"},
+		{"url", `"defaultRedirect": "https://example.com", "redirects": [{"rule": "/a", "url": "https://evil.com"}]`, "rule /a: target https://evil.com is not on an allowed host"},
+		{"targets", `"defaultRedirect": "https://example.com", "redirects": [{"rule": "/a", "targets": ["https://a.example.com", "//evil.com"]}]`, "rule /a: target //evil.com is not on an allowed host"},
+	}
+	for _, tt := range loads {
+		t.Run("load "+tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(`{"version": 1, "allowedTargetHosts": ["example.com"], ` + tt.conf + `}`))
+			if tt.err == "" && err != nil {
+				t.Errorf("parseConfig = %v, want it to load", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("parseConfig = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
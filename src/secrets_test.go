@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	writeFile(t, secretFile, "from-a-file\n")
+	t.Setenv("GOLOW_TEST_SECRET", "from-the-env")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		err   string
+	}{
+		{"literal", "plain", "plain", ""},
+		{"empty", "", "", ""},
+		{"env", "env:GOLOW_TEST_SECRET", "from-the-env", ""},
+		{"unset env", "env:GOLOW_TEST_MISSING", "", "GOLOW_TEST_MISSING isn't set"},
+		{"file drops the trailing newline", "file:" + secretFile, "from-a-file", ""},
+		{"missing file", "file:" + filepath.Join(dir, "missing"), "", "no such file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSecret(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("resolveSecret(%q) = %q, %v, want an error containing %q", tt.value, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveSecret(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigningKeySecrets(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	writeFile(t, keyFile, "file-key\n")
+	t.Setenv("GOLOW_TEST_KEY", "env-key")
+	setGlobal(t, &adminUser, "admin")
+	setGlobal(t, &adminPass, "secret")
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/env", "url": "https://example.com/env", "signingKey": "env:GOLOW_TEST_KEY"},
+		{"rule": "/file", "url": "https://example.com/file", "signingKey": "file:`+keyFile+`"}
+	]}`)
+	want := map[string]string{"/env": "env-key", "/file": "file-key"}
+	for _, rule := range conf.RedirectRules {
+		if rule.SigningKey != want[rule.Path] {
+			t.Errorf("rule %s signingKey = %q, want %q", rule.Path, rule.SigningKey, want[rule.Path])
+		}
+	}
+
+	// Redacted in the admin dump
+	useConfig(t, conf)
+	rec := adminRequest(http.MethodGet, "/rules.json", "admin", "secret")
+	rules := []URLRule{}
+	if err := json.NewDecoder(rec.Body).Decode(&rules); err != nil {
+		t.Fatalf("GET /rules.json = %d: %v", rec.Code, err)
+	}
+	for _, rule := range rules {
+		if rule.SigningKey != redactedSecret {
+			t.Errorf("rules.json shows rule %s signingKey %q, want it redacted", rule.Path, rule.SigningKey)
+		}
+	}
+
+	_, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "url": "https://example.com", "signingKey": "env:GOLOW_TEST_MISSING"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "rule /x: signingKey") {
+		t.Errorf("parseConfig with an unset signingKey env = %v, want a signingKey error", err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumpState - Deliver SIGUSR1 on the channel
+func notifyDumpState(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyRestart - Deliver SIGUSR2 on the channel
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
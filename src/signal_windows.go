@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyDumpState - Windows has no SIGUSR1, the state dump is admin only there
+func notifyDumpState(c chan<- os.Signal) {}
+
+// notifyRestart - Windows has no SIGUSR2 (or listener handoff), so no restarts
+func notifyRestart(c chan<- os.Signal) {}
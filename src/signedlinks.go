@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters a signed link carries, see signLink
+const (
+	expiresParam   = "expires"
+	signatureParam = "sig"
+)
+
+// redactedSecret - Shown in place of a secret in anything the admin pages dump
+const redactedSecret = "[redacted]"
+
+// Why a signed link was refused
+var (
+	errLinkUnsigned = errors.New("link isn't signed")
+	errLinkExpired  = errors.New("link has expired")
+	errLinkTampered = errors.New("link signature doesn't match")
+)
+
+// linkSignature - HMAC-SHA256 over the path and every query parameter but the
+// signature itself, in the sorted order url.Values encodes them in
+func linkSignature(key []byte, path string, query url.Values) string {
+	signed := url.Values{}
+	for name, values := range query {
+		if name != signatureParam {
+			signed[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path + "?" + signed.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signLink - The link with an expiry and a signature a Rule with the same
+// signingKey will accept until then, for `-sign`
+func signLink(key []byte, link string, expires time.Time) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del(signatureParam)
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(signatureParam, linkSignature(key, u.Path, query))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// verifyLink - Check the request carries a signature for its path and query
+// that hasn't expired, then take the signing parameters off so they never
+// reach the target
+func verifyLink(key []byte, r *http.Request, now time.Time) error {
+	query := r.URL.Query()
+	sig, expires := query.Get(signatureParam), query.Get(expiresParam)
+	if sig == "" || expires == "" {
+		return errLinkUnsigned
+	}
+
+	// The signature covers the expiry, check it first so a tampered expiry
+	// reads as tampered
+	if !hmac.Equal([]byte(sig), []byte(linkSignature(key, r.URL.Path, query))) {
+		return errLinkTampered
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errLinkTampered
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return errLinkExpired
+	}
+
+	query.Del(signatureParam)
+	query.Del(expiresParam)
+	r.URL.RawQuery = query.Encode()
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedLinks(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setGlobal(t, &clock, func() time.Time { return now })
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/download", "url": "https://files.example.com/get", "signingKey": "s3cret", "options": {"preserveQuery": true}},
+		{"rule": "/other", "url": "https://files.example.com/other", "signingKey": "s3cret"}
+	]}`)
+
+	sign := func(key, link string, expires time.Time) string {
+		signed, err := signLink([]byte(key), link, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := sign("s3cret", "/download?file=report.pdf", now.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		link     string
+		status   int
+		location string
+		body     string
+	}{
+		{"valid", valid, http.StatusTemporaryRedirect, "https://files.example.com/get?file=report.pdf", ""},
+		{"valid until the second it expires", sign("s3cret", "/download?file=a", now), http.StatusTemporaryRedirect, "https://files.example.com/get?file=a", ""},
+		{"expired", sign("s3cret", "/download?file=report.pdf", now.Add(-time.Second)), http.StatusForbidden, "", errLinkExpired.Error()},
+		{"tampered parameter", strings.Replace(valid, "report.pdf", "secrets.pdf", 1), http.StatusForbidden, "", errLinkTampered.Error()},
+		{"tampered expiry", strings.Replace(valid, "expires=", "expires=9", 1), http.StatusForbidden, "", errLinkTampered.Error()},
+		{"added parameter", valid + "&admin=1", http.StatusForbidden, "", errLinkTampered.Error()},
+		{"another key", sign("other", "/download?file=report.pdf", now.Add(time.Hour)), http.StatusForbidden, "", errLinkTampered.Error()},
+		{"signed for another path", strings.Replace(sign("s3cret", "/other?file=report.pdf", now.Add(time.Hour)), "/other", "/download", 1), http.StatusForbidden, "", errLinkTampered.Error()},
+		{"unsigned", "/download?file=report.pdf", http.StatusForbidden, "", errLinkUnsigned.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(conf, httptest.NewRequest(http.MethodGet, tt.link, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.link, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if tt.body != "" && !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("GET %s body = %q, want it to say %q", tt.link, rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
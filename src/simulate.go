@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// simulate - Run a made up request through the Config (router and
+// middleware, as it would be served) and write out which Rule it matched
+// and the response, for `-simulate`. Nothing is listened on.
+func simulate(out io.Writer, conf Config, method string, target string) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("-simulate needs a method and an absolute url, e.g. -simulate GET https://example.com/path")
+	}
+
+	router := buildRouter(conf)
+	req := httptest.NewRequest(strings.ToUpper(method), target, nil)
+
+	// Read from inside the chain, the Rule is the one the request matched
+	// once the middleware normalized it
+	rule := "none, the default redirect"
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+				rule = route.GetName()
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	rec := httptest.NewRecorder()
+	chain(router, buildMiddleware(conf)).ServeHTTP(rec, req)
+
+	fmt.Fprintf(out, "%s %s\n", req.Method, target)
+	fmt.Fprintf(out, "Rule: %s\n", rule)
+	for _, v := range activeRules(conf) {
+		if v.ID() == rule && v.Description != "" {
+			fmt.Fprintf(out, "Description: %s\n", v.Description)
+		}
+	}
+	fmt.Fprintf(out, "Status: %d %s\n", rec.Code, http.StatusText(rec.Code))
+
+	names := make([]string, 0, len(rec.Header()))
+	for name := range rec.Header() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range rec.Header()[name] {
+			fmt.Fprintf(out, "%s: %s\n", name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org", "options": {"statusCode": 301}},
+		{"rule": "/post", "methods": ["POST"], "url": "https://example.com/posted"},
+		{"host": "docs.example.com", "rule": "/guide", "url": "https://docs.example.com/v2/guide"}
+	]}`)
+	setGlobal(t, &cleanPaths, true)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   []string
+		err    bool
+	}{
+		{"matching", "GET", "https://example.com/go", []string{"GET https://example.com/go\n", "Rule: /go\n", "Status: 301 Moved Permanently\n", "Location: https://golang.org\n"}, false},
+		{"method is uppercased", "post", "https://example.com/post", []string{"POST https://example.com/post\n", "Rule: /post\n", "Location: https://example.com/posted\n"}, false},
+		{"not matching", "GET", "https://example.com/missing", []string{"Rule: none, the default redirect\n", "Status: 307 Temporary Redirect\n", "Location: https://example.com\n"}, false},
+		{"method mismatch", "GET", "https://example.com/post", []string{"Rule: none, the default redirect\n", "Location: https://example.com\n"}, false},
+		{"un-normalized url", "GET", "https://DOCS.Example.com:443//guide", []string{"Rule: docs.example.com/guide\n", "Location: https://docs.example.com/v2/guide\n"}, false},
+		{"relative url", "GET", "/go", nil, true},
+		{"no url", "GET", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &strings.Builder{}
+			err := simulate(out, conf, tt.method, tt.url)
+			if tt.err {
+				if err == nil {
+					t.Errorf("simulate(%s, %q) = nil, want an error", tt.method, tt.url)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("simulate(%s, %q) = %v", tt.method, tt.url, err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("simulate output is missing %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
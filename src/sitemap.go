@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// sitemapURLSet - The `<urlset>` of a sitemap.xml
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemapPaths - Paths of the exact-match Rules for the host. Wildcard and
+// variable paths have no single URL to list, so they're left out, as are
+// Gone Rules.
+func sitemapPaths(conf Config, host string) []string {
+	paths := []string{}
+	for _, rule := range activeRules(conf) {
+		if rule.Gone || strings.ContainsAny(rule.Path, "*{") {
+			continue
+		}
+		if rule.Host != "" && normalizeHost(rule.Host) != host {
+			continue
+		}
+		paths = append(paths, rule.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// sitemapHandler - `/sitemap.xml` with every exact-match Rule path for the host
+func sitemapHandler(conf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := strings.TrimSuffix(sitemapBase, "/")
+		if base == "" {
+			base = requestScheme(r) + "://" + r.Host
+		}
+		base += strings.TrimSuffix(basePath, "/")
+
+		set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+		for _, path := range sitemapPaths(conf, r.Host) {
+			set.URLs = append(set.URLs, sitemapURL{Loc: base + path})
+		}
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(set); err != nil {
+			loggerFromContext(r.Context()).Error("Failed to Encode Sitemap", "err", err)
+		}
+	})
+}
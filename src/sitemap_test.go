@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSitemap(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs", "url": "https://docs.example.com"},
+		{"rule": "/files/*", "url": "https://files.example.com"},
+		{"rule": "/user/{name}", "url": "https://example.com/u/{{.Vars.name}}", "template": true},
+		{"rule": "/old", "gone": true},
+		{"rule": "/off", "url": "https://example.com/off", "enabled": false},
+		{"host": "b.example.com", "rule": "/b", "url": "https://example.com/b"}
+	]}`)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		base    string
+		host    string
+		status  int
+		locs    []string
+	}{
+		{"off", false, "", "go.example.com", http.StatusTemporaryRedirect, nil},
+		{"request host", true, "", "go.example.com", http.StatusOK, []string{"http://go.example.com/docs", "http://go.example.com/go"}},
+		{"configured base", true, "https://short.example/", "go.example.com", http.StatusOK, []string{"https://short.example/docs", "https://short.example/go"}},
+		{"host rules for their host", true, "", "b.example.com", http.StatusOK, []string{"http://b.example.com/b", "http://b.example.com/docs", "http://b.example.com/go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &enableSitemap, tt.enabled)
+			setGlobal(t, &sitemapBase, tt.base)
+
+			req := httptest.NewRequest(http.MethodGet, "/sitemap.xml", nil)
+			req.Host = tt.host
+			rec := serve(conf, req)
+			if rec.Code != tt.status {
+				t.Fatalf("GET /sitemap.xml = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want XML", ct)
+			}
+
+			set := sitemapURLSet{}
+			if err := xml.Unmarshal(rec.Body.Bytes(), &set); err != nil {
+				t.Fatalf("sitemap isn't XML: %v\n%s", err, rec.Body)
+			}
+			if set.XMLNS != "http://www.sitemaps.org/schemas/sitemap/0.9" {
+				t.Errorf("xmlns = %q", set.XMLNS)
+			}
+			locs := []string{}
+			for _, u := range set.URLs {
+				locs = append(locs, u.Loc)
+			}
+			if !reflect.DeepEqual(locs, tt.locs) {
+				t.Errorf("sitemap lists %v, want %v", locs, tt.locs)
+			}
+		})
+	}
+}
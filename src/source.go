@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSource - Somewhere the Config can be Loaded from (local file, remote URL)
+type ConfigSource interface {
+	Load() (Config, error)
+	String() string
+}
+
+// fileSource - Loads the Config from a file on disk
+type fileSource struct {
+	path string
+}
+
+func (s fileSource) Load() (Config, error) {
+	return s.loadIncluding(nil)
+}
+
+// loadIncluding - Load the file and everything it includes, with stack
+// holding the files already being loaded above it so a loop is an error
+// instead of running forever.
+func (s fileSource) loadIncluding(stack []string) (Config, error) {
+	abs, err := filepath.Abs(s.path)
+	if err != nil {
+		return Config{}, err
+	}
+	if containsString(stack, abs) {
+		return Config{}, fmt.Errorf("%s: circular include (%s)", s.path, strings.Join(append(stack, abs), " -> "))
+	}
+
+	conf, err := s.load()
+	if err != nil || len(conf.Include) == 0 {
+		return conf, err
+	}
+
+	configs := []Config{}
+	names := []string{}
+	for _, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(s.path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: include %s: %v", s.path, pattern, err)
+		}
+		// A glob may match nothing, a plain path has to be there
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			matches = []string{pattern}
+		}
+
+		for _, match := range matches {
+			included, err := fileSource{path: match}.loadIncluding(append(stack, abs))
+			if err != nil {
+				return Config{}, err
+			}
+			included.Include = nil
+			configs = append(configs, included)
+			names = append(names, match)
+		}
+	}
+
+	conf.Include = nil
+	merged, err := mergeConfigs(append(names, s.path), append(configs, conf)...)
+	if err != nil {
+		return merged, err
+	}
+	return merged, validateConfig(merged)
+}
+
+// load - Read and decode just this file
+func (s fileSource) load() (Config, error) {
+	if info, err := os.Stat(s.path); err == nil && info.Size() > streamConfigSize && isJSON(s.path) {
+		return s.stream()
+	}
+
+	fileData, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	conf, err := parseConfigFormat(fileData, s.path, filepath.Dir(s.path))
+	if err != nil {
+		return conf, fmt.Errorf("%s: %v", s.path, err)
+	}
+	return conf, nil
+}
+
+// stream - Load a large JSON Config without holding the whole file in memory
+func (s fileSource) stream() (Config, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+
+	conf, err := streamConfig(f, filepath.Dir(s.path))
+	if err != nil {
+		return conf, fmt.Errorf("%s: %v", s.path, err)
+	}
+	return conf, nil
+}
+
+func (s fileSource) String() string {
+	return s.path
+}
+
+// httpSource - Loads the Config from a remote URL
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s httpSource) Load() (Config, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return Config{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Config{}, fmt.Errorf("unexpected status fetching config: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Config{}, err
+	}
+
+	conf, err := parseConfigFormat(body, resp.Request.URL.Path, "")
+	if err != nil {
+		return conf, fmt.Errorf("%s: %v", s.url, err)
+	}
+	if len(conf.Include) > 0 {
+		return conf, fmt.Errorf("%s: include only works for config files on disk", s.url)
+	}
+	return conf, nil
+}
+
+func (s httpSource) String() string {
+	return s.url
+}
+
+// embeddedConfig - config.example.json, built into the binary by `-use-embedded`
+//
+//go:embed config.example.json
+var embeddedConfig []byte
+
+// embeddedSource - Loads the Config built into the binary
+type embeddedSource struct{}
+
+func (embeddedSource) Load() (Config, error) {
+	return parseConfig(embeddedConfig)
+}
+
+func (embeddedSource) String() string {
+	return "embedded config"
+}
+
+// embeddedFallback - Use the embedded Config only when the file doesn't exist.
+// A file that exists but is broken is still an error, so precedence is the
+// `-config` file, then the embedded Config, then `-on-config-error`.
+type embeddedFallback struct {
+	ConfigSource
+}
+
+func (s embeddedFallback) Load() (Config, error) {
+	conf, err := s.ConfigSource.Load()
+	if err != nil && os.IsNotExist(err) {
+		slog.Info("No config found, using the embedded config", "source", s.ConfigSource.String())
+		return embeddedSource{}.Load()
+	}
+	return conf, err
+}
+
+// multiSource - Several Sources merged left to right, see mergeConfigs
+type multiSource []ConfigSource
+
+func (s multiSource) Load() (Config, error) {
+	configs := make([]Config, 0, len(s))
+	names := make([]string, 0, len(s))
+	for _, src := range s {
+		conf, err := src.Load()
+		if err != nil {
+			return conf, err
+		}
+		configs = append(configs, conf)
+		names = append(names, src.String())
+	}
+
+	merged, err := mergeConfigs(names, configs...)
+	if err != nil {
+		return merged, err
+	}
+	return merged, validateConfig(merged)
+}
+
+func (s multiSource) String() string {
+	names := make([]string, len(s))
+	for i, src := range s {
+		names[i] = src.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// fallbackSource - Sources tried in order, the first that Loads wins. For
+// when the primary can be down, e.g. a remote URL backed by a local copy.
+type fallbackSource []ConfigSource
+
+func (s fallbackSource) Load() (Config, error) {
+	var conf Config
+	var err error
+	for i, src := range s {
+		conf, err = src.Load()
+		if err == nil {
+			if i > 0 {
+				slog.Warn("Loaded Config from a fallback source", "source", src.String())
+			}
+			return conf, nil
+		}
+		if i < len(s)-1 {
+			slog.Warn("Unable to Load Config from source, trying the next", "source", src.String(), "err", err)
+		}
+	}
+	return conf, fmt.Errorf("all %d config sources failed, last: %w", len(s), err)
+}
+
+func (s fallbackSource) String() string {
+	names := make([]string, len(s))
+	for i, src := range s {
+		names[i] = src.String()
+	}
+	return strings.Join(names, "|")
+}
+
+// newConfigSource - Pick the Source based on the location given to `-config`.
+// A `|` separated list is a fallback chain tried left to right, and a comma
+// separated list is merged with later entries winning.
+func newConfigSource(location string) ConfigSource {
+	if strings.Contains(location, "|") {
+		sources := fallbackSource{}
+		for _, part := range strings.Split(location, "|") {
+			if part = strings.TrimSpace(part); part != "" {
+				sources = append(sources, newConfigSource(part))
+			}
+		}
+		return sources
+	}
+
+	if strings.Contains(location, ",") {
+		sources := multiSource{}
+		for _, part := range splitList(location) {
+			sources = append(sources, newConfigSource(part))
+		}
+		return sources
+	}
+
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return httpSource{url: location, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return fileSource{path: location}
+}
+
+// parseConfig - Decode the raw Config data, unknown keys are an error so a
+// typo doesn't silently turn a rule off.
+func parseConfig(data []byte) (Config, error) {
+	return parseJSONConfig(data, "")
+}
+
+// parseJSONConfig - parseConfig, reading relative lookupFiles from dir
+func parseJSONConfig(data []byte, dir string) (Config, error) {
+	conf := Config{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&conf); err != nil {
+		offset := dec.InputOffset()
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		default:
+			// Unknown keys only report where the object ended, point at the key instead
+			if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+				if i := bytes.LastIndex(data[:offset], []byte(name)); i >= 0 {
+					offset = int64(i)
+				}
+			}
+		}
+		line, col := lineAndColumn(data, offset)
+		return conf, fmt.Errorf("line %d, column %d: %v", line, col, err)
+	}
+
+	if dec.More() {
+		line, col := lineAndColumn(data, dec.InputOffset())
+		return conf, fmt.Errorf("line %d, column %d: unexpected data after the config", line, col)
+	}
+
+	return conf, finishConfig(&conf, dir)
+}
+
+// parseYAMLConfig - Decode YAML Config data, with the same unknown key checks
+func parseYAMLConfig(data []byte, dir string) (Config, error) {
+	conf := Config{}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	// An empty document is an empty Config, not an error
+	if err := dec.Decode(&conf); err != nil && err != io.EOF {
+		return conf, err
+	}
+
+	return conf, finishConfig(&conf, dir)
+}
+
+// streamConfigSize - JSON Configs bigger than this are streamed, see streamConfig
+const streamConfigSize = 32 << 20
+
+// streamConfig - Decode a JSON Config one Rule at a time, for configs with
+// hundreds of thousands of Rules. The document is never held whole and each
+// Rule is finished and registered on the router as it is decoded, the Config
+// keeps the Rules for everything that reports on them but applyConfig gets
+// the router ready built. The Rules need the settings, which can come after
+// them, so a first pass reads just those. Relative lookupFiles are read from dir.
+func streamConfig(r io.ReadSeeker, dir string) (Config, error) {
+	dec, err := streamObject(r)
+	if err != nil {
+		return Config{}, err
+	}
+	fail := func(err error) (Config, error) {
+		return Config{}, fmt.Errorf("byte %d: %v", dec.InputOffset(), err)
+	}
+
+	rest := map[string]json.RawMessage{}
+	rules := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		key := tok.(string)
+
+		if key == "redirects" {
+			skip := func() error {
+				rules++
+				var rule json.RawMessage
+				return dec.Decode(&rule)
+			}
+			if err := streamRules(dec, skip); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return fail(err)
+		}
+		rest[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+
+	// The settings go through the same unknown key checks
+	data, err := json.Marshal(rest)
+	if err != nil {
+		return Config{}, err
+	}
+	conf := Config{}
+	restDec := json.NewDecoder(bytes.NewReader(data))
+	restDec.DisallowUnknownFields()
+	if err := restDec.Decode(&conf); err != nil {
+		return conf, err
+	}
+	version := conf.Version
+	if err := finishSettings(&conf); err != nil {
+		return conf, err
+	}
+
+	// Now the Rules, into a list sized by the first pass so it never grows
+	if dec, err = streamObject(r); err != nil {
+		return Config{}, err
+	}
+	conf.RedirectRules = make([]URLRule, 0, rules)
+	b := newRouterBuilder(conf)
+	enabled, disabled := splitList(enableTags), splitList(disableTags)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		if tok.(string) != "redirects" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		err = streamRules(dec, func() error {
+			rule := URLRule{}
+			if err := dec.Decode(&rule); err != nil {
+				return err
+			}
+			if err := finishRule(conf, version, dir, &rule); err != nil {
+				return err
+			}
+
+			conf.RedirectRules = append(conf.RedirectRules, rule)
+			if ruleServed(rule, enabled, disabled) {
+				b.add(rule)
+			}
+			if len(conf.RedirectRules)%100000 == 0 {
+				slog.Info("Loading Config", "rules", len(conf.RedirectRules))
+			}
+			return nil
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	conf.router = b.router(conf)
+	slog.Info("Loaded Config", "rules", len(conf.RedirectRules))
+	return conf, nil
+}
+
+// streamObject - A Decoder at the start of the JSON object r holds, past its {
+func streamObject(r io.ReadSeeker) (*json.Decoder, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.DisallowUnknownFields()
+	if tok, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("byte %d: %v", dec.InputOffset(), err)
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("byte %d: config must be a JSON object", dec.InputOffset())
+	}
+	return dec, nil
+}
+
+// streamRules - Call rule to decode each element of the redirects list, one
+// at a time so only the one is ever in memory
+func streamRules(dec *json.Decoder, rule func() error) error {
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return errors.New("redirects must be a list")
+	}
+	for dec.More() {
+		if err := rule(); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// parseTOMLConfig - Decode TOML Config data, with the same unknown key checks
+func parseTOMLConfig(data []byte, dir string) (Config, error) {
+	conf := Config{}
+
+	meta, err := toml.Decode(string(data), &conf)
+	if err != nil {
+		return conf, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return conf, fmt.Errorf("unknown field %q", undecoded[0].String())
+	}
+
+	return conf, finishConfig(&conf, dir)
+}
+
+// isYAML - If the name says the Config is YAML, `.yaml`/`.yml`
+func isYAML(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// isJSON - If the Config is read as JSON, anything not YAML or TOML
+func isJSON(name string) bool {
+	return !isYAML(name) && !strings.EqualFold(path.Ext(name), ".toml")
+}
+
+// parseConfigFormat - Decode the Config in the format its name suggests,
+// `.yaml`/`.yml` are YAML, `.toml` is TOML and everything else is JSON.
+// Relative lookupFiles are read from dir.
+func parseConfigFormat(data []byte, name, dir string) (Config, error) {
+	if isYAML(name) {
+		return parseYAMLConfig(data, dir)
+	}
+	if strings.EqualFold(path.Ext(name), ".toml") {
+		return parseTOMLConfig(data, dir)
+	}
+	return parseJSONConfig(data, dir)
+}
+
+// lineAndColumn - Turn a byte offset into a 1 based line and column
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// loadConfig - Load the Config from a file path or URL
+func loadConfig(location string) (Config, error) {
+	return newConfigSource(location).Load()
+}
+
+// loadWithRetry - Keep trying to Load the Config with exponential backoff
+// until it works or the deadline passes. A zero deadline only tries once.
+func loadWithRetry(src ConfigSource, deadline time.Duration) (Config, error) {
+	giveUp := time.Now().Add(deadline)
+	backoff := 500 * time.Millisecond
+
+	for {
+		conf, err := src.Load()
+		if err == nil {
+			return conf, nil
+		}
+
+		remaining := time.Until(giveUp)
+		if remaining <= 0 {
+			return conf, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		slog.Warn("Failed to Load Config, retrying", "source", src.String(), "in", backoff, "err", err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// startupConfig - What to serve when the first Load failed. With
+// `-on-config-error=serve-default` that's only the broken Config's
+// defaultRedirect, checked again since it may be the very reason the Config
+// was refused, otherwise (or with no usable default) the error stands.
+func startupConfig(broken Config, err error) (Config, error) {
+	if onConfigError != onConfigErrorDefault {
+		return Config{}, err
+	}
+	if broken.FinalRedirect == "" {
+		return Config{}, fmt.Errorf("%v (and there is no defaultRedirect to serve instead)", err)
+	}
+
+	conf := Config{Version: currentConfigVersion, FinalRedirect: broken.FinalRedirect, BlockedTargetHosts: broken.BlockedTargetHosts}
+	if _, parseErr := url.Parse(conf.FinalRedirect); parseErr != nil {
+		return Config{}, fmt.Errorf("%v (and defaultRedirect can't be served instead: %v)", err, parseErr)
+	}
+	normalizeTargets(&conf)
+	if validErr := validateConfig(conf); validErr != nil {
+		return Config{}, fmt.Errorf("%v (and the defaultRedirect can't be served instead: %v)", err, validErr)
+	}
+	return conf, nil
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakySource - Fails the first failures Loads, then hands out its Config
+type flakySource struct {
+	failures int
+	calls    int
+	conf     Config
+}
+
+func (s *flakySource) Load() (Config, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return Config{}, errors.New("connection refused")
+	}
+	return s.conf, nil
+}
+
+func (s *flakySource) String() string {
+	return "flaky"
+}
+
+func TestLoadWithRetry(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	tests := []struct {
+		name      string
+		failures  int
+		deadline  time.Duration
+		wantErr   bool
+		wantCalls int
+	}{
+		{"first try", 0, 0, false, 1},
+		{"fails twice then loads", 2, 10 * time.Second, false, 3},
+		{"no deadline only tries once", 2, 0, true, 1},
+		{"gives up at the deadline", 100, 300 * time.Millisecond, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &flakySource{failures: tt.failures, conf: conf}
+			got, err := loadWithRetry(src, tt.deadline)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if src.calls != tt.wantCalls {
+				t.Errorf("Load called %d times, want %d", src.calls, tt.wantCalls)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// The server starts on what was loaded
+			rec := serve(got, httptest.NewRequest(http.MethodGet, "/go", nil))
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "https://golang.org" {
+				t.Errorf("GET /go = %d %q, want a 307 to https://golang.org", rec.Code, rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"misspelled key", "{\n  \"version\": 1,\n  \"defaultRedirect\": \"https://example.com\",\n  \"redirect\": []\n}", []string{"line 4, column 3", `unknown field "redirect"`}},
+		{"misspelled rule option", "{\"version\": 1, \"defaultRedirect\": \"https://example.com\", \"redirects\": [\n  {\"rule\": \"/go\", \"url\": \"https://golang.org\", \"options\": {\"statusCod\": 301}}\n]}", []string{"line 2", `unknown field "statusCod"`}},
+		{"syntax error", "{\n  \"version\": 1,\n  \"defaultRedirect\": \"https://example.com\"\n  \"redirects\": []\n}", []string{"line 4, column 4", "invalid character"}},
+		{"wrong type", "{\"version\": 1,\n\"defaultRedirect\": 5}", []string{"line 2", "string"}},
+		{"trailing data", "{\"version\": 1, \"defaultRedirect\": \"https://example.com\"}\n{}", []string{"line 2, column 1", "unexpected data"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.data))
+			if err == nil {
+				t.Fatal("parseConfig accepted it")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStartupConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		data   string
+		target string
+		err    string
+	}{
+		{"exit", onConfigErrorExit, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org", "bogus": 1}]}`, "", "bogus"},
+		{"serve-default", onConfigErrorDefault, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org", "bogus": 1}]}`, "https://example.com", ""},
+		{"serve-default without a default", onConfigErrorDefault, `{"version": 1, "redirects": [{"rule": "/go", "bogus": 1}]}`, "", "no defaultRedirect"},
+		{"serve-default with a blocked default", onConfigErrorDefault, `{"version": 1, "defaultRedirect": "https://evil.example.com", "blockedTargetHosts": ["evil.example.com"]}`, "", "blocked host"},
+		{"serve-default with a default that isn't a url", onConfigErrorDefault, `{"version": 1, "defaultRedirect": "https://example.com/%zz", "redirects": [{"rule": "/go", "bogus": 1}]}`, "", "invalid URL escape"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &onConfigError, tt.mode)
+
+			broken, loadErr := parseConfig([]byte(tt.data))
+			if loadErr == nil {
+				t.Fatal("the config was meant to be invalid")
+			}
+
+			conf, err := startupConfig(broken, loadErr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("startupConfig = %v, want an error mentioning %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conf.RedirectRules) != 0 {
+				t.Errorf("fallback still has %d rules", len(conf.RedirectRules))
+			}
+			for _, path := range []string{"/", "/go"} {
+				rec := serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != tt.target {
+					t.Errorf("GET %s = %d %q, want 307 %q", path, rec.Code, rec.Header().Get("Location"), tt.target)
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedFallback(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(present, []byte(`{"version": 1, "defaultRedirect": "https://from-file.example.com"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"version": 1,`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := parseConfig(embeddedConfig)
+	if err != nil {
+		t.Fatalf("the embedded config doesn't load: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		target string
+		err    bool
+	}{
+		{"missing file uses the embedded config", filepath.Join(dir, "missing.json"), embedded.FinalRedirect, false},
+		{"the file wins", present, "https://from-file.example.com", false},
+		{"a broken file is still an error", broken, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := embeddedFallback{newConfigSource(tt.path)}.Load()
+			if tt.err {
+				if err == nil {
+					t.Error("Load succeeded, want the file's error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.FinalRedirect != tt.target {
+				t.Errorf("defaultRedirect = %q, want %q", conf.FinalRedirect, tt.target)
+			}
+		})
+	}
+}
+
+func TestTOMLConfig(t *testing.T) {
+	dir := t.TempDir()
+	tomlFile := filepath.Join(dir, "golow.toml")
+	writeFile(t, tomlFile, `version = 1
+defaultRedirect = "https://example.com"
+
+[hostDefaults]
+"a.example.com" = "https://a.example.com/home"
+
+[[redirects]]
+rule = "/go"
+url = "https://golang.org"
+tags = ["lang"]
+methods = ["GET", "HEAD"]
+description = "Go"
+
+[redirects.options]
+statusCode = 301
+preserveQuery = true
+
+[[redirects]]
+host = "docs.example.com"
+rule = "/app"
+url = "https://app.example.com"
+enabled = true
+
+[[redirects.headerRules]]
+header = "X-Tenant"
+match = "^acme$"
+url = "https://acme.example.com"
+
+[[redirects]]
+rule = "/ab"
+
+[[redirects.variants]]
+url = "https://a.example.com"
+weight = 3
+
+[[redirects.variants]]
+url = "https://b.example.com"
+weight = 1
+`)
+	fromJSON := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "hostDefaults": {"a.example.com": "https://a.example.com/home"}, "redirects": [
+		{"rule": "/go", "url": "https://golang.org", "tags": ["lang"], "methods": ["GET", "HEAD"], "description": "Go", "options": {"statusCode": 301, "preserveQuery": true}},
+		{"host": "docs.example.com", "rule": "/app", "url": "https://app.example.com", "enabled": true, "headerRules": [{"header": "X-Tenant", "match": "^acme$", "url": "https://acme.example.com"}]},
+		{"rule": "/ab", "variants": [{"url": "https://a.example.com", "weight": 3}, {"url": "https://b.example.com", "weight": 1}]}
+	]}`)
+
+	fromTOML, err := newConfigSource(tomlFile).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromTOML, fromJSON) {
+		t.Errorf("TOML config = %+v\nwant the JSON equivalent %+v", fromTOML, fromJSON)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/go?x=1", nil)
+	if rec := serve(fromTOML, req); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://golang.org?x=1" {
+		t.Errorf("GET /go?x=1 = %d %q, want the TOML options applied", rec.Code, rec.Header().Get("Location"))
+	}
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown key", "version = 1\ndefaultRedirect = \"https://example.com\"\nredirect = []\n", "unknown field"},
+		{"not TOML", "version = \n", ""},
+		{"invalid rule", "version = 1\ndefaultRedirect = \"https://example.com\"\n[[redirects]]\nrule = \"/x\"\nurl = \"https://example.com\"\nlogLevel = \"loud\"\n", "logLevel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseConfigFormat([]byte(tt.data), "golow.toml", ""); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseConfigFormat = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStreamConfig(t *testing.T) {
+	// The settings the Rules need come after them
+	data := `{"version": 1, "redirects": [
+		{"rule": "/docs*", "url": "docs.example.com"},
+		{"rule": "/docs/api", "url": "api.example.com"},
+		{"rule": "/off", "url": "example.com/off", "enabled": false}
+	], "defaultRedirect": "https://example.com", "defaultScheme": "http"}`
+
+	conf, err := streamConfig(strings.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.router == nil {
+		t.Fatal("no router was built while streaming")
+	}
+	parsed := mustConfig(t, data)
+	if !reflect.DeepEqual(conf.RedirectRules, parsed.RedirectRules) {
+		t.Errorf("streamed rules = %+v, parsed as a whole = %+v", conf.RedirectRules, parsed.RedirectRules)
+	}
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/docs/api", "http://api.example.com"},
+		{"/docs/guide", "http://docs.example.com"},
+		{"/off", "https://example.com"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		conf.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := rec.Header().Get("Location"); got != tt.location {
+			t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+		}
+	}
+
+	errorTests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown rule key", `{"redirects": [{"rule": "/a", "url": "https://example.com", "nope": 1}]}`, `unknown field "nope"`},
+		{"unknown setting", `{"redirects": [], "nope": 1}`, `unknown field "nope"`},
+		{"invalid rule", `{"redirects": [{"rule": "/a", "url": "https://example.com", "options": {"statusCode": 200}}]}`, "not a redirect"},
+		{"invalid setting", `{"redirects": [], "queryMerge": "some"}`, "queryMerge"},
+		{"redirects not a list", `{"redirects": {}}`, "redirects must be a list"},
+		{"not an object", `[]`, "must be a JSON object"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := streamConfig(strings.NewReader(tt.data), ""); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("streamConfig = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// loadHeap - How far the heap grew while load ran over what the Config it
+// loads holds once it's done, so the memory loading needed besides the
+// Config (and its router) itself
+func loadHeap(t *testing.T, load func() Config) (peak, held uint64) {
+	t.Helper()
+	read := func() uint64 {
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(sample)
+		return sample[0].Value.Uint64()
+	}
+	runtime.GC()
+	before := read()
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if v := read(); v > peak {
+				peak = v
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+		}
+	}()
+	conf := load()
+	close(done)
+	<-sampled
+	// The sampler can miss the end of a load that's quicker than its tick
+	if v := read(); v > peak {
+		peak = v
+	}
+
+	runtime.GC()
+	held = read() - before
+	if len(conf.RedirectRules) != 50000 || conf.router == nil {
+		t.Fatalf("loaded %d rules, want 50000 and their router", len(conf.RedirectRules))
+	}
+	if peak < before+held {
+		return 0, held
+	}
+	return peak - before - held, held
+}
+
+func TestStreamConfigMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates a large config")
+	}
+	// Little garbage left lying around, so the peak is mostly what's live
+	defer debug.SetGCPercent(debug.SetGCPercent(1))
+
+	path := filepath.Join(t.TempDir(), "large.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The router is the same either way and noisy to measure (compiling every
+	// route makes a lot of garbage), so the Rules are tagged out of it and
+	// what's measured is the document and the Rules themselves
+	setGlobal(t, &disableTags, "bulk")
+	description := strings.Repeat("padded out the way real descriptions are. ", 4)
+	fmt.Fprint(f, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`)
+	for i := 0; i < 50000; i++ {
+		if i > 0 {
+			fmt.Fprint(f, ",")
+		}
+		fmt.Fprintf(f, "\n    {\n      \"rule\": \"/r/%d\",\n      \"tags\": [\"bulk\"],\n      \"url\": \"https://example.com/a/rather/long/target/%d?utm_source=golow&utm_medium=redirect\",\n      \"description\": \"generated rule number %d, %s\"\n    }", i, i, i, description)
+	}
+	fmt.Fprint(f, "]}")
+	f.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	naiveExtra, naiveHeld := loadHeap(t, func() Config {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf, err := parseConfig(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.router = buildRouter(conf)
+		return conf
+	})
+	streamExtra, streamHeld := loadHeap(t, func() Config {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		conf, err := streamConfig(file, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	})
+
+	t.Logf("%d MB file, loaded whole needed %d MB on top of the %d MB it holds, streamed %d MB on top of %d MB",
+		info.Size()>>20, naiveExtra>>20, naiveHeld>>20, streamExtra>>20, streamHeld>>20)
+	// Loading it whole holds the document twice (read, then buffered to
+	// decode), streaming only ever a Rule of it
+	if streamExtra > uint64(info.Size()) || streamExtra*4 > naiveExtra {
+		t.Errorf("streaming needed %d bytes on top of the config and loading it whole %d, want well under both that and the %d byte file",
+			streamExtra, naiveExtra, info.Size())
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	setGlobal(t, &onRuleConflict, ruleConflictLastWins)
+	file := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		writeFile(t, path, data)
+		return path
+	}
+	rule := func(path string) string {
+		return `{"rule": "` + path + `", "url": "https://example.com` + path + `"}`
+	}
+
+	file("shared/a.json", `{"version": 1, "redirects": [`+rule("/a")+`, `+rule("/local")+`]}`)
+	file("shared/b.json", `{"version": 1, "include": ["../common/nested.json"], "redirects": [`+rule("/b")+`]}`)
+	file("common/nested.json", `{"version": 1, "redirects": [`+rule("/nested")+`]}`)
+	file("loop/x.json", `{"version": 1, "include": ["y.json"], "defaultRedirect": "https://example.com"}`)
+	file("loop/y.json", `{"version": 1, "include": ["x.json"]}`)
+	file("loop/self.json", `{"version": 1, "include": ["self.json"], "defaultRedirect": "https://example.com"}`)
+
+	t.Run("shared rules come before the local ones", func(t *testing.T) {
+		main := file("main.json", `{"version": 1, "include": ["shared/*.json", "none/*.json"], "defaultRedirect": "https://example.com", "redirects": [
+			{"rule": "/local", "url": "https://example.com/mine"}
+		]}`)
+		conf, err := fileSource{path: main}.Load()
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+
+		got := []string{}
+		for _, rule := range conf.RedirectRules {
+			got = append(got, rule.Path+" "+rule.URL)
+		}
+		want := []string{"/a https://example.com/a", "/local https://example.com/mine", "/nested https://example.com/nested", "/b https://example.com/b"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("rules = %q, want %q", got, want)
+		}
+		if conf.FinalRedirect != "https://example.com" || conf.Include != nil {
+			t.Errorf("defaultRedirect %q include %v, want the local default and no includes left", conf.FinalRedirect, conf.Include)
+		}
+	})
+
+	tests := []struct {
+		name string
+		path string
+		err  string
+	}{
+		{"circular", filepath.Join(dir, "loop/x.json"), "circular include"},
+		{"includes itself", filepath.Join(dir, "loop/self.json"), "circular include"},
+		{"missing file", file("missing.json", `{"version": 1, "include": ["gone.json"], "defaultRedirect": "https://example.com"}`), "gone.json"},
+		{"bad glob", file("badglob.json", `{"version": 1, "include": ["[.json"], "defaultRedirect": "https://example.com"}`), "include"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := (fileSource{path: tt.path}).Load(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load(%s) = %v, want an error containing %q", tt.path, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFallbackSource(t *testing.T) {
+	good := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com/second"}`)
+	first := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com/first"}`)
+
+	tests := []struct {
+		name    string
+		sources []*flakySource
+		want    string
+		calls   []int
+		err     string
+	}{
+		{"first fails, second works", []*flakySource{{failures: 1}, {conf: good}}, "https://example.com/second", []int{1, 1}, ""},
+		{"first works, the rest aren't tried", []*flakySource{{conf: first}, {conf: good}}, "https://example.com/first", []int{1, 0}, ""},
+		{"two fail, the third works", []*flakySource{{failures: 1}, {failures: 1}, {conf: good}}, "https://example.com/second", []int{1, 1, 1}, ""},
+		{"all fail", []*flakySource{{failures: 1}, {failures: 1}}, "", []int{1, 1}, "all 2 config sources failed, last: connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := fallbackSource{}
+			for _, s := range tt.sources {
+				chain = append(chain, s)
+			}
+			logs := captureLogs(t)
+			conf, err := chain.Load()
+
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Load = %v, want %q", err, tt.err)
+				}
+			} else if err != nil || conf.FinalRedirect != tt.want {
+				t.Errorf("Load = %q, %v, want %q", conf.FinalRedirect, err, tt.want)
+			}
+			for i, s := range tt.sources {
+				if s.calls != tt.calls[i] {
+					t.Errorf("source %d loaded %d times, want %d", i, s.calls, tt.calls[i])
+				}
+			}
+			if fellBack := findLog(logs(), "Loaded Config from a fallback source") != nil; fellBack != (tt.err == "" && tt.calls[1] > 0) {
+				t.Errorf("logged loading from a fallback = %v", fellBack)
+			}
+		})
+	}
+
+	t.Run("from -config", func(t *testing.T) {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusInternalServerError)
+		}))
+		defer down.Close()
+		path := filepath.Join(t.TempDir(), "local.json")
+		writeFile(t, path, `{"version": 1, "defaultRedirect": "https://example.com/local"}`)
+
+		src := newConfigSource(down.URL + " | " + path)
+		if got := src.String(); got != down.URL+"|"+path {
+			t.Errorf("String = %q", got)
+		}
+		conf, err := src.Load()
+		if err != nil || conf.FinalRedirect != "https://example.com/local" {
+			t.Errorf("Load = %q, %v, want the local file's config", conf.FinalRedirect, err)
+		}
+	})
+}
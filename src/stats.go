@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hitCounter - Concurrency safe per Rule hit counts
+type hitCounter struct {
+	mu     sync.RWMutex
+	counts map[string]*uint64
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{counts: map[string]*uint64{}}
+}
+
+// Inc - Count one hit for the Rule
+func (h *hitCounter) Inc(rule string) {
+	h.mu.RLock()
+	count, ok := h.counts[rule]
+	h.mu.RUnlock()
+
+	if !ok {
+		h.mu.Lock()
+		if count, ok = h.counts[rule]; !ok {
+			count = new(uint64)
+			h.counts[rule] = count
+		}
+		h.mu.Unlock()
+	}
+
+	atomic.AddUint64(count, 1)
+}
+
+// Get - The current count for the Rule
+func (h *hitCounter) Get(rule string) uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if count, ok := h.counts[rule]; ok {
+		return atomic.LoadUint64(count)
+	}
+	return 0
+}
+
+// Snapshot - Copy of every count
+func (h *hitCounter) Snapshot() map[string]uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	snapshot := make(map[string]uint64, len(h.counts))
+	for rule, count := range h.counts {
+		snapshot[rule] = atomic.LoadUint64(count)
+	}
+	return snapshot
+}
+
+// Restore - Add saved counts on top of anything counted so far
+func (h *hitCounter) Restore(counts map[string]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for rule, n := range counts {
+		count, ok := h.counts[rule]
+		if !ok {
+			count = new(uint64)
+			h.counts[rule] = count
+		}
+		atomic.AddUint64(count, n)
+	}
+}
+
+// hits - Redirect counts keyed by Rule ID, the default is counted under ""
+var hits = newHitCounter()
+
+// startedAt - When the process started
+var startedAt = time.Now()
+
+// active - The Config currently being served and when it was loaded
+var active struct {
+	sync.RWMutex
+	conf     Config
+	loadedAt time.Time
+}
+
+// setActiveConfig - Record the Config that is now being served
+func setActiveConfig(conf Config) {
+	active.Lock()
+	defer active.Unlock()
+	active.conf = conf
+	active.loadedAt = time.Now()
+}
+
+// activeConfig - The Config being served and when it was loaded
+func activeConfig() (Config, time.Time) {
+	active.RLock()
+	defer active.RUnlock()
+	return active.conf, active.loadedAt
+}
+
+// logState - Log a snapshot of what is being served, for a quick look
+// without the admin listener (SIGUSR1)
+func logState() {
+	conf, loadedAt := activeConfig()
+
+	slog.Info("State", "rules", len(activeRules(conf)),
+		"uptime", time.Since(startedAt).Round(time.Second), "lastReload", loadedAt.Format(time.RFC3339))
+
+	counts := hits.Snapshot()
+	rules := make([]string, 0, len(counts))
+	for rule := range counts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	for _, rule := range rules {
+		name := rule
+		if name == "" {
+			name = "(default)"
+		}
+		slog.Info("State", "rule", name, "hits", counts[rule])
+	}
+}
+
+// dumpStateOn - Log the state for every signal that arrives, until c closes
+func dumpStateOn(c <-chan os.Signal) {
+	for range c {
+		logState()
+	}
+}
+
+// enabledFeatures - The optional features turned on by the flags and Config,
+// in a fixed order so the summary reads the same every start
+func enabledFeatures(conf Config) []string {
+	features := []string{}
+	add := func(name string, on bool) {
+		if on {
+			features = append(features, name)
+		}
+	}
+
+	ruleUses := func(uses func(URLRule) bool) bool {
+		for _, rule := range activeRules(conf) {
+			if uses(rule) {
+				return true
+			}
+		}
+		return false
+	}
+
+	add("tls", tlsCert != "")
+	add("tls-reload", tlsCert != "" && tlsReload > 0)
+	add("h2c", enableH2C && tlsCert == "")
+	add("admin", adminAddr != "")
+	add("metrics", adminAddr != "")
+	add("follower", followerMode && adminAddr != "")
+	add("pprof", enablePprof && adminAddr != "")
+	add("statsd", statsdAddr != "")
+	add("rate-limit", ruleUses(func(rule URLRule) bool { return rule.RateLimit != nil }))
+	add("proxy", ruleUses(func(rule URLRule) bool { return rule.Type == ruleTypeProxy }))
+	add("target-cache", ruleUses(func(rule URLRule) bool { return rule.CacheTTL != "" }))
+	add("analytics", analyticsFile != "")
+	add("audit", auditFile != "")
+	add("hits-file", hitsFile != "")
+	add("early-hints", earlyHints)
+	add("compress-html", compressHTMLSize > 0)
+	add("log-dedupe", logDedupe > 0)
+	add("request-timeout", requestTimeout > 0)
+	add("max-conns", maxConns > 0)
+	add("trusted-proxies", len(trustedProxies) > 0)
+	add("client-rate-limit", clientRPS > 0)
+	add("ip-filter", len(allowedClients) > 0 || len(blockedClients) > 0)
+	add("tracing", enableTracing)
+	add("trust-forwarded-host", trustForwardedHost)
+	add("inherit-scheme", inheritScheme)
+	add("clean-paths", cleanPaths)
+	add("base-path", basePath != "")
+	add("sitemap", enableSitemap)
+	add("warmup", warmupCheck)
+	add("graceful-restart", gracefulRestart)
+	add("reuse-port", reusePort)
+	add("no-keepalive", disableKeepAlive)
+	return features
+}
+
+// logStartup - One line saying what this process is serving and with which
+// features, so a misconfigured flag shows up in the first log line read
+func logStartup(conf Config) {
+	slog.Info("Startup Summary", "addr", listenAddr, "admin", adminAddr, "config", configSource.String(),
+		"rules", len(activeRules(conf)), "features", strings.Join(enabledFeatures(conf), ","))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	useConfig(t, mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/a", "url": "https://example.com/a"},
+		{"rule": "/b", "url": "https://example.com/b"}
+	]}`))
+	setGlobal(t, &hits, newHitCounter())
+	hits.Inc("/a")
+	hits.Inc("/a")
+	hits.Inc("")
+	logs := captureLogs(t)
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		dumpStateOn(signals)
+		close(done)
+	}()
+	signals <- os.Interrupt
+	close(signals)
+	<-done
+
+	lines := logs()
+	summary := findLog(lines, "State")
+	if summary == nil || summary["rules"] != float64(2) || summary["uptime"] == nil || summary["lastReload"] == nil {
+		t.Fatalf("state summary = %v, want 2 rules with the uptime and last reload", summary)
+	}
+
+	tests := []struct {
+		rule string
+		hits float64
+	}{
+		{"(default)", 1},
+		{"/a", 2},
+	}
+	for _, tt := range tests {
+		found := false
+		for _, line := range lines {
+			if line["msg"] == "State" && line["rule"] == tt.rule {
+				found = true
+				if line["hits"] != tt.hits {
+					t.Errorf("rule %s logged %v hits, want %v", tt.rule, line["hits"], tt.hits)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no State line for rule %s", tt.rule)
+		}
+	}
+}
+
+func TestStartupSummary(t *testing.T) {
+	plain := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/a", "url": "https://example.com/a"}]}`)
+	ruled := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/a", "url": "https://example.com/a", "cacheTTL": "1m"},
+		{"rule": "/limited", "url": "https://example.com/b", "rateLimit": {"rps": 1, "burst": 1}},
+		{"type": "proxy", "rule": "/api", "url": "https://api.example.com"}
+	]}`)
+
+	tests := []struct {
+		name     string
+		conf     Config
+		set      func(t *testing.T)
+		features string
+	}{
+		{"nothing optional", plain, func(t *testing.T) {}, ""},
+		{"admin brings metrics, pprof needs admin", plain, func(t *testing.T) {
+			setGlobal(t, &adminAddr, ":8081")
+			setGlobal(t, &enablePprof, true)
+		}, "admin,metrics,pprof"},
+		{"pprof alone is off", plain, func(t *testing.T) { setGlobal(t, &enablePprof, true) }, ""},
+		{"tls without reload", plain, func(t *testing.T) { setGlobal(t, &tlsCert, "cert.pem") }, "tls"},
+		{"h2c is only without tls", plain, func(t *testing.T) {
+			setGlobal(t, &enableH2C, true)
+			setGlobal(t, &tlsCert, "cert.pem")
+		}, "tls"},
+		{"from the rules", ruled, func(t *testing.T) {}, "rate-limit,proxy,target-cache"},
+		{"flags", plain, func(t *testing.T) {
+			setGlobal(t, &requestTimeout, time.Second)
+			setGlobal(t, &cleanPaths, true)
+			setGlobal(t, &warmupCheck, true)
+		}, "request-timeout,clean-paths,warmup"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.set(t)
+			setGlobal(t, &listenAddr, ":8080")
+			setGlobal[ConfigSource](t, &configSource, fileSource{path: "config.json"})
+			logs := captureLogs(t)
+			logStartup(tt.conf)
+
+			line := findLog(logs(), "Startup Summary")
+			if line == nil {
+				t.Fatal("no Startup Summary logged")
+			}
+			if line["features"] != tt.features {
+				t.Errorf("features = %q, want %q", line["features"], tt.features)
+			}
+			if line["addr"] != ":8080" || line["rules"] != float64(len(tt.conf.RedirectRules)) {
+				t.Errorf("summary = %v, want addr :8080 and %d rules", line, len(tt.conf.RedirectRules))
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// statsdQueue - Metric lines waiting to be sent, more than this and new
+// ones are dropped rather than slowing a request down
+const statsdQueue = 4096
+
+// statsdClient - Sends counters and timings as StatsD lines over UDP
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	lines  chan string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// statsd - The `-statsd-addr` client, nil when StatsD is off
+var statsd *statsdClient
+
+// statsdName - Anything but letters, digits, `-` and `_` in a metric name segment
+var statsdName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func newStatsdClient(addr string, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &statsdClient{conn: conn, prefix: strings.TrimSuffix(prefix, "."), lines: make(chan string, statsdQueue), stop: make(chan struct{}), done: make(chan struct{})}
+	go s.send()
+	return s, nil
+}
+
+// send - Write the queued lines out, a lost packet is only a lost metric.
+// The queue is never closed, a request still finishing after Close can't
+// panic on it, so stop says when to flush what's left and return.
+func (s *statsdClient) send() {
+	defer close(s.done)
+	for {
+		select {
+		case line := <-s.lines:
+			s.conn.Write([]byte(line))
+		case <-s.stop:
+			for {
+				select {
+				case line := <-s.lines:
+					s.conn.Write([]byte(line))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// queue - Hand the line to send without ever blocking the caller
+func (s *statsdClient) queue(line string) {
+	select {
+	case s.lines <- line:
+	default:
+	}
+}
+
+// CountRedirect - One Redirect for the Rule ("" is the default) and status
+func (s *statsdClient) CountRedirect(rule string, status int) {
+	if s == nil {
+		return
+	}
+	name := strings.Trim(statsdName.ReplaceAllString(rule, "_"), "_")
+	if name == "" {
+		name = "default"
+	}
+	s.queue(fmt.Sprintf("%s.redirects.%s.%d:1|c", s.prefix, name, status))
+}
+
+// Timing - How long a public request took
+func (s *statsdClient) Timing(took time.Duration) {
+	if s == nil {
+		return
+	}
+	s.queue(fmt.Sprintf("%s.request_ms:%.3f|ms", s.prefix, float64(took)/float64(time.Millisecond)))
+}
+
+// Close - Send what's queued and close the socket
+func (s *statsdClient) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.conn.Close()
+}
+
+// statsdTiming - Send every public request's latency to StatsD
+func statsdTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		statsd.Timing(time.Since(start))
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := newStatsdClient(conn.LocalAddr().String(), "golow.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &statsd, client)
+	setGlobal(t, &redirects, newRedirectCounter())
+	setGlobal(t, &hits, newHitCounter())
+
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/go", "url": "https://golang.org"},
+		{"rule": "/docs/{page}", "url": "https://docs.example.com", "options": {"statusCode": 301}}
+	]}`)
+	for _, path := range []string{"/go", "/docs/intro", "/missing"} {
+		serve(conf, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	client.Close()
+
+	lines := []string{}
+	buf := make([]byte, 1024)
+	for len(lines) < 6 {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %q before %v", lines, err)
+		}
+		lines = append(lines, string(buf[:n]))
+	}
+	sort.Strings(lines)
+
+	counts := []string{}
+	timings := 0
+	timing := regexp.MustCompile(`^golow\.test\.request_ms:[0-9]+\.[0-9]{3}\|ms$`)
+	for _, line := range lines {
+		if timing.MatchString(line) {
+			timings++
+		} else {
+			counts = append(counts, line)
+		}
+	}
+
+	want := []string{"golow.test.redirects.default.307:1|c", "golow.test.redirects.docs_page.301:1|c", "golow.test.redirects.go.307:1|c"}
+	if strings.Join(counts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("counters = %q, want %q", counts, want)
+	}
+	if timings != 3 {
+		t.Errorf("got %d timings in %q, want one per request", timings, lines)
+	}
+}
+
+func TestStatsdNeverBlocks(t *testing.T) {
+	// Nothing sending, the queue fills and everything after is dropped
+	s := &statsdClient{prefix: "golow", lines: make(chan string, 2)}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			s.CountRedirect("/go", http.StatusFound)
+			s.Timing(time.Millisecond)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a full StatsD queue blocked the request")
+	}
+	if len(s.lines) != 2 {
+		t.Errorf("queued %d lines, want the queue full at 2", len(s.lines))
+	}
+
+	var off *statsdClient
+	off.CountRedirect("/go", http.StatusFound)
+	off.Timing(time.Millisecond)
+	off.Close()
+}
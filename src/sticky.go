@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// Values for a Rule's `sticky`, what a client's variant is bucketed by
+const (
+	stickyIP     = "ip"
+	stickyCookie = "cookie"
+)
+
+// bucketCookie - Holds the random ID a `sticky: cookie` client is bucketed by
+const bucketCookie = "golow_bucket"
+
+// bucketCookieAge - How long a client keeps its bucket
+const bucketCookieAge = 365 * 24 * time.Hour
+
+// stickyKey - What the client is bucketed by, its IP or its bucket cookie
+func stickyKey(r *http.Request, sticky string) string {
+	if sticky == stickyCookie {
+		if cookie, err := r.Cookie(bucketCookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return clientIP(r)
+}
+
+// assignBucket - Give a client without a bucket cookie one, set on the
+// response and added to the request so this very request uses it too
+func assignBucket(w http.ResponseWriter, r *http.Request) *http.Request {
+	if _, err := r.Cookie(bucketCookie); err == nil {
+		return r
+	}
+
+	id := newRequestID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     bucketCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(bucketCookieAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	r = r.Clone(r.Context())
+	r.AddCookie(&http.Cookie{Name: bucketCookie, Value: id})
+	return r
+}
+
+// pickBucket - Like pickWeighted, but the same key always lands on the same
+// target (for as long as the targets and weights stay the same)
+func pickBucket(targets []WeightedTarget, key string) string {
+	total := 0
+	for _, t := range targets {
+		total += t.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	n := int(h.Sum64() % uint64(total))
+	for _, t := range targets {
+		if n < t.Weight {
+			return t.URL
+		}
+		n -= t.Weight
+	}
+	return ""
+}
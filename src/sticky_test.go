@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSticky(t *testing.T) {
+	tests := []struct {
+		name   string
+		sticky string
+		// request - The i'th request from client n
+		request func(n, i int) *http.Request
+	}{
+		{"ip", stickyIP, func(n, i int) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/ab", nil)
+			req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:%d", n/256, n%256, 1000+i)
+			return req
+		}},
+		{"cookie, even as the IP changes", stickyCookie, func(n, i int) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/ab", nil)
+			req.RemoteAddr = fmt.Sprintf("10.1.0.%d:1000", i)
+			req.AddCookie(&http.Cookie{Name: bucketCookie, Value: fmt.Sprintf("client-%d", n)})
+			return req
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"rule": "/ab", "sticky": "`+tt.sticky+`", "variants": [
+					{"url": "https://a.example.com", "weight": 1},
+					{"url": "https://b.example.com", "weight": 1}
+				]}
+			]}`)
+			handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+			seen := map[string]int{}
+			for n := 0; n < 200; n++ {
+				first := ""
+				for i := 0; i < 10; i++ {
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, tt.request(n, i))
+					got := rec.Header().Get("Location")
+					if i == 0 {
+						first = got
+						seen[got]++
+					} else if got != first {
+						t.Fatalf("client %d got %q, then %q on request %d", n, first, got, i)
+					}
+				}
+			}
+			// Sticky, but still split between the variants
+			if len(seen) != 2 || seen["https://a.example.com"] < 60 || seen["https://b.example.com"] < 60 {
+				t.Errorf("200 clients were bucketed %v, want a rough even split", seen)
+			}
+		})
+	}
+
+	t.Run("a new client is given a bucket cookie", func(t *testing.T) {
+		conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+			{"rule": "/ab", "sticky": "cookie", "variants": [
+				{"url": "https://a.example.com", "weight": 1},
+				{"url": "https://b.example.com", "weight": 1}
+			]}
+		]}`)
+		handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ab", nil))
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != bucketCookie || cookies[0].Value == "" || !cookies[0].HttpOnly {
+			t.Fatalf("first response set %v, want one HttpOnly %s cookie", cookies, bucketCookie)
+		}
+		first := rec.Header().Get("Location")
+
+		// Coming back with it, the client lands where its first request did
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/ab", nil)
+			req.AddCookie(cookies[0])
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Location"); got != first {
+				t.Fatalf("request %d with the cookie = %q, want %q", i, got, first)
+			}
+			if len(rec.Result().Cookies()) != 0 {
+				t.Errorf("request %d was given another cookie", i)
+			}
+		}
+	})
+
+	for _, tt := range []struct {
+		rule string
+		want string
+	}{
+		{`{"rule": "/ab", "sticky": "ip", "url": "https://example.com"}`, "sticky needs some variants"},
+		{`{"rule": "/ab", "sticky": "session", "variants": [{"url": "https://a.example.com", "weight": 1}]}`, `sticky must be ip or cookie, got "session"`},
+		{`{"rule": "/ab", "variants": [{"url": "https://a.example.com", "weight": 0}]}`, "variants need a url and a weight above 0"},
+	} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [` + tt.rule + `]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%s) = %v, want %q", tt.rule, err, tt.want)
+		}
+	}
+}
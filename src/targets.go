@@ -0,0 +1,417 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/language"
+)
+
+// targetSelector - Picks the target for a request to a Rule, with anything
+// expensive (language matching) prepared once when the router is built.
+type targetSelector struct {
+	rule        URLRule
+	langMatcher language.Matcher
+	locales     language.Matcher
+	referers    []*regexp.Regexp
+	headers     []*regexp.Regexp
+	times       []timeWindow
+	location    *time.Location
+	cache       *targetCache
+	templates   map[string]*template.Template
+	rampStart   time.Time
+	rampFor     time.Duration
+	lookupKey   string
+	holidays    map[string]bool
+	next        uint64
+}
+
+// timeWindow - A TimeTarget as minutes into the day
+type timeWindow struct {
+	start, end int
+	url        string
+}
+
+// shortCodeVar - The path variable a shortener Rule looks its Codes up by,
+// e.g. `/{code}` or `/s/{code}`
+const shortCodeVar = "code"
+
+// localeVar - Replaced in a Rule's target with the best of its Locales for
+// the request, e.g. `https://example.com/{locale}/docs`
+const localeVar = "{locale}"
+
+// subdomainVar - Replaced in the target of a Rule for a `*.example.com` host
+// with the subdomain the request was for
+const subdomainVar = "{subdomain}"
+
+// subdomainKey / subdomainPattern - The mux host variable a wildcard host
+// matches into, one or more DNS labels
+const (
+	subdomainKey     = "subdomain"
+	subdomainPattern = `[a-z0-9-]+(?:\.[a-z0-9-]+)*`
+)
+
+// isWildcardHost - If the Rule's host is `*.example.com`
+func isWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// clockLayout - How TimeTarget times are written
+const clockLayout = "15:04"
+
+// dateLayout - How Holidays dates are written
+const dateLayout = "2006-01-02"
+
+// clock - The current time, a var so the time of day can be faked
+var clock = time.Now
+
+func newTargetSelector(rule URLRule, location *time.Location) *targetSelector {
+	s := &targetSelector{rule: rule, location: location}
+
+	if rule.Type == ruleTypeLookup {
+		// Already checked by validateConfig, there is just the one
+		s.lookupKey = pathVarNames(rule.Path)[0]
+	}
+
+	for _, t := range rule.TimeTargets {
+		// Already checked by validateConfig
+		start, _ := time.Parse(clockLayout, t.Start)
+		end, _ := time.Parse(clockLayout, t.End)
+		s.times = append(s.times, timeWindow{
+			start: start.Hour()*60 + start.Minute(),
+			end:   end.Hour()*60 + end.Minute(),
+			url:   t.URL,
+		})
+	}
+
+	if len(rule.LangRules) > 0 {
+		tags := make([]language.Tag, len(rule.LangRules))
+		for i, l := range rule.LangRules {
+			// Already checked by validateConfig
+			tags[i], _ = language.Parse(l.Lang)
+		}
+		s.langMatcher = language.NewMatcher(tags)
+	}
+
+	if len(rule.Locales) > 0 {
+		tags := make([]language.Tag, len(rule.Locales))
+		for i, l := range rule.Locales {
+			// Already checked by validateConfig
+			tags[i], _ = language.Parse(l)
+		}
+		s.locales = language.NewMatcher(tags)
+	}
+
+	for _, ref := range rule.RefererRules {
+		// Already checked by validateConfig
+		s.referers = append(s.referers, regexp.MustCompile(ref.Match))
+	}
+
+	for _, h := range rule.HeaderRules {
+		// Already checked by validateConfig
+		s.headers = append(s.headers, regexp.MustCompile(h.Match))
+	}
+
+	if rule.Holidays != nil {
+		s.holidays = map[string]bool{}
+		for _, date := range rule.Holidays.Dates {
+			// Already checked by validateConfig
+			day, _ := time.Parse(dateLayout, date)
+			s.holidays[day.Format(dateLayout)] = true
+		}
+	}
+
+	if rule.Ramp != nil {
+		// Already checked by validateConfig
+		s.rampStart, _ = time.Parse(time.RFC3339, rule.Ramp.Start)
+		s.rampFor, _ = time.ParseDuration(rule.Ramp.Duration)
+	}
+
+	if rule.Template {
+		s.templates = map[string]*template.Template{}
+		for _, target := range rule.targets() {
+			// Already checked by validateConfig
+			s.templates[target], _ = parseTargetTemplate(target)
+		}
+	}
+
+	if rule.CacheTTL != "" && rule.cacheable() {
+		// Already checked by validateConfig
+		ttl, _ := time.ParseDuration(rule.CacheTTL)
+		s.cache = newTargetCache(ttl)
+	}
+
+	return s
+}
+
+// Select - Where this request goes, the first branch the request satisfies
+// wins, otherwise the next of the Rule's Targets or its own URL.
+func (s *targetSelector) Select(r *http.Request) string {
+	target := s.selectCached(r)
+	if isWildcardHost(s.rule.Host) && strings.Contains(target, subdomainVar) {
+		target = strings.ReplaceAll(target, subdomainVar, mux.Vars(r)[subdomainKey])
+	}
+	return target
+}
+
+// selectCached - Select, through the target cache when the Rule has one
+func (s *targetSelector) selectCached(r *http.Request) string {
+	if s.templates != nil {
+		return s.localize(r, s.render(r, s.selectTarget(r)))
+	}
+	if s.cache == nil {
+		return s.localize(r, s.selectTarget(r))
+	}
+
+	key := s.cacheKey(r)
+	if target, ok := s.cache.Get(key); ok {
+		return target
+	}
+	target := s.localize(r, s.selectTarget(r))
+	s.cache.Set(key, target)
+	return target
+}
+
+// selectTarget - Work out the target for the request, skipping the cache
+func (s *targetSelector) selectTarget(r *http.Request) string {
+	// A shortener only goes where its code says, an unknown code gets the default
+	if s.rule.Type == ruleTypeShortener {
+		return s.rule.Codes[mux.Vars(r)[shortCodeVar]]
+	}
+	// Same for a lookup, only with its table from the lookupFile
+	if s.rule.Type == ruleTypeLookup {
+		return s.rule.lookup[mux.Vars(r)[s.lookupKey]]
+	}
+
+	for _, c := range s.rule.CookieRules {
+		cookie, err := r.Cookie(c.Name)
+		if err == nil && (c.Value == "" || cookie.Value == c.Value) {
+			return c.URL
+		}
+	}
+
+	if referer := r.Referer(); referer != "" {
+		for i, match := range s.referers {
+			if match.MatchString(referer) {
+				return s.rule.RefererRules[i].URL
+			}
+		}
+	}
+
+	for i, match := range s.headers {
+		h := s.rule.HeaderRules[i]
+		if value := r.Header.Get(h.Header); value != "" && match.MatchString(value) {
+			return h.URL
+		}
+	}
+
+	if len(s.rule.QueryRules) > 0 {
+		query := r.URL.Query()
+		for _, q := range s.rule.QueryRules {
+			if values, ok := query[q.Param]; ok && (q.Value == "" || containsString(values, q.Value)) {
+				return q.URL
+			}
+		}
+	}
+
+	// HTTP/2 (and later) clients can be steered to a host tuned for them
+	if s.rule.HTTP2URL != "" && r.ProtoMajor >= 2 {
+		return s.rule.HTTP2URL
+	}
+
+	// A holiday trumps the usual hours
+	if s.holidays != nil && s.holidays[clock().In(s.location).Format(dateLayout)] {
+		return s.rule.Holidays.URL
+	}
+
+	if len(s.times) > 0 {
+		if target, ok := s.selectTime(clock()); ok {
+			return target
+		}
+	}
+
+	if s.langMatcher != nil {
+		if target, ok := s.selectLang(r); ok {
+			return target
+		}
+	}
+
+	// Round robin, each hit takes the next of the Targets
+	if n := len(s.rule.Targets); n > 0 {
+		i := (atomic.AddUint64(&s.next, 1) - 1) % uint64(n)
+		return s.rule.Targets[i]
+	}
+
+	if len(s.rule.Variants) > 0 {
+		if s.rule.Sticky == "" {
+			return pickWeighted(s.rule.Variants)
+		}
+		return pickBucket(s.rule.Variants, s.rule.ID()+"|"+stickyKey(r, s.rule.Sticky))
+	}
+
+	if s.rule.Ramp != nil {
+		return s.selectRamp(clock())
+	}
+
+	return s.rule.URL
+}
+
+// rampSteps - Resolution of a Ramp's split, in weights out of this
+const rampSteps = 1000
+
+// selectRamp - The url or the Ramp's URL, weighted by how far through the
+// Ramp we are
+func (s *targetSelector) selectRamp(now time.Time) string {
+	done := rampSteps
+	if elapsed := now.Sub(s.rampStart); elapsed < s.rampFor {
+		done = int(int64(elapsed) * rampSteps / int64(s.rampFor))
+		if done < 0 {
+			done = 0
+		}
+	}
+	return pickWeighted([]WeightedTarget{
+		{URL: s.rule.URL, Weight: rampSteps - done},
+		{URL: s.rule.Ramp.URL, Weight: done},
+	})
+}
+
+// selectTime - The TimeTarget covering the time of day, Start inclusive and
+// End exclusive
+func (s *targetSelector) selectTime(now time.Time) (string, bool) {
+	now = now.In(s.location)
+	minute := now.Hour()*60 + now.Minute()
+
+	for _, w := range s.times {
+		inside := minute >= w.start && minute < w.end
+		if w.end < w.start {
+			inside = minute >= w.start || minute < w.end
+		}
+		if inside {
+			return w.url, true
+		}
+	}
+	return "", false
+}
+
+// selectLang - The LangRule best matching the Accept-Language header
+func (s *targetSelector) selectLang(r *http.Request) (string, bool) {
+	prefs, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(prefs) == 0 {
+		return "", false
+	}
+
+	_, index, confidence := s.langMatcher.Match(prefs...)
+	if confidence == language.No {
+		return "", false
+	}
+	return s.rule.LangRules[index].URL, true
+}
+
+// render - Run the target through its template, an error sends the request
+// to the default like a Rule with no target
+func (s *targetSelector) render(r *http.Request, target string) string {
+	tmpl, ok := s.templates[target]
+	if !ok {
+		return target
+	}
+
+	rendered, err := renderTarget(tmpl, r)
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("Failed to Render Target Template", "err", err)
+		return ""
+	}
+	return rendered
+}
+
+// localize - Put the Locale best matching Accept-Language into the target,
+// the first of the Rule's Locales when nothing matches
+func (s *targetSelector) localize(r *http.Request, target string) string {
+	if s.locales == nil || !strings.Contains(target, localeVar) {
+		return target
+	}
+
+	index := 0
+	if prefs, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil && len(prefs) > 0 {
+		// No match gives the first of the Locales anyway
+		_, index, _ = s.locales.Match(prefs...)
+	}
+	return strings.ReplaceAll(target, localeVar, s.rule.Locales[index])
+}
+
+// pickWeighted - One of the targets at random, each as likely as its Weight
+func pickWeighted(targets []WeightedTarget) string {
+	total := 0
+	for _, t := range targets {
+		total += t.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	n := rand.Intn(total)
+	for _, t := range targets {
+		if n < t.Weight {
+			return t.URL
+		}
+		n -= t.Weight
+	}
+	return ""
+}
+
+// targetFields - Every target the Rule can send a request to, as pointers so
+// load time normalization can rewrite them in place
+func (rule *URLRule) targetFields() []*string {
+	fields := []*string{&rule.URL, &rule.HTTP2URL}
+	for i := range rule.Targets {
+		fields = append(fields, &rule.Targets[i])
+	}
+	for i := range rule.CookieRules {
+		fields = append(fields, &rule.CookieRules[i].URL)
+	}
+	for i := range rule.LangRules {
+		fields = append(fields, &rule.LangRules[i].URL)
+	}
+	for i := range rule.RefererRules {
+		fields = append(fields, &rule.RefererRules[i].URL)
+	}
+	for i := range rule.HeaderRules {
+		fields = append(fields, &rule.HeaderRules[i].URL)
+	}
+	for i := range rule.QueryRules {
+		fields = append(fields, &rule.QueryRules[i].URL)
+	}
+	for i := range rule.TimeTargets {
+		fields = append(fields, &rule.TimeTargets[i].URL)
+	}
+	if rule.Ramp != nil {
+		fields = append(fields, &rule.Ramp.URL)
+	}
+	if rule.Holidays != nil {
+		fields = append(fields, &rule.Holidays.URL)
+	}
+	for i := range rule.Variants {
+		fields = append(fields, &rule.Variants[i].URL)
+	}
+	return fields
+}
+
+// targets - Every target the Rule can send a request to
+func (rule URLRule) targets() []string {
+	targets := []string{}
+	for _, field := range rule.targetFields() {
+		targets = append(targets, *field)
+	}
+	for _, target := range rule.Codes {
+		targets = append(targets, target)
+	}
+	for _, target := range rule.lookup {
+		targets = append(targets, target)
+	}
+	return targets
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCookieRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/app", "url": "https://example.com/stable", "cookieRules": [
+			{"name": "beta", "value": "yes", "url": "https://example.com/beta"},
+			{"name": "staff", "url": "https://example.com/internal"},
+			{"name": "beta", "url": "https://example.com/beta-any"}
+		]}
+	]}`)
+
+	tests := []struct {
+		name     string
+		cookies  []*http.Cookie
+		location string
+	}{
+		{"no cookie", nil, "https://example.com/stable"},
+		{"matching value", []*http.Cookie{{Name: "beta", Value: "yes"}}, "https://example.com/beta"},
+		{"other value falls to the name only rule", []*http.Cookie{{Name: "beta", Value: "no"}}, "https://example.com/beta-any"},
+		{"any value", []*http.Cookie{{Name: "staff", Value: "1"}}, "https://example.com/internal"},
+		{"first satisfied rule wins", []*http.Cookie{{Name: "staff", Value: "1"}, {Name: "beta", Value: "yes"}}, "https://example.com/beta"},
+		{"unrelated cookie", []*http.Cookie{{Name: "session", Value: "abc"}}, "https://example.com/stable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			for _, c := range tt.cookies {
+				req.AddCookie(c)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /app = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestLangRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/docs", "url": "https://example.com/docs", "langRules": [
+			{"lang": "fr", "url": "https://example.com/fr/docs"},
+			{"lang": "en", "url": "https://example.com/en/docs"},
+			{"lang": "pt-BR", "url": "https://example.com/pt-br/docs"}
+		]}
+	]}`)
+
+	tests := []struct {
+		acceptLanguage string
+		location       string
+	}{
+		{"fr", "https://example.com/fr/docs"},
+		{"fr-CA,fr;q=0.9", "https://example.com/fr/docs"},
+		{"en", "https://example.com/en/docs"},
+		{"en-GB,en;q=0.8", "https://example.com/en/docs"},
+		{"de;q=0.9, fr;q=0.5", "https://example.com/fr/docs"},
+		{"pt-BR", "https://example.com/pt-br/docs"},
+		{"ja", "https://example.com/docs"},
+		{"", "https://example.com/docs"},
+		{"not a language;;", "https://example.com/docs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptLanguage, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("Accept-Language %q = %q, want %q", tt.acceptLanguage, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestLocales(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/docs", "url": "https://example.com/{locale}/docs", "locales": ["en", "fr", "pt-BR"]},
+		{"rule": "/guide*", "url": "https://example.com/{locale}/guide", "locales": ["de", "en"], "options": {"appendPath": true}}
+	]}`)
+	setGlobal(t, &maxAppendLength, 100)
+	setGlobal(t, &maxAppendSegments, 10)
+
+	tests := []struct {
+		path           string
+		acceptLanguage string
+		location       string
+	}{
+		{"/docs", "fr", "https://example.com/fr/docs"},
+		{"/docs", "fr-CA,fr;q=0.9", "https://example.com/fr/docs"},
+		{"/docs", "de;q=0.9, pt-BR;q=0.5", "https://example.com/pt-BR/docs"},
+		{"/docs", "en-GB", "https://example.com/en/docs"},
+		{"/docs", "ja", "https://example.com/en/docs"},
+		{"/docs", "", "https://example.com/en/docs"},
+		{"/docs", "not a language;;", "https://example.com/en/docs"},
+		{"/guide/intro", "de-AT", "https://example.com/de/guide/intro"},
+		{"/guide/intro", "", "https://example.com/de/guide/intro"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.acceptLanguage, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s with Accept-Language %q = %q, want %q", tt.path, tt.acceptLanguage, got, tt.location)
+			}
+		})
+	}
+
+	for name, rule := range map[string]string{
+		"no locales": `{"rule": "/x", "url": "https://example.com/{locale}/x"}`,
+		"bad tag":    `{"rule": "/x", "url": "https://example.com/{locale}/x", "locales": ["not a tag"]}`,
+	} {
+		if _, err := parseConfig([]byte(`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [` + rule + `]}`)); err == nil || !strings.Contains(err.Error(), "locale") {
+			t.Errorf("parseConfig with %s = %v, want a locale error", name, err)
+		}
+	}
+}
+
+func TestRefererRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/buy", "url": "https://shop.example.com", "refererRules": [
+			{"match": "^https://(www\\.)?partner\\.com/", "url": "https://shop.example.com?ref=partner"},
+			{"match": "news\\.ycombinator\\.com", "url": "https://shop.example.com?ref=hn"}
+		]}
+	]}`)
+
+	tests := []struct {
+		name     string
+		referer  string
+		location string
+	}{
+		{"no referer", "", "https://shop.example.com"},
+		{"partner", "https://partner.com/deals", "https://shop.example.com?ref=partner"},
+		{"partner www", "https://www.partner.com/", "https://shop.example.com?ref=partner"},
+		{"anchored match", "https://evil.com/?https://partner.com/", "https://shop.example.com"},
+		{"unanchored match", "https://news.ycombinator.com/item?id=1", "https://shop.example.com?ref=hn"},
+		{"unknown referer", "https://search.example.net/", "https://shop.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/buy", nil)
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /buy from %q = %q, want %q", tt.referer, got, tt.location)
+			}
+		})
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/buy", "url": "https://example.com", "refererRules": [{"match": "(", "url": "https://example.com/x"}]}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/buy", "url": "https://example.com", "refererRules": [{"match": "partner"}]}]}`,
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "refererRules") {
+			t.Errorf("parseConfig(%s) = %v, want a refererRules error", data, err)
+		}
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/app", "url": "https://app.example.com", "headerRules": [
+			{"header": "X-Tenant", "match": "^acme$", "url": "https://acme.example.com"},
+			{"header": "X-Tenant", "match": "^(globex|initech)$", "url": "https://big.example.com"},
+			{"header": "X-Beta", "match": ".", "url": "https://beta.example.com"}
+		]}
+	]}`)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		location string
+	}{
+		{"no headers falls back", nil, "https://app.example.com"},
+		{"first rule", map[string]string{"X-Tenant": "acme"}, "https://acme.example.com"},
+		{"second rule", map[string]string{"X-Tenant": "initech"}, "https://big.example.com"},
+		{"anchored match", map[string]string{"X-Tenant": "acme-corp"}, "https://app.example.com"},
+		{"header name isn't case sensitive", map[string]string{"x-tenant": "globex"}, "https://big.example.com"},
+		{"other header", map[string]string{"X-Beta": "1"}, "https://beta.example.com"},
+		{"first match wins", map[string]string{"X-Tenant": "acme", "X-Beta": "1"}, "https://acme.example.com"},
+		{"unknown tenant falls through to a later rule", map[string]string{"X-Tenant": "hooli", "X-Beta": "1"}, "https://beta.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /app with %v = %q, want %q", tt.headers, got, tt.location)
+			}
+		})
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "headerRules": [{"header": "X-Tenant", "match": "(", "url": "https://example.com/x"}]}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "headerRules": [{"match": "acme", "url": "https://example.com/x"}]}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "headerRules": [{"header": "X-Tenant", "match": "acme"}]}]}`,
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "headerRules") {
+			t.Errorf("parseConfig(%s) = %v, want a headerRules error", data, err)
+		}
+	}
+}
+
+func TestQueryRules(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/app", "url": "https://example.com/app", "queryRules": [
+			{"param": "platform", "value": "ios", "url": "https://apps.apple.com/app"},
+			{"param": "platform", "value": "android", "url": "https://play.google.com/app"},
+			{"param": "beta", "url": "https://beta.example.com/app"}
+		]}
+	]}`)
+
+	tests := []struct {
+		name     string
+		path     string
+		location string
+	}{
+		{"no query falls back", "/app", "https://example.com/app"},
+		{"value match", "/app?platform=ios", "https://apps.apple.com/app"},
+		{"other value match", "/app?platform=android", "https://play.google.com/app"},
+		{"unknown value falls back", "/app?platform=windows", "https://example.com/app"},
+		{"value is case sensitive", "/app?platform=IOS", "https://example.com/app"},
+		{"any of several values", "/app?platform=web&platform=android", "https://play.google.com/app"},
+		{"present with no value", "/app?beta", "https://beta.example.com/app"},
+		{"present with a value", "/app?beta=0", "https://beta.example.com/app"},
+		{"first rule wins", "/app?beta=1&platform=ios", "https://apps.apple.com/app"},
+		{"other params don't count", "/app?utm_source=mail", "https://example.com/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(conf, httptest.NewRequest(http.MethodGet, tt.path, nil)).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "queryRules": [{"url": "https://example.com/x"}]}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://example.com", "queryRules": [{"param": "platform"}]}]}`,
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "queryRules") {
+			t.Errorf("parseConfig(%s) = %v, want a queryRules error", data, err)
+		}
+	}
+}
+
+func TestTimeTargets(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skipf("no zone database: %v", err)
+	}
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "timezone": "America/New_York", "redirects": [
+		{"rule": "/help", "url": "https://example.com/weekend", "timeTargets": [
+			{"start": "09:00", "end": "17:00", "url": "https://example.com/office"},
+			{"start": "22:00", "end": "06:00", "url": "https://example.com/night"}
+		]}
+	]}`)
+
+	// January, so New York is UTC-5
+	tests := []struct {
+		name     string
+		now      string
+		location string
+	}{
+		{"just before opening", "2024-01-15T13:59:59Z", "https://example.com/weekend"},
+		{"opening", "2024-01-15T14:00:00Z", "https://example.com/office"},
+		{"last minute open", "2024-01-15T21:59:59Z", "https://example.com/office"},
+		{"closing", "2024-01-15T22:00:00Z", "https://example.com/weekend"},
+		{"overnight, before midnight", "2024-01-16T03:00:00Z", "https://example.com/night"},
+		{"overnight, after midnight", "2024-01-16T10:59:00Z", "https://example.com/night"},
+		{"overnight ends", "2024-01-16T11:00:00Z", "https://example.com/weekend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setGlobal(t, &clock, func() time.Time { return now })
+
+			req := httptest.NewRequest(http.MethodGet, "/help", nil)
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /help at %s = %q, want %q", tt.now, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestHolidays(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skipf("no zone database: %v", err)
+	}
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "timezone": "America/New_York", "redirects": [
+		{"rule": "/help", "url": "https://example.com/weekend", "cacheTTL": "1h", "timeTargets": [
+			{"start": "09:00", "end": "17:00", "url": "https://example.com/office"},
+			{"start": "22:00", "end": "06:00", "url": "https://example.com/night"}
+		], "holidays": {"dates": ["2024-12-25", "2025-01-01"], "url": "https://example.com/closed"}}
+	]}`)
+	// One handler throughout, a holiday isn't cached past its day
+	handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+	// December, so New York is UTC-5. The days are New York's, not UTC's.
+	tests := []struct {
+		name     string
+		now      string
+		location string
+	}{
+		{"office hours the day before", "2024-12-24T15:00:00Z", "https://example.com/office"},
+		{"Christmas Eve night, Christmas in UTC", "2024-12-25T03:00:00Z", "https://example.com/night"},
+		{"Christmas, overnight hours", "2024-12-25T05:00:00Z", "https://example.com/closed"},
+		{"Christmas, office hours", "2024-12-25T15:00:00Z", "https://example.com/closed"},
+		{"Christmas night, Boxing Day in UTC", "2024-12-26T04:59:59Z", "https://example.com/closed"},
+		{"Boxing Day", "2024-12-26T05:00:00Z", "https://example.com/night"},
+		{"Boxing Day office hours", "2024-12-26T15:00:00Z", "https://example.com/office"},
+		{"New Year's Day", "2025-01-01T15:00:00Z", "https://example.com/closed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setGlobal(t, &clock, func() time.Time { return now })
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/help", nil))
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("GET /help at %s = %q, want %q", tt.now, got, tt.location)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		holidays string
+		want     string
+	}{
+		{`{"dates": ["2024-12-25"]}`, "holidays need some dates and a url"},
+		{`{"dates": [], "url": "https://example.com/closed"}`, "holidays need some dates and a url"},
+		{`{"dates": ["25/12/2024"], "url": "https://example.com/closed"}`, `holiday "25/12/2024" isn't a date`},
+	} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/help", "url": "https://example.com", "holidays": ` + tt.holidays + `}]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig with holidays %s = %v, want %q", tt.holidays, err, tt.want)
+		}
+	}
+}
+
+func TestRamp(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/app", "url": "https://old.example.com", "ramp": {"url": "https://new.example.com", "start": "2024-05-01T12:00:00Z", "duration": "4h"}}
+	]}`)
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		share float64
+	}{
+		{"before the start", start.Add(-time.Hour), 0},
+		{"at the start", start, 0},
+		{"a quarter through", start.Add(time.Hour), 0.25},
+		{"half way", start.Add(2 * time.Hour), 0.5},
+		{"three quarters", start.Add(3 * time.Hour), 0.75},
+		{"done", start.Add(4 * time.Hour), 1},
+		{"long after", start.Add(100 * time.Hour), 1},
+	}
+
+	const n = 2000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &clock, func() time.Time { return tt.at })
+
+			moved := 0
+			for i := 0; i < n; i++ {
+				switch got := serve(conf, httptest.NewRequest(http.MethodGet, "/app", nil)).Header().Get("Location"); got {
+				case "https://new.example.com":
+					moved++
+				case "https://old.example.com":
+				default:
+					t.Fatalf("GET /app = %q", got)
+				}
+			}
+
+			// Exactly at either end, within five standard deviations between
+			share := float64(moved) / n
+			if (tt.share == 0 || tt.share == 1) && share != tt.share || share < tt.share-0.06 || share > tt.share+0.06 {
+				t.Errorf("%.3f of requests went to the new target, want %.2f", share, tt.share)
+			}
+		})
+	}
+
+	for name, ramp := range map[string]string{
+		"no url":      `{"start": "2024-05-01T12:00:00Z", "duration": "4h"}`,
+		"bad start":   `{"url": "https://new.example.com", "start": "tomorrow", "duration": "4h"}`,
+		"no duration": `{"url": "https://new.example.com", "start": "2024-05-01T12:00:00Z", "duration": "0s"}`,
+	} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/app", "url": "https://old.example.com", "ramp": ` + ramp + `}]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "ramp needs") {
+			t.Errorf("parseConfig with %s = %v, want a ramp error", name, err)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+	}{
+		{"one", []string{"https://a.example.com"}},
+		{"two", []string{"https://a.example.com", "https://b.example.com"}},
+		{"three", []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"}},
+	}
+
+	const perTarget = 50
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"rule": "/lb", "targets": ["`+strings.Join(tt.targets, `", "`)+`"]}
+			]}`)
+			// One handler for every request, as the server holds it
+			handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			counts := map[string]int{}
+			for n := 0; n < perTarget*len(tt.targets); n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lb", nil))
+					mu.Lock()
+					counts[rec.Header().Get("Location")]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if len(counts) != len(tt.targets) {
+				t.Errorf("requests went to %v, want only %v", counts, tt.targets)
+			}
+			for _, target := range tt.targets {
+				if counts[target] != perTarget {
+					t.Errorf("%s was hit %d times, want exactly %d", target, counts[target], perTarget)
+				}
+			}
+
+			// In order, one after another
+			for _, want := range append(tt.targets, tt.targets...) {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lb", nil))
+				if got := rec.Header().Get("Location"); got != want {
+					t.Fatalf("next GET /lb = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShortener(t *testing.T) {
+	for _, ttl := range []string{"", "1m"} {
+		t.Run("cacheTTL "+ttl, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"type": "shortener", "rule": "/s/{code}", "cacheTTL": "`+ttl+`", "codes": {
+					"gh": "https://github.com",
+					"go": "https://golang.org"
+				}}
+			]}`)
+			// One handler throughout, so a cached target would be seen again
+			handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+			tests := []struct {
+				path     string
+				location string
+			}{
+				{"/s/gh", "https://github.com"},
+				{"/s/go", "https://golang.org"},
+				{"/s/gh", "https://github.com"},
+				{"/s/nope", "https://example.com"},
+				{"/s/go", "https://golang.org"},
+				{"/s/", "https://example.com"},
+			}
+			for _, tt := range tests {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+				if got := rec.Header().Get("Location"); got != tt.location {
+					t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+				}
+			}
+		})
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"type": "shortener", "rule": "/s/{id}", "codes": {"gh": "https://github.com"}}]}`,
+		`{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"type": "shortener", "rule": "/s/{code}"}]}`,
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "shortener rule needs {code}") {
+			t.Errorf("parseConfig(%s) = %v, want a shortener error", data, err)
+		}
+	}
+}
+
+func TestHTTP2URL(t *testing.T) {
+	for _, ttl := range []string{"", "1m"} {
+		t.Run("cacheTTL "+ttl, func(t *testing.T) {
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+				{"rule": "/app", "url": "https://h1.example.com", "http2URL": "https://h2.example.com", "cacheTTL": "`+ttl+`"},
+				{"rule": "/plain", "url": "https://plain.example.com", "cacheTTL": "`+ttl+`"}
+			]}`)
+			// One handler throughout, so a target cached for the other protocol would be seen
+			handler := chain(buildRouter(conf), buildMiddleware(conf))
+
+			tests := []struct {
+				path     string
+				major    int
+				location string
+			}{
+				{"/app", 1, "https://h1.example.com"},
+				{"/app", 2, "https://h2.example.com"},
+				{"/app", 1, "https://h1.example.com"},
+				{"/app", 3, "https://h2.example.com"},
+				{"/plain", 2, "https://plain.example.com"},
+				{"/plain", 1, "https://plain.example.com"},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				req.ProtoMajor, req.ProtoMinor = tt.major, 0
+				req.Proto = fmt.Sprintf("HTTP/%d.0", tt.major)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if got := rec.Header().Get("Location"); got != tt.location {
+					t.Errorf("GET %s over %s = %q, want %q", tt.path, req.Proto, got, tt.location)
+				}
+			}
+		})
+	}
+}
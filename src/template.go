@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+)
+
+// targetData - What a `template` Rule's target can reference
+type targetData struct {
+	Host     string
+	Path     string
+	Vars     map[string]string
+	Query    url.Values
+	Header   http.Header
+	ClientIP string
+}
+
+// templateFuncs - Only the text/template builtins, with `call` taken away
+// so a Config can't run anything it's handed
+var templateFuncs = template.FuncMap{
+	"call": func(...interface{}) (interface{}, error) {
+		return nil, errors.New("call isn't allowed in target templates")
+	},
+}
+
+// parseTargetTemplate - Compile a `template` Rule target
+func parseTargetTemplate(target string) (*template.Template, error) {
+	return template.New("target").Funcs(templateFuncs).Option("missingkey=zero").Parse(target)
+}
+
+// newTargetData - What a template sees of the request. Copies, nothing it's
+// handed is shared with the handlers still to run.
+func newTargetData(r *http.Request) targetData {
+	vars := map[string]string{}
+	for k, v := range mux.Vars(r) {
+		vars[k] = v
+	}
+	return targetData{
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Vars:     vars,
+		Query:    r.URL.Query(),
+		Header:   r.Header.Clone(),
+		ClientIP: clientIP(r),
+	}
+}
+
+// renderTarget - Build the target for the request from its template
+func renderTarget(tmpl *template.Template, r *http.Request) (string, error) {
+	out := strings.Builder{}
+	err := tmpl.Execute(&out, newTargetData(r))
+	return strings.TrimSpace(out.String()), err
+}
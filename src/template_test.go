@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTargetTemplates(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [
+		{"rule": "/u/{team}/{name}", "template": true,
+			"url": "https://{{.Vars.team}}.example.com/{{.Vars.name}}?tab={{.Query.Get \"tab\"}}&lang={{index .Header \"Accept-Language\" 0}}&ip={{.ClientIP}}"},
+		{"rule": "/where*", "template": true, "url": "https://example.com/from?host={{.Host}}&path={{.Path}}"},
+		{"rule": "/maybe", "template": true, "url": "https://example.com/{{if .Query.Get \"beta\"}}beta{{else}}stable{{end}}"},
+		{"rule": "/call", "template": true, "url": "https://example.com/{{call .Vars}}"}
+	]}`)
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		location string
+	}{
+		{"vars, query, header and client IP", "/u/blue/ana?tab=repos", map[string]string{"Accept-Language": "fr"}, "https://blue.example.com/ana?tab=repos&lang=fr&ip=192.0.2.1"},
+		{"host and path", "/where/now", nil, "https://example.com/from?host=example.com&path=/where/now"},
+		{"branches on the query", "/maybe?beta=1", nil, "https://example.com/beta"},
+		{"missing query", "/maybe", nil, "https://example.com/stable"},
+		{"call is refused, the default is used", "/call", nil, "https://example.com"},
+		{"a failed index falls to the default", "/u/blue/ana", nil, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := serve(conf, req).Header().Get("Location"); got != tt.location {
+				t.Errorf("GET %s = %q, want %q", tt.path, got, tt.location)
+			}
+		})
+	}
+
+	// Compiled when the Config loads, anything outside the builtins is refused
+	for _, target := range []string{`https://example.com/{{exec "rm"}}`, `https://example.com/{{.Vars.x`} {
+		data := `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/x", "template": true, "url": "` + strings.ReplaceAll(target, `"`, `\"`) + `"}]}`
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), "rule /x: template") {
+			t.Errorf("parseConfig with target %s = %v, want a template error", target, err)
+		}
+	}
+
+	t.Run("the template is handed copies", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/u/blue", nil), map[string]string{"team": "blue"})
+		req.Header.Set("Accept-Language", "fr")
+		data := newTargetData(req)
+		data.Header.Set("Authorization", "forged")
+		data.Header.Del("Accept-Language")
+		data.Vars["team"] = "red"
+		if req.Header.Get("Authorization") != "" || req.Header.Get("Accept-Language") != "fr" || mux.Vars(req)["team"] != "blue" {
+			t.Errorf("changing the template's data changed the request, header %v, vars %v", req.Header, mux.Vars(req))
+		}
+	})
+}
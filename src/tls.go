@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader - Serves the certificate from `-tls-cert`/`-tls-key`, loading
+// it again whenever either file changes so renewals don't need a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime - The newest modification time of the two files
+func (c *certReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged - Load the files again if they changed since the last load.
+// A broken pair (e.g. caught mid renewal) keeps the current certificate.
+func (c *certReloader) reloadIfChanged() {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		slog.Error("Unable to Check TLS Certificate", "err", err)
+		return
+	}
+
+	c.mu.RLock()
+	changed := modTime.After(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := c.load(); err != nil {
+		slog.Warn("Unable to Reload TLS Certificate, keeping the current one", "err", err)
+		return
+	}
+	slog.Info("Reloaded TLS Certificate", "file", c.certFile)
+}
+
+// watch - Check the files for changes every interval until done is closed
+func (c *certReloader) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reloadIfChanged()
+		case <-done:
+			return
+		}
+	}
+}
+
+// GetCertificate - For tls.Config, always hands out the latest certificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
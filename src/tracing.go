@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// traceparentHeader - The W3C Trace Context header, `00-<trace id>-<parent id>-<flags>`
+var traceparentHeader = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// zeroTraceID - All zeros, never a valid trace ID
+var zeroTraceID = strings.Repeat("0", 32)
+
+// tracing - Join the trace the client (or the proxy in front) started with
+// its `traceparent`, or start a new one, for `-tracing`. The trace and span
+// IDs go on the request's log lines, and the request carries on with a
+// traceparent naming this span as the parent so proxied upstreams join in.
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID, flags := "", "01"
+		if m := traceparentHeader.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != zeroTraceID {
+			traceID, flags = m[1], m[3]
+		} else {
+			traceID = newRequestID() + newRequestID()
+		}
+		spanID := newRequestID()
+
+		r.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-"+flags)
+		next.ServeHTTP(w, withLogFields(r, "traceId", traceID, "spanId", spanID))
+	})
+}
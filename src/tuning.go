@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// setGCPercent / setMemoryLimit - The runtime knobs tuneRuntime turns,
+// variables so they can be swapped out
+var (
+	setGCPercent   = debug.SetGCPercent
+	setMemoryLimit = debug.SetMemoryLimit
+)
+
+// memoryUnits - Suffixes `-memory-limit` takes, the same ones as GOMEMLIMIT
+var memoryUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1},
+}
+
+// parseMemoryLimit - Bytes from e.g. `512MiB`, `2GiB` or a plain number
+func parseMemoryLimit(value string) (int64, error) {
+	number, unit := value, int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			number, unit = strings.TrimSuffix(value, u.suffix), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("%q isn't a size like 512MiB or 2GiB", value)
+	}
+	return n * unit, nil
+}
+
+// tuneRuntime - Apply `-gogc` (0 leaves it to GOGC, negative turns the GC
+// off) and `-memory-limit` (empty leaves it to GOMEMLIMIT), then log what
+// the runtime ends up with
+func tuneRuntime(gogc int, memoryLimit string) error {
+	if memoryLimit != "" {
+		limit, err := parseMemoryLimit(memoryLimit)
+		if err != nil {
+			return err
+		}
+		setMemoryLimit(limit)
+	}
+
+	percent := os.Getenv("GOGC")
+	if percent == "" {
+		percent = "100"
+	}
+	if gogc != 0 {
+		setGCPercent(gogc)
+		percent = strconv.Itoa(gogc)
+		if gogc < 0 {
+			percent = "off"
+		}
+	}
+
+	// A negative limit only reads the current one
+	limit := "none"
+	if current := setMemoryLimit(-1); current != math.MaxInt64 {
+		limit = strconv.FormatInt(current, 10)
+	}
+	slog.Info("Runtime Tuning", "gogc", percent, "memoryLimitBytes", limit)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTuneRuntime(t *testing.T) {
+	t.Setenv("GOGC", "")
+
+	tests := []struct {
+		name        string
+		gogc        int
+		memoryLimit string
+		gcCalls     []int
+		limitCalls  []int64
+		logGOGC     string
+		logLimit    string
+	}{
+		{"left alone", 0, "", nil, []int64{-1}, "100", "none"},
+		{"both set", 50, "512MiB", []int{50}, []int64{512 << 20, -1}, "50", "536870912"},
+		{"GC off", -1, "", []int{-1}, []int64{-1}, "off", "none"},
+		{"GiB", 0, "2GiB", nil, []int64{2 << 30, -1}, "100", "2147483648"},
+		{"plain bytes", 0, "1048576", nil, []int64{1 << 20, -1}, "100", "1048576"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gcCalls []int
+			var limitCalls []int64
+			current := int64(math.MaxInt64)
+			setGlobal(t, &setGCPercent, func(percent int) int {
+				gcCalls = append(gcCalls, percent)
+				return 100
+			})
+			setGlobal(t, &setMemoryLimit, func(limit int64) int64 {
+				limitCalls = append(limitCalls, limit)
+				old := current
+				if limit >= 0 {
+					current = limit
+				}
+				return old
+			})
+			logs := captureLogs(t)
+
+			if err := tuneRuntime(tt.gogc, tt.memoryLimit); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gcCalls, tt.gcCalls) || !reflect.DeepEqual(limitCalls, tt.limitCalls) {
+				t.Errorf("SetGCPercent(%v) SetMemoryLimit(%v), want SetGCPercent(%v) SetMemoryLimit(%v)", gcCalls, limitCalls, tt.gcCalls, tt.limitCalls)
+			}
+			line := findLog(logs(), "Runtime Tuning")
+			if line == nil || line["gogc"] != tt.logGOGC || line["memoryLimitBytes"] != tt.logLimit {
+				t.Errorf("logged %v, want gogc %s and memoryLimitBytes %s", line, tt.logGOGC, tt.logLimit)
+			}
+		})
+	}
+
+	t.Run("GOGC from the environment", func(t *testing.T) {
+		t.Setenv("GOGC", "200")
+		setGlobal(t, &setMemoryLimit, func(int64) int64 { return math.MaxInt64 })
+		logs := captureLogs(t)
+		if err := tuneRuntime(0, ""); err != nil {
+			t.Fatal(err)
+		}
+		if line := findLog(logs(), "Runtime Tuning"); line == nil || line["gogc"] != "200" {
+			t.Errorf("logged %v, want the GOGC in effect", line)
+		}
+	})
+
+	for _, limit := range []string{"lots", "0", "-5MiB", "1.5GiB", "9999999TiB"} {
+		setGlobal(t, &setMemoryLimit, func(int64) int64 {
+			t.Fatalf("an invalid -memory-limit %q was applied", limit)
+			return 0
+		})
+		if err := tuneRuntime(0, limit); err == nil || !strings.Contains(err.Error(), "isn't a size like 512MiB") {
+			t.Errorf("tuneRuntime(0, %q) = %v, want an error", limit, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// warmupSample - How many Rules the warmup probe routes
+const warmupSample = 10
+
+// warmup - Probe the health check and route a sample of the Rules through the
+// built router before anything is sent our way. Routing only (no handler
+// runs) so the probe never shows up in hit counts or analytics.
+func warmup(conf Config) error {
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("health check returned %d", rec.Code)
+	}
+
+	router, ok := currentRouter.Load().(*mux.Router)
+	if !ok {
+		return fmt.Errorf("no router has been built")
+	}
+
+	probed := 0
+	for _, rule := range activeRules(conf) {
+		if probed == warmupSample {
+			break
+		}
+		// Variables need a value to route, nothing sensible to make up
+		if strings.Contains(rule.Path, "{") {
+			continue
+		}
+
+		// Sent the way the Rule takes requests: with its first method, a made
+		// up subdomain for a wildcard host and on its own listener port
+		method := http.MethodGet
+		if len(rule.Methods) > 0 {
+			method = strings.ToUpper(rule.Methods[0])
+		}
+		req := httptest.NewRequest(method, strings.TrimSuffix(basePath, "/")+strings.TrimSuffix(rule.Path, "*"), nil)
+		if isWildcardHost(rule.Host) {
+			req.Host = "warmup" + normalizeHost(strings.TrimPrefix(rule.Host, "*"))
+		} else if rule.Host != "" {
+			req.Host = normalizeHost(rule.Host)
+		}
+		if rule.Port != 0 {
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: rule.Port}))
+		}
+
+		match := mux.RouteMatch{}
+		if !router.Match(req, &match) || match.MatchErr != nil || match.Route == nil {
+			return fmt.Errorf("rule %s doesn't route", rule.ID())
+		}
+		probed++
+	}
+
+	return nil
+}
+
+// readyAfterWarmup - Report ready for the Config just applied, once the
+// `-warmup` probe passes when it's turned on
+func readyAfterWarmup(conf Config) {
+	if warmupCheck {
+		if err := warmup(conf); err != nil {
+			slog.Error("Warmup Failed, not ready until a reload works", "err", err)
+			return
+		}
+	}
+	setConfigLoaded()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// keepRouter - Put currentRouter back once the test is done with it
+func keepRouter(t *testing.T) {
+	t.Helper()
+	old := currentRouter.Load()
+	t.Cleanup(func() {
+		if old != nil {
+			currentRouter.Store(old)
+		}
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"plain rules", `{"rule": "/go", "url": "https://golang.org"}, {"rule": "/files/*", "url": "https://files.example.com"}`, ""},
+		{"method limited", `{"rule": "/form", "methods": ["post"], "url": "https://example.com/form"}`, ""},
+		{"port scoped", `{"rule": "/p", "port": 8443, "url": "https://example.com/8443"}`, ""},
+		{"wildcard host", `{"host": "*.example.com", "rule": "/h", "url": "https://example.com/h"}`, ""},
+		{"host", `{"host": "www.example.com", "rule": "/h", "url": "https://example.com/www"}`, ""},
+		{"variables are skipped", `{"rule": "/u/{name}", "url": "https://example.com/u/{{.Vars.name}}", "template": true}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &listenAddr, ":8080,:8443")
+			keepRouter(t)
+			useConfig(t, Config{})
+			conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [`+tt.rules+`]}`)
+			if err := applyConfig(conf); err != nil {
+				t.Fatal(err)
+			}
+			if err := warmup(conf); err != nil {
+				t.Errorf("warmup = %v, want every rule to route", err)
+			}
+		})
+	}
+
+	t.Run("a router without the rules fails", func(t *testing.T) {
+		keepRouter(t)
+		conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+		currentRouter.Store(mux.NewRouter())
+		if err := warmup(conf); err == nil || !strings.Contains(err.Error(), "rule /go doesn't route") {
+			t.Errorf("warmup = %v, want /go refused", err)
+		}
+	})
+}
+
+func TestReadyAfterWarmup(t *testing.T) {
+	conf := mustConfig(t, `{"version": 1, "defaultRedirect": "https://example.com", "redirects": [{"rule": "/go", "url": "https://golang.org"}]}`)
+
+	tests := []struct {
+		name   string
+		warmup bool
+		broken bool
+		ready  int
+	}{
+		{"warmup passes", true, false, http.StatusOK},
+		{"warmup fails", true, true, http.StatusServiceUnavailable},
+		{"no warmup", false, true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &warmupCheck, tt.warmup)
+			setGlobal(t, &configLoaded, int32(0))
+			keepRouter(t)
+			useConfig(t, Config{})
+			if err := applyConfig(conf); err != nil {
+				t.Fatal(err)
+			}
+			if tt.broken {
+				currentRouter.Store(mux.NewRouter())
+			}
+
+			if rec := adminRequest(http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("GET /readyz = %d before warmup, want 503", rec.Code)
+			}
+			readyAfterWarmup(conf)
+			if rec := adminRequest(http.MethodGet, "/readyz", "", ""); rec.Code != tt.ready {
+				t.Errorf("GET /readyz = %d after warmup, want %d", rec.Code, tt.ready)
+			}
+		})
+	}
+}